@@ -0,0 +1,96 @@
+// Command natinspect decodes natto and STUN datagrams into readable trees.
+//
+// Usage:
+//
+//	natinspect capture.pcapng ...   decode the UDP datagrams of pcapng files ("-" for stdin)
+//	natinspect -hex 4e415431...     decode datagrams given in hex
+//	natinspect -lua > natto.lua     write a Wireshark dissector
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aethiopicuschan/natto/nat/inspect"
+)
+
+func main() {
+	// Parse command-line arguments.
+	lua := flag.Bool("lua", false, "write a Wireshark Lua dissector to stdout")
+	hexArgs := flag.Bool("hex", false, "treat arguments as hex-encoded datagrams")
+	flag.Parse()
+
+	if !*lua && flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	err := run(out, *lua, *hexArgs, flag.Args())
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "natinspect:", err)
+		os.Exit(1)
+	}
+}
+
+// run writes the dissector or decodes args to w.
+func run(w io.Writer, lua, hexArgs bool, args []string) error {
+	if lua {
+		return inspect.WriteLuaDissector(w)
+	}
+
+	if hexArgs {
+		for i, arg := range args {
+			b, err := hex.DecodeString(arg)
+			if err != nil {
+				return fmt.Errorf("argument %d: %w", i+1, err)
+			}
+			fmt.Fprintln(w, inspect.Decode(b))
+		}
+		return nil
+	}
+
+	for _, name := range args {
+		if err := inspectFile(w, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// inspectFile decodes the datagrams of a pcapng file, or of stdin if name is "-".
+func inspectFile(w io.Writer, name string) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = bufio.NewReader(f)
+	}
+
+	datagrams, err := inspect.ReadCapture(r)
+	if err != nil {
+		return err
+	}
+	for i, d := range datagrams {
+		fmt.Fprintf(w, "#%d %s %s -> %s", i+1, d.Time.Format("15:04:05.000000"), d.Src, d.Dst)
+		if d.Direction != inspect.DirectionUnknown {
+			fmt.Fprintf(w, " (%s)", d.Direction)
+		}
+		fmt.Fprintln(w)
+		if d.Comment != "" {
+			fmt.Fprintf(w, "Comment: %s\n", d.Comment)
+		}
+		fmt.Fprintln(w, inspect.Decode(d.Payload))
+	}
+	return nil
+}
@@ -64,4 +64,5 @@ func main() {
 	fmt.Printf("Mapping Behavior  : %s\n", result.Mapping)
 	fmt.Printf("Filtering Behavior: %s\n", result.Filtering)
 	fmt.Printf("UDP Punching OK   : %v\n", result.PunchingOK)
+	fmt.Printf("Hairpinning       : %v\n", result.Hairpinning)
 }
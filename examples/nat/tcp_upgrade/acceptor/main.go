@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,8 +17,8 @@ import (
 var publicIP = flag.String("ip", "127.0.0.1", "address to show to dialer")
 
 func mustListenUDP() *net.UDPConn {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv6unspecified, // dual-stack: reaches IPv4 and IPv6 peers
 		Port: 0,
 	})
 	if err != nil {
@@ -26,17 +27,6 @@ func mustListenUDP() *net.UDPConn {
 	return conn
 }
 
-func mustListenTCP() *net.TCPListener {
-	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
-		Port: 0, // pick random
-	})
-	if err != nil {
-		panic(err)
-	}
-	return ln
-}
-
 func main() {
 	flag.Parse()
 
@@ -51,7 +41,7 @@ func main() {
 	fmt.Println("My peer ID: peer-B")
 
 	udpLocal := udpConn.LocalAddr().(*net.UDPAddr)
-	fmt.Printf("UDP listen addr to share: %s:%d\n", *publicIP, udpLocal.Port)
+	fmt.Println("UDP listen addr to share:", net.JoinHostPort(*publicIP, strconv.Itoa(udpLocal.Port)))
 	fmt.Println()
 
 	mux := nat.NewMux(udpConn)
@@ -85,28 +75,13 @@ func main() {
 	fmt.Println("Peer Addr :", res.Addr)
 	fmt.Println()
 
-	// --- TCP listen ---
-	tcpLn := mustListenTCP()
-	defer tcpLn.Close()
-	tcpPort := tcpLn.Addr().(*net.TCPAddr).Port
-
-	// Notify dialer via UDP session.
-	notify := fmt.Sprintf("TCP_PORT:%d", tcpPort)
-	go func() {
-		ticker := time.NewTicker(300 * time.Millisecond)
-		defer ticker.Stop()
-
-		for range 10 {
-			_ = udpSess.SendData([]byte(notify))
-			<-ticker.C
-		}
-	}()
+	// --- TCP hole punching ---
+	fmt.Println("Waiting for TCP punch...")
 
-	fmt.Println("TCP listening on:", tcpLn.Addr().String())
-	fmt.Println("Sent to dialer via UDP:", notify)
-	fmt.Println("Waiting for TCP connect...")
+	tcpCtx, cancelTCP := context.WithTimeout(runCtx, 30*time.Second)
+	defer cancelTCP()
 
-	tcpConn, err := tcpLn.AcceptTCP()
+	tcpConn, err := nat.AcceptTCP(tcpCtx, udpSess, nat.TCPOptions{})
 	if err != nil {
 		fmt.Println("tcp accept error:", err)
 		os.Exit(1)
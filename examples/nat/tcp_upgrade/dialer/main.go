@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -14,8 +13,8 @@ import (
 )
 
 func mustListenUDP() *net.UDPConn {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv6unspecified, // dual-stack: reaches IPv4 and IPv6 peers
 		Port: 0,
 	})
 	if err != nil {
@@ -24,15 +23,6 @@ func mustListenUDP() *net.UDPConn {
 	return conn
 }
 
-func parseTCPPortMsg(b []byte) (int, bool) {
-	s := strings.TrimSpace(string(b))
-	if !strings.HasPrefix(s, "TCP_PORT:") {
-		return 0, false
-	}
-	n, err := strconv.Atoi(strings.TrimPrefix(s, "TCP_PORT:"))
-	return n, err == nil && n > 0 && n < 65536
-}
-
 func main() {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -43,13 +33,7 @@ func main() {
 	addrStr, _ := reader.ReadString('\n')
 	addrStr = strings.TrimSpace(addrStr)
 
-	host, _, err := net.SplitHostPort(addrStr)
-	if err != nil {
-		fmt.Println("invalid address:", err)
-		os.Exit(1)
-	}
-
-	remoteUDP, err := net.ResolveUDPAddr("udp4", addrStr)
+	remoteUDP, err := net.ResolveUDPAddr("udp", addrStr)
 	if err != nil {
 		panic(err)
 	}
@@ -103,31 +87,13 @@ func main() {
 	runCtx, cancelRun := context.WithCancel(context.Background())
 	defer cancelRun()
 
-	fmt.Println("Waiting for TCP port announcement via UDP...")
-	var tcpPort int
-
-	for {
-		msg, _, err := udpSess.RecvData(runCtx)
-		if err != nil {
-			fmt.Println("udp recv error:", err)
-			os.Exit(1)
-		}
-		if len(msg) == 0 {
-			continue // keepalive
-		}
-		if p, ok := parseTCPPortMsg(msg); ok {
-			tcpPort = p
-			break
-		}
-	}
-
-	fmt.Println("Got TCP port:", tcpPort)
+	// ---- TCP hole punching ----
+	fmt.Println("Punching TCP...")
 
-	// ---- TCP connect ----
-	tcpAddr := net.JoinHostPort(host, strconv.Itoa(tcpPort))
-	fmt.Println("Dialing TCP to:", tcpAddr)
+	tcpCtx, cancelTCP := context.WithTimeout(runCtx, 30*time.Second)
+	defer cancelTCP()
 
-	tcpConn, err := net.DialTimeout("tcp4", tcpAddr, 10*time.Second)
+	tcpConn, err := nat.DialTCP(tcpCtx, udpSess, nat.TCPOptions{})
 	if err != nil {
 		fmt.Println("tcp dial error:", err)
 		os.Exit(1)
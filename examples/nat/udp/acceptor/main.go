@@ -6,16 +6,18 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aethiopicuschan/natto/nat"
 )
 
-var publicIP = flag.String("ip", "127.0.0.1", "address to show to dialer")
+var publicIP = flag.String("ip", "127.0.0.1", "addresses to show to dialer, comma-separated (e.g. an IPv4 and an IPv6 one)")
 
 func mustListen() *net.UDPConn {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv6unspecified, // dual-stack: reaches IPv4 and IPv6 peers
 		Port: 0,
 	})
 	if err != nil {
@@ -35,12 +37,12 @@ func main() {
 	fmt.Println("=== Acceptor ===")
 	fmt.Println("My peer ID: peer-B")
 	local := conn.LocalAddr().(*net.UDPAddr)
-	fmt.Printf(
-		"Listening UDP addr: %s:%d\n",
-		*publicIP,
-		local.Port,
-	)
-	fmt.Println("Send this address to the dialer.")
+	var addrs []string
+	for _, ip := range strings.Split(*publicIP, ",") {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSpace(ip), strconv.Itoa(local.Port)))
+	}
+	fmt.Println("Listening UDP addr:", strings.Join(addrs, " "))
+	fmt.Println("Send these addresses to the dialer.")
 	fmt.Println()
 
 	mux := nat.NewMux(conn)
@@ -13,8 +13,8 @@ import (
 )
 
 func mustListen() *net.UDPConn {
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
-		IP:   net.IPv4(0, 0, 0, 0),
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.IPv6unspecified, // dual-stack: reaches IPv4 and IPv6 peers
 		Port: 0,
 	})
 	if err != nil {
@@ -28,14 +28,20 @@ func main() {
 
 	fmt.Println("=== Dialer ===")
 	fmt.Println("My peer ID: peer-A")
-	fmt.Print("Enter acceptor UDP address (host:port): ")
+	fmt.Print("Enter acceptor UDP addresses (host:port, space-separated): ")
 
-	addrStr, _ := reader.ReadString('\n')
-	addrStr = strings.TrimSpace(addrStr)
-
-	remoteAddr, err := net.ResolveUDPAddr("udp", addrStr)
-	if err != nil {
-		panic(err)
+	line, _ := reader.ReadString('\n')
+	var remoteAddrs []*net.UDPAddr
+	for _, s := range strings.Fields(line) {
+		addr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			panic(err)
+		}
+		remoteAddrs = append(remoteAddrs, addr)
+	}
+	if len(remoteAddrs) == 0 {
+		fmt.Println("no address given")
+		os.Exit(1)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -49,9 +55,11 @@ func main() {
 	mux := nat.NewMux(conn)
 	mux.Start(ctx)
 
+	// With IPv6 and IPv4 addresses, IPv6 is tried first (Happy Eyeballs).
 	peerB := &nat.Peer{
-		ID:   "peer-B",
-		Addr: remoteAddr,
+		ID:         "peer-B",
+		Addr:       remoteAddrs[0],
+		Candidates: remoteAddrs[1:],
 	}
 
 	fmt.Println("Dialing...")
@@ -63,6 +71,7 @@ func main() {
 		peerB,
 		nat.DialOptions{
 			Interval:          200 * time.Millisecond,
+			AttemptDelay:      nat.DefaultAttemptDelay,
 			Queue:             16,
 			KeepaliveInterval: 5 * time.Second,
 		},
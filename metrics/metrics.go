@@ -0,0 +1,82 @@
+// Package metrics defines how packages nat and stun report measurements, and
+// Registry, which collects them and serves them in the Prometheus text
+// exposition format using only the standard library.
+//
+// Reporting packages describe each metric with a Desc and send samples to a
+// Recorder. A Registry is a Recorder; adapters to other monitoring systems
+// implement Recorder as well.
+package metrics
+
+// Kind is the type of a metric.
+type Kind int
+
+const (
+	// Counter is a value that only increases, such as a number of packets.
+	Counter Kind = iota
+
+	// Gauge is a value that goes up and down, such as open sessions.
+	Gauge
+
+	// Histogram counts observations, such as durations, in buckets.
+	Histogram
+)
+
+// String returns the kind as written in a Prometheus TYPE line.
+func (k Kind) String() string {
+	switch k {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Histogram:
+		return "histogram"
+	default:
+		return "untyped"
+	}
+}
+
+// DefBuckets are the histogram buckets used when Desc.Buckets is nil,
+// suited to durations in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Desc describes a metric. Descs are compared by pointer, so reporting
+// packages declare them once as package-level variables.
+type Desc struct {
+	// Name is the metric name, such as "natto_bytes_total".
+	Name string
+	Help string
+	Kind Kind
+
+	// Labels are the names of the labels whose values accompany every sample.
+	Labels []string
+
+	// Buckets are the ascending upper bounds of a histogram's buckets.
+	// Defaults to DefBuckets.
+	Buckets []float64
+}
+
+// Recorder receives samples. Label values are given in the order of
+// Desc.Labels. Implementations must be safe for concurrent use.
+type Recorder interface {
+	// Add adds delta to a counter or gauge.
+	Add(d *Desc, delta float64, labels ...string)
+
+	// Observe records a histogram observation.
+	Observe(d *Desc, value float64, labels ...string)
+}
+
+// Discard is a Recorder that ignores every sample.
+var Discard Recorder = discard{}
+
+type discard struct{}
+
+func (discard) Add(*Desc, float64, ...string)     {}
+func (discard) Observe(*Desc, float64, ...string) {}
+
+// Or returns r, or Discard if r is nil.
+func Or(r Recorder) Recorder {
+	if r == nil {
+		return Discard
+	}
+	return r
+}
@@ -0,0 +1,288 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry is a Recorder that keeps the current value of every series and
+// writes them in the Prometheus text exposition format. It is an
+// http.Handler, to be mounted at the path Prometheus scrapes, usually
+// "/metrics".
+//
+// Samples for a series seen before only take a read lock and update the
+// series with atomic operations, so concurrent receive loops do not wait
+// on each other.
+//
+// The zero value is ready to use.
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// family holds the series of one metric.
+type family struct {
+	desc   *Desc
+	series map[string]*series
+}
+
+// series is the state of one combination of label values.
+type series struct {
+	labels []string
+	value  atomicFloat
+
+	// Histograms only.
+	buckets []float64
+	counts  []atomic.Uint64 // per bucket, not cumulative
+	sum     atomicFloat
+	count   atomic.Uint64
+}
+
+// atomicFloat is a float64 updated atomically.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register declares metrics up front, so that they are written before any
+// sample is recorded. Metrics without labels are written as zero.
+// Recording a sample registers its metric as well.
+func (r *Registry) Register(descs ...*Desc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range descs {
+		f := r.family(d)
+		if len(d.Labels) == 0 {
+			f.get(nil)
+		}
+	}
+}
+
+// Add implements Recorder.
+func (r *Registry) Add(d *Desc, delta float64, labels ...string) {
+	r.series(d, labels).value.add(delta)
+}
+
+// Observe implements Recorder.
+func (r *Registry) Observe(d *Desc, value float64, labels ...string) {
+	s := r.series(d, labels)
+	i, _ := slices.BinarySearch(s.buckets, value)
+	if i < len(s.counts) {
+		s.counts[i].Add(1)
+	}
+	s.sum.add(value)
+	s.count.Add(1)
+}
+
+// series returns the series of d for labels. A series seen before is found
+// under the read lock, without allocating.
+func (r *Registry) series(d *Desc, labels []string) *series {
+	var buf [64]byte
+	key := appendKey(buf[:0], labels)
+
+	r.mu.RLock()
+	if f, ok := r.families[d.Name]; ok && f.desc == d && len(labels) == len(d.Labels) {
+		if s, ok := f.series[string(key)]; ok {
+			r.mu.RUnlock()
+			return s
+		}
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.family(d).get(labels)
+}
+
+// appendKey appends the map key of a series with the label values labels.
+func appendKey(b []byte, labels []string) []byte {
+	for i, l := range labels {
+		if i > 0 {
+			b = append(b, '\xff')
+		}
+		b = append(b, l...)
+	}
+	return b
+}
+
+// family returns the family of d, creating it if needed. The caller holds
+// r.mu for writing.
+func (r *Registry) family(d *Desc) *family {
+	if r.families == nil {
+		r.families = make(map[string]*family)
+	}
+	f, ok := r.families[d.Name]
+	if !ok {
+		f = &family{desc: d, series: make(map[string]*series)}
+		r.families[d.Name] = f
+	} else if f.desc != d {
+		panic("metrics: metric " + d.Name + " described twice")
+	}
+	return f
+}
+
+// get returns the series for labels, creating it if needed.
+func (f *family) get(labels []string) *series {
+	if len(labels) != len(f.desc.Labels) {
+		panic(fmt.Sprintf("metrics: metric %s has %d labels, got %d values", f.desc.Name, len(f.desc.Labels), len(labels)))
+	}
+	key := string(appendKey(nil, labels))
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(labels)}
+		if f.desc.Kind == Histogram {
+			s.buckets = f.desc.Buckets
+			if s.buckets == nil {
+				s.buckets = DefBuckets
+			}
+			s.counts = make([]atomic.Uint64, len(s.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// WriteText writes every metric in the text exposition format, sorted by
+// name and label values.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	r.mu.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		r.families[name].write(bw)
+	}
+	r.mu.RUnlock()
+
+	return bw.Flush()
+}
+
+// ServeHTTP writes the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_ = r.WriteText(w)
+}
+
+// write writes the HELP and TYPE lines and the samples of f.
+func (f *family) write(w *bufio.Writer) {
+	d := f.desc
+	if d.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", d.Name, escapeHelp(d.Help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.Name, d.Kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if d.Kind != Histogram {
+			writeSample(w, d.Name, d.Labels, s.labels, "", s.value.load())
+			continue
+		}
+
+		// Observations may land while the buckets are read; the total never
+		// falls below their sum.
+		count := s.count.Load()
+		names := append(slices.Clone(d.Labels), "le")
+		var cum uint64
+		for i, le := range s.buckets {
+			cum += s.counts[i].Load()
+			writeSample(w, d.Name+"_bucket", names, s.labels, formatFloat(le), float64(cum))
+		}
+		count = max(count, cum)
+		writeSample(w, d.Name+"_bucket", names, s.labels, "+Inf", float64(count))
+		writeSample(w, d.Name+"_sum", d.Labels, s.labels, "", s.sum.load())
+		writeSample(w, d.Name+"_count", d.Labels, s.labels, "", float64(count))
+	}
+}
+
+// writeSample writes a sample line. Label names beyond values, such as the
+// "le" of histogram buckets, take the value extra.
+func writeSample(w *bufio.Writer, name string, names, values []string, extra string, v float64) {
+	w.WriteString(name)
+	if len(names) > 0 {
+		w.WriteByte('{')
+		for i, n := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			val := extra
+			if i < len(values) {
+				val = values[i]
+			}
+			w.WriteString(n)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(val))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+// formatFloat formats v as the exposition format expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes a HELP text.
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabel escapes a label value.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,137 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aethiopicuschan/natto/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testCounter = &metrics.Desc{
+		Name:   "test_packets_total",
+		Help:   "Packets\nby kind.",
+		Kind:   metrics.Counter,
+		Labels: []string{"kind"},
+	}
+	testGauge = &metrics.Desc{
+		Name: "test_open",
+		Kind: metrics.Gauge,
+	}
+	testHistogram = &metrics.Desc{
+		Name:    "test_seconds",
+		Help:    "Durations.",
+		Kind:    metrics.Histogram,
+		Buckets: []float64{0.1, 1},
+	}
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	reg.Register(testGauge)
+	reg.Add(testCounter, 2, `da"ta`)
+	reg.Add(testCounter, 1, "control")
+	reg.Add(testCounter, 3, "control")
+	reg.Observe(testHistogram, 0.1)
+	reg.Observe(testHistogram, 0.5)
+	reg.Observe(testHistogram, 7)
+
+	var b strings.Builder
+	assert.NoError(t, reg.WriteText(&b))
+	assert.Equal(t, `# TYPE test_open gauge
+test_open 0
+# HELP test_packets_total Packets\nby kind.
+# TYPE test_packets_total counter
+test_packets_total{kind="control"} 4
+test_packets_total{kind="da\"ta"} 2
+# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 7.6
+test_seconds_count 3
+`, b.String())
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 1000 {
+				reg.Add(testCounter, 1, "data")
+				reg.Observe(testHistogram, 0.5)
+			}
+		})
+	}
+	wg.Wait()
+
+	var b strings.Builder
+	assert.NoError(t, reg.WriteText(&b))
+	assert.Contains(t, b.String(), `test_packets_total{kind="data"} 8000`)
+	assert.Contains(t, b.String(), "test_seconds_count 8000")
+	assert.Contains(t, b.String(), "test_seconds_sum 4000")
+}
+
+func TestRegistryAddAllocs(t *testing.T) {
+	reg := metrics.NewRegistry()
+	reg.Add(testCounter, 1, "data")
+
+	// Samples for a known series do not allocate.
+	allocs := testing.AllocsPerRun(100, func() { reg.Add(testCounter, 1, "data") })
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkRegistryAdd(b *testing.B) {
+	reg := metrics.NewRegistry()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			reg.Add(testCounter, 1, "data")
+		}
+	})
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	reg.Add(testGauge, 1)
+	reg.Add(testGauge, -1)
+	reg.Add(testGauge, 1)
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, metrics.ContentType, rec.Header().Get("Content-Type"))
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, "# TYPE test_open gauge\ntest_open 1\n", string(body))
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	assert.Panics(t, func() { reg.Add(testCounter, 1) })
+	assert.Panics(t, func() {
+		reg.Add(testGauge, 1)
+		reg.Add(&metrics.Desc{Name: testGauge.Name, Kind: metrics.Gauge}, 1)
+	})
+}
+
+func TestDiscard(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, metrics.Discard, metrics.Or(nil))
+	reg := metrics.NewRegistry()
+	assert.Equal(t, metrics.Recorder(reg), metrics.Or(reg))
+	metrics.Discard.Add(testCounter, 1)
+	metrics.Discard.Observe(testHistogram, 1)
+}
@@ -2,6 +2,8 @@ package nat
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"time"
 )
 
@@ -9,6 +11,28 @@ import (
 type AcceptOptions struct {
 	Queue             int
 	KeepaliveInterval time.Duration
+
+	// IdleTimeout fails the Session with ErrPeerUnreachable when nothing is
+	// received from the peer for this long. It requires KeepaliveInterval.
+	IdleTimeout time.Duration
+
+	// Backpressure selects how the Session's queues handle overflow.
+	// The default drops the newest packet.
+	Backpressure BackpressurePolicy
+
+	// BlockTimeout bounds how long the Block policy waits for room.
+	BlockTimeout time.Duration
+
+	// Logger receives accepted and ignored handshakes and the events of the
+	// created Session (see Session.SetLogger). Defaults to the logger of
+	// the Mux.
+	Logger *slog.Logger
+
+	// OnEvent receives the progress of Accept: PunchStarted,
+	// PunchHelloReceived, PunchPeerKnown and then PunchSucceeded,
+	// PunchTimedOut if the context deadline passes first, or PunchFailed.
+	// It is invoked synchronously and must not block.
+	OnEvent func(PunchEvent)
 }
 
 // Acceptor waits for incoming hole-punching attempts.
@@ -33,30 +57,100 @@ func NewAcceptor(mux *Mux, selfID string, opts AcceptOptions) *Acceptor {
 // Only a single peer is accepted per Acceptor.
 func (a *Acceptor) Accept(ctx context.Context) (*Session, *PunchResult, error) {
 	control := a.mux.Control()
+	log := a.opts.Logger
+	if log == nil {
+		log = a.mux.log()
+	}
+	log = log.With("self", a.selfID)
+
+	start := time.Now()
+	rec := a.mux.metrics()
+	rec.Add(metricPunchAttempts, 1)
+	a.emit(PunchEvent{Type: PunchStarted})
+	fail := func(err error) (*Session, *PunchResult, error) {
+		typ, outcome := PunchFailed, "failed"
+		if errors.Is(err, context.DeadlineExceeded) {
+			typ, outcome = PunchTimedOut, "timed_out"
+		}
+		rec.Add(metricPunches, 1, outcome, behaviorLabel(NATUnknown))
+		a.emit(PunchEvent{Type: typ, Err: err})
+		return nil, nil, err
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, nil, ctx.Err()
+			return fail(ctx.Err())
 		case <-a.closed:
-			return nil, nil, ErrConnectionClosed
-		case inb := <-control:
-			if inb.pkt.Kind != PacketControl {
+			return fail(ErrConnectionClosed)
+		case inb, ok := <-control:
+			if !ok {
+				return fail(ErrConnectionClosed)
+			}
+			if !inb.pkt.Kind.isControl() {
+				log.Debug("nat: accept ignoring non-control packet", "from", inb.addr, "kind", inb.pkt.Kind)
 				continue
 			}
 
-			msg, err := DecodeMessage(inb.pkt.Payload)
+			msg, err := DecodePacketMessage(inb.pkt)
 			if err != nil {
+				log.Debug("nat: accept ignoring undecodable control message", "from", inb.addr, "err", err)
 				continue
 			}
 			if msg.Type != MessageHello {
+				log.Debug("nat: accept ignoring message", "from", inb.addr, "type", msg.Type)
 				continue
 			}
 
 			// If the initiator specified the destination, ensure it's for us.
 			if msg.ToPeerID != "" && msg.ToPeerID != a.selfID {
+				log.Debug("nat: accept ignoring hello for another peer", "from", inb.addr, "to_peer_id", msg.ToPeerID)
+				continue
+			}
+			// A HELLO queued before its first copy was accepted belongs to a
+			// session that already exists; answer it once more.
+			hello := acceptedHello{addr: inb.addr.String(), peerID: msg.PeerID, connID: msg.ConnID}
+			if acc, ok := a.mux.acceptedConn(hello); ok {
+				log.Debug("nat: accept answering repeated hello", "from", inb.addr, "peer_id", msg.PeerID)
+				ack := &Message{
+					Type:      MessageAck,
+					PeerID:    a.selfID,
+					ToPeerID:  msg.PeerID,
+					Timestamp: time.Now().UnixNano(),
+					Echo:      msg.Timestamp,
+					ConnID:    acc.connID,
+				}
+				_ = a.mux.sendMessage(inb.addr, ack, encodingOf(inb.pkt.Kind))
 				continue
 			}
+			log.Info("nat: accept hello received", "from", inb.addr, "peer_id", msg.PeerID, "remote_conn_id", msg.ConnID)
+			a.emit(PunchEvent{Type: PunchHelloReceived, PeerID: msg.PeerID, Addr: inb.addr})
+			a.emit(PunchEvent{Type: PunchPeerKnown, PeerID: msg.PeerID, Addr: inb.addr})
+
+			queue := a.opts.Queue
+			if queue <= 0 {
+				queue = 32
+			}
+			qopts := QueueOptions{
+				Size:         queue,
+				Policy:       a.opts.Backpressure,
+				BlockTimeout: a.opts.BlockTimeout,
+			}
+
+			res := &PunchResult{
+				Addr:     inb.addr,
+				PeerID:   msg.PeerID,
+				Encoding: encodingOf(inb.pkt.Kind),
+			}
+
+			// Dialers announcing a connection ID get a connection-ID session.
+			if msg.ConnID != 0 {
+				res.LocalConnID = a.mux.allocConn(qopts)
+				if res.LocalConnID == 0 {
+					return fail(ErrConnectionClosed)
+				}
+				res.RemoteConnID = msg.ConnID
+			}
 
 			// Immediately ACK the first HELLO so the dialer can progress without waiting
 			// for a second HELLO tick.
@@ -65,33 +159,47 @@ func (a *Acceptor) Accept(ctx context.Context) (*Session, *PunchResult, error) {
 				PeerID:    a.selfID,
 				ToPeerID:  msg.PeerID,
 				Timestamp: time.Now().UnixNano(),
+				Echo:      msg.Timestamp,
+				ConnID:    res.LocalConnID,
 			}
-			if payload, err := EncodeMessage(ack); err == nil {
-				_ = a.mux.Send(inb.addr, PacketControl, payload)
-			}
-
-			res := &PunchResult{
-				Addr:   inb.addr,
-				PeerID: msg.PeerID,
+			if err := a.mux.sendMessage(inb.addr, ack, res.Encoding); err != nil {
+				log.Warn("nat: accept sending ack failed", "to", inb.addr, "err", err)
 			}
 
-			queue := a.opts.Queue
-			if queue <= 0 {
-				queue = 32
+			var sess *Session
+			if res.RemoteConnID != 0 {
+				sess = NewConnSession(a.mux, res.Addr, res.LocalConnID, res.RemoteConnID, qopts)
+				a.mux.rememberAccepted(hello, res.LocalConnID, a.selfID)
+			} else {
+				sess = NewSessionWithOptions(a.mux, res.Addr, qopts)
 			}
-
-			sess := NewSession(a.mux, res.Addr, queue)
+			sess.setEncoding(res.Encoding)
+			sess.SetLogger(a.opts.Logger)
 
 			if a.opts.KeepaliveInterval > 0 {
 				sess.SetKeepalive(a.opts.KeepaliveInterval)
+				sess.SetIdleTimeout(a.opts.IdleTimeout)
 				sess.StartKeepalive(ctx)
 			}
 
+			rec.Add(metricPunches, 1, "succeeded", behaviorLabel(res.Behavior))
+			rec.Observe(metricPunchConnect, time.Since(start).Seconds(), behaviorLabel(res.Behavior))
+			a.emit(PunchEvent{Type: PunchSucceeded, PeerID: res.PeerID, Addr: res.Addr, Result: res})
 			return sess, res, nil
 		}
 	}
 }
 
+// emit delivers ev to AcceptOptions.OnEvent, if set.
+func (a *Acceptor) emit(ev PunchEvent) {
+	if a.opts.OnEvent == nil {
+		return
+	}
+	ev.Local = a.mux.LocalAddr()
+	ev.Time = time.Now()
+	a.opts.OnEvent(ev)
+}
+
 func (a *Acceptor) Close() {
 	close(a.closed)
 }
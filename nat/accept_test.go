@@ -150,3 +150,172 @@ func TestAcceptorAccept(t *testing.T) {
 		})
 	}
 }
+
+func TestAcceptLegacyDialer(t *testing.T) {
+	t.Parallel()
+
+	bConn := newLocalUDP(t)
+	legacy := newLocalUDP(t)
+	defer bConn.Close()
+	defer legacy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	bMux := nat.NewMux(bConn)
+	bMux.Start(ctx)
+
+	acceptor := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{})
+	acceptCh := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, err := acceptor.Accept(ctx)
+		assert.NoError(t, err)
+		acceptCh <- sess
+	}()
+
+	// A dialer that predates connection IDs sends a HELLO without one.
+	payload, err := nat.EncodeMessage(&nat.Message{Type: nat.MessageHello, PeerID: "old", ToPeerID: "peer-b"})
+	assert.NoError(t, err)
+	hello, err := nat.EncodePacket(nat.PacketControl, payload)
+	assert.NoError(t, err)
+	_, err = legacy.WriteToUDP(hello, bConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	var sess *nat.Session
+	select {
+	case sess = <-acceptCh:
+	case <-ctx.Done():
+		assert.FailNow(t, "legacy dialer was not accepted")
+	}
+	assert.Zero(t, sess.LocalConnID())
+
+	// The ACK carries no connection ID either.
+	buf := make([]byte, 1500)
+	_ = legacy.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := legacy.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	pkt, err := nat.DecodePacket(buf[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), pkt.Version)
+	assert.Equal(t, nat.PacketControl, pkt.Kind) // JSON, as the HELLO was
+	ack, err := nat.DecodeMessage(pkt.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, nat.MessageAck, ack.Type)
+	assert.Zero(t, ack.ConnID)
+
+	// Version 1 data from the dialer's address reaches the session.
+	data, err := nat.EncodePacket(nat.PacketData, []byte("legacy"))
+	assert.NoError(t, err)
+	_, err = legacy.WriteToUDP(data, bConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	got, _, err := sess.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), got)
+}
+
+func TestAcceptRepeatedHello(t *testing.T) {
+	t.Parallel()
+
+	bConn := newLocalUDP(t)
+	dialer := newLocalUDP(t)
+	defer bConn.Close()
+	defer dialer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	bMux := nat.NewMux(bConn)
+	bMux.Start(ctx)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+
+	// The dialer sends its HELLO again before it sees the ACK.
+	helloAt := func(ts int64) []byte {
+		payload, err := nat.EncodeMessageBinary(&nat.Message{Type: nat.MessageHello, PeerID: "peer-a", ToPeerID: "peer-b", Timestamp: ts, ConnID: 7})
+		assert.NoError(t, err)
+		hello, err := nat.EncodePacket(nat.PacketMessage, payload)
+		assert.NoError(t, err)
+		return hello
+	}
+	for i := range 3 {
+		_, err := dialer.WriteToUDP(helloAt(int64(i+1)), bAddr)
+		assert.NoError(t, err)
+	}
+
+	sess, res, err := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{}).Accept(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A later Accept answers the repeats instead of accepting them again.
+	shortCtx, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	_, _, err = nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{}).Accept(shortCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	buf := make([]byte, 1500)
+	for range 3 {
+		_ = dialer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := dialer.ReadFromUDP(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pkt, err := nat.DecodePacket(buf[:n])
+		assert.NoError(t, err)
+		ack, err := nat.DecodePacketMessage(pkt)
+		assert.NoError(t, err)
+		assert.Equal(t, nat.MessageAck, ack.Type)
+		assert.Equal(t, res.LocalConnID, ack.ConnID)
+	}
+
+	// Once the session is gone, the same HELLO starts a new one.
+	sess.Close()
+	_, err = dialer.WriteToUDP(helloAt(4), bAddr)
+	assert.NoError(t, err)
+	sess2, _, err := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{}).Accept(ctx)
+	if assert.NoError(t, err) {
+		sess2.Close()
+	}
+}
+
+func TestAcceptLeavesNoDuplicateHello(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	defer aConn.Close()
+	bConn := newLocalUDP(t)
+	defer bConn.Close()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	// Dial sends each HELLO in both encodings until it hears from the
+	// acceptor; the copy not accepted must not pile up on the Mux.
+	for range 3 {
+		accepted := make(chan *nat.Session, 1)
+		go func() {
+			sess, _, _ := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{}).Accept(ctx)
+			accepted <- sess
+		}()
+
+		sess, _, err := nat.Dial(ctx, aMux, "peer-a", &nat.Peer{ID: "peer-b", Addr: bConn.LocalAddr().(*net.UDPAddr)}, nat.DialOptions{
+			Interval: 20 * time.Millisecond,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		bSess := <-accepted
+		if !assert.NotNil(t, bSess) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, bMux.Control())
+		sess.Close()
+		<-bSess.Done()
+	}
+}
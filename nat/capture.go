@@ -0,0 +1,339 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html.
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optTSResol  = 9 // if_tsresol
+	optEPBFlags = 2 // epb_flags
+
+	// linkTypeRaw is LINKTYPE_RAW: packets start with an IPv4 or IPv6 header.
+	linkTypeRaw = 101
+
+	// Direction bits of epb_flags.
+	flagInbound  = 1
+	flagOutbound = 2
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	protoUDP      = 17
+)
+
+// Capture writes the packets sent and received by Muxes to a pcapng stream,
+// wrapped in synthesized IP and UDP headers so that tools like Wireshark
+// show addresses and ports. Each packet carries a comment describing its
+// frame, such as its kind, connection ID or control message, and for
+// received packets the reason they were dropped, if any.
+//
+// A Capture is attached with Mux.SetCapture and may be shared by several
+// Muxes. Packets are queued to a goroutine that writes them, so a slow writer
+// does not hold up sending and receiving; when the queue is full, packets
+// are left out of the capture and counted by Dropped. After the first write
+// error, the Capture stops writing and Err reports the error. Close flushes
+// the queue.
+type Capture struct {
+	w    io.Writer
+	ch   chan []byte
+	done chan struct{}
+
+	// mu guards closed, so that ch is not sent on once closed.
+	mu     sync.RWMutex
+	closed bool
+
+	dropped atomic.Uint64
+
+	errMu sync.Mutex
+	err   error
+}
+
+// captureQueue is how many packets a Capture buffers for its writer.
+const captureQueue = 1024
+
+// NewCapture writes a pcapng section header and interface description to w
+// and returns a Capture that appends packets to it. The Capture writes from
+// its own goroutine until Close is called.
+func NewCapture(w io.Writer) (*Capture, error) {
+	c := &Capture{
+		w:    w,
+		ch:   make(chan []byte, captureQueue),
+		done: make(chan struct{}),
+	}
+
+	// Section header: byte-order magic, version 1.0, unknown section length.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	c.writeBlock(encodeBlock(blockSectionHeader, shb, nil))
+
+	// Interface description: raw IP, no snap length, nanosecond timestamps.
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], linkTypeRaw)
+	opts := appendOption(nil, optTSResol, []byte{9})
+	c.writeBlock(encodeBlock(blockInterfaceDescription, idb, opts))
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Err returns the first error encountered while writing, if any.
+func (c *Capture) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Dropped returns the number of packets left out because the queue was full.
+func (c *Capture) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Close writes the packets still queued and stops the Capture; packets
+// handed to it afterwards are ignored. It returns Err. The underlying
+// writer is not closed.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+	c.mu.Unlock()
+
+	<-c.done
+	return c.Err()
+}
+
+// run writes queued blocks until the queue is closed.
+func (c *Capture) run() {
+	defer close(c.done)
+	for b := range c.ch {
+		c.writeBlock(b)
+	}
+}
+
+// write queues a packet with the given UDP payload sent from src to dst.
+// inbound selects the direction flag.
+func (c *Capture) write(t time.Time, src, dst *net.UDPAddr, payload []byte, inbound bool, comment string) {
+	data, origLen := synthesizeUDP(src, dst, payload)
+
+	ts := uint64(t.UnixNano())
+	body := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface ID
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(origLen))
+	body = append(body, data...)
+	body = pad32(body)
+
+	flags := make([]byte, 4)
+	if inbound {
+		binary.LittleEndian.PutUint32(flags, flagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, flagOutbound)
+	}
+	opts := appendOption(nil, optEPBFlags, flags)
+	if comment != "" {
+		opts = appendOption(opts, optComment, []byte(comment))
+	}
+	b := encodeBlock(blockEnhancedPacket, body, opts)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.ch <- b:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// writeBlock writes an encoded block unless a write has failed before.
+// It is only called by NewCapture and then by run.
+func (c *Capture) writeBlock(b []byte) {
+	c.errMu.Lock()
+	failed := c.err != nil
+	c.errMu.Unlock()
+	if failed {
+		return
+	}
+
+	_, err := c.w.Write(b)
+	if err != nil {
+		c.errMu.Lock()
+		c.err = err
+		c.errMu.Unlock()
+	}
+}
+
+// encodeBlock returns a pcapng block with the given type, 32-bit aligned
+// body and options. Non-empty options are terminated with opt_endofopt.
+func encodeBlock(typ uint32, body, opts []byte) []byte {
+	if len(opts) > 0 {
+		opts = appendOption(opts, optEndOfOpt, nil)
+	}
+
+	total := 12 + len(body) + len(opts)
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, uint32(total))
+	b = append(b, body...)
+	b = append(b, opts...)
+	return binary.LittleEndian.AppendUint32(b, uint32(total))
+}
+
+// appendOption appends a pcapng option, padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return pad32(b)
+}
+
+// pad32 pads b with zeros to a multiple of four bytes.
+func pad32(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// synthesizeUDP builds an IPv4 or IPv6 datagram carrying payload from src
+// to dst. Payloads too large for the length fields are truncated; origLen
+// is the length the full datagram would have had.
+func synthesizeUDP(src, dst *net.UDPAddr, payload []byte) (data []byte, origLen int) {
+	// An unspecified address, such as that of a socket bound to all
+	// interfaces, takes the family of the other end.
+	unspecified := func(ip net.IP) bool { return ip == nil || ip.IsUnspecified() }
+	var v4 bool
+	switch {
+	case unspecified(src.IP):
+		v4 = dst.IP.To4() != nil
+	case unspecified(dst.IP):
+		v4 = src.IP.To4() != nil
+	default:
+		v4 = src.IP.To4() != nil && dst.IP.To4() != nil
+	}
+	ipOf := func(ip net.IP) net.IP {
+		switch {
+		case v4 && unspecified(ip):
+			return make(net.IP, net.IPv4len)
+		case v4:
+			return ip.To4()
+		case unspecified(ip):
+			return make(net.IP, net.IPv6len)
+		default:
+			return ip.To16()
+		}
+	}
+	srcIP, dstIP := ipOf(src.IP), ipOf(dst.IP)
+
+	ipLen := ipv6HeaderLen
+	maxPayload := 0xFFFF - udpHeaderLen
+	if v4 {
+		ipLen = ipv4HeaderLen
+		maxPayload -= ipLen
+	}
+	origLen = ipLen + udpHeaderLen + len(payload)
+	if len(payload) > maxPayload {
+		payload = payload[:maxPayload]
+	}
+
+	udpLen := udpHeaderLen + len(payload)
+	udp := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+
+	// The UDP checksum covers a pseudo header of addresses, protocol and length.
+	pseudo := make([]byte, 0, 2*len(srcIP)+4)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	pseudo = append(pseudo, 0, protoUDP)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(udpLen))
+	sum := checksum(pseudo, udp)
+	if sum == 0 {
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+
+	ip := make([]byte, ipLen, ipLen+udpLen)
+	if v4 {
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen))
+		ip[8] = 64
+		ip[9] = protoUDP
+		copy(ip[12:16], srcIP)
+		copy(ip[16:20], dstIP)
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+	} else {
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+		ip[6] = protoUDP
+		ip[7] = 64
+		copy(ip[8:24], srcIP)
+		copy(ip[24:40], dstIP)
+	}
+	return append(ip, udp...), origLen
+}
+
+// checksum computes the Internet checksum over the concatenation of parts,
+// each of which but the last must have an even length.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, p := range parts {
+		for i := 0; i+1 < len(p); i += 2 {
+			sum += uint32(p[i])<<8 | uint32(p[i+1])
+		}
+		if len(p)%2 == 1 {
+			sum += uint32(p[len(p)-1]) << 8
+		}
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// describeFrame returns a capture comment for a frame: its magic, kind and
+// connection ID, and the type and peers of a control message.
+func describeFrame(pkt *Packet) string {
+	s := fmt.Sprintf("NAT%d %s", pkt.Version, pkt.Kind)
+	if pkt.Version == 2 {
+		s += fmt.Sprintf(" conn=%08x", pkt.ConnID)
+	}
+	if pkt.Kind.isControl() {
+		msg, err := DecodePacketMessage(pkt)
+		if err != nil {
+			return s + " (invalid message)"
+		}
+		s += fmt.Sprintf(" %s %s->%s", msg.Type, msg.PeerID, msg.ToPeerID)
+		if msg.ConnID != 0 {
+			s += fmt.Sprintf(" conn_id=%08x", msg.ConnID)
+		}
+	}
+	return s
+}
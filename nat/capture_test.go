@@ -0,0 +1,240 @@
+package nat_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// capturedPacket is an Enhanced Packet Block read back from a capture.
+type capturedPacket struct {
+	inbound bool
+	comment string
+	data    []byte
+}
+
+// readCapture parses the blocks written by a nat.Capture.
+func readCapture(t *testing.T, b []byte) []capturedPacket {
+	t.Helper()
+
+	var pkts []capturedPacket
+	for i := 0; len(b) > 0; i++ {
+		if !assert.GreaterOrEqual(t, len(b), 12) {
+			t.FailNow()
+		}
+		typ := binary.LittleEndian.Uint32(b[0:4])
+		total := int(binary.LittleEndian.Uint32(b[4:8]))
+		if !assert.Zero(t, total%4) || !assert.LessOrEqual(t, total, len(b)) {
+			t.FailNow()
+		}
+		assert.Equal(t, uint32(total), binary.LittleEndian.Uint32(b[total-4:total]))
+		body := b[8 : total-4]
+		b = b[total:]
+
+		switch i {
+		case 0:
+			assert.Equal(t, uint32(0x0A0D0D0A), typ)
+			assert.Equal(t, uint32(0x1A2B3C4D), binary.LittleEndian.Uint32(body[0:4]))
+			continue
+		case 1:
+			assert.Equal(t, uint32(1), typ)
+			assert.Equal(t, uint16(101), binary.LittleEndian.Uint16(body[0:2]))
+			continue
+		}
+
+		assert.Equal(t, uint32(6), typ)
+		capLen := int(binary.LittleEndian.Uint32(body[12:16]))
+		p := capturedPacket{data: body[20 : 20+capLen]}
+		opts := body[20+(capLen+3)/4*4:]
+		for len(opts) >= 4 {
+			code := binary.LittleEndian.Uint16(opts[0:2])
+			n := int(binary.LittleEndian.Uint16(opts[2:4]))
+			value := opts[4 : 4+n]
+			switch code {
+			case 1:
+				p.comment = string(value)
+			case 2:
+				p.inbound = binary.LittleEndian.Uint32(value)&3 == 1
+			}
+			opts = opts[4+(n+3)/4*4:]
+		}
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+// onesSum folds the Internet checksum of b; a valid header sums to 0xFFFF.
+func onesSum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
+}
+
+func TestMuxCapture(t *testing.T) {
+	t.Parallel()
+
+	aConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer aConn.Close()
+	bConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer bConn.Close()
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	capture, err := nat.NewCapture(&buf)
+	assert.NoError(t, err)
+
+	mux := nat.NewMux(aConn)
+	mux.SetCapture(capture)
+	mux.Start(ctx)
+
+	waitReceived := func(n uint64) {
+		t.Helper()
+		assert.Eventually(t, func() bool { return mux.Stats().Received == n }, 2*time.Second, 5*time.Millisecond)
+	}
+
+	// Outbound data, then inbound garbage, unrouted data and a control message.
+	assert.NoError(t, mux.Send(bAddr, nat.PacketData, []byte("out")))
+	hello, err := nat.EncodeMessage(&nat.Message{Type: nat.MessageHello, PeerID: "peer-b", ToPeerID: "peer-a"})
+	assert.NoError(t, err)
+	for _, wire := range [][]byte{
+		[]byte("garbage"),
+		must(nat.EncodePacket(nat.PacketData, []byte("unrouted"))),
+		must(nat.EncodeConnPacket(nat.PacketControl, 0xabcd, hello)),
+		must(nat.EncodePacket(nat.PacketControl, hello)),
+	} {
+		_, err = bConn.WriteToUDP(wire, aAddr)
+		assert.NoError(t, err)
+	}
+	waitReceived(4)
+
+	// Nothing is captured once capturing is turned off.
+	mux.SetCapture(nil)
+	_, err = bConn.WriteToUDP([]byte("uncaptured"), aAddr)
+	assert.NoError(t, err)
+	waitReceived(5)
+
+	assert.NoError(t, mux.Close())
+	assert.NoError(t, capture.Close())
+	assert.Zero(t, capture.Dropped())
+
+	pkts := readCapture(t, buf.Bytes())
+	if !assert.Len(t, pkts, 5) {
+		return
+	}
+
+	want := []struct {
+		inbound bool
+		comment string
+	}{
+		{false, "NAT1 data"},
+		{true, "undecodable: not a nat packet"},
+		{true, "NAT1 data; dropped: no receiver"},
+		{true, "NAT2 control conn=0000abcd hello peer-b->peer-a; dropped: unknown connection id"},
+		{true, "NAT1 control hello peer-b->peer-a"},
+	}
+	for i, w := range want {
+		assert.Equal(t, w.inbound, pkts[i].inbound, i)
+		assert.Equal(t, w.comment, pkts[i].comment, i)
+	}
+
+	// The outbound packet has valid IPv4 and UDP headers around the frame.
+	data := pkts[0].data
+	assert.Equal(t, byte(0x45), data[0])
+	assert.Equal(t, uint16(0xFFFF), onesSum(data[:20]))
+	assert.Equal(t, aAddr.IP.To4(), net.IP(data[12:16]))
+	assert.Equal(t, bAddr.IP.To4(), net.IP(data[16:20]))
+	assert.Equal(t, uint16(aAddr.Port), binary.BigEndian.Uint16(data[20:22]))
+	assert.Equal(t, uint16(bAddr.Port), binary.BigEndian.Uint16(data[22:24]))
+	assert.Equal(t, must(nat.EncodePacket(nat.PacketData, []byte("out"))), data[28:])
+
+	pseudo := append(append(append([]byte{}, data[12:20]...), 0, 17), data[24:26]...)
+	assert.Equal(t, uint16(0xFFFF), onesSum(append(pseudo, data[20:]...)))
+
+	// Inbound packets go the other way.
+	assert.Equal(t, bAddr.IP.To4(), net.IP(pkts[1].data[12:16]))
+	assert.Equal(t, []byte("garbage"), pkts[1].data[28:])
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// blockingWriter blocks writes after the first n until release is closed.
+type blockingWriter struct {
+	n       int
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if w.n--; w.n < 0 {
+		<-w.release
+	}
+	return w.buf.Write(b)
+}
+
+func TestCaptureSlowWriter(t *testing.T) {
+	t.Parallel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	to := newLocalUDP(t)
+	defer to.Close()
+
+	// The writer takes the headers, then stalls.
+	w := &blockingWriter{n: 2, release: make(chan struct{})}
+	capture, err := nat.NewCapture(w)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := nat.NewMux(conn)
+	mux.SetCapture(capture)
+
+	// Sending goes on while the writer is stuck; the overflow is counted.
+	const sent = 1100
+	for range sent {
+		assert.NoError(t, mux.Send(to.LocalAddr().(*net.UDPAddr), nat.PacketData, []byte("x")))
+	}
+	dropped := capture.Dropped()
+	assert.Positive(t, dropped)
+
+	close(w.release)
+	assert.NoError(t, capture.Close())
+	assert.Len(t, readCapture(t, w.buf.Bytes()), sent-int(dropped))
+}
+
+func TestNewCaptureError(t *testing.T) {
+	t.Parallel()
+
+	_, err := nat.NewCapture(failingWriter{})
+	assert.EqualError(t, err, "disk full")
+}
+
+// must returns b, panicking if err is set.
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,27 @@
+package nat
+
+import (
+	"net"
+
+	"github.com/aethiopicuschan/natto/stun"
+)
+
+// PacketConn is the packet transport a Mux runs on. *net.UDPConn satisfies
+// it, as does any net.PacketConn, such as a rate limiter wrapping a socket,
+// a relayed connection or an in-memory connection from package nattest.
+// It is the transport of package stun, so one connection serves both.
+//
+// Source addresses that are not *net.UDPAddr are converted with
+// stun.UDPAddrOf, and must be an IP and port.
+type PacketConn = stun.PacketConn
+
+// listenUDP returns a ListenFunc that opens UDP sockets on ip.
+func listenUDP(ip net.IP) ListenFunc {
+	return func() (PacketConn, error) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
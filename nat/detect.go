@@ -1,7 +1,10 @@
 package nat
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
 	"net"
 	"time"
 
@@ -39,6 +42,7 @@ const (
 
 // NATResult is the final detection result.
 type NATResult struct {
+	// LocalAddr is the local address of the socket the STUN probes ran on.
 	LocalAddr *net.UDPAddr
 
 	MappedAddr1 stun.MappedAddress
@@ -48,12 +52,25 @@ type NATResult struct {
 	Mapping    MappingBehavior
 	Filtering  FilteringBehavior
 	PunchingOK bool
+
+	// Hairpinning reports whether the NAT forwards a packet sent from inside
+	// to one of its own mapped addresses back inside. Without it, peers behind
+	// the same NAT can only reach each other via their local addresses.
+	Hairpinning bool
+}
+
+// MappedPorts returns the external ports observed by the STUN probes, in order.
+// Peers behind a symmetric NAT can share them as Peer.MappedPorts.
+func (r *NATResult) MappedPorts() []int {
+	return []int{r.MappedAddr1.Port, r.MappedAddr2.Port}
 }
 
-// DetectNAT performs a best-effort NAT type detection using STUN.
+// DetectNAT performs a best-effort NAT type detection using STUN, and checks
+// whether the NAT supports hairpinning. The probes run on fresh sockets bound
+// to the IP of conn, or opened with WithListen, so conn itself is not read from.
 func DetectNAT(
 	ctx context.Context,
-	conn *net.UDPConn,
+	conn PacketConn,
 	opts ...DetectOption,
 ) (*NATResult, error) {
 
@@ -62,34 +79,60 @@ func DetectNAT(
 			"stun.l.google.com:19302",
 			"stun1.l.google.com:19302",
 		},
-		Timeout: 2 * time.Second,
+		Timeout:        2 * time.Second,
+		HairpinTimeout: 500 * time.Millisecond,
 	}
 	for _, opt := range opts {
 		opt(&cfg)
 	}
 
-	result := &NATResult{
-		LocalAddr: conn.LocalAddr().(*net.UDPAddr),
+	listen := cfg.Listen
+	if listen == nil {
+		var ip net.IP
+		if local := stun.UDPAddrOf(conn.LocalAddr()); local != nil {
+			ip = local.IP
+		}
+		listen = listenUDP(ip)
 	}
 
 	client := stun.NewClient()
 	client.Timeout = cfg.Timeout
 
+	// Both probes run on one socket, so that its mapping can be compared
+	// and then used for the hairpinning check.
+	probe, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+
+	result := &NATResult{
+		LocalAddr: stun.UDPAddrOf(probe.LocalAddr()),
+	}
+
 	// ---- STUN #1 ----
-	m1, err := stunBind(ctx, client, cfg.STUNServers[0])
+	m1, err := stunBind(ctx, client, probe, cfg.STUNServers[0])
 	if err != nil {
 		return nil, err
 	}
 	result.MappedAddr1 = m1
 
 	// ---- STUN #2 ----
-	m2, err := stunBind(ctx, client, cfg.STUNServers[1])
+	m2, err := stunBind(ctx, client, probe, cfg.STUNServers[1])
 	if err != nil {
 		return nil, err
 	}
 	result.MappedAddr2 = m2
 
 	classifyNAT(result)
+
+	// ---- Hairpinning ----
+	hairpin, err := detectHairpin(ctx, listen, probe, m1, cfg.HairpinTimeout)
+	if err != nil {
+		return nil, err
+	}
+	result.Hairpinning = hairpin
+
 	return result, nil
 }
 
@@ -98,6 +141,7 @@ func DetectNAT(
 func stunBind(
 	ctx context.Context,
 	client *stun.Client,
+	conn PacketConn,
 	addr string,
 ) (stun.MappedAddress, error) {
 
@@ -106,13 +150,69 @@ func stunBind(
 		return stun.MappedAddress{}, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, raddr)
+	return client.BindingRequestTo(ctx, conn, raddr)
+}
+
+// detectHairpin sends a random token from a second local socket to the
+// mapped address of probe and reports whether probe receives it.
+func detectHairpin(
+	ctx context.Context,
+	listen ListenFunc,
+	probe PacketConn,
+	mapped stun.MappedAddress,
+	timeout time.Duration,
+) (bool, error) {
+
+	sender, err := listen()
 	if err != nil {
-		return stun.MappedAddress{}, err
+		return false, err
+	}
+	defer sender.Close()
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return false, err
 	}
-	defer conn.Close()
 
-	return client.BindingRequestConn(ctx, conn)
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer func() { _ = probe.SetReadDeadline(time.Time{}) }()
+
+	// Send a few copies in case one is lost.
+	target := &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+	interval := timeout / 3
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := sender.WriteTo(token, target); err != nil {
+			return false, err
+		}
+
+		waitUntil := time.Now().Add(interval)
+		if waitUntil.After(deadline) {
+			waitUntil = deadline
+		}
+		_ = probe.SetReadDeadline(waitUntil)
+		for {
+			n, _, err := probe.ReadFrom(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return false, err
+			}
+			if bytes.Equal(buf[:n], token) {
+				return true, nil
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
 }
 
 func classifyNAT(r *NATResult) {
@@ -149,8 +249,10 @@ func classifyNAT(r *NATResult) {
 }
 
 type detectConfig struct {
-	STUNServers []string
-	Timeout     time.Duration
+	STUNServers    []string
+	Timeout        time.Duration
+	HairpinTimeout time.Duration
+	Listen         ListenFunc
 }
 
 type DetectOption func(*detectConfig)
@@ -166,3 +268,19 @@ func WithDetectTimeout(d time.Duration) DetectOption {
 		c.Timeout = d
 	}
 }
+
+// WithHairpinTimeout sets how long DetectNAT waits for a hairpinned packet.
+// It defaults to 500ms.
+func WithHairpinTimeout(d time.Duration) DetectOption {
+	return func(c *detectConfig) {
+		c.HairpinTimeout = d
+	}
+}
+
+// WithListen sets how DetectNAT opens its probe sockets.
+// By default they are UDP sockets on the IP of the conn passed to DetectNAT.
+func WithListen(listen ListenFunc) DetectOption {
+	return func(c *detectConfig) {
+		c.Listen = listen
+	}
+}
@@ -1,8 +1,12 @@
 package nat_test
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aethiopicuschan/natto/nat"
 	"github.com/aethiopicuschan/natto/stun"
@@ -89,3 +93,113 @@ func TestClassifyNAT(t *testing.T) {
 		})
 	}
 }
+
+// simulatedNAT answers STUN requests with the address of its public socket,
+// and forwards what arrives there back to the last STUN client if hairpin is set.
+type simulatedNAT struct {
+	stunConn *net.UDPConn
+	public   *net.UDPConn
+	hairpin  bool
+
+	mu     sync.Mutex
+	inside *net.UDPAddr
+}
+
+func newSimulatedNAT(t *testing.T, hairpin bool) *simulatedNAT {
+	t.Helper()
+
+	stunConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	public, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	n := &simulatedNAT{stunConn: stunConn, public: public, hairpin: hairpin}
+	go n.serveSTUN()
+	go n.forward()
+	t.Cleanup(func() {
+		stunConn.Close()
+		public.Close()
+	})
+	return n
+}
+
+func (n *simulatedNAT) serveSTUN() {
+	pub := n.public.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 1500)
+	for {
+		size, src, err := n.stunConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := stun.Parse(buf[:size])
+		if err != nil {
+			continue
+		}
+		n.mu.Lock()
+		n.inside = src
+		n.mu.Unlock()
+
+		value := []byte{0, 1, byte(pub.Port >> 8), byte(pub.Port)}
+		resp := &stun.Message{
+			Method:        stun.MethodBinding,
+			Class:         stun.ClassSuccessResponse,
+			Cookie:        stun.MagicCookie,
+			TransactionID: req.TransactionID,
+			Attributes: []stun.Attribute{
+				{Type: stun.AttrMappedAddress, Value: append(value, pub.IP.To4()...)},
+			},
+		}
+		_, _ = n.stunConn.WriteToUDP(resp.Marshal(), src)
+	}
+}
+
+func (n *simulatedNAT) forward() {
+	buf := make([]byte, 1500)
+	for {
+		size, _, err := n.public.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		inside := n.inside
+		n.mu.Unlock()
+		if n.hairpin && inside != nil {
+			_, _ = n.public.WriteToUDP(buf[:size], inside)
+		}
+	}
+}
+
+func TestDetectNATHairpinning(t *testing.T) {
+	t.Parallel()
+
+	for _, hairpin := range []bool{true, false} {
+		t.Run(fmt.Sprintf("hairpin=%v", hairpin), func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			sim := newSimulatedNAT(t, hairpin)
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			server := sim.stunConn.LocalAddr().String()
+			r, err := nat.DetectNAT(ctx, conn,
+				nat.WithSTUNServers(server, server),
+				nat.WithHairpinTimeout(300*time.Millisecond),
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, sim.public.LocalAddr().(*net.UDPAddr).Port, r.MappedAddr1.Port)
+			assert.Equal(t, nat.MappingIndependent, r.Mapping)
+			assert.Equal(t, hairpin, r.Hairpinning)
+		})
+	}
+}
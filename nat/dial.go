@@ -2,6 +2,7 @@ package nat
 
 import (
 	"context"
+	"log/slog"
 	"time"
 )
 
@@ -15,6 +16,50 @@ type DialOptions struct {
 
 	// KeepaliveInterval enables session keepalive if > 0.
 	KeepaliveInterval time.Duration
+
+	// IdleTimeout fails the Session with ErrPeerUnreachable when nothing is
+	// received from the peer for this long. It requires KeepaliveInterval.
+	IdleTimeout time.Duration
+
+	// Backpressure selects how the Session's queues handle overflow.
+	// The default drops the newest packet.
+	Backpressure BackpressurePolicy
+
+	// BlockTimeout bounds how long the Block policy waits for room.
+	BlockTimeout time.Duration
+
+	// Strategy optionally adds remote addresses to probe, such as
+	// PortPrediction or BirthdayProbe for peers behind symmetric NATs.
+	Strategy PunchStrategy
+
+	// BirthdaySockets opens this many extra local sockets for birthday
+	// punching (see Puncher.SetBirthdaySockets). Listen opens them.
+	// If the hole is punched on one of them, the Session runs on
+	// PunchResult.Mux, which the caller closes once done.
+	BirthdaySockets int
+	Listen          ListenFunc
+
+	// Muxes are further started Muxes to punch from, such as one per address
+	// family (see Puncher.AddMux). The Session runs on PunchResult.Mux.
+	Muxes []*Mux
+
+	// AttemptDelay races the peer's candidates Happy Eyeballs style,
+	// the private address first, then IPv6 (see Puncher.SetAttemptDelay).
+	AttemptDelay time.Duration
+
+	// LocalGrace is how long a public candidate's success waits for the
+	// peer's private address to answer (see Puncher.SetLocalGrace).
+	// Defaults to Interval.
+	LocalGrace time.Duration
+
+	// Logger receives the progress of punching and the events of the
+	// created Session (see Puncher.SetLogger and Session.SetLogger).
+	// Defaults to the logger of the Mux.
+	Logger *slog.Logger
+
+	// OnEvent receives the progress of punching (see
+	// Puncher.SetEventHandler).
+	OnEvent func(PunchEvent)
 }
 
 // Dial performs NAT traversal with the peer and returns a Session on success.
@@ -30,18 +75,42 @@ func Dial(ctx context.Context, mux *Mux, selfID string, peer *Peer, opt DialOpti
 		queue = 32
 	}
 
+	qopts := QueueOptions{
+		Size:         queue,
+		Policy:       opt.Backpressure,
+		BlockTimeout: opt.BlockTimeout,
+	}
+
 	p := NewPuncher(mux, selfID, interval)
+	p.connOpts = qopts
+	p.SetStrategy(opt.Strategy)
+	p.SetBirthdaySockets(opt.BirthdaySockets, opt.Listen)
+	p.SetLocalGrace(opt.LocalGrace)
+	p.SetAttemptDelay(opt.AttemptDelay)
+	for _, m := range opt.Muxes {
+		p.AddMux(m)
+	}
+	p.SetLogger(opt.Logger)
+	p.SetEventHandler(opt.OnEvent)
 
 	pr, err = p.Punch(ctx, peer)
 	if err != nil {
 		return
 	}
 
-	sess = NewSession(mux, pr.Addr, queue)
-	sess.UpdateRemote(pr.Addr)
+	if pr.RemoteConnID != 0 {
+		sess = NewConnSession(pr.Mux, pr.Addr, pr.LocalConnID, pr.RemoteConnID, qopts)
+	} else {
+		// The peer only speaks address-based packets.
+		sess = NewSessionWithOptions(pr.Mux, pr.Addr, qopts)
+		sess.UpdateRemote(pr.Addr)
+	}
+	sess.setEncoding(pr.Encoding)
+	sess.SetLogger(opt.Logger)
 
 	if opt.KeepaliveInterval > 0 {
 		sess.SetKeepalive(opt.KeepaliveInterval)
+		sess.SetIdleTimeout(opt.IdleTimeout)
 		sess.StartKeepalive(ctx)
 	}
 
@@ -116,7 +116,10 @@ func TestDialAndAccept(t *testing.T) {
 
 			assert.NoError(t, dialErr)
 			assert.NotNil(t, dialSess)
-			assert.NotNil(t, dialRes)
+			if assert.NotNil(t, dialRes) {
+				// The Acceptor's ACK echoes the HELLO's timestamp.
+				assert.Positive(t, dialRes.RTT)
+			}
 
 			var acc acceptResult
 			select {
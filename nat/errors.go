@@ -15,6 +15,28 @@ var (
 	// is unexpectedly closed.
 	ErrConnectionClosed = errors.New("connection closed")
 
+	// ErrRemoteClosed is returned when the remote peer closed the session.
+	ErrRemoteClosed = errors.New("connection closed by remote peer")
+
+	// ErrPeerUnreachable is returned when nothing has been received from the
+	// remote peer within the session's idle timeout.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+
+	// ErrMultipathUnsupported is returned when adding a path to a Session
+	// that is not demultiplexed by connection ID.
+	ErrMultipathUnsupported = errors.New("multipath requires a connection-id session")
+
+	// ErrConnIDInUse is returned when a connection ID is already registered on a Mux.
+	ErrConnIDInUse = errors.New("connection id already in use")
+
+	// ErrTCPUnsupported is returned by DialTCP and AcceptTCP on platforms
+	// where a local TCP port cannot be shared.
+	ErrTCPUnsupported = errors.New("tcp hole punching is not supported on this platform")
+
+	// ErrResponsePortUnsupported is returned by MeasureBindingLifetime when
+	// the STUN server ignores RESPONSE-PORT.
+	ErrResponsePortUnsupported = errors.New("stun server does not support RESPONSE-PORT")
+
 	// ErrMessageIsNil is returned when trying to encode a nil message.
 	ErrMessageIsNil = errors.New("message is nil")
 
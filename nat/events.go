@@ -0,0 +1,141 @@
+package nat
+
+import (
+	"net"
+	"time"
+)
+
+// SessionEventType identifies the kind of a SessionEvent.
+type SessionEventType string
+
+const (
+	// SessionPathQuiet is emitted when nothing has been received from the peer
+	// for the session's quiet timeout. The session stays open.
+	SessionPathQuiet SessionEventType = "path-quiet"
+
+	// SessionPathRecovered is emitted when traffic resumes after SessionPathQuiet.
+	SessionPathRecovered SessionEventType = "path-recovered"
+
+	// SessionMigrated is emitted when the session has validated a new remote
+	// address and switched to it.
+	SessionMigrated SessionEventType = "migrated"
+
+	// SessionPathValidated is emitted when a path added by either peer has
+	// answered a path challenge and can carry traffic.
+	SessionPathValidated SessionEventType = "path-validated"
+
+	// SessionFailover is emitted when the session switches its active path.
+	SessionFailover SessionEventType = "failover"
+
+	// SessionKeepaliveAdjusted is emitted when StartAdaptiveKeepalive has
+	// measured the binding lifetime and changed the keepalive interval.
+	SessionKeepaliveAdjusted SessionEventType = "keepalive-adjusted"
+)
+
+// SessionEvent reports a change in the state of a Session's path.
+type SessionEvent struct {
+	Type SessionEventType
+
+	// PathID identifies the path the event is about.
+	// The path a Session was created with has ID zero.
+	PathID uint32
+
+	// Addr is the remote address of the path when the event occurred.
+	Addr *net.UDPAddr
+
+	// Prev is the previous remote address for SessionMigrated, or the remote
+	// address of the previously active path for SessionFailover.
+	Prev *net.UDPAddr
+
+	// Idle is how long nothing had been received from the peer.
+	Idle time.Duration
+
+	// Interval and Lifetime are the new keepalive interval and the measured
+	// binding lifetime for SessionKeepaliveAdjusted.
+	Interval time.Duration
+	Lifetime time.Duration
+
+	Time time.Time
+}
+
+// PunchEventType identifies the kind of a PunchEvent.
+type PunchEventType string
+
+const (
+	// PunchStarted is emitted when Punch or Accept begins.
+	// Candidates lists the peer's addresses Punch is going to probe.
+	PunchStarted PunchEventType = "started"
+
+	// PunchHelloSent is emitted for every HELLO sent to a candidate.
+	PunchHelloSent PunchEventType = "hello-sent"
+
+	// PunchHelloReceived is emitted when a HELLO from the peer arrives.
+	PunchHelloReceived PunchEventType = "hello-received"
+
+	// PunchAckReceived is emitted when an ACK from the peer arrives.
+	PunchAckReceived PunchEventType = "ack-received"
+
+	// PunchPeerKnown is emitted when the peer is heard from for the first
+	// time. Punch then stops spraying candidates and slows down.
+	PunchPeerKnown PunchEventType = "peer-known"
+
+	// PunchAddressChanged is emitted when the peer is heard from an address
+	// other than the one Punch was sending to.
+	PunchAddressChanged PunchEventType = "address-changed"
+
+	// PunchBehaviorInferred is emitted when the NAT behavior heuristic
+	// reported in PunchResult.Behavior changes.
+	PunchBehaviorInferred PunchEventType = "behavior-inferred"
+
+	// PunchSucceeded is emitted with the result when the hole is punched.
+	PunchSucceeded PunchEventType = "succeeded"
+
+	// PunchTimedOut is emitted when the context deadline passes first.
+	PunchTimedOut PunchEventType = "timed-out"
+
+	// PunchFailed is emitted when punching ends otherwise without success,
+	// such as when the context is cancelled or the Mux is closed.
+	PunchFailed PunchEventType = "failed"
+)
+
+// PunchEvent reports progress of a Puncher or an Acceptor.
+type PunchEvent struct {
+	Type PunchEventType
+
+	// PeerID is the remote peer's ID, if known.
+	PeerID string
+
+	// Addr is the candidate a HELLO was sent to, the address a message
+	// came from, the peer's new address, or the address the hole was
+	// punched to, depending on Type.
+	Addr *net.UDPAddr
+
+	// Prev is the address Punch was sending to before PunchAddressChanged.
+	Prev *net.UDPAddr
+
+	// Local is the local address of the socket used, which differs from the
+	// Mux's when birthday punching.
+	Local net.Addr
+
+	// CandidateType tells which kind of candidate Addr is.
+	CandidateType CandidateType
+
+	// Candidates are the peer's addresses for PunchStarted.
+	Candidates []*net.UDPAddr
+
+	// Round counts the rounds of probing, starting at zero, for PunchHelloSent.
+	Round int
+
+	// Behavior is the inferred NAT behavior for PunchBehaviorInferred and
+	// PunchSucceeded, and the behavior inferred so far when punching fails.
+	Behavior NATBehavior
+
+	// Result is the outcome for PunchSucceeded.
+	Result *PunchResult
+
+	// Err is the reason for PunchTimedOut and PunchFailed, or why sending
+	// failed for PunchHelloSent.
+	Err error
+
+	Time time.Time
+}
@@ -1,6 +1,38 @@
 package nat
 
+import (
+	"net"
+	"time"
+)
+
 // ExportClassifyNAT exposes classifyNAT for black-box testing.
 func ExportClassifyNAT(r *NATResult) {
 	classifyNAT(r)
 }
+
+// ExportRTTSamples feeds samples into a fresh RTT estimator and returns its state.
+func ExportRTTSamples(samples ...time.Duration) (st SessionStats) {
+	var e rttEstimator
+	for _, d := range samples {
+		e.sample(d)
+	}
+	e.fill(&st)
+	return
+}
+
+// ExportDedup feeds sequence numbers into a fresh duplicate filter and
+// reports which were accepted.
+func ExportDedup(seqs ...uint64) []bool {
+	var w dedupWindow
+	out := make([]bool, len(seqs))
+	for i, seq := range seqs {
+		out[i] = w.accept(seq)
+	}
+	return out
+}
+
+// ExportDispatchControl routes a control packet through the control
+// demultiplexer of m, as its receive loop does.
+func ExportDispatchControl(m *Mux, pkt *Packet, from *net.UDPAddr) bool {
+	return m.dispatchControl(inbound{pkt: pkt, addr: from})
+}
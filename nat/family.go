@@ -0,0 +1,99 @@
+package nat
+
+import (
+	"net"
+	"slices"
+	"time"
+
+	"github.com/aethiopicuschan/natto/stun"
+)
+
+// DefaultAttemptDelay is the Connection Attempt Delay recommended by
+// RFC 8305 (Happy Eyeballs), for Puncher.SetAttemptDelay.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// isIPv6 reports whether addr is an IPv6 address, as opposed to an IPv4 or
+// IPv4-mapped one.
+func isIPv6(addr *net.UDPAddr) bool {
+	return addr.IP.To4() == nil
+}
+
+// canSend reports whether the socket of m can send to addr, judged by its
+// local address: sockets bound to an IPv4 address only reach IPv4, those
+// bound to a specific IPv6 address only IPv6, and those bound to the IPv6
+// wildcard are dual-stack. Sockets with an unknown address are assumed to
+// reach both.
+func (m *Mux) canSend(addr *net.UDPAddr) bool {
+	local := stun.UDPAddrOf(m.LocalAddr())
+	if local == nil || local.IP == nil || (local.IP.IsUnspecified() && local.IP.To4() == nil) {
+		return true
+	}
+	return isIPv6(local) == isIPv6(addr)
+}
+
+// interleaveFamilies orders addrs for Happy Eyeballs (RFC 8305, Section 4):
+// alternating between IPv6 and IPv4, starting with IPv6, while keeping the
+// order within each family.
+func interleaveFamilies(addrs []*net.UDPAddr) []*net.UDPAddr {
+	var v6, v4 []*net.UDPAddr
+	for _, a := range addrs {
+		if isIPv6(a) {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+
+	out := make([]*net.UDPAddr, 0, len(addrs))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
+
+// HostCandidates returns the addresses of the local network interfaces at
+// the port of mux, for the families mux can send to, IPv6 first. Loopback,
+// link-local and multicast addresses are left out.
+//
+// Global IPv6 addresses are usually reachable without any NAT, so they make
+// good Peer.Candidates; a private IPv4 address serves as Peer.LocalAddr.
+func HostCandidates(mux *Mux) ([]*net.UDPAddr, error) {
+	local := stun.UDPAddrOf(mux.LocalAddr())
+	if local == nil {
+		return nil, nil
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*net.UDPAddr
+	for _, ia := range ifaddrs {
+		ipnet, ok := ia.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		addr := &net.UDPAddr{IP: ipnet.IP, Port: local.Port}
+		if mux.canSend(addr) {
+			out = append(out, addr)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b *net.UDPAddr) int {
+		switch {
+		case isIPv6(a) == isIPv6(b):
+			return 0
+		case isIPv6(a):
+			return -1
+		default:
+			return 1
+		}
+	})
+	return out, nil
+}
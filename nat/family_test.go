@@ -0,0 +1,231 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// listenOrSkip opens a UDP socket on ip, skipping the test if the host
+// lacks the address family.
+func listenOrSkip(t *testing.T, ip net.IP) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dualStackPeer starts an acceptor on a dual-stack socket and returns its
+// port and a channel receiving the accepted session.
+func dualStackPeer(t *testing.T, ctx context.Context, id string) (int, <-chan *nat.Session) {
+	t.Helper()
+
+	listenOrSkip(t, net.IPv6loopback).Close()
+	conn := listenOrSkip(t, net.IPv6unspecified)
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+
+	accepted := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, _ := nat.NewAcceptor(mux, id, nat.AcceptOptions{}).Accept(ctx)
+		accepted <- sess
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port, accepted
+}
+
+func TestDialDualStack(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	port, accepted := dualStackPeer(t, ctx, "peer-b")
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: port}
+
+	mux := nat.NewMux(listenOrSkip(t, net.IPv6unspecified))
+	mux.Start(ctx)
+
+	// IPv6 goes first; IPv4 is not started before it answers.
+	sess, res, err := nat.Dial(ctx, mux, "peer-a", &nat.Peer{ID: "peer-b", Addr: v4, Candidates: []*net.UDPAddr{v6}}, nat.DialOptions{
+		Interval:     20 * time.Millisecond,
+		AttemptDelay: time.Second,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	assert.True(t, res.Addr.IP.Equal(net.IPv6loopback), res.Addr)
+
+	bSess := <-accepted
+	if assert.NotNil(t, bSess) {
+		defer bSess.Close()
+		assert.NoError(t, sess.Send([]byte("over v6")))
+		data, _, err := bSess.Recv(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "over v6", string(data))
+	}
+}
+
+func TestDialDualStackLANFirst(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	port, accepted := dualStackPeer(t, ctx, "peer-b")
+	lan := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: port}
+
+	mux := nat.NewMux(listenOrSkip(t, net.IPv6unspecified))
+	mux.Start(ctx)
+
+	// The private address is probed before the IPv6 candidate, although
+	// Happy Eyeballs puts IPv6 first among the others.
+	var events eventRecorder
+	sess, res, err := nat.Dial(ctx, mux, "peer-a", &nat.Peer{ID: "peer-b", Addr: v6, LocalAddr: lan}, nat.DialOptions{
+		Interval:     20 * time.Millisecond,
+		AttemptDelay: time.Second,
+		OnEvent:      events.handle,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	if bSess := <-accepted; assert.NotNil(t, bSess) {
+		defer bSess.Close()
+	}
+	assert.Equal(t, nat.CandidateHost, res.CandidateType)
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	for _, ev := range events.events {
+		if ev.Type == nat.PunchStarted {
+			assert.Equal(t, []*net.UDPAddr{lan, v6}, ev.Candidates)
+		}
+		if ev.Type == nat.PunchHelloSent {
+			assert.Equal(t, lan.String(), ev.Addr.String())
+			break
+		}
+	}
+}
+
+func TestDialHappyEyeballsFallback(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	port, accepted := dualStackPeer(t, ctx, "peer-b")
+	dead := listenOrSkip(t, net.IPv6loopback)
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+	dead.Close()
+
+	mux := nat.NewMux(listenOrSkip(t, net.IPv6unspecified))
+	mux.Start(ctx)
+
+	const delay = 100 * time.Millisecond
+	var events eventRecorder
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	sess, res, err := nat.Dial(ctx, mux, "peer-a", &nat.Peer{ID: "peer-b", Addr: v4, Candidates: []*net.UDPAddr{deadAddr}}, nat.DialOptions{
+		Interval:     20 * time.Millisecond,
+		AttemptDelay: delay,
+		OnEvent:      events.handle,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	if bSess := <-accepted; assert.NotNil(t, bSess) {
+		defer bSess.Close()
+	}
+	assert.True(t, res.Addr.IP.Equal(v4.IP), res.Addr)
+
+	// The IPv6 candidate was started first, the IPv4 one a delay later.
+	var first6, first4 time.Time
+	events.mu.Lock()
+	for _, ev := range events.events {
+		if ev.Type != nat.PunchHelloSent {
+			continue
+		}
+		if ev.Addr.IP.To4() == nil && first6.IsZero() {
+			first6 = ev.Time
+		}
+		if ev.Addr.IP.To4() != nil && first4.IsZero() {
+			first4 = ev.Time
+		}
+	}
+	events.mu.Unlock()
+	assert.False(t, first6.IsZero())
+	assert.GreaterOrEqual(t, first4.Sub(first6), delay)
+}
+
+func TestDialPerFamilyMuxes(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	port, accepted := dualStackPeer(t, ctx, "peer-b")
+
+	// An IPv4 Mux and an IPv6 one, against an IPv6-only peer.
+	mux4 := nat.NewMux(newLocalUDP(t))
+	mux6 := nat.NewMux(listenOrSkip(t, net.IPv6loopback))
+	mux4.Start(ctx)
+	mux6.Start(ctx)
+
+	var events eventRecorder
+	sess, res, err := nat.Dial(ctx, mux4, "peer-a", &nat.Peer{ID: "peer-b", Addr: &net.UDPAddr{IP: net.IPv6loopback, Port: port}}, nat.DialOptions{
+		Interval: 20 * time.Millisecond,
+		Muxes:    []*nat.Mux{mux6},
+		OnEvent:  events.handle,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	assert.Same(t, mux6, res.Mux)
+
+	bSess := <-accepted
+	if assert.NotNil(t, bSess) {
+		defer bSess.Close()
+		assert.NoError(t, bSess.Send([]byte("back")))
+		data, _, err := sess.Recv(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "back", string(data))
+	}
+
+	// Nothing was sent from the IPv4 socket.
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	for _, ev := range events.events {
+		if ev.Type == nat.PunchHelloSent {
+			assert.NoError(t, ev.Err)
+			assert.Equal(t, mux6.LocalAddr(), ev.Local)
+		}
+	}
+}
+
+func TestHostCandidates(t *testing.T) {
+	t.Parallel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+
+	cands, err := nat.HostCandidates(mux)
+	assert.NoError(t, err)
+	for _, c := range cands {
+		assert.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, c.Port)
+		assert.NotNil(t, c.IP.To4(), "IPv6 candidate %s for an IPv4 socket", c)
+		assert.False(t, c.IP.IsLoopback())
+	}
+}
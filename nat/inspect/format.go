@@ -0,0 +1,134 @@
+package inspect
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/aethiopicuschan/natto/nat"
+)
+
+// FieldType selects how a header field is read and displayed.
+type FieldType int
+
+const (
+	// FieldString is ASCII text, such as the magic.
+	FieldString FieldType = iota
+
+	// FieldUint is a big-endian unsigned integer of 1, 2 or 4 bytes.
+	FieldUint
+
+	// FieldHex is a FieldUint displayed in hexadecimal.
+	FieldHex
+)
+
+// Field describes a fixed-position field of a frame header.
+type Field struct {
+	// Name is the display name, such as "Kind".
+	Name string
+
+	// Abbrev is the Wireshark filter name below "natto.", such as "kind".
+	Abbrev string
+
+	Type   FieldType
+	Offset int
+	Size   int
+
+	// Values names the known values of a FieldUint.
+	Values map[uint64]string
+}
+
+// Format describes the layout of one version of the nat packet framing.
+type Format struct {
+	// Name is the frame magic, such as "NAT1".
+	Name string
+
+	// HeaderLen is the number of bytes before the payload.
+	HeaderLen int
+
+	// Fields lists the header fields in wire order.
+	Fields []Field
+
+	// Length is the Abbrev of the field carrying the payload length.
+	Length string
+
+	// Kind is the Abbrev of the field carrying the PacketKind.
+	Kind string
+}
+
+// field returns the field with the given Abbrev.
+func (f Format) field(abbrev string) Field {
+	for _, fd := range f.Fields {
+		if fd.Abbrev == abbrev {
+			return fd
+		}
+	}
+	panic("inspect: no field " + abbrev + " in " + f.Name)
+}
+
+// kindNames names the known packet kinds.
+var kindNames = map[uint64]string{
+	uint64(nat.PacketControl): nat.PacketControl.String(),
+	uint64(nat.PacketData):    nat.PacketData.String(),
+	uint64(nat.PacketDataSeq): nat.PacketDataSeq.String(),
+	uint64(nat.PacketMessage): nat.PacketMessage.String(),
+}
+
+// Formats are the frame layouts decoded by Decode and by the Wireshark
+// dissector written by WriteLuaDissector, see nat.Packet.
+var Formats = []Format{
+	{
+		Name:      "NAT1",
+		HeaderLen: 7,
+		Fields: []Field{
+			{Name: "Magic", Abbrev: "magic", Type: FieldString, Offset: 0, Size: 4},
+			{Name: "Kind", Abbrev: "kind", Type: FieldUint, Offset: 4, Size: 1, Values: kindNames},
+			{Name: "Length", Abbrev: "length", Type: FieldUint, Offset: 5, Size: 2},
+		},
+		Length: "length",
+		Kind:   "kind",
+	},
+	{
+		Name:      "NAT2",
+		HeaderLen: 11,
+		Fields: []Field{
+			{Name: "Magic", Abbrev: "magic", Type: FieldString, Offset: 0, Size: 4},
+			{Name: "Kind", Abbrev: "kind", Type: FieldUint, Offset: 4, Size: 1, Values: kindNames},
+			{Name: "Connection ID", Abbrev: "conn_id", Type: FieldHex, Offset: 5, Size: 4},
+			{Name: "Length", Abbrev: "length", Type: FieldUint, Offset: 9, Size: 2},
+		},
+		Length: "length",
+		Kind:   "kind",
+	},
+}
+
+// MessageField describes a field of a control message.
+type MessageField struct {
+	// Name is the nat.Message field name, such as "PeerID".
+	Name string
+
+	// Key is its JSON key, such as "peer_id".
+	Key string
+
+	// Tag is its tag in the binary encoding, see nat.EncodeMessageBinary.
+	Tag byte
+}
+
+// MessageFields lists the fields of nat.Message in declaration order.
+var MessageFields = messageFields()
+
+// messageFields derives MessageFields from the JSON tags of nat.Message and
+// nat.MessageFieldTag.
+func messageFields() []MessageField {
+	t := reflect.TypeFor[nat.Message]()
+	fields := make([]MessageField, 0, t.NumField())
+	for i := range t.NumField() {
+		f := t.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		tag, _ := nat.MessageFieldTag(f.Name)
+		fields = append(fields, MessageField{Name: f.Name, Key: key, Tag: tag})
+	}
+	return fields
+}
@@ -0,0 +1,270 @@
+// Package inspect decodes datagrams exchanged by package nat into
+// human-readable trees, like the packet details pane of Wireshark.
+//
+// Decode understands the frames of nat.Packet, including the control
+// messages they carry, and the STUN messages of package stun. The frame
+// layouts are described by Formats and MessageFields, from which
+// WriteLuaDissector generates a Wireshark dissector, so both views stay in
+// step with the wire format. ReadCapture reads the datagrams of a pcapng
+// file, such as one written by nat.Capture.
+//
+// The natinspect command wraps this package.
+package inspect
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/stun"
+)
+
+// previewLen is the number of bytes shown of opaque data.
+const previewLen = 32
+
+// Node is a line of a decoded tree.
+type Node struct {
+	Name     string
+	Value    string
+	Children []*Node
+}
+
+// add appends a child node and returns it.
+func (n *Node) add(name, value string) *Node {
+	c := &Node{Name: name, Value: value}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// String renders the tree, indenting children by four spaces per level.
+func (n *Node) String() string {
+	var b strings.Builder
+	n.write(&b, 0)
+	return b.String()
+}
+
+// write renders n at the given depth.
+func (n *Node) write(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("    ", depth))
+	b.WriteString(n.Name)
+	if n.Value != "" {
+		b.WriteString(": ")
+		b.WriteString(n.Value)
+	}
+	b.WriteByte('\n')
+	for _, c := range n.Children {
+		c.write(b, depth+1)
+	}
+}
+
+// Decode decodes a UDP payload into a tree. Datagrams that are neither nat
+// frames nor STUN messages are shown as opaque data.
+func Decode(b []byte) *Node {
+	if len(b) >= 4 {
+		for _, f := range Formats {
+			if string(b[:4]) == f.Name {
+				return decodeFrame(f, b)
+			}
+		}
+	}
+	if msg, err := stun.Parse(b); err == nil {
+		return decodeSTUN(msg, len(b))
+	}
+
+	n := &Node{Name: fmt.Sprintf("Unknown datagram (%d bytes)", len(b))}
+	n.add("Data", preview(b))
+	return n
+}
+
+// decodeFrame decodes a nat frame laid out as f.
+func decodeFrame(f Format, b []byte) *Node {
+	n := &Node{Name: fmt.Sprintf("%s frame (%d bytes)", f.Name, len(b))}
+	if len(b) < f.HeaderLen {
+		n.add("Error", fmt.Sprintf("truncated header: %d of %d bytes", len(b), f.HeaderLen))
+		return n
+	}
+
+	for _, fd := range f.Fields {
+		n.add(fd.Name, fieldValue(fd, b))
+	}
+
+	length := int(readUint(f.field(f.Length), b))
+	payload := b[f.HeaderLen:]
+	if length > len(payload) {
+		n.add("Error", fmt.Sprintf("payload length %d exceeds the %d bytes remaining", length, len(payload)))
+	} else {
+		if trailing := len(payload) - length; trailing > 0 {
+			n.add("Trailing", fmt.Sprintf("%d bytes", trailing))
+		}
+		payload = payload[:length]
+	}
+
+	switch kind := nat.PacketKind(readUint(f.field(f.Kind), b)); kind {
+	case nat.PacketControl, nat.PacketMessage:
+		decodeMessage(n, &nat.Packet{Kind: kind, Payload: payload})
+	case nat.PacketData:
+		n.add("Data", preview(payload))
+	case nat.PacketDataSeq:
+		if len(payload) < 8 {
+			n.add("Error", "truncated sequence number")
+			break
+		}
+		n.add("Sequence", fmt.Sprint(binary.BigEndian.Uint64(payload)))
+		n.add("Data", preview(payload[8:]))
+	default:
+		n.add("Payload", preview(payload))
+	}
+	return n
+}
+
+// readUint reads an integer field of b.
+func readUint(fd Field, b []byte) uint64 {
+	var v uint64
+	for _, c := range b[fd.Offset : fd.Offset+fd.Size] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// fieldValue formats a header field of b.
+func fieldValue(fd Field, b []byte) string {
+	if fd.Type == FieldString {
+		return string(b[fd.Offset : fd.Offset+fd.Size])
+	}
+
+	v := readUint(fd, b)
+	s := fmt.Sprint(v)
+	if fd.Type == FieldHex {
+		s = fmt.Sprintf("0x%0*x", 2*fd.Size, v)
+	}
+	if fd.Values != nil {
+		name, ok := fd.Values[v]
+		if !ok {
+			name = "unknown"
+		}
+		s = fmt.Sprintf("%s (%s)", name, s)
+	}
+	return s
+}
+
+// decodeMessage adds the fields of the control message in pkt to n,
+// omitting empty ones.
+func decodeMessage(n *Node, pkt *nat.Packet) {
+	msg, err := nat.DecodePacketMessage(pkt)
+	if err != nil {
+		n.add("Error", "invalid message: "+err.Error())
+		n.add("Payload", preview(pkt.Payload))
+		return
+	}
+
+	m := n.add("Message", "")
+	v := reflect.ValueOf(msg).Elem()
+	for _, mf := range MessageFields {
+		fv := v.FieldByName(mf.Name)
+		if fv.IsZero() {
+			continue
+		}
+		var s string
+		switch x := fv.Interface().(type) {
+		case []byte:
+			s = hex.EncodeToString(x)
+		case []string:
+			s = strings.Join(x, ", ")
+		default:
+			s = fmt.Sprint(x)
+		}
+		m.add(mf.Name, s)
+	}
+}
+
+// stunClasses names the STUN message classes.
+var stunClasses = map[int]string{
+	stun.ClassRequest:         "Request",
+	stun.ClassIndication:      "Indication",
+	stun.ClassSuccessResponse: "Success Response",
+	stun.ClassErrorResponse:   "Error Response",
+}
+
+// stunAttributes names the STUN attributes known to package stun.
+var stunAttributes = map[uint16]string{
+	stun.AttrMappedAddress:     "MAPPED-ADDRESS",
+	stun.AttrXORMappedAddress:  "XOR-MAPPED-ADDRESS",
+	stun.AttrErrorCode:         "ERROR-CODE",
+	stun.AttrUnknownAttributes: "UNKNOWN-ATTRIBUTES",
+	stun.AttrResponsePort:      "RESPONSE-PORT",
+	stun.AttrSoftware:          "SOFTWARE",
+}
+
+// decodeSTUN decodes a STUN message of size bytes.
+func decodeSTUN(msg *stun.Message, size int) *Node {
+	method := fmt.Sprintf("Method 0x%03x", msg.Method)
+	if msg.Method == stun.MethodBinding {
+		method = "Binding"
+	}
+	n := &Node{Name: fmt.Sprintf("STUN %s %s (%d bytes)", method, stunClasses[msg.Class], size)}
+	n.add("Method", method)
+	n.add("Class", stunClasses[msg.Class])
+	n.add("Length", fmt.Sprint(msg.Length))
+	n.add("Magic Cookie", fmt.Sprintf("0x%08x", msg.Cookie))
+	n.add("Transaction ID", hex.EncodeToString(msg.TransactionID[:]))
+
+	if len(msg.Attributes) == 0 {
+		return n
+	}
+	attrs := n.add("Attributes", "")
+	for _, a := range msg.Attributes {
+		name, ok := stunAttributes[a.Type]
+		if !ok {
+			name = "Unknown"
+		}
+		attrs.add(fmt.Sprintf("%s (0x%04x)", name, a.Type), stunValue(msg, a))
+	}
+	return n
+}
+
+// stunValue formats the value of a STUN attribute of msg.
+func stunValue(msg *stun.Message, a stun.Attribute) string {
+	switch a.Type {
+	case stun.AttrMappedAddress, stun.AttrXORMappedAddress:
+		decode := stun.DecodeMappedAddress
+		if a.Type == stun.AttrXORMappedAddress {
+			decode = func(a stun.Attribute) (stun.MappedAddress, error) {
+				return stun.DecodeXORMappedAddress(a, msg.TransactionID)
+			}
+		}
+		if addr, err := decode(a); err == nil {
+			return fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+		}
+
+	case stun.AttrResponsePort:
+		if port, err := stun.DecodeResponsePort(a); err == nil {
+			return fmt.Sprint(port)
+		}
+
+	case stun.AttrErrorCode:
+		// 2 reserved bytes, class (hundreds), number, reason phrase.
+		if len(a.Value) >= 4 {
+			code := int(a.Value[2]&0x07)*100 + int(a.Value[3])
+			return fmt.Sprintf("%d %q", code, a.Value[4:])
+		}
+
+	case stun.AttrSoftware:
+		return fmt.Sprintf("%q", a.Value)
+	}
+	return preview(a.Value)
+}
+
+// preview formats opaque data as its length and leading bytes in hex.
+func preview(b []byte) string {
+	s := fmt.Sprintf("%d bytes", len(b))
+	if len(b) == 0 {
+		return s
+	}
+	if len(b) > previewLen {
+		return s + " " + hex.EncodeToString(b[:previewLen]) + "..."
+	}
+	return s + " " + hex.EncodeToString(b)
+}
@@ -0,0 +1,217 @@
+package inspect_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/nat/inspect"
+	"github.com/aethiopicuschan/natto/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeControl(t *testing.T) {
+	t.Parallel()
+
+	payload, err := nat.EncodeMessage(&nat.Message{
+		Type:      nat.MessageHello,
+		PeerID:    "peer-a",
+		ToPeerID:  "peer-b",
+		Timestamp: 1700000000,
+		ConnID:    0xabcd,
+		Token:     []byte{1, 2},
+		Addrs:     []string{"10.0.0.1:1", "10.0.0.2:2"},
+	})
+	assert.NoError(t, err)
+	wire, err := nat.EncodePacket(nat.PacketControl, payload)
+	assert.NoError(t, err)
+
+	want := `NAT1 frame (` + strconv.Itoa(len(wire)) + ` bytes)
+    Magic: NAT1
+    Kind: control (1)
+    Length: ` + strconv.Itoa(len(payload)) + `
+    Message
+        Type: hello
+        PeerID: peer-a
+        ToPeerID: peer-b
+        Timestamp: 1700000000
+        ConnID: 43981
+        Token: 0102
+        Addrs: 10.0.0.1:1, 10.0.0.2:2
+`
+	assert.Equal(t, want, inspect.Decode(wire).String())
+}
+
+func TestDecodeBinaryMessage(t *testing.T) {
+	t.Parallel()
+
+	payload, err := nat.EncodeMessageBinary(&nat.Message{
+		Type:      nat.MessageKeepaliveAck,
+		PeerID:    "peer-a",
+		Timestamp: 1700000000,
+		Echo:      1690000000,
+		Challenge: []byte{0xff},
+	})
+	assert.NoError(t, err)
+	wire, err := nat.EncodeConnPacket(nat.PacketMessage, 7, payload)
+	assert.NoError(t, err)
+
+	want := `NAT2 frame (` + strconv.Itoa(len(wire)) + ` bytes)
+    Magic: NAT2
+    Kind: message (4)
+    Connection ID: 0x00000007
+    Length: ` + strconv.Itoa(len(payload)) + `
+    Message
+        Type: keepalive-ack
+        PeerID: peer-a
+        Timestamp: 1700000000
+        Echo: 1690000000
+        Challenge: ff
+`
+	assert.Equal(t, want, inspect.Decode(wire).String())
+}
+
+func TestDecodeData(t *testing.T) {
+	t.Parallel()
+
+	wire, err := nat.EncodeConnPacket(nat.PacketData, 0x1234, []byte("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, `NAT2 frame (13 bytes)
+    Magic: NAT2
+    Kind: data (2)
+    Connection ID: 0x00001234
+    Length: 2
+    Data: 2 bytes 6869
+`, inspect.Decode(wire).String())
+
+	seq := append([]byte{0, 0, 0, 0, 0, 0, 0, 7}, "x"...)
+	wire, err = nat.EncodePacket(nat.PacketDataSeq, seq)
+	assert.NoError(t, err)
+	assert.Equal(t, `NAT1 frame (16 bytes)
+    Magic: NAT1
+    Kind: data-seq (3)
+    Length: 9
+    Sequence: 7
+    Data: 1 bytes 78
+`, inspect.Decode(wire).String())
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{
+			name: "truncated header",
+			in:   []byte("NAT2\x02\x00\x00"),
+			want: "NAT2 frame (7 bytes)\n    Error: truncated header: 7 of 11 bytes\n",
+		},
+		{
+			name: "short payload",
+			in:   []byte("NAT1\x09\x00\x05abc"),
+			want: `NAT1 frame (10 bytes)
+    Magic: NAT1
+    Kind: unknown (9)
+    Length: 5
+    Error: payload length 5 exceeds the 3 bytes remaining
+    Payload: 3 bytes 616263
+`,
+		},
+		{
+			name: "trailing bytes",
+			in:   []byte("NAT1\x02\x00\x01abc"),
+			want: `NAT1 frame (10 bytes)
+    Magic: NAT1
+    Kind: data (2)
+    Length: 1
+    Trailing: 2 bytes
+    Data: 1 bytes 61
+`,
+		},
+		{
+			name: "invalid message",
+			in:   []byte("NAT1\x01\x00\x01{"),
+			want: `NAT1 frame (8 bytes)
+    Magic: NAT1
+    Kind: control (1)
+    Length: 1
+    Error: invalid message: unexpected end of JSON input
+    Payload: 1 bytes 7b
+`,
+		},
+		{
+			name: "unknown",
+			in:   []byte("hello"),
+			want: "Unknown datagram (5 bytes)\n    Data: 5 bytes 68656c6c6f\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, inspect.Decode(tt.in).String())
+		})
+	}
+}
+
+func TestDecodeSTUN(t *testing.T) {
+	t.Parallel()
+
+	msg := &stun.Message{
+		Method:        stun.MethodBinding,
+		Class:         stun.ClassSuccessResponse,
+		Cookie:        stun.MagicCookie,
+		TransactionID: stun.TransactionID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		Attributes: []stun.Attribute{
+			{Type: stun.AttrMappedAddress, Value: []byte{0, 1, 0x13, 0x88, 198, 51, 100, 1}},
+			stun.ResponsePortAttr(4000),
+			{Type: stun.AttrSoftware, Value: []byte("natto")},
+			{Type: 0x8028, Value: []byte{0xde, 0xad, 0xbe, 0xef}},
+		},
+	}
+	assert.Equal(t, `STUN Binding Success Response (60 bytes)
+    Method: Binding
+    Class: Success Response
+    Length: 40
+    Magic Cookie: 0x2112a442
+    Transaction ID: 0102030405060708090a0b0c
+    Attributes
+        MAPPED-ADDRESS (0x0001): 198.51.100.1:5000
+        RESPONSE-PORT (0x0027): 4000
+        SOFTWARE (0x8022): "natto"
+        Unknown (0x8028): 4 bytes deadbeef
+`, inspect.Decode(msg.Marshal()).String())
+}
+
+func TestFormatsMatchEncoding(t *testing.T) {
+	t.Parallel()
+
+	// The header lengths agree with the nat encoders.
+	v1, err := nat.EncodePacket(nat.PacketData, []byte("abc"))
+	assert.NoError(t, err)
+	v2, err := nat.EncodeConnPacket(nat.PacketControl, 0x01020304, []byte("{}"))
+	assert.NoError(t, err)
+
+	wires := map[string][]byte{"NAT1": v1, "NAT2": v2}
+	assert.Len(t, inspect.Formats, len(wires))
+	for _, f := range inspect.Formats {
+		wire := wires[f.Name]
+		pkt, err := nat.DecodePacket(wire)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, len(wire)-len(pkt.Payload), f.HeaderLen, f.Name)
+	}
+}
+
+func TestMessageFields(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, inspect.MessageField{Name: "Type", Key: "type", Tag: 1}, inspect.MessageFields[0])
+	assert.Contains(t, inspect.MessageFields, inspect.MessageField{Name: "ToPeerID", Key: "to_peer_id", Tag: 3})
+	for _, mf := range inspect.MessageFields {
+		assert.NotZero(t, mf.Tag, mf.Name)
+	}
+}
@@ -0,0 +1,326 @@
+package inspect
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/aethiopicuschan/natto/nat"
+)
+
+// luaTemplate renders the Wireshark dissector. The frame layouts and
+// message fields are filled in from Formats, MessageFields and
+// nat.MessageTypeForCode.
+var luaTemplate = template.Must(template.New("dissector").Funcs(template.FuncMap{
+	"protoField": luaProtoField,
+	"quote":      luaQuote,
+}).Parse(`-- Wireshark dissector for natto NAT traversal frames.
+-- Generated by natinspect -lua; do not edit.
+--
+-- Install by copying into the Wireshark personal plugins directory.
+-- Frames are recognized heuristically on any UDP port; STUN is left to the
+-- built-in dissector.
+
+local natto = Proto("natto", "natto NAT traversal")
+local f = natto.fields
+{{- range .Fields}}
+f[{{quote .Abbrev}}] = {{protoField .}}
+{{- end}}
+f["payload"] = ProtoField.bytes("natto.payload", "Payload")
+{{range .Message}}
+f[{{quote (print "msg." .Key)}}] = ProtoField.string({{quote (print "natto.msg." .Key)}}, {{quote .Name}})
+{{- end}}
+
+local formats = {
+{{- range .Formats}}
+	[{{quote .Name}}] = {
+		header = {{.HeaderLen}},
+		fields = {
+{{- range .Fields}}
+			{ {{quote .Abbrev}}, {{.Offset}}, {{.Size}} },
+{{- end}}
+		},
+		length = { {{.LengthField.Offset}}, {{.LengthField.Size}} },
+		kind = { {{.KindField.Offset}}, {{.KindField.Size}} },
+	},
+{{- end}}
+}
+
+local kinds = {
+{{- range $v, $name := .Kinds}}
+	[{{$v}}] = {{quote $name}},
+{{- end}}
+}
+
+local message_keys = {
+{{- range .Message}}
+	{{quote .Key}},
+{{- end}}
+}
+
+local message_tags = {
+{{- range .Tags}}
+	[{{.Tag}}] = { key = {{quote .Key}}, size = {{.Size}}, hex = {{.Hex}} },
+{{- end}}
+}
+
+local message_types = {
+{{- range $code, $typ := .Types}}
+	[{{$code}}] = {{quote (print $typ)}},
+{{- end}}
+}
+
+-- json_value extracts the value of key from a flat JSON object.
+local function json_value(s, key)
+	local pattern = '"' .. key .. '"%s*:%s*'
+	local str = s:match(pattern .. '"(.-)"')
+	if str ~= nil then
+		return str
+	end
+	local list = s:match(pattern .. '(%b[])')
+	if list ~= nil then
+		return list
+	end
+	return s:match(pattern .. '([^,}]+)')
+end
+
+-- uvarint reads the unsigned varint at offset i of r and returns its value
+-- and size, or nil if it is truncated.
+local function uvarint(r, i)
+	local v, mul = 0, 1
+	for n = 1, 10 do
+		if i + n > r:len() then
+			return nil
+		end
+		local b = r(i + n - 1, 1):uint()
+		v = v + (b % 128) * mul
+		if b < 128 then
+			return v, n
+		end
+		mul = mul * 128
+	end
+	return nil
+end
+
+-- binary_message adds the fields of the binary-encoded message in r to msg
+-- and returns the message type.
+local function binary_message(r, msg)
+	if r:len() < 2 or r(0, 1):uint() ~= 1 then
+		msg:add_expert_info(PI_MALFORMED, PI_ERROR, "unknown message version")
+		return nil
+	end
+	local typ = message_types[r(1, 1):uint()]
+	if typ ~= nil then
+		msg:add(f["msg.type"], r(1, 1), typ)
+	end
+	local i = 2
+	while i < r:len() do
+		local n, k = uvarint(r, i + 1)
+		if n == nil or i + 1 + k + n > r:len() then
+			msg:add_expert_info(PI_MALFORMED, PI_ERROR, "truncated message field")
+			break
+		end
+		local t = message_tags[r(i, 1):uint()]
+		if t ~= nil and n > 0 then
+			local v = r(i + 1 + k, n)
+			local s
+			if t.size == 8 then
+				s = tostring(v:int64())
+			elseif t.size == 4 then
+				s = tostring(v:uint())
+			elseif t.hex then
+				s = tostring(v:bytes():tohex())
+			else
+				s = v:string()
+			end
+			msg:add(f["msg." .. t.key], r(i, 1 + k + n), s)
+			if t.key == "type" then
+				typ = s
+			end
+		end
+		i = i + 1 + k + n
+	end
+	return typ
+end
+
+local function dissect(tvb, pinfo, tree)
+	if tvb:len() < 4 then
+		return 0
+	end
+	local magic = tvb(0, 4):string()
+	local fmt = formats[magic]
+	if fmt == nil or tvb:len() < fmt.header then
+		return 0
+	end
+
+	pinfo.cols.protocol = "NATTO"
+	local sub = tree:add(natto, tvb(), magic .. " frame")
+	for _, d in ipairs(fmt.fields) do
+		sub:add(f[d[1]], tvb(d[2], d[3]))
+	end
+
+	local length = tvb(fmt.length[1], fmt.length[2]):uint()
+	local kind = tvb(fmt.kind[1], fmt.kind[2]):uint()
+	local avail = tvb:len() - fmt.header
+	if length > avail then
+		sub:add_expert_info(PI_MALFORMED, PI_ERROR, "payload length exceeds frame")
+		length = avail
+	end
+	local info = magic .. " " .. (kinds[kind] or "unknown")
+	if length == 0 then
+		pinfo.cols.info = info
+		return tvb:len()
+	end
+
+	local payload = tvb(fmt.header, length)
+	if kinds[kind] == "control" then
+		local msg = sub:add(natto, payload, "Message")
+		local s = payload:string()
+		for _, key in ipairs(message_keys) do
+			local v = json_value(s, key)
+			if v ~= nil then
+				msg:add(f["msg." .. key], payload, v)
+			end
+		end
+		local typ = json_value(s, "type")
+		if typ ~= nil then
+			info = info .. " " .. typ
+		end
+	elseif kinds[kind] == "message" then
+		local typ = binary_message(payload, sub:add(natto, payload, "Message"))
+		if typ ~= nil then
+			info = info .. " " .. typ
+		end
+	else
+		sub:add(f["payload"], payload)
+	end
+	pinfo.cols.info = info
+	return tvb:len()
+end
+
+function natto.dissector(tvb, pinfo, tree)
+	return dissect(tvb, pinfo, tree)
+end
+
+natto:register_heuristic("udp", function(tvb, pinfo, tree)
+	return dissect(tvb, pinfo, tree) > 0
+end)
+`))
+
+// luaTag describes how the dissector shows a field of the binary message
+// encoding: as an integer of Size bytes, or else as hex or a string.
+type luaTag struct {
+	MessageField
+	Size int
+	Hex  bool
+}
+
+// luaTags derives the luaTags of MessageFields from the nat.Message field types.
+func luaTags() []luaTag {
+	t := reflect.TypeFor[nat.Message]()
+	tags := make([]luaTag, len(MessageFields))
+	for i, mf := range MessageFields {
+		tags[i].MessageField = mf
+		f, _ := t.FieldByName(mf.Name)
+		switch f.Type.Kind() {
+		case reflect.Int64, reflect.Uint64:
+			tags[i].Size = 8
+		case reflect.Uint32:
+			tags[i].Size = 4
+		case reflect.Slice:
+			tags[i].Hex = f.Type.Elem().Kind() == reflect.Uint8
+		}
+	}
+	return tags
+}
+
+// luaFormat is a Format with its length and kind fields resolved.
+type luaFormat struct {
+	Format
+	LengthField Field
+	KindField   Field
+}
+
+// WriteLuaDissector writes a Wireshark dissector in Lua for the frames
+// described by Formats and the control messages described by MessageFields.
+func WriteLuaDissector(w io.Writer) error {
+	// Fields with the same Abbrev are declared once.
+	var fields []Field
+	formats := make([]luaFormat, len(Formats))
+	for i, f := range Formats {
+		for _, fd := range f.Fields {
+			if !slices.ContainsFunc(fields, func(x Field) bool { return x.Abbrev == fd.Abbrev }) {
+				fields = append(fields, fd)
+			}
+		}
+		formats[i] = luaFormat{Format: f, LengthField: f.field(f.Length), KindField: f.field(f.Kind)}
+	}
+
+	return luaTemplate.Execute(w, map[string]any{
+		"Fields":  fields,
+		"Formats": formats,
+		"Message": MessageFields,
+		"Tags":    luaTags(),
+		"Types":   luaTypes(),
+		"Kinds":   kindNames,
+	})
+}
+
+// luaTypes returns the message types by their code in the binary encoding.
+func luaTypes() map[int]nat.MessageType {
+	types := make(map[int]nat.MessageType)
+	for code := 1; code < 256; code++ {
+		if typ, ok := nat.MessageTypeForCode(byte(code)); ok {
+			types[code] = typ
+		}
+	}
+	return types
+}
+
+// luaProtoField returns the ProtoField constructor for a header field.
+func luaProtoField(f Field) (string, error) {
+	abbrev := luaQuote("natto." + f.Abbrev)
+	name := luaQuote(f.Name)
+	if f.Type == FieldString {
+		return fmt.Sprintf("ProtoField.string(%s, %s)", abbrev, name), nil
+	}
+
+	var typ string
+	switch f.Size {
+	case 1:
+		typ = "uint8"
+	case 2:
+		typ = "uint16"
+	case 4:
+		typ = "uint32"
+	default:
+		return "", fmt.Errorf("inspect: unsupported size %d of field %s", f.Size, f.Abbrev)
+	}
+	base := "base.DEC"
+	if f.Type == FieldHex {
+		base = "base.HEX"
+	}
+	if f.Values == nil {
+		return fmt.Sprintf("ProtoField.%s(%s, %s, %s)", typ, abbrev, name, base), nil
+	}
+
+	values := make([]uint64, 0, len(f.Values))
+	for v := range f.Values {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+	entries := make([]string, len(values))
+	for i, v := range values {
+		entries[i] = fmt.Sprintf("[%d] = %s", v, luaQuote(f.Values[v]))
+	}
+	return fmt.Sprintf("ProtoField.%s(%s, %s, %s, { %s })", typ, abbrev, name, base, strings.Join(entries, ", ")), nil
+}
+
+// luaQuote quotes s as a Lua string literal.
+func luaQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
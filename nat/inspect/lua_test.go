@@ -0,0 +1,83 @@
+package inspect_test
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aethiopicuschan/natto/nat/inspect"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestWriteLuaDissector(t *testing.T) {
+	t.Parallel()
+
+	var b strings.Builder
+	assert.NoError(t, inspect.WriteLuaDissector(&b))
+	lua := b.String()
+
+	// Every format, field and message key appears in the dissector.
+	for _, f := range inspect.Formats {
+		assert.Contains(t, lua, `["`+f.Name+`"] = {`)
+		for _, fd := range f.Fields {
+			assert.Contains(t, lua, `"natto.`+fd.Abbrev+`"`)
+		}
+	}
+	for _, mf := range inspect.MessageFields {
+		assert.Contains(t, lua, `ProtoField.string("natto.msg.`+mf.Key+`", "`+mf.Name+`")`)
+	}
+	assert.Contains(t, lua, `ProtoField.uint8("natto.kind", "Kind", base.DEC, { [1] = "control", [2] = "data", [3] = "data-seq", [4] = "message" })`)
+	assert.Contains(t, lua, `[4] = { key = "ts", size = 8, hex = false },`)
+	assert.Contains(t, lua, `[9] = { key = "token", size = 0, hex = true },`)
+	assert.Contains(t, lua, `[1] = "hello",`)
+	assert.Contains(t, lua, `ProtoField.uint32("natto.conn_id", "Connection ID", base.HEX)`)
+
+	// Shared fields are declared once.
+	assert.Equal(t, 1, strings.Count(lua, `f["magic"] =`))
+	assert.Contains(t, lua, `natto:register_heuristic("udp"`)
+}
+
+func TestWriteLuaDissectorGolden(t *testing.T) {
+	t.Parallel()
+
+	var b strings.Builder
+	assert.NoError(t, inspect.WriteLuaDissector(&b))
+
+	// Run with -update after changing the dissector, and review the diff.
+	golden := filepath.Join("testdata", "natto.lua")
+	if *update {
+		assert.NoError(t, os.WriteFile(golden, []byte(b.String()), 0o644))
+	}
+	want, err := os.ReadFile(golden)
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(want), b.String())
+	}
+}
+
+func TestWriteLuaDissectorSyntax(t *testing.T) {
+	t.Parallel()
+
+	var luac string
+	for _, name := range []string{"luac", "luac5.4", "luac5.3", "luac5.2"} {
+		if path, err := exec.LookPath(name); err == nil {
+			luac = path
+			break
+		}
+	}
+	if luac == "" {
+		t.Skip("luac is not on PATH")
+	}
+
+	var b strings.Builder
+	assert.NoError(t, inspect.WriteLuaDissector(&b))
+	file := filepath.Join(t.TempDir(), "natto.lua")
+	assert.NoError(t, os.WriteFile(file, []byte(b.String()), 0o644))
+
+	out, err := exec.Command(luac, "-p", file).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
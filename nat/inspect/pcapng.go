@@ -0,0 +1,324 @@
+package inspect
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNotPcapng is returned by ReadCapture for input that does not
+	// start with a pcapng section header.
+	ErrNotPcapng = errors.New("inspect: not a pcapng file")
+
+	// ErrMalformedCapture is returned by ReadCapture for truncated or
+	// inconsistent blocks.
+	ErrMalformedCapture = errors.New("inspect: malformed pcapng block")
+)
+
+// pcapng block types and options read by ReadCapture.
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	optComment  = 1
+	optEPBFlags = 2
+	optTSResol  = 9
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeVLAN = 0x8100
+
+	protoUDP = 17
+)
+
+// Direction is the direction of a captured packet, if recorded.
+type Direction int
+
+const (
+	DirectionUnknown Direction = iota
+	DirectionInbound
+	DirectionOutbound
+)
+
+// String returns the direction name.
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// Datagram is a UDP datagram read from a capture.
+type Datagram struct {
+	Time      time.Time
+	Src, Dst  *net.UDPAddr
+	Direction Direction
+
+	// Comment is the packet comment, such as the description and drop
+	// reason written by nat.Capture.
+	Comment string
+
+	Payload []byte
+}
+
+// captureInterface is an interface described in a pcapng section.
+type captureInterface struct {
+	linkType uint16
+	unit     time.Duration // of a timestamp tick, zero if below a nanosecond
+	perSec   float64       // ticks per second
+}
+
+// ReadCapture reads the UDP datagrams of a pcapng stream. Packets on links
+// other than raw IP and Ethernet, and packets that are not UDP, are skipped.
+func ReadCapture(r io.Reader) ([]Datagram, error) {
+	var (
+		order  binary.ByteOrder = binary.LittleEndian
+		ifaces []captureInterface
+		out    []Datagram
+		first  = true
+	)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF && !first {
+				return out, nil
+			}
+			if first {
+				return nil, ErrNotPcapng
+			}
+			return nil, ErrMalformedCapture
+		}
+
+		typ := binary.LittleEndian.Uint32(hdr[0:4])
+		if first && typ != blockSectionHeader {
+			return nil, ErrNotPcapng
+		}
+		first = false
+
+		if typ == blockSectionHeader {
+			// The byte-order magic follows the length and decides how to read it.
+			var magic [4]byte
+			if _, err := io.ReadFull(r, magic[:]); err != nil {
+				return nil, ErrMalformedCapture
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic[:]) == byteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic[:]) == byteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return nil, ErrNotPcapng
+			}
+			total := int(order.Uint32(hdr[4:8]))
+			if total < 28 || total%4 != 0 {
+				return nil, ErrMalformedCapture
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(total-12)); err != nil {
+				return nil, ErrMalformedCapture
+			}
+			ifaces = nil
+			continue
+		}
+
+		total := int(order.Uint32(hdr[4:8]))
+		if total < 12 || total%4 != 0 {
+			return nil, ErrMalformedCapture
+		}
+		block := make([]byte, total-8)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, ErrMalformedCapture
+		}
+		body := block[:len(block)-4]
+
+		switch order.Uint32(hdr[0:4]) {
+		case blockInterfaceDescription:
+			iface, err := readInterface(order, body)
+			if err != nil {
+				return nil, err
+			}
+			ifaces = append(ifaces, iface)
+
+		case blockEnhancedPacket:
+			d, ok, err := readPacket(order, ifaces, body)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, d)
+			}
+		}
+	}
+}
+
+// readInterface reads the body of an Interface Description Block.
+func readInterface(order binary.ByteOrder, body []byte) (captureInterface, error) {
+	if len(body) < 8 {
+		return captureInterface{}, ErrMalformedCapture
+	}
+	iface := captureInterface{linkType: order.Uint16(body[0:2])}
+
+	resol := byte(6) // microseconds
+	err := readOptions(order, body[8:], func(code uint16, value []byte) {
+		if code == optTSResol && len(value) == 1 {
+			resol = value[0]
+		}
+	})
+	if err != nil {
+		return captureInterface{}, err
+	}
+
+	if resol&0x80 != 0 {
+		iface.perSec = math.Exp2(float64(resol & 0x7F))
+	} else {
+		iface.perSec = math.Pow10(int(resol))
+	}
+	if iface.perSec <= 1e9 {
+		iface.unit = time.Duration(1e9 / iface.perSec)
+	}
+	return iface, nil
+}
+
+// readPacket reads the body of an Enhanced Packet Block. It reports false
+// for packets that are not UDP.
+func readPacket(order binary.ByteOrder, ifaces []captureInterface, body []byte) (Datagram, bool, error) {
+	if len(body) < 20 {
+		return Datagram{}, false, ErrMalformedCapture
+	}
+	id := int(order.Uint32(body[0:4]))
+	if id >= len(ifaces) {
+		return Datagram{}, false, ErrMalformedCapture
+	}
+	iface := ifaces[id]
+	ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+	capLen := int(order.Uint32(body[12:16]))
+	padded := (capLen + 3) &^ 3
+	if capLen < 0 || 20+padded > len(body) {
+		return Datagram{}, false, ErrMalformedCapture
+	}
+	data := body[20 : 20+capLen]
+
+	var d Datagram
+	if iface.unit > 0 {
+		d.Time = time.Unix(0, int64(ts)*int64(iface.unit))
+	} else {
+		sec := float64(ts) / iface.perSec
+		d.Time = time.Unix(0, int64(sec*1e9))
+	}
+	err := readOptions(order, body[20+padded:], func(code uint16, value []byte) {
+		switch code {
+		case optComment:
+			d.Comment = string(value)
+		case optEPBFlags:
+			if len(value) == 4 {
+				d.Direction = Direction(order.Uint32(value) & 3)
+			}
+		}
+	})
+	if err != nil {
+		return Datagram{}, false, err
+	}
+	if d.Direction > DirectionOutbound {
+		d.Direction = DirectionUnknown
+	}
+
+	ok := parseUDP(iface.linkType, data, &d)
+	return d, ok, nil
+}
+
+// readOptions calls fn for each option in b.
+func readOptions(order binary.ByteOrder, b []byte, fn func(code uint16, value []byte)) error {
+	for len(b) >= 4 {
+		code := order.Uint16(b[0:2])
+		n := int(order.Uint16(b[2:4]))
+		if code == 0 {
+			return nil
+		}
+		padded := (n + 3) &^ 3
+		if 4+padded > len(b) {
+			return ErrMalformedCapture
+		}
+		fn(code, b[4:4+n])
+		b = b[4+padded:]
+	}
+	return nil
+}
+
+// parseUDP fills the addresses and payload of d from a link-layer frame.
+// It reports false if the frame is not a UDP datagram.
+func parseUDP(linkType uint16, b []byte, d *Datagram) bool {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeEthernet:
+		if len(b) < 14 {
+			return false
+		}
+		etherType := binary.BigEndian.Uint16(b[12:14])
+		b = b[14:]
+		if etherType == etherTypeVLAN {
+			if len(b) < 4 {
+				return false
+			}
+			etherType = binary.BigEndian.Uint16(b[2:4])
+			b = b[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(b) == 0 {
+		return false
+	}
+
+	var srcIP, dstIP net.IP
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0F) * 4
+		if ihl < 20 || len(b) < ihl || b[9] != protoUDP {
+			return false
+		}
+		// Only first fragments carry the UDP header.
+		if binary.BigEndian.Uint16(b[6:8])&0x1FFF != 0 {
+			return false
+		}
+		srcIP, dstIP = net.IP(b[12:16]), net.IP(b[16:20])
+		b = b[ihl:]
+	case 6:
+		if len(b) < 40 || b[6] != protoUDP {
+			return false
+		}
+		srcIP, dstIP = net.IP(b[8:24]), net.IP(b[24:40])
+		b = b[40:]
+	default:
+		return false
+	}
+
+	if len(b) < 8 {
+		return false
+	}
+	n := int(binary.BigEndian.Uint16(b[4:6]))
+	if n < 8 || n > len(b) {
+		n = len(b)
+	}
+	d.Src = &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(b[0:2]))}
+	d.Dst = &net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(b[2:4]))}
+	d.Payload = b[8:n]
+	return true
+}
@@ -0,0 +1,85 @@
+package inspect_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/nat/inspect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCapture(t *testing.T) {
+	t.Parallel()
+
+	aConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer aConn.Close()
+	bConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer bConn.Close()
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var buf bytes.Buffer
+	capture, err := nat.NewCapture(&buf)
+	assert.NoError(t, err)
+
+	mux := nat.NewMux(aConn)
+	mux.SetCapture(capture)
+	mux.Start(ctx)
+
+	start := time.Now()
+	assert.NoError(t, mux.Send(bAddr, nat.PacketData, []byte("out")))
+	_, err = bConn.WriteToUDP([]byte("inbound"), aAddr)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return mux.Stats().Received == 1 }, 2*time.Second, 5*time.Millisecond)
+	assert.NoError(t, mux.Close())
+	assert.NoError(t, capture.Close())
+
+	got, err := inspect.ReadCapture(&buf)
+	if !assert.NoError(t, err) || !assert.Len(t, got, 2) {
+		return
+	}
+
+	out, in := got[0], got[1]
+	assert.Equal(t, inspect.DirectionOutbound, out.Direction)
+	assert.Equal(t, aAddr.String(), out.Src.String())
+	assert.Equal(t, bAddr.String(), out.Dst.String())
+	assert.Equal(t, "NAT1 data", out.Comment)
+	assert.Equal(t, "NAT1 frame (10 bytes)", inspect.Decode(out.Payload).Name)
+	assert.WithinDuration(t, start, out.Time, time.Second)
+
+	assert.Equal(t, inspect.DirectionInbound, in.Direction)
+	assert.Equal(t, bAddr.String(), in.Src.String())
+	assert.Equal(t, aAddr.String(), in.Dst.String())
+	assert.Equal(t, "undecodable: not a nat packet", in.Comment)
+	assert.Equal(t, []byte("inbound"), in.Payload)
+}
+
+func TestReadCaptureErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := inspect.ReadCapture(bytes.NewReader(nil))
+	assert.ErrorIs(t, err, inspect.ErrNotPcapng)
+	_, err = inspect.ReadCapture(bytes.NewReader([]byte("not a capture file")))
+	assert.ErrorIs(t, err, inspect.ErrNotPcapng)
+
+	var buf bytes.Buffer
+	capture, err := nat.NewCapture(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, capture.Close())
+	_, err = inspect.ReadCapture(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	assert.ErrorIs(t, err, inspect.ErrMalformedCapture)
+
+	// A header-only capture has no datagrams.
+	got, err := inspect.ReadCapture(&buf)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
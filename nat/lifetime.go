@@ -0,0 +1,200 @@
+package nat
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/aethiopicuschan/natto/stun"
+)
+
+const (
+	// defaultLifetimeStep is the default spacing of probed idle times.
+	defaultLifetimeStep = 5 * time.Second
+
+	// defaultLifetimeMax is the default longest idle time probed.
+	defaultLifetimeMax = 2 * time.Minute
+
+	// lifetimeReplyTimeout bounds how long a trial waits for the redirected response.
+	lifetimeReplyTimeout = time.Second
+
+	// lifetimeBaselineAttempts is how many times the trial without idle time
+	// runs before the server is taken not to support RESPONSE-PORT.
+	lifetimeBaselineAttempts = 3
+)
+
+// LifetimeOptions configures MeasureBindingLifetime.
+type LifetimeOptions struct {
+	// STUNServer is the STUN server used for probing ("host:port").
+	// It must support RESPONSE-PORT (RFC 5780), as stun.Server does.
+	STUNServer string
+
+	// Step is the spacing of the probed idle times. Defaults to 5 seconds.
+	Step time.Duration
+
+	// Max is the longest idle time probed. Defaults to 2 minutes.
+	Max time.Duration
+
+	// Listen opens the probe sockets. Defaults to UDP sockets on all interfaces.
+	Listen ListenFunc
+}
+
+// MeasureBindingLifetime measures how long the NAT keeps an idle UDP binding.
+//
+// Following RFC 5780, each trial creates a binding with a STUN request from
+// one socket, waits for an idle time, and then asks the server from a second
+// socket to send a response to the first binding's port (RESPONSE-PORT).
+// The binding is alive if the response arrives. Trials for Step, 2*Step, ...
+// up to Max run concurrently, so measuring takes about as long as the
+// binding lives.
+//
+// It returns the longest idle time the binding survived, which is a lower
+// bound of its lifetime and is Max if the binding outlived every trial.
+// If the server does not honor RESPONSE-PORT, which is concluded after the
+// trial without idle time has failed a few times, it returns
+// ErrResponsePortUnsupported.
+func MeasureBindingLifetime(ctx context.Context, opts LifetimeOptions) (time.Duration, error) {
+	step := opts.Step
+	if step <= 0 {
+		step = defaultLifetimeStep
+	}
+	maxIdle := opts.Max
+	if maxIdle <= 0 {
+		maxIdle = defaultLifetimeMax
+	}
+
+	server, err := net.ResolveUDPAddr("udp", opts.STUNServer)
+	if err != nil {
+		return 0, err
+	}
+
+	listen := opts.Listen
+	if listen == nil {
+		listen = listenUDP(nil)
+	}
+
+	// The second socket, shared by every trial; it only sends.
+	sender, err := listen()
+	if err != nil {
+		return 0, err
+	}
+	defer sender.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Trial 0 has no idle time and checks that the server supports RESPONSE-PORT.
+	idles := []time.Duration{0}
+	for d := step; d <= maxIdle; d += step {
+		idles = append(idles, d)
+	}
+
+	type result struct {
+		i     int
+		alive bool
+		err   error
+	}
+	results := make(chan result, len(idles)+lifetimeBaselineAttempts-1)
+	run := func(i int) {
+		go func() {
+			alive, err := lifetimeTrial(ctx, listen, sender, server, idles[i])
+			results <- result{i, alive, err}
+		}()
+	}
+	for i := range idles {
+		run(i)
+	}
+
+	// Bindings are assumed to expire monotonically, so the answer is known
+	// once every trial before the first dead one has survived.
+	alive := make([]bool, len(idles))
+	done := make([]bool, len(idles))
+	pending := len(idles)
+	baselines := 1
+	for pending > 0 {
+		r := <-results
+		pending--
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		// A lost response to the baseline does not prove that RESPONSE-PORT
+		// is unsupported; it is tried again before concluding so.
+		if r.i == 0 && !r.alive && baselines < lifetimeBaselineAttempts {
+			baselines++
+			pending++
+			run(0)
+			continue
+		}
+		done[r.i] = true
+		alive[r.i] = r.alive
+
+		for i := range idles {
+			if !done[i] {
+				break
+			}
+			if !alive[i] {
+				if i == 0 {
+					return 0, ErrResponsePortUnsupported
+				}
+				return idles[i-1], nil
+			}
+		}
+	}
+	return idles[len(idles)-1], nil
+}
+
+// lifetimeTrial creates a binding, waits for idle and reports whether a
+// response redirected to the binding still arrives.
+func lifetimeTrial(ctx context.Context, listen ListenFunc, sender PacketConn, server *net.UDPAddr, idle time.Duration) (bool, error) {
+	conn, err := listen()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client := stun.NewClient()
+	mapped, err := client.BindingRequestTo(ctx, conn, server)
+	if err != nil {
+		return false, err
+	}
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+	}
+
+	tid, err := stun.NewTransactionID()
+	if err != nil {
+		return false, err
+	}
+	req := stun.NewBindingRequest(tid)
+	req.Attributes = append(req.Attributes, stun.ResponsePortAttr(mapped.Port))
+	reqBytes := req.Marshal()
+
+	// The request is retransmitted a few times in case one is lost,
+	// which does not refresh the binding under test.
+	buf := make([]byte, 1500)
+	for range 3 {
+		if _, err := sender.WriteTo(reqBytes, server); err != nil {
+			return false, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(lifetimeReplyTimeout / 3))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if resp, err := stun.Parse(buf[:n]); err == nil && resp.TransactionID == tid {
+				return true, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,296 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+// expiringNAT relays packets sent to its ingress address to a STUN server,
+// giving each inside address its own external socket. A binding expires when
+// nothing has been sent from inside for timeout; responses arriving after
+// that are dropped.
+type expiringNAT struct {
+	ingress *net.UDPConn
+	server  *net.UDPAddr
+	timeout time.Duration
+
+	mu       sync.Mutex
+	bindings map[string]*natBinding
+}
+
+type natBinding struct {
+	ext     *net.UDPConn
+	inside  *net.UDPAddr
+	lastOut time.Time
+}
+
+func newExpiringNAT(t *testing.T, server *net.UDPAddr, timeout time.Duration) *expiringNAT {
+	t.Helper()
+
+	ingress, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	n := &expiringNAT{
+		ingress:  ingress,
+		server:   server,
+		timeout:  timeout,
+		bindings: make(map[string]*natBinding),
+	}
+	go n.serve()
+	t.Cleanup(func() {
+		ingress.Close()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for _, b := range n.bindings {
+			b.ext.Close()
+		}
+	})
+	return n
+}
+
+func (n *expiringNAT) addr() string {
+	return n.ingress.LocalAddr().String()
+}
+
+func (n *expiringNAT) serve() {
+	buf := make([]byte, 1500)
+	for {
+		size, src, err := n.ingress.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		b, ok := n.bindings[src.String()]
+		if ok && time.Since(b.lastOut) > n.timeout {
+			b.ext.Close()
+			ok = false
+		}
+		if !ok {
+			ext, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				n.mu.Unlock()
+				continue
+			}
+			b = &natBinding{ext: ext, inside: src}
+			n.bindings[src.String()] = b
+			go n.forward(b)
+		}
+		b.lastOut = time.Now()
+		n.mu.Unlock()
+
+		_, _ = b.ext.WriteToUDP(buf[:size], n.server)
+	}
+}
+
+// forward relays what arrives at a binding's external socket back inside.
+func (n *expiringNAT) forward(b *natBinding) {
+	buf := make([]byte, 1500)
+	for {
+		size, _, err := b.ext.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		expired := time.Since(b.lastOut) > n.timeout
+		n.mu.Unlock()
+		if !expired {
+			_, _ = n.ingress.WriteToUDP(buf[:size], b.inside)
+		}
+	}
+}
+
+func startSTUNServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	srv, err := stun.ListenUDP("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go func() { _ = srv.Serve() }()
+	t.Cleanup(func() { srv.Close() })
+	return srv.Conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestMeasureBindingLifetime(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sim := newExpiringNAT(t, startSTUNServer(t), 250*time.Millisecond)
+
+	start := time.Now()
+	lifetime, err := nat.MeasureBindingLifetime(ctx, nat.LifetimeOptions{
+		STUNServer: sim.addr(),
+		Step:       100 * time.Millisecond,
+		Max:        time.Second,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, lifetime)
+
+	// Trials beyond the first dead one are not waited for.
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestMeasureBindingLifetimeOutlivesMax(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sim := newExpiringNAT(t, startSTUNServer(t), time.Minute)
+
+	lifetime, err := nat.MeasureBindingLifetime(ctx, nat.LifetimeOptions{
+		STUNServer: sim.addr(),
+		Step:       100 * time.Millisecond,
+		Max:        300 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 300*time.Millisecond, lifetime)
+}
+
+// fakeSTUNServer answers Binding requests with the source as the mapped
+// address, sending the response to the address dest returns, or nowhere if
+// it returns nil.
+func fakeSTUNServer(t *testing.T, dest func(src *net.UDPAddr, req *stun.Message) *net.UDPAddr) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, err := stun.Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			to := dest(src, req)
+			if to == nil {
+				continue
+			}
+			value := []byte{0, 1, byte(src.Port >> 8), byte(src.Port)}
+			resp := &stun.Message{
+				Method:        stun.MethodBinding,
+				Class:         stun.ClassSuccessResponse,
+				Cookie:        stun.MagicCookie,
+				TransactionID: req.TransactionID,
+				Attributes: []stun.Attribute{
+					{Type: stun.AttrMappedAddress, Value: append(value, src.IP.To4()...)},
+				},
+			}
+			_, _ = conn.WriteToUDP(resp.Marshal(), to)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestMeasureBindingLifetimeUnsupported(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A server that always answers the source, ignoring RESPONSE-PORT.
+	server := fakeSTUNServer(t, func(src *net.UDPAddr, _ *stun.Message) *net.UDPAddr { return src })
+
+	_, err := nat.MeasureBindingLifetime(ctx, nat.LifetimeOptions{
+		STUNServer: server,
+		Step:       100 * time.Millisecond,
+		Max:        200 * time.Millisecond,
+	})
+	assert.ErrorIs(t, err, nat.ErrResponsePortUnsupported)
+}
+
+func TestMeasureBindingLifetimeBaselineLost(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A server honoring RESPONSE-PORT whose responses to the first port
+	// asked for, that of the first baseline trial, are all lost.
+	var mu sync.Mutex
+	lost := 0
+	server := fakeSTUNServer(t, func(src *net.UDPAddr, req *stun.Message) *net.UDPAddr {
+		a, ok := req.GetAttribute(stun.AttrResponsePort)
+		if !ok {
+			return src
+		}
+		port, err := stun.DecodeResponsePort(a)
+		if err != nil {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if lost == 0 {
+			lost = port
+		}
+		if port == lost {
+			return nil
+		}
+		return &net.UDPAddr{IP: src.IP, Port: port}
+	})
+
+	lifetime, err := nat.MeasureBindingLifetime(ctx, nat.LifetimeOptions{
+		STUNServer: server,
+		Step:       100 * time.Millisecond,
+		Max:        200 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, lifetime)
+}
+
+func TestAdaptiveKeepalive(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sim := newExpiringNAT(t, startSTUNServer(t), 250*time.Millisecond)
+	a, b := newSessionPair(t, ctx)
+	defer a.Close()
+	defer b.Close()
+
+	events := make(chan nat.SessionEvent, 8)
+	a.SetEventHandler(func(ev nat.SessionEvent) {
+		if ev.Type == nat.SessionKeepaliveAdjusted {
+			events <- ev
+		}
+	})
+
+	a.SetKeepalive(time.Second)
+	a.StartAdaptiveKeepalive(ctx, nat.LifetimeOptions{
+		STUNServer: sim.addr(),
+		Step:       100 * time.Millisecond,
+		Max:        time.Second,
+	})
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, 200*time.Millisecond, ev.Lifetime)
+		assert.Equal(t, 100*time.Millisecond, ev.Interval)
+	case <-ctx.Done():
+		t.Fatal("keepalive interval not adjusted")
+	}
+	assert.Equal(t, 100*time.Millisecond, a.KeepaliveInterval())
+
+	// Keepalives now go out at the new interval and are acknowledged.
+	time.Sleep(500 * time.Millisecond)
+	assert.GreaterOrEqual(t, a.Stats().ProbesAcked, uint64(3))
+}
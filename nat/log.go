@@ -0,0 +1,14 @@
+package nat
+
+import "log/slog"
+
+// discardLogger is used when no Logger is configured.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// loggerOr returns l, or a logger that discards everything if l is nil.
+func loggerOr(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discardLogger
+	}
+	return l
+}
@@ -0,0 +1,95 @@
+package nat_test
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordHandler is a slog.Handler that records the messages logged to it.
+type recordHandler struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs = append(h.msgs, r.Level.String()+" "+r.Message)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+// has reports whether msg has been logged.
+func (h *recordHandler) has(msg string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Contains(h.msgs, msg)
+}
+
+func TestLogging(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	defer aConn.Close()
+	bConn := newLocalUDP(t)
+	defer bConn.Close()
+
+	// The dialer logs through its options, the acceptor through its Mux.
+	var dialLog, muxLog recordHandler
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	bMux.SetLogger(slog.New(&muxLog))
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	peerB := &nat.Peer{ID: "peer-b", Addr: bConn.LocalAddr().(*net.UDPAddr)}
+	accepted := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, _ := nat.NewAcceptor(bMux, peerB.ID, nat.AcceptOptions{}).Accept(ctx)
+		accepted <- sess
+	}()
+
+	aSess, _, err := nat.Dial(ctx, aMux, "peer-a", peerB, nat.DialOptions{
+		Interval: 20 * time.Millisecond,
+		Logger:   slog.New(&dialLog),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	bSess := <-accepted
+	if !assert.NotNil(t, bSess) {
+		return
+	}
+
+	assert.True(t, dialLog.has("DEBUG nat: punch started"))
+	assert.True(t, dialLog.has("DEBUG nat: punch probing candidates"))
+	assert.True(t, dialLog.has("INFO nat: punch peer known"))
+	assert.True(t, dialLog.has("INFO nat: punch succeeded"))
+	assert.True(t, muxLog.has("INFO nat: accept hello received"))
+
+	// Garbage is reported by the Mux.
+	_, err = aConn.WriteToUDP([]byte("garbage"), bConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return muxLog.has("DEBUG nat: mux packet not delivered") }, time.Second, 5*time.Millisecond)
+
+	// Closing is logged by both sessions.
+	aSess.Close()
+	<-bSess.Done()
+	assert.True(t, dialLog.has("DEBUG nat: session ended"))
+	assert.True(t, muxLog.has("INFO nat: session ended"))
+}
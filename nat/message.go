@@ -13,10 +13,36 @@ const (
 
 	// MessageAck is sent in response to MessageHello to confirm reachability.
 	MessageAck MessageType = "ack"
+
+	// MessageBye is sent by a Session that is being closed locally.
+	MessageBye MessageType = "bye"
+
+	// MessageByeAck is sent in response to MessageBye to confirm the close.
+	MessageByeAck MessageType = "bye-ack"
+
+	// MessageKeepalive is sent periodically by a Session to probe liveness.
+	MessageKeepalive MessageType = "keepalive"
+
+	// MessageKeepaliveAck is sent in response to MessageKeepalive.
+	MessageKeepaliveAck MessageType = "keepalive-ack"
+
+	// MessagePathChallenge is sent by a Session to validate a new remote address.
+	MessagePathChallenge MessageType = "path-challenge"
+
+	// MessagePathResponse echoes the Challenge of a MessagePathChallenge
+	// back to the address it came from.
+	MessagePathResponse MessageType = "path-response"
+
+	// MessageTCPOffer starts TCP hole punching (see DialTCP).
+	MessageTCPOffer MessageType = "tcp-offer"
+
+	// MessageTCPAnswer accepts a MessageTCPOffer (see AcceptTCP).
+	MessageTCPAnswer MessageType = "tcp-answer"
 )
 
 // Message is a small control packet exchanged during NAT traversal.
-// It is intentionally simple and JSON-encoded for debuggability.
+// It is sent in the binary encoding of EncodeMessageBinary by default, or
+// as JSON for debuggability (see MessageEncoding).
 type Message struct {
 	// Type indicates the purpose of this message.
 	Type MessageType `json:"type"`
@@ -30,9 +56,34 @@ type Message struct {
 
 	// Timestamp can be used by the receiver to reason about freshness.
 	Timestamp int64 `json:"ts"`
+
+	// Echo carries the Timestamp of the message being answered, if any.
+	Echo int64 `json:"echo,omitempty"`
+
+	// ConnID is the connection ID the sender wants to receive session packets on.
+	// It is set in MessageHello and MessageAck; zero means the sender only
+	// understands address-based (version 1) packets.
+	ConnID uint32 `json:"conn_id,omitempty"`
+
+	// Challenge carries the unpredictable data of a path challenge and its response.
+	Challenge []byte `json:"challenge,omitempty"`
+
+	// PathID names the path a path challenge or response is about.
+	// The path a session was created with has ID zero.
+	PathID uint32 `json:"path_id,omitempty"`
+
+	// Token identifies a TCP hole punching attempt in MessageTCPOffer and
+	// MessageTCPAnswer, and authenticates the resulting connection.
+	Token []byte `json:"token,omitempty"`
+
+	// Addrs lists the sender's TCP addresses ("host:port") in MessageTCPOffer
+	// and MessageTCPAnswer.
+	Addrs []string `json:"addrs,omitempty"`
 }
 
-// EncodeMessage serializes a Message into bytes.
+// EncodeMessage serializes a Message into its JSON encoding,
+// MessageEncodingJSON. The default encoding is the binary one of
+// EncodeMessageBinary.
 func EncodeMessage(msg *Message) (b []byte, err error) {
 	if msg == nil {
 		err = ErrMessageIsNil
@@ -42,8 +93,18 @@ func EncodeMessage(msg *Message) (b []byte, err error) {
 	return
 }
 
-// DecodeMessage deserializes bytes into a Message.
+// DecodeMessage deserializes a Message in either encoding: JSON objects are
+// decoded as JSON, anything else as the binary encoding. Receivers that know
+// the packet kind use DecodePacketMessage instead.
 func DecodeMessage(data []byte) (*Message, error) {
+	if len(data) > 0 && data[0] == binaryMessageVersion {
+		return DecodeMessageBinary(data)
+	}
+	return decodeMessageJSON(data)
+}
+
+// decodeMessageJSON deserializes the JSON encoding of a Message.
+func decodeMessageJSON(data []byte) (*Message, error) {
 	var msg Message
 	if err := json.Unmarshal(data, &msg); err != nil {
 		return nil, err
@@ -0,0 +1,327 @@
+package nat
+
+import (
+	"encoding/binary"
+)
+
+// MessageEncoding selects how a Message is encoded on the wire. The packet
+// kind tells receivers which encoding a control packet uses, so peers
+// decode both regardless of their own setting.
+type MessageEncoding uint8
+
+const (
+	// MessageEncodingBinary is the compact TLV encoding of
+	// EncodeMessageBinary, carried in PacketMessage packets. It is the default.
+	MessageEncodingBinary MessageEncoding = iota
+
+	// MessageEncodingJSON is the JSON encoding of EncodeMessage. It is
+	// easier to read in packet captures, and handshakes in it are carried in
+	// PacketControl packets, as peers built before the binary encoding
+	// existed expect. Session messages are carried in PacketMessage packets
+	// in either encoding.
+	MessageEncodingJSON
+)
+
+// String returns the encoding name.
+func (e MessageEncoding) String() string {
+	switch e {
+	case MessageEncodingBinary:
+		return "binary"
+	case MessageEncodingJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// encodingOf returns the encoding of messages in packets of kind k.
+func encodingOf(k PacketKind) MessageEncoding {
+	if k == PacketMessage {
+		return MessageEncodingBinary
+	}
+	return MessageEncodingJSON
+}
+
+// encodeMessage encodes msg with e and returns the packet kind to carry it.
+func encodeMessage(msg *Message, e MessageEncoding) (PacketKind, []byte, error) {
+	if e == MessageEncodingJSON {
+		b, err := EncodeMessage(msg)
+		return PacketControl, b, err
+	}
+	b, err := EncodeMessageBinary(msg)
+	return PacketMessage, b, err
+}
+
+// payloadEncoding returns the encoding of a Message in a PacketMessage
+// payload, which Sessions send in either encoding.
+func payloadEncoding(payload []byte) MessageEncoding {
+	if len(payload) > 0 && payload[0] == binaryMessageVersion {
+		return MessageEncodingBinary
+	}
+	return MessageEncodingJSON
+}
+
+// DecodePacketMessage decodes the Message carried by a PacketMessage or
+// PacketControl packet. PacketControl packets carry JSON; PacketMessage
+// packets carry the binary encoding, or JSON if sent by a Session set to it.
+func DecodePacketMessage(pkt *Packet) (*Message, error) {
+	switch pkt.Kind {
+	case PacketMessage:
+		return DecodeMessage(pkt.Payload)
+	case PacketControl:
+		return decodeMessageJSON(pkt.Payload)
+	default:
+		return nil, ErrInvalidMessage
+	}
+}
+
+// binaryMessageVersion is the version byte of the binary encoding.
+const binaryMessageVersion = 1
+
+// messageTypeCodes lists the message types by their code in the binary
+// encoding. Types without a code, such as those of newer versions, are sent
+// by name, and code 0 stands for them.
+var messageTypeCodes = []MessageType{
+	0:  "",
+	1:  MessageHello,
+	2:  MessageAck,
+	3:  MessageBye,
+	4:  MessageByeAck,
+	5:  MessageKeepalive,
+	6:  MessageKeepaliveAck,
+	7:  MessagePathChallenge,
+	8:  MessagePathResponse,
+	9:  MessageTCPOffer,
+	10: MessageTCPAnswer,
+}
+
+// Field tags of the binary encoding.
+const (
+	tagType      = 1  // string, for types without a code
+	tagPeerID    = 2  // string
+	tagToPeerID  = 3  // string
+	tagTimestamp = 4  // int64
+	tagEcho      = 5  // int64
+	tagConnID    = 6  // uint32
+	tagChallenge = 7  // bytes
+	tagPathID    = 8  // uint32
+	tagToken     = 9  // bytes
+	tagAddr      = 10 // string, once per address
+)
+
+// messageTags maps the Message field names to their tags in the binary
+// encoding.
+var messageTags = map[string]byte{
+	"Type":      tagType,
+	"PeerID":    tagPeerID,
+	"ToPeerID":  tagToPeerID,
+	"Timestamp": tagTimestamp,
+	"Echo":      tagEcho,
+	"ConnID":    tagConnID,
+	"Challenge": tagChallenge,
+	"PathID":    tagPathID,
+	"Token":     tagToken,
+	"Addrs":     tagAddr,
+}
+
+// MessageTypeForCode returns the message type with code in the binary
+// encoding. It reports false for code 0, which stands for types sent by
+// name, and for codes no type has.
+func MessageTypeForCode(code byte) (MessageType, bool) {
+	if code == 0 || int(code) >= len(messageTypeCodes) {
+		return "", false
+	}
+	return messageTypeCodes[code], true
+}
+
+// MessageFieldTag returns the tag of the Message field named name in the
+// binary encoding, and false if the field has none.
+func MessageFieldTag(name string) (byte, bool) {
+	tag, ok := messageTags[name]
+	return tag, ok
+}
+
+// EncodeMessageBinary serializes a Message into its binary encoding.
+//
+// Layout:
+// [0]   version (1)
+// [1]   type code, or 0 if the type is sent by name
+// [2..] fields, each a tag byte, a uvarint length and the value
+//
+// Integers are big endian and of fixed size; empty fields are omitted.
+// Decoders skip fields with unknown tags, so fields can be added without
+// a new version.
+func EncodeMessageBinary(msg *Message) ([]byte, error) {
+	if msg == nil {
+		return nil, ErrMessageIsNil
+	}
+
+	code := 0
+	for i, t := range messageTypeCodes[1:] {
+		if t == msg.Type {
+			code = i + 1
+			break
+		}
+	}
+
+	size := 2
+	if code == 0 {
+		size += fieldSize(len(msg.Type))
+	}
+	size += fieldSize(len(msg.PeerID)) + fieldSize(len(msg.ToPeerID)) +
+		fieldSize(len(msg.Challenge)) + fieldSize(len(msg.Token))
+	for _, a := range msg.Addrs {
+		size += fieldSize(len(a))
+	}
+	size += 2*fieldSize(8) + 2*fieldSize(4)
+
+	b := make([]byte, 2, size)
+	b[0] = binaryMessageVersion
+	b[1] = byte(code)
+	if code == 0 {
+		b = appendField(b, tagType, string(msg.Type))
+	}
+	b = appendField(b, tagPeerID, msg.PeerID)
+	b = appendField(b, tagToPeerID, msg.ToPeerID)
+	b = appendUint64Field(b, tagTimestamp, uint64(msg.Timestamp))
+	b = appendUint64Field(b, tagEcho, uint64(msg.Echo))
+	b = appendUint32Field(b, tagConnID, msg.ConnID)
+	b = appendField(b, tagChallenge, msg.Challenge)
+	b = appendUint32Field(b, tagPathID, msg.PathID)
+	b = appendField(b, tagToken, msg.Token)
+	for _, a := range msg.Addrs {
+		b = appendField(b, tagAddr, a)
+	}
+	return b, nil
+}
+
+// fieldSize returns the most bytes a field with an n byte value takes.
+func fieldSize(n int) int {
+	return 1 + binary.MaxVarintLen16 + n
+}
+
+// appendField appends a field unless value is empty.
+func appendField[T string | []byte](b []byte, tag byte, value T) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendUint64Field appends an 8 byte field unless v is zero.
+func appendUint64Field(b []byte, tag byte, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = append(b, tag, 8)
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+// appendUint32Field appends a 4 byte field unless v is zero.
+func appendUint32Field(b []byte, tag byte, v uint32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = append(b, tag, 4)
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+// DecodeMessageBinary deserializes the binary encoding of a Message.
+// The strings of the Message share one copy of data.
+func DecodeMessageBinary(data []byte) (*Message, error) {
+	if len(data) < 2 || data[0] != binaryMessageVersion {
+		return nil, ErrInvalidMessage
+	}
+
+	var msg Message
+	if code := int(data[1]); code < len(messageTypeCodes) {
+		msg.Type = messageTypeCodes[code]
+	} else {
+		return nil, ErrInvalidMessage
+	}
+
+	var str string
+	substr := func(start, n int) string {
+		if str == "" {
+			str = string(data)
+		}
+		return str[start : start+n]
+	}
+	err := readFields(data, 2, func(tag byte, start, n int) bool {
+		v := data[start : start+n]
+		switch tag {
+		case tagType:
+			msg.Type = MessageType(substr(start, n))
+		case tagPeerID:
+			msg.PeerID = substr(start, n)
+		case tagToPeerID:
+			msg.ToPeerID = substr(start, n)
+		case tagTimestamp, tagEcho:
+			if n != 8 {
+				return false
+			}
+			if tag == tagTimestamp {
+				msg.Timestamp = int64(binary.BigEndian.Uint64(v))
+			} else {
+				msg.Echo = int64(binary.BigEndian.Uint64(v))
+			}
+		case tagConnID, tagPathID:
+			if n != 4 {
+				return false
+			}
+			if tag == tagConnID {
+				msg.ConnID = binary.BigEndian.Uint32(v)
+			} else {
+				msg.PathID = binary.BigEndian.Uint32(v)
+			}
+		case tagChallenge:
+			msg.Challenge = append([]byte(nil), v...)
+		case tagToken:
+			msg.Token = append([]byte(nil), v...)
+		case tagAddr:
+			msg.Addrs = append(msg.Addrs, substr(start, n))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// readFields calls fn with the tag, offset and length of each field of b
+// from offset i on, stopping if fn returns false. It returns
+// ErrInvalidMessage if a field is truncated or fn rejects it.
+func readFields(b []byte, i int, fn func(tag byte, start, n int) bool) error {
+	for i < len(b) {
+		tag := b[i]
+		n, k := binary.Uvarint(b[i+1:])
+		if k <= 0 || n > uint64(len(b)-i-1-k) {
+			return ErrInvalidMessage
+		}
+		start := i + 1 + k
+		if !fn(tag, start, int(n)) {
+			return ErrInvalidMessage
+		}
+		i = start + int(n)
+	}
+	return nil
+}
+
+// messageRecipient returns the ToPeerID of a binary-encoded message without
+// decoding the rest of it, or nil if it has none.
+func messageRecipient(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != binaryMessageVersion {
+		return nil, ErrInvalidMessage
+	}
+	var to []byte
+	err := readFields(data, 2, func(tag byte, start, n int) bool {
+		if tag == tagToPeerID {
+			to = data[start : start+n]
+		}
+		return true
+	})
+	return to, err
+}
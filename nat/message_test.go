@@ -1,8 +1,12 @@
 package nat_test
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/aethiopicuschan/natto/metrics"
 	"github.com/aethiopicuschan/natto/nat"
 	"github.com/stretchr/testify/assert"
 )
@@ -28,3 +32,327 @@ func TestMessageEncodeDecode(t *testing.T) {
 	assert.Equal(t, in.ToPeerID, out.ToPeerID)
 	assert.Equal(t, in.Timestamp, out.Timestamp)
 }
+
+func TestMessageBinaryEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	in := &nat.Message{
+		Type:      nat.MessageTCPOffer,
+		PeerID:    "peer-a",
+		ToPeerID:  "peer-b",
+		Timestamp: -1,
+		Echo:      1700000000000000000,
+		ConnID:    0xdeadbeef,
+		Challenge: []byte{1, 2, 3},
+		PathID:    7,
+		Token:     make([]byte, 200),
+		Addrs:     []string{"10.0.0.1:1", "[::1]:2"},
+	}
+
+	b, err := nat.EncodeMessageBinary(in)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), b[0])
+
+	out, err := nat.DecodeMessageBinary(b)
+	assert.NoError(t, err)
+	assert.Equal(t, in, out)
+
+	// DecodeMessage tells the encodings apart.
+	out, err = nat.DecodeMessage(b)
+	assert.NoError(t, err)
+	assert.Equal(t, in, out)
+
+	// Zero fields are omitted and decode as zero.
+	b, err = nat.EncodeMessageBinary(&nat.Message{Type: nat.MessageKeepalive})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 5}, b)
+	out, err = nat.DecodeMessageBinary(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &nat.Message{Type: nat.MessageKeepalive}, out)
+
+	_, err = nat.EncodeMessageBinary(nil)
+	assert.ErrorIs(t, err, nat.ErrMessageIsNil)
+}
+
+func TestMessageBinaryExtensible(t *testing.T) {
+	t.Parallel()
+
+	// Types without a code are sent by name.
+	b, err := nat.EncodeMessageBinary(&nat.Message{Type: "future", PeerID: "peer-a"})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), b[1])
+	out, err := nat.DecodeMessageBinary(b)
+	assert.NoError(t, err)
+	assert.Equal(t, nat.MessageType("future"), out.Type)
+
+	// Fields with unknown tags are skipped.
+	b = append(b, 200, 3, 'x', 'y', 'z')
+	b = append(b, 3, 6, 'p', 'e', 'e', 'r', '-', 'b')
+	out, err = nat.DecodeMessageBinary(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &nat.Message{Type: "future", PeerID: "peer-a", ToPeerID: "peer-b"}, out)
+}
+
+func TestMessageBinaryMalformed(t *testing.T) {
+	t.Parallel()
+
+	valid, err := nat.EncodeMessageBinary(&nat.Message{Type: nat.MessageHello, PeerID: "peer-a"})
+	assert.NoError(t, err)
+
+	for name, b := range map[string][]byte{
+		"empty":           nil,
+		"version":         {2, 1},
+		"type code":       {1, 200},
+		"truncated":       valid[:len(valid)-1],
+		"truncated len":   {1, 1, 2, 0x80},
+		"timestamp size":  {1, 1, 4, 2, 0, 1},
+		"connection size": {1, 1, 6, 1, 9},
+	} {
+		_, err := nat.DecodeMessageBinary(b)
+		assert.ErrorIs(t, err, nat.ErrInvalidMessage, name)
+	}
+}
+
+func TestMessageBinaryTables(t *testing.T) {
+	t.Parallel()
+
+	typ, ok := nat.MessageTypeForCode(1)
+	assert.True(t, ok)
+	assert.Equal(t, nat.MessageHello, typ)
+	_, ok = nat.MessageTypeForCode(0)
+	assert.False(t, ok)
+	_, ok = nat.MessageTypeForCode(200)
+	assert.False(t, ok)
+
+	tag, ok := nat.MessageFieldTag("PeerID")
+	assert.True(t, ok)
+	assert.Equal(t, byte(2), tag)
+	_, ok = nat.MessageFieldTag("Unknown")
+	assert.False(t, ok)
+}
+
+func TestDecodeMessageJSONWhitespace(t *testing.T) {
+	t.Parallel()
+
+	out, err := nat.DecodeMessage([]byte(" \n\t{\"type\":\"hello\",\"peer_id\":\"peer-a\"}"))
+	assert.NoError(t, err)
+	assert.Equal(t, &nat.Message{Type: nat.MessageHello, PeerID: "peer-a"}, out)
+}
+
+func TestDecodePacketMessage(t *testing.T) {
+	t.Parallel()
+
+	msg := &nat.Message{Type: nat.MessageHello, PeerID: "peer-a"}
+	jsonb, err := nat.EncodeMessage(msg)
+	assert.NoError(t, err)
+	binb, err := nat.EncodeMessageBinary(msg)
+	assert.NoError(t, err)
+
+	// The packet kind selects the encoding.
+	out, err := nat.DecodePacketMessage(&nat.Packet{Kind: nat.PacketControl, Payload: jsonb})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+	out, err = nat.DecodePacketMessage(&nat.Packet{Kind: nat.PacketMessage, Payload: binb})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	_, err = nat.DecodePacketMessage(&nat.Packet{Kind: nat.PacketControl, Payload: binb})
+	assert.Error(t, err)
+	_, err = nat.DecodePacketMessage(&nat.Packet{Kind: nat.PacketData, Payload: binb})
+	assert.ErrorIs(t, err, nat.ErrInvalidMessage)
+}
+
+func TestDialMessageEncoding(t *testing.T) {
+	t.Parallel()
+
+	for _, enc := range []nat.MessageEncoding{nat.MessageEncodingBinary, nat.MessageEncodingJSON} {
+		t.Run(enc.String(), func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			aConn := newLocalUDP(t)
+			defer aConn.Close()
+			bConn := newLocalUDP(t)
+			defer bConn.Close()
+
+			// Only the dialer chooses; the acceptor answers in kind.
+			aMux := nat.NewMux(aConn)
+			aMux.SetMessageEncoding(enc)
+			bMux := nat.NewMux(bConn)
+			aMux.Start(ctx)
+			bMux.Start(ctx)
+
+			reg := metrics.NewRegistry()
+			bMux.SetMetrics(reg)
+
+			type accepted struct {
+				sess *nat.Session
+				res  *nat.PunchResult
+			}
+			acceptCh := make(chan accepted, 1)
+			go func() {
+				sess, res, _ := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{}).Accept(ctx)
+				acceptCh <- accepted{sess, res}
+			}()
+
+			aSess, aRes, err := nat.Dial(ctx, aMux, "peer-a", &nat.Peer{ID: "peer-b", Addr: bConn.LocalAddr().(*net.UDPAddr)}, nat.DialOptions{
+				Interval: 20 * time.Millisecond,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			b := <-acceptCh
+			if !assert.NotNil(t, b.sess) {
+				return
+			}
+			assert.Equal(t, enc, aRes.Encoding)
+			assert.Equal(t, enc, b.res.Encoding)
+
+			// Session control messages keep to the encoding.
+			aSess.Close()
+			<-b.sess.Done()
+			assert.ErrorIs(t, b.sess.Err(), nat.ErrRemoteClosed)
+
+			// The dialer also sends JSON HELLOs until it has heard from the
+			// acceptor, but the acceptor's handshake is in kind. Session
+			// messages are PacketMessage in either encoding.
+			out := scrape(reg)
+			if enc == nat.MessageEncodingJSON {
+				assert.Contains(t, out, `natto_bytes_total{direction="sent",kind="control"}`)
+			} else {
+				assert.NotContains(t, out, `natto_bytes_total{direction="sent",kind="control"}`)
+			}
+			assert.Contains(t, out, `natto_bytes_total{direction="received",kind="message"}`)
+			assert.Contains(t, out, `natto_bytes_total{direction="sent",kind="message"}`)
+		})
+	}
+}
+
+func TestDialJSONOnlyPeer(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A peer built before the binary encoding: it drops PacketMessage
+	// packets and answers JSON HELLOs only.
+	old := newLocalUDP(t)
+	defer old.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := old.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := nat.DecodePacket(buf[:n])
+			if err != nil || pkt.Kind != nat.PacketControl {
+				continue
+			}
+			hello, err := nat.DecodeMessage(pkt.Payload)
+			if err != nil || hello.Type != nat.MessageHello {
+				continue
+			}
+			ack, _ := nat.EncodeMessage(&nat.Message{Type: nat.MessageAck, PeerID: "old", ToPeerID: hello.PeerID, ConnID: 42})
+			wire, _ := nat.EncodePacket(nat.PacketControl, ack)
+			_, _ = old.WriteToUDP(wire, from)
+		}
+	}()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+
+	sess, res, err := nat.Dial(ctx, mux, "peer-a", &nat.Peer{ID: "old", Addr: old.LocalAddr().(*net.UDPAddr)}, nat.DialOptions{
+		Interval: 20 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	assert.Equal(t, nat.MessageEncodingJSON, res.Encoding)
+	assert.Equal(t, uint32(42), res.RemoteConnID)
+}
+
+// benchMessage is a typical HELLO.
+var benchMessage = &nat.Message{
+	Type:      nat.MessageHello,
+	PeerID:    "6f1c2a9e-peer-a",
+	ToPeerID:  "0b7d4e31-peer-b",
+	Timestamp: 1700000000000000000,
+	ConnID:    0x1234abcd,
+}
+
+// benchEncodings are the message codecs compared by the benchmarks.
+var benchEncodings = []struct {
+	name   string
+	encode func(*nat.Message) ([]byte, error)
+	decode func([]byte) (*nat.Message, error)
+	kind   nat.PacketKind
+}{
+	{"json", nat.EncodeMessage, nat.DecodeMessage, nat.PacketControl},
+	{"binary", nat.EncodeMessageBinary, nat.DecodeMessageBinary, nat.PacketMessage},
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	for _, enc := range benchEncodings {
+		b.Run(enc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var n int
+			for b.Loop() {
+				p, _ := enc.encode(benchMessage)
+				n = len(p)
+			}
+			b.ReportMetric(float64(n), "bytes/msg")
+		})
+	}
+}
+
+// BenchmarkDecodeMessage compares full decodes. The binary decoder makes one
+// more allocation than the JSON one, for the copy of data its strings share,
+// but is several times faster; the receive loop itself only looks for the
+// recipient, without allocating (see BenchmarkDispatchControl).
+func BenchmarkDecodeMessage(b *testing.B) {
+	for _, enc := range benchEncodings {
+		b.Run(enc.name, func(b *testing.B) {
+			p, _ := enc.encode(benchMessage)
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := enc.decode(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDispatchControl measures the receive loop routing a HELLO to the
+// Puncher or Acceptor waiting for it.
+func BenchmarkDispatchControl(b *testing.B) {
+	for _, enc := range benchEncodings {
+		b.Run(enc.name, func(b *testing.B) {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			mux := nat.NewMux(conn)
+			defer mux.Close()
+			ch := mux.ControlFor(benchMessage.ToPeerID)
+
+			p, _ := enc.encode(benchMessage)
+			pkt := &nat.Packet{Version: 1, Kind: enc.kind, Payload: p}
+			from := conn.LocalAddr().(*net.UDPAddr)
+			b.ReportAllocs()
+			for b.Loop() {
+				if !nat.ExportDispatchControl(mux, pkt, from) {
+					b.Fatal("not queued")
+				}
+				<-ch
+			}
+		})
+	}
+}
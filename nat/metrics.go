@@ -0,0 +1,71 @@
+package nat
+
+import (
+	"github.com/aethiopicuschan/natto/metrics"
+)
+
+// Metrics reported to the Recorder set with Mux.SetMetrics.
+var (
+	metricPunchAttempts = &metrics.Desc{
+		Name: "natto_punch_attempts_total",
+		Help: "Hole punching attempts started by Puncher.Punch and Acceptor.Accept.",
+		Kind: metrics.Counter,
+	}
+	metricPunches = &metrics.Desc{
+		Name:   "natto_punches_total",
+		Help:   "Hole punching attempts ended, by outcome (succeeded, timed_out, failed) and inferred NAT behavior.",
+		Kind:   metrics.Counter,
+		Labels: []string{"outcome", "behavior"},
+	}
+	metricPunchConnect = &metrics.Desc{
+		Name:   "natto_punch_connect_seconds",
+		Help:   "Time from the start of Puncher.Punch or Acceptor.Accept to success, by inferred NAT behavior.",
+		Kind:   metrics.Histogram,
+		Labels: []string{"behavior"},
+		Buckets: []float64{
+			.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30,
+		},
+	}
+	metricSessionsActive = &metrics.Desc{
+		Name: "natto_sessions_active",
+		Help: "Sessions created and not yet ended.",
+		Kind: metrics.Gauge,
+	}
+	metricBytes = &metrics.Desc{
+		Name:   "natto_bytes_total",
+		Help:   "Bytes of frames sent and received, headers included, by direction and packet kind.",
+		Kind:   metrics.Counter,
+		Labels: []string{"direction", "kind"},
+	}
+	metricKeepalives = &metrics.Desc{
+		Name: "natto_keepalives_sent_total",
+		Help: "Keepalive probes sent by Sessions.",
+		Kind: metrics.Counter,
+	}
+	metricDrops = &metrics.Desc{
+		Name:   "natto_mux_drops_total",
+		Help:   "Datagrams a Mux did not deliver, by reason (undecodable, unknown_conn, no_receiver, queue_full).",
+		Kind:   metrics.Counter,
+		Labels: []string{"reason"},
+	}
+)
+
+// Metrics describes the metrics of this package, to declare them with
+// metrics.Registry.Register before they are first reported.
+var Metrics = []*metrics.Desc{
+	metricPunchAttempts,
+	metricPunches,
+	metricPunchConnect,
+	metricSessionsActive,
+	metricBytes,
+	metricKeepalives,
+	metricDrops,
+}
+
+// behaviorLabel returns the label value for b.
+func behaviorLabel(b NATBehavior) string {
+	if b == "" {
+		return string(NATUnknown)
+	}
+	return string(b)
+}
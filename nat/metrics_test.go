@@ -0,0 +1,129 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/metrics"
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrape returns the text exposition of reg.
+func scrape(reg *metrics.Registry) string {
+	var b strings.Builder
+	_ = reg.WriteText(&b)
+	return b.String()
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	defer aConn.Close()
+	bConn := newLocalUDP(t)
+	defer bConn.Close()
+
+	aReg, bReg := metrics.NewRegistry(), metrics.NewRegistry()
+	aReg.Register(nat.Metrics...)
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.SetMetrics(aReg)
+	bMux.SetMetrics(bReg)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	// Declared metrics start at zero.
+	assert.Contains(t, scrape(aReg), "natto_sessions_active 0\n")
+
+	peerB := &nat.Peer{ID: "peer-b", Addr: bConn.LocalAddr().(*net.UDPAddr)}
+	accepted := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, _ := nat.NewAcceptor(bMux, peerB.ID, nat.AcceptOptions{}).Accept(ctx)
+		accepted <- sess
+	}()
+
+	aSess, _, err := nat.Dial(ctx, aMux, "peer-a", peerB, nat.DialOptions{
+		Interval:          20 * time.Millisecond,
+		KeepaliveInterval: 10 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	bSess := <-accepted
+	if !assert.NotNil(t, bSess) {
+		return
+	}
+
+	assert.NoError(t, aSess.Send([]byte("hello")))
+	_, _, err = bSess.Recv(ctx)
+	assert.NoError(t, err)
+
+	_, err = aConn.WriteToUDP([]byte("garbage"), bConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		out := scrape(aReg)
+		return !strings.Contains(out, "natto_keepalives_sent_total 0\n") &&
+			strings.Contains(scrape(bReg), `natto_mux_drops_total{reason="undecodable"} 1`)
+	}, 2*time.Second, 5*time.Millisecond)
+
+	out := scrape(aReg)
+	assert.Contains(t, out, "natto_punch_attempts_total 1\n")
+	assert.Contains(t, out, `natto_punches_total{outcome="succeeded",behavior="endpoint-independent-like"} 1`)
+	assert.Contains(t, out, `natto_punch_connect_seconds_count{behavior="endpoint-independent-like"} 1`)
+	assert.Contains(t, out, "natto_sessions_active 1\n")
+	assert.Contains(t, out, `natto_bytes_total{direction="sent",kind="data"} 16`) // v2 header and "hello"
+	assert.Contains(t, out, `natto_bytes_total{direction="received",kind="message"}`)
+	assert.Contains(t, scrape(bReg), `natto_bytes_total{direction="received",kind="data"} 16`)
+
+	// The Acceptor reports its side of the handshake.
+	out = scrape(bReg)
+	assert.Contains(t, out, "natto_punch_attempts_total 1\n")
+	assert.Contains(t, out, `natto_punches_total{outcome="succeeded",behavior="unknown"} 1`)
+	assert.Contains(t, out, `natto_punch_connect_seconds_count{behavior="unknown"} 1`)
+
+	aSess.Close()
+	<-bSess.Done()
+	assert.Contains(t, scrape(aReg), "natto_sessions_active 0\n")
+	assert.Contains(t, scrape(bReg), "natto_sessions_active 0\n")
+}
+
+func TestMetricsPunchTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	reg := metrics.NewRegistry()
+	mux.SetMetrics(reg)
+	mux.Start(context.Background())
+	defer mux.Close()
+
+	p := nat.NewPuncher(mux, "peer-a", 20*time.Millisecond)
+	_, err := p.Punch(ctx, &nat.Peer{ID: "peer-b", Addr: ackingPeer(t, -1)})
+	assert.ErrorIs(t, err, nat.ErrPunchTimeout)
+
+	out := scrape(reg)
+	assert.Contains(t, out, "natto_punch_attempts_total 1\n")
+	assert.Contains(t, out, `natto_punches_total{outcome="timed_out",behavior="unknown"} 1`)
+	assert.NotContains(t, out, "natto_punch_connect_seconds")
+
+	actx, acancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer acancel()
+	_, _, err = nat.NewAcceptor(mux, "peer-a", nat.AcceptOptions{}).Accept(actx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	out = scrape(reg)
+	assert.Contains(t, out, "natto_punch_attempts_total 2\n")
+	assert.Contains(t, out, `natto_punches_total{outcome="timed_out",behavior="unknown"} 2`)
+}
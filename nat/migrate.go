@@ -0,0 +1,172 @@
+package nat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"time"
+)
+
+const (
+	// pathChallengeInterval limits how often an address is challenged.
+	pathChallengeInterval = 100 * time.Millisecond
+
+	// pathChallengeTimeout is how long a challenge stays answerable.
+	pathChallengeTimeout = 3 * time.Second
+
+	// maxPathChallenges bounds the number of outstanding challenges per session.
+	maxPathChallenges = 8
+)
+
+// challengeKey identifies the address a challenge was sent to.
+type challengeKey struct {
+	mux  *Mux
+	addr string
+}
+
+// pathChallenge is an outstanding validation of a remote address.
+// Retransmissions reuse data, so a late response to an earlier copy still counts.
+type pathChallenge struct {
+	data      []byte
+	firstSent time.Time
+	lastSent  time.Time
+}
+
+// observeAddr is called for every packet of a connection-ID session, after
+// the packet has been handled.
+// Packets from an address that no path knows are still delivered, since the
+// connection ID ties them to this session, but the session only sends to that
+// address once it has answered a path challenge.
+func (s *Session) observeAddr(mux *Mux, addr *net.UDPAddr, now time.Time) {
+	if s.localID == 0 || addr == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed || s.pathFor(mux, addr) != nil {
+		s.mu.Unlock()
+		return
+	}
+	key := challengeKey{mux: mux, addr: addr.String()}
+	if c, ok := s.challenges[key]; ok && now.Sub(c.lastSent) < pathChallengeInterval {
+		s.mu.Unlock()
+		return
+	}
+	msg := s.challengeMessage(mux, addr, 0, now)
+	s.mu.Unlock()
+
+	if msg != nil {
+		_ = s.sendMessageTo(mux, addr, msg)
+	}
+}
+
+// challengeMessage records a challenge of addr on mux and returns the message
+// to send, or nil if too many challenges are outstanding. pathID is set when
+// validating a path added by AddPath. The caller holds s.mu.
+func (s *Session) challengeMessage(mux *Mux, addr *net.UDPAddr, pathID uint32, now time.Time) *Message {
+	for k, c := range s.challenges {
+		if now.Sub(c.firstSent) > pathChallengeTimeout {
+			delete(s.challenges, k)
+		}
+	}
+
+	key := challengeKey{mux: mux, addr: addr.String()}
+	c, ok := s.challenges[key]
+	if !ok {
+		if len(s.challenges) >= maxPathChallenges {
+			return nil
+		}
+		c = &pathChallenge{data: make([]byte, 8), firstSent: now}
+		_, _ = rand.Read(c.data)
+		s.challenges[key] = c
+	}
+	c.lastSent = now
+
+	return &Message{
+		Type:      MessagePathChallenge,
+		Timestamp: now.UnixNano(),
+		Challenge: c.data,
+		PathID:    pathID,
+	}
+}
+
+// answerChallenge echoes a path challenge back to where it came from,
+// naming the path it arrived on so the challenger knows which one it is.
+func (s *Session) answerChallenge(mux *Mux, addr *net.UDPAddr, msg *Message) {
+	id := msg.PathID
+	if id == 0 {
+		s.mu.RLock()
+		if p := s.pathFor(mux, addr); p != nil {
+			id = p.id
+		}
+		s.mu.RUnlock()
+	}
+
+	resp := &Message{
+		Type:      MessagePathResponse,
+		Timestamp: time.Now().UnixNano(),
+		Challenge: msg.Challenge,
+		PathID:    id,
+	}
+	_ = s.sendMessageTo(mux, addr, resp)
+}
+
+// handlePathResponse completes a challenge of addr on mux.
+//
+// If a path already uses the address, it is now validated. Otherwise the path
+// named by the response migrates to the address, or, if the session has no
+// such path, the peer has added one and the session learns it.
+func (s *Session) handlePathResponse(mux *Mux, addr *net.UDPAddr, msg *Message, now time.Time) {
+	s.mu.Lock()
+	key := challengeKey{mux: mux, addr: addr.String()}
+	c, ok := s.challenges[key]
+	if s.closed || !ok || !bytes.Equal(msg.Challenge, c.data) {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.challenges, key)
+
+	var ev *SessionEvent
+	if p := s.pathFor(mux, addr); p != nil {
+		if !p.validated {
+			p.validated = true
+			p.lastRecv = now
+			close(p.validatedCh)
+			ev = &SessionEvent{Type: SessionPathValidated, PathID: p.id, Addr: addr, Time: now}
+		}
+	} else if p := s.pathByID(msg.PathID); p != nil {
+		prev := p.remote
+		p.mux = mux
+		p.remote = addr
+		p.lastRecv = now
+		p.quiet = false
+		if !p.validated {
+			p.validated = true
+			close(p.validatedCh)
+		}
+		ev = &SessionEvent{Type: SessionMigrated, PathID: p.id, Addr: addr, Prev: prev, Time: now}
+	} else {
+		s.paths = append(s.paths, &path{
+			id:          msg.PathID,
+			mux:         mux,
+			remote:      addr,
+			validated:   true,
+			validatedCh: closedSignal(),
+			lastRecv:    now,
+		})
+		ev = &SessionEvent{Type: SessionPathValidated, PathID: msg.PathID, Addr: addr, Time: now}
+	}
+	fn := s.onEvent
+	s.mu.Unlock()
+
+	if ev != nil {
+		s.emit(fn, *ev)
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
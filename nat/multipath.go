@@ -0,0 +1,356 @@
+package nat
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+)
+
+// MultipathPolicy selects how a Session uses its validated paths.
+type MultipathPolicy int
+
+const (
+	// ActiveBackup sends over a single active path. The earliest added path
+	// that is not quiet is preferred, so the Session fails over when the
+	// active path goes quiet and fails back once a preferred path recovers.
+	// This is the default.
+	ActiveBackup MultipathPolicy = iota
+
+	// Redundant sends data over every validated path. The peer delivers the
+	// first copy and drops the others. Control packets use the active path.
+	Redundant
+)
+
+// String returns the policy name.
+func (p MultipathPolicy) String() string {
+	switch p {
+	case ActiveBackup:
+		return "active-backup"
+	case Redundant:
+		return "redundant"
+	default:
+		return "unknown"
+	}
+}
+
+// path is one route to the peer: a local Mux and a remote address.
+// Its fields are guarded by Session.mu.
+type path struct {
+	id     uint32
+	mux    *Mux
+	remote *net.UDPAddr
+
+	validated   bool
+	validatedCh chan struct{}
+
+	rtt      rttEstimator
+	lastRecv time.Time
+	quiet    bool
+}
+
+// SetMultipathPolicy sets how data is spread over the session's paths.
+func (s *Session) SetMultipathPolicy(policy MultipathPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+// AddPath adds a path to the peer at remote over mux, which may be a Mux on
+// another local interface. It requires a session with a connection ID.
+//
+// The path is validated with MessagePathChallenge; AddPath blocks until the
+// peer answers over the new path, ctx is done or the session ends.
+// The peer learns the path from the exchange and can use it as well.
+// Failover between paths relies on keepalive (see StartKeepalive).
+func (s *Session) AddPath(ctx context.Context, mux *Mux, remote *net.UDPAddr) error {
+	if s.localID == 0 {
+		return ErrMultipathUnsupported
+	}
+	if mux.isClosed() {
+		return ErrConnectionClosed
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrConnectionClosed
+	}
+	if s.pathFor(mux, remote) != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if !s.hasMux(mux) {
+		q, created := mux.registerConn(s.localID, s.opts)
+		if !created {
+			s.mu.Unlock()
+			return ErrConnIDInUse
+		}
+		in := &muxIn{mux: mux, q: q}
+		s.ins = append(s.ins, in)
+		go s.readLoop(in)
+	}
+	p := &path{
+		id:          s.newPathID(),
+		mux:         mux,
+		remote:      remote,
+		validatedCh: make(chan struct{}),
+		lastRecv:    time.Now(),
+	}
+	s.paths = append(s.paths, p)
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(pathChallengeInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		msg := s.challengeMessage(mux, remote, p.id, time.Now())
+		s.mu.Unlock()
+		_ = s.sendMessageTo(mux, remote, msg)
+
+		select {
+		case <-p.validatedCh:
+			return nil
+		case <-ctx.Done():
+			s.removePath(p)
+			return ctx.Err()
+		case <-s.done:
+			return s.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// PathStats returns a snapshot of every path of the session.
+func (s *Session) PathStats() []PathStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]PathStats, 0, len(s.paths))
+	for _, p := range s.paths {
+		st := PathStats{
+			ID:           p.id,
+			Local:        p.mux.LocalAddr(),
+			Remote:       p.remote,
+			Active:       p == s.active,
+			Validated:    p.validated,
+			LastReceived: p.lastRecv,
+		}
+		p.rtt.fillPath(&st)
+		out = append(out, st)
+	}
+	return out
+}
+
+// validatedPaths returns the paths that can carry traffic. The caller holds s.mu.
+func (s *Session) validatedPaths() []*path {
+	var out []*path
+	for _, p := range s.paths {
+		if p.validated {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// pathFor returns the path that packets from addr on mux belong to, if any.
+// Address-based sessions only ever have their single path. The caller holds s.mu.
+func (s *Session) pathFor(mux *Mux, addr *net.UDPAddr) *path {
+	if s.localID == 0 {
+		return s.paths[0]
+	}
+	for _, p := range s.paths {
+		if p.mux == mux && sameAddr(p.remote, addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// pathByID returns the path with the given ID, if any. The caller holds s.mu.
+func (s *Session) pathByID(id uint32) *path {
+	for _, p := range s.paths {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// hasMux reports whether the session is registered on mux. The caller holds s.mu.
+func (s *Session) hasMux(mux *Mux) bool {
+	for _, in := range s.ins {
+		if in.mux == mux {
+			return true
+		}
+	}
+	return false
+}
+
+// newPathID returns an unused, non-zero path ID. The caller holds s.mu.
+func (s *Session) newPathID() uint32 {
+	for {
+		id := rand.Uint32()
+		if id != 0 && s.pathByID(id) == nil {
+			return id
+		}
+	}
+}
+
+// selectActive makes the earliest validated path that is not quiet active.
+// It returns the resulting SessionFailover event, if any. The caller holds s.mu.
+func (s *Session) selectActive(now time.Time) *SessionEvent {
+	var best *path
+	for _, p := range s.paths {
+		if p.validated && !p.quiet {
+			best = p
+			break
+		}
+	}
+	if best == nil || best == s.active {
+		return nil
+	}
+
+	prev := s.active
+	s.active = best
+	return &SessionEvent{Type: SessionFailover, PathID: best.id, Addr: best.remote, Prev: prev.remote, Time: now}
+}
+
+// removePath forgets p, failing over if it was active.
+func (s *Session) removePath(p *path) {
+	s.mu.Lock()
+	s.paths = slices.DeleteFunc(s.paths, func(q *path) bool { return q == p })
+	ev := s.replaceActive(p)
+	fn := s.onEvent
+	s.mu.Unlock()
+
+	if ev != nil {
+		s.emit(fn, *ev)
+	}
+}
+
+// dropMux forgets every path over a Mux that has been closed.
+// The session ends once no path is left.
+func (s *Session) dropMux(mux *Mux) {
+	s.mu.Lock()
+	s.ins = slices.DeleteFunc(s.ins, func(in *muxIn) bool { return in.mux == mux })
+	if len(s.ins) == 0 {
+		s.mu.Unlock()
+		s.finish(ErrConnectionClosed)
+		return
+	}
+
+	active := s.active
+	s.paths = slices.DeleteFunc(s.paths, func(p *path) bool { return p.mux == mux })
+	if len(s.validatedPaths()) == 0 {
+		s.mu.Unlock()
+		s.finish(ErrConnectionClosed)
+		return
+	}
+	ev := s.replaceActive(active)
+	fn := s.onEvent
+	s.mu.Unlock()
+
+	if ev != nil {
+		s.emit(fn, *ev)
+	}
+}
+
+// replaceActive picks a new active path if removed was the active one.
+// The caller holds s.mu.
+func (s *Session) replaceActive(removed *path) *SessionEvent {
+	if s.active != removed {
+		return nil
+	}
+	for _, p := range s.paths {
+		if p.validated {
+			s.active = p
+			return &SessionEvent{Type: SessionFailover, PathID: p.id, Addr: p.remote, Prev: removed.remote, Time: time.Now()}
+		}
+	}
+	return nil
+}
+
+// sendRedundant sends data over every path in paths. The caller holds s.mu.
+// It fails only if no copy could be sent.
+func (s *Session) sendRedundant(paths []*path, data []byte) error {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(payload, s.seq.Add(1))
+	copy(payload[8:], data)
+
+	var err error
+	sent := false
+	for _, p := range paths {
+		if e := s.sendOn(p, PacketDataSeq, payload); e != nil {
+			err = e
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// deduplicate strips the sequence number from a PacketDataSeq payload.
+// It returns false for duplicates and malformed payloads.
+func (s *Session) deduplicate(payload []byte) ([]byte, bool) {
+	if len(payload) < 8 {
+		return nil, false
+	}
+	seq := binary.BigEndian.Uint64(payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dedup.accept(seq) {
+		return nil, false
+	}
+	return payload[8:], true
+}
+
+// dedupWindow remembers the last 64 sequence numbers seen.
+type dedupWindow struct {
+	top  uint64
+	seen uint64
+}
+
+// accept reports whether seq has not been seen before. Sequence numbers more
+// than 64 behind the highest one seen are rejected.
+func (w *dedupWindow) accept(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+
+	case seq > w.top:
+		if shift := seq - w.top; shift < 64 {
+			w.seen <<= shift
+		} else {
+			w.seen = 0
+		}
+		w.seen |= 1
+		w.top = seq
+		return true
+
+	case w.top-seq >= 64:
+		return false
+
+	default:
+		bit := uint64(1) << (w.top - seq)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
+
+// closedSignal returns an already closed signal channel.
+func closedSignal() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
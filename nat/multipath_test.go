@@ -0,0 +1,209 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// multipathPair connects A to B over two A-side Muxes.
+type multipathPair struct {
+	aConn, a2Conn, bConn *net.UDPConn
+	aMux, a2Mux          *nat.Mux
+	a, b                 *nat.Session
+	aEvents, bEvents     chan nat.SessionEvent
+}
+
+func newMultipathPair(t *testing.T, ctx context.Context) *multipathPair {
+	t.Helper()
+
+	mp := &multipathPair{
+		aConn:   newLocalUDP(t),
+		a2Conn:  newLocalUDP(t),
+		bConn:   newLocalUDP(t),
+		aEvents: make(chan nat.SessionEvent, 16),
+		bEvents: make(chan nat.SessionEvent, 16),
+	}
+	t.Cleanup(func() {
+		mp.aConn.Close()
+		mp.a2Conn.Close()
+		mp.bConn.Close()
+	})
+
+	mp.aMux = nat.NewMux(mp.aConn)
+	mp.a2Mux = nat.NewMux(mp.a2Conn)
+	bMux := nat.NewMux(mp.bConn)
+	mp.aMux.Start(ctx)
+	mp.a2Mux.Start(ctx)
+	bMux.Start(ctx)
+
+	bAddr := mp.bConn.LocalAddr().(*net.UDPAddr)
+	mp.a = nat.NewConnSession(mp.aMux, bAddr, 1, 2, nat.QueueOptions{})
+	mp.b = nat.NewConnSession(bMux, mp.aConn.LocalAddr().(*net.UDPAddr), 2, 1, nat.QueueOptions{})
+	mp.a.SetEventHandler(func(ev nat.SessionEvent) { mp.aEvents <- ev })
+	mp.b.SetEventHandler(func(ev nat.SessionEvent) { mp.bEvents <- ev })
+
+	if !assert.NoError(t, mp.a.AddPath(ctx, mp.a2Mux, bAddr)) {
+		t.FailNow()
+	}
+	return mp
+}
+
+// waitEvent returns the next event of type typ from ch.
+func waitEvent(t *testing.T, ctx context.Context, ch <-chan nat.SessionEvent, typ nat.SessionEventType) nat.SessionEvent {
+	t.Helper()
+
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-ctx.Done():
+			assert.FailNow(t, "event not emitted", string(typ))
+		}
+	}
+}
+
+func TestMultipathAddPath(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mp := newMultipathPair(t, ctx)
+
+	// B learns the new path from the validation exchange.
+	ev := waitEvent(t, ctx, mp.bEvents, nat.SessionPathValidated)
+	assert.Equal(t, mp.a2Conn.LocalAddr().String(), ev.Addr.String())
+
+	paths := mp.a.PathStats()
+	if assert.Len(t, paths, 2) {
+		assert.True(t, paths[0].Active)
+		assert.True(t, paths[1].Validated)
+		assert.NotZero(t, paths[1].ID)
+		assert.Equal(t, mp.a2Conn.LocalAddr().String(), paths[1].Local.String())
+	}
+	assert.Len(t, mp.b.PathStats(), 2)
+
+	// Both paths are probed separately once keepalive runs.
+	mp.a.SetKeepalive(20 * time.Millisecond)
+	mp.a.StartKeepalive(ctx)
+	assert.Eventually(t, func() bool {
+		for _, p := range mp.a.PathStats() {
+			if p.ProbesAcked == 0 {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMultipathFailover(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mp := newMultipathPair(t, ctx)
+	waitEvent(t, ctx, mp.bEvents, nat.SessionPathValidated)
+
+	for _, s := range []*nat.Session{mp.a, mp.b} {
+		s.SetKeepalive(20 * time.Millisecond)
+		s.SetQuietTimeout(100 * time.Millisecond)
+		s.StartKeepalive(ctx)
+	}
+
+	// A's first interface goes away.
+	assert.NoError(t, mp.aMux.Close())
+
+	ev := waitEvent(t, ctx, mp.aEvents, nat.SessionFailover)
+	assert.Equal(t, mp.bConn.LocalAddr().String(), ev.Addr.String())
+
+	// B notices its active path has gone quiet and switches too.
+	ev = waitEvent(t, ctx, mp.bEvents, nat.SessionFailover)
+	assert.Equal(t, mp.a2Conn.LocalAddr().String(), ev.Addr.String())
+
+	assert.NoError(t, mp.a.SendData([]byte("from a")))
+	got, from, err := mp.b.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("from a"), got)
+	assert.Equal(t, mp.a2Conn.LocalAddr().String(), from.String())
+
+	assert.NoError(t, mp.b.SendData([]byte("from b")))
+	got, _, err = mp.a.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("from b"), got)
+
+	assert.NoError(t, mp.a.Err())
+	assert.NoError(t, mp.b.Err())
+}
+
+func TestMultipathRedundant(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mp := newMultipathPair(t, ctx)
+	mp.a.SetMultipathPolicy(nat.Redundant)
+
+	for _, msg := range []string{"one", "two", "three"} {
+		assert.NoError(t, mp.a.SendData([]byte(msg)))
+	}
+
+	for _, want := range []string{"one", "two", "three"} {
+		got, _, err := mp.b.RecvData(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(want), got)
+	}
+
+	// The second copies are dropped.
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	_, _, err := mp.b.RecvData(short)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, mp.b.Stats().PacketsReceived, uint64(6))
+}
+
+func TestAddPathRequiresConnSession(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+
+	s := nat.NewSession(mux, conn.LocalAddr().(*net.UDPAddr), 4)
+	defer s.Close()
+	assert.ErrorIs(t, s.AddPath(ctx, mux, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}), nat.ErrMultipathUnsupported)
+}
+
+func TestDedupWindow(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		seqs []uint64
+		want []bool
+	}{
+		{"in order", []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicates", []uint64{1, 1, 2, 1}, []bool{true, false, true, false}},
+		{"reordered", []uint64{3, 1, 2, 3}, []bool{true, true, true, false}},
+		{"too old", []uint64{100, 36, 37}, []bool{true, false, true}},
+		{"zero", []uint64{0}, []bool{false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, nat.ExportDedup(tt.seqs...))
+		})
+	}
+}
@@ -2,8 +2,16 @@ package nat
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aethiopicuschan/natto/metrics"
+	"github.com/aethiopicuschan/natto/stun"
 )
 
 // inbound represents a received packet with its source address.
@@ -12,46 +20,287 @@ type inbound struct {
 	addr *net.UDPAddr
 }
 
-// Mux multiplexes incoming UDP packets by address and control semantics.
+// Mux multiplexes incoming UDP packets by connection ID, address and control semantics.
+//
+// Version 2 packets are routed by the connection ID in their header, so a
+// session keeps receiving when the peer's NAT rebinds its port, and several
+// sessions can share one remote endpoint. Version 1 packets are routed by
+// source address.
 type Mux struct {
-	conn *net.UDPConn
+	conn PacketConn
+
+	// udp is conn if it is a *net.UDPConn, whose UDP-specific methods
+	// avoid converting addresses.
+	udp *net.UDPConn
+
+	// ownsConn is set for Muxes over sockets opened by this package,
+	// whose connection is closed together with the Mux.
+	ownsConn bool
+
+	// Connection ID demux
+	connMu sync.RWMutex
+	byConn map[uint32]*packetQueue
+
+	// accepted maps the HELLOs Acceptors made connection-ID sessions for to
+	// those sessions, while they are registered. The Mux answers repeats
+	// of these HELLOs itself, so that retransmitted and duplicate HELLOs are
+	// neither accepted twice nor left in a control queue.
+	accepted map[acceptedHello]acceptedSession
+
+	// lastHello is the last HELLO offered to a control queue. It is only
+	// used by the receive loop.
+	lastHello sentHello
 
 	// Address-based demux
 	addrMu sync.RWMutex
-	byAddr map[string]chan inbound
+	byAddr map[string]*packetQueue
 
-	// Control fallback channel
-	controlCh chan inbound
+	// Control fallback queue
+	control *packetQueue
 
 	// Control demux by peer ID
 	controlMu     sync.RWMutex
-	controlByPeer map[string]chan inbound
+	controlByPeer map[string]*packetQueue
+
+	// Global counters, see MuxStats.
+	received    atomic.Uint64
+	delivered   atomic.Uint64
+	dropped     atomic.Uint64
+	undecodable atomic.Uint64
+
+	// capture receives a copy of every packet if set, see SetCapture.
+	capture atomic.Pointer[Capture]
+
+	// logger receives drops and receive errors, see SetLogger.
+	logger atomic.Pointer[slog.Logger]
+
+	// recorder receives traffic and drop metrics, see SetMetrics.
+	recorder atomic.Pointer[metrics.Recorder]
+
+	// encoding is the MessageEncoding of messages the Mux initiates, see
+	// SetMessageEncoding.
+	encoding atomic.Uint32
 
 	startOnce sync.Once
+	closeOnce sync.Once
+
+	// closed is closed when Close begins; loopDone when the receive loop exits.
+	closed   chan struct{}
+	loopDone chan struct{}
 }
 
-// NewMux creates a new Mux for the given UDP connection.
-func NewMux(conn *net.UDPConn) *Mux {
+// NewMux creates a new Mux for the given connection, usually a *net.UDPConn.
+func NewMux(conn PacketConn) *Mux {
+	udp, _ := conn.(*net.UDPConn)
 	return &Mux{
 		conn:          conn,
-		byAddr:        make(map[string]chan inbound),
-		controlCh:     make(chan inbound, 32),
-		controlByPeer: make(map[string]chan inbound),
+		udp:           udp,
+		byConn:        make(map[uint32]*packetQueue),
+		accepted:      make(map[acceptedHello]acceptedSession),
+		byAddr:        make(map[string]*packetQueue),
+		control:       newFallbackQueue(),
+		controlByPeer: make(map[string]*packetQueue),
+		closed:        make(chan struct{}),
+		loopDone:      make(chan struct{}),
 	}
 }
 
 // Start begins the receive loop.
 // It must be called exactly once.
+//
+// Cancelling ctx has the same effect as calling Close.
+// The loop also stops if the underlying connection is closed.
 func (m *Mux) Start(ctx context.Context) {
 	m.startOnce.Do(func() {
-		go m.recvLoop(ctx)
+		go func() {
+			m.recvLoop()
+			close(m.loopDone)
+			_ = m.Close()
+		}()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = m.Close()
+			case <-m.closed:
+			}
+		}()
+	})
+}
+
+// Close stops the receive loop and closes every channel handed out by
+// Control, ControlFor and Register, so readers observe ErrConnectionClosed.
+//
+// The underlying connection is owned by the caller and is left open, except
+// for Muxes returned in PunchResult.Mux by birthday punching, which close it.
+// Close is safe to call multiple times.
+func (m *Mux) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+
+		// If the loop was never started, make sure it never will be.
+		m.startOnce.Do(func() {
+			close(m.loopDone)
+		})
+
+		// Unblock a pending read, then restore the connection for the caller.
+		_ = m.conn.SetReadDeadline(time.Now())
+		<-m.loopDone
+		_ = m.conn.SetReadDeadline(time.Time{})
+
+		m.release()
+		if m.ownsConn {
+			_ = m.conn.Close()
+		}
 	})
+	return nil
+}
+
+// release closes all channels and drops all registrations.
+func (m *Mux) release() {
+	m.connMu.Lock()
+	for id, q := range m.byConn {
+		q.close()
+		delete(m.byConn, id)
+	}
+	clear(m.accepted)
+	m.connMu.Unlock()
+
+	m.addrMu.Lock()
+	for key, q := range m.byAddr {
+		q.close()
+		delete(m.byAddr, key)
+	}
+	m.addrMu.Unlock()
+
+	m.controlMu.Lock()
+	for id, q := range m.controlByPeer {
+		q.close()
+		delete(m.controlByPeer, id)
+	}
+	m.controlMu.Unlock()
+
+	m.control.close()
+}
+
+// MuxStats counts datagrams handled by a Mux since it was created.
+type MuxStats struct {
+	// Received is the number of datagrams read from the connection.
+	Received uint64
+
+	// Delivered is the number of packets queued for a reader.
+	Delivered uint64
+
+	// Dropped is the number of packets discarded because a queue was full
+	// or no reader was registered for them.
+	Dropped uint64
+
+	// Undecodable is the number of datagrams that were not valid packets.
+	Undecodable uint64
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (m *Mux) LocalAddr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Stats returns the global counters of the Mux.
+func (m *Mux) Stats() MuxStats {
+	return MuxStats{
+		Received:    m.received.Load(),
+		Delivered:   m.delivered.Load(),
+		Dropped:     m.dropped.Load(),
+		Undecodable: m.undecodable.Load(),
+	}
+}
+
+// SetCapture starts writing every packet the Mux sends or receives to c,
+// including undecodable and dropped ones. A nil c stops capturing.
+// It may be called at any time. Close c once no Mux uses it any more.
+func (m *Mux) SetCapture(c *Capture) {
+	m.capture.Store(c)
+}
+
+// SetLogger sets the logger for undecodable and dropped packets and receive
+// errors, all at debug level. Punchers, Acceptors and Sessions on the Mux
+// log to it too unless given a logger of their own. A nil l disables logging.
+// It may be called at any time.
+func (m *Mux) SetLogger(l *slog.Logger) {
+	m.logger.Store(l)
+}
+
+// log returns the logger set with SetLogger, or one that discards everything.
+func (m *Mux) log() *slog.Logger {
+	return loggerOr(m.logger.Load())
+}
+
+// SetMetrics sets the Recorder for traffic and drops on the Mux. Punchers
+// and Sessions on the Mux report to it too; Sessions keep the Recorder set
+// when they were created. A nil r disables metrics. See Metrics for what is
+// reported. It may be called at any time.
+func (m *Mux) SetMetrics(r metrics.Recorder) {
+	if r == nil {
+		m.recorder.Store(nil)
+		return
+	}
+	m.recorder.Store(&r)
+}
+
+// metrics returns the Recorder set with SetMetrics, or metrics.Discard.
+func (m *Mux) metrics() metrics.Recorder {
+	if r := m.recorder.Load(); r != nil {
+		return *r
+	}
+	return metrics.Discard
+}
+
+// SetMessageEncoding sets the encoding of the control messages Punchers,
+// Acceptors and Sessions on the Mux initiate, MessageEncodingBinary by
+// default. Replies use the encoding of the message they answer, and
+// Sessions use the encoding their peer last sent, so the setting only needs
+// to match on one side.
+//
+// With MessageEncodingBinary, Punchers also send each HELLO as JSON until the
+// peer has answered, and then keep to the encoding of its answers, so peers
+// built before the binary encoding existed can still be dialed. Use
+// MessageEncodingJSON for readable captures. It may be called at any time.
+func (m *Mux) SetMessageEncoding(e MessageEncoding) {
+	m.encoding.Store(uint32(e))
+}
+
+// messageEncoding returns the encoding set with SetMessageEncoding.
+func (m *Mux) messageEncoding() MessageEncoding {
+	return MessageEncoding(m.encoding.Load())
+}
+
+// QueueStats returns the counters of the queue registered for addr.
+// It reports false if addr is not registered.
+func (m *Mux) QueueStats(addr *net.UDPAddr) (QueueStats, bool) {
+	m.addrMu.RLock()
+	defer m.addrMu.RUnlock()
+
+	q, ok := m.byAddr[addr.String()]
+	if !ok {
+		return QueueStats{}, false
+	}
+	return q.stats(), true
+}
+
+// isClosed reports whether Close has been called.
+func (m *Mux) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 // Control returns the fallback control channel.
-// Packets not addressed to a specific peer are delivered here.
+// Packets not addressed to a specific peer are delivered here. When it is
+// full, the receive loop waits for room, so that no handshake is lost.
 func (m *Mux) Control() <-chan inbound {
-	return m.controlCh
+	return m.control.ch
 }
 
 // ControlFor returns a dedicated control channel for the given peer ID.
@@ -60,31 +309,238 @@ func (m *Mux) ControlFor(peerID string) <-chan inbound {
 	m.controlMu.Lock()
 	defer m.controlMu.Unlock()
 
-	ch, ok := m.controlByPeer[peerID]
+	if m.isClosed() {
+		return closedInbound()
+	}
+
+	q, ok := m.controlByPeer[peerID]
 	if !ok {
-		ch = make(chan inbound, 32)
-		m.controlByPeer[peerID] = ch
+		q = newPacketQueue(QueueOptions{})
+		m.controlByPeer[peerID] = q
 	}
-	return ch
+	return q.ch
 }
 
 // Register registers a channel for packets from the given address.
+// Packets are dropped when the queue is full.
 func (m *Mux) Register(addr *net.UDPAddr, queue int) <-chan inbound {
+	return m.RegisterWithOptions(addr, QueueOptions{Size: queue})
+}
+
+// RegisterWithOptions registers a channel for packets from the given address,
+// applying opts.Policy when the queue is full.
+// If addr is already registered, the existing channel is returned and opts is ignored.
+func (m *Mux) RegisterWithOptions(addr *net.UDPAddr, opts QueueOptions) <-chan inbound {
+	q, _ := m.register(addr, opts)
+	return q.ch
+}
+
+// register registers addr and returns its queue, reporting whether it was created.
+// The queue is a throwaway closed one if the Mux is closed.
+func (m *Mux) register(addr *net.UDPAddr, opts QueueOptions) (*packetQueue, bool) {
 	key := addr.String()
 
-	if queue <= 0 {
-		queue = 32
+	m.addrMu.Lock()
+	defer m.addrMu.Unlock()
+
+	if m.isClosed() {
+		return &packetQueue{ch: closedInbound()}, false
+	}
+
+	q, ok := m.byAddr[key]
+	if !ok {
+		q = newPacketQueue(opts)
+		m.byAddr[key] = q
+	}
+	return q, !ok
+}
+
+// RegisterConn registers a channel for version 2 packets carrying connID.
+// If connID is already registered, the existing channel is returned and opts is ignored.
+func (m *Mux) RegisterConn(connID uint32, opts QueueOptions) <-chan inbound {
+	q, _ := m.registerConn(connID, opts)
+	return q.ch
+}
+
+// registerConn registers connID and returns its queue.
+// created reports whether the registration is new.
+func (m *Mux) registerConn(connID uint32, opts QueueOptions) (q *packetQueue, created bool) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if m.isClosed() {
+		return &packetQueue{ch: closedInbound()}, false
+	}
+
+	q, ok := m.byConn[connID]
+	if !ok {
+		q = newPacketQueue(opts)
+		m.byConn[connID] = q
+	}
+	return q, !ok
+}
+
+// allocConn registers a fresh, random, non-zero connection ID.
+// It returns zero if the Mux is closed.
+func (m *Mux) allocConn(opts QueueOptions) uint32 {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if m.isClosed() {
+		return 0
+	}
+
+	for {
+		id := rand.Uint32()
+		if _, taken := m.byConn[id]; id != 0 && !taken {
+			m.byConn[id] = newPacketQueue(opts)
+			return id
+		}
+	}
+}
+
+// UnregisterConn removes the registration for connID and closes its channel.
+func (m *Mux) UnregisterConn(connID uint32) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if q, ok := m.byConn[connID]; ok {
+		q.close()
+		delete(m.byConn, connID)
+		m.forgetAccepted(connID)
+	}
+}
+
+// unregisterConn removes the registration for connID only if it still uses ch.
+func (m *Mux) unregisterConn(connID uint32, ch <-chan inbound) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if q, ok := m.byConn[connID]; ok && q.ch == ch {
+		q.close()
+		delete(m.byConn, connID)
+		m.forgetAccepted(connID)
 	}
+}
+
+// acceptedHello identifies a HELLO by its source and content.
+type acceptedHello struct {
+	addr   string
+	peerID string
+	connID uint32
+}
+
+// sentHello identifies one HELLO a dialer sent, in whichever encoding.
+type sentHello struct {
+	acceptedHello
+	timestamp int64
+}
+
+// acceptedSession is the session an Acceptor made for a HELLO.
+type acceptedSession struct {
+	// connID is the session's local connection ID.
+	connID uint32
+
+	// selfID is the peer ID the Acceptor answered as.
+	selfID string
+}
+
+// acceptedConn returns the session accepted for h, if it is still
+// registered.
+func (m *Mux) acceptedConn(h acceptedHello) (acceptedSession, bool) {
+	m.connMu.RLock()
+	defer m.connMu.RUnlock()
+	acc, ok := m.accepted[h]
+	return acc, ok
+}
+
+// rememberAccepted records that h was accepted by selfID with local
+// connection ID id.
+func (m *Mux) rememberAccepted(h acceptedHello, id uint32, selfID string) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if _, ok := m.byConn[id]; ok {
+		m.accepted[h] = acceptedSession{connID: id, selfID: selfID}
+	}
+}
+
+// forgetAccepted drops the accepted HELLOs of connection ID id.
+// The caller holds m.connMu.
+func (m *Mux) forgetAccepted(id uint32) {
+	for h, v := range m.accepted {
+		if v.connID == id {
+			delete(m.accepted, h)
+		}
+	}
+}
+
+// dispatchHello handles the HELLOs no Acceptor or Puncher needs to see:
+// repeats of a HELLO that was already accepted are answered with an ACK,
+// and the second copy of a HELLO sent in both encodings is dropped. It
+// reports whether inb was handled, with the capture note for it.
+func (m *Mux) dispatchHello(inb inbound) (string, bool) {
+	msg, err := DecodePacketMessage(inb.pkt)
+	if err != nil || msg.Type != MessageHello {
+		return "", false
+	}
+
+	hello := acceptedHello{addr: inb.addr.String(), peerID: msg.PeerID, connID: msg.ConnID}
+	if acc, ok := m.acceptedConn(hello); ok && (msg.ToPeerID == "" || msg.ToPeerID == acc.selfID) {
+		m.log().Debug("nat: mux answering repeated hello", "from", inb.addr, "peer_id", msg.PeerID)
+		ack := &Message{
+			Type:      MessageAck,
+			PeerID:    acc.selfID,
+			ToPeerID:  msg.PeerID,
+			Timestamp: time.Now().UnixNano(),
+			Echo:      msg.Timestamp,
+			ConnID:    acc.connID,
+		}
+		_ = m.sendMessage(inb.addr, ack, encodingOf(inb.pkt.Kind))
+		return "answered: repeated hello", true
+	}
+
+	// Until they hear back, dialers send each HELLO in both encodings. The
+	// copies carry the same timestamp and arrive one after the other; the
+	// first is answered, so the second would only linger in a queue.
+	sent := sentHello{acceptedHello: hello, timestamp: msg.Timestamp}
+	if sent == m.lastHello {
+		return "dropped: duplicate hello", true
+	}
+	m.lastHello = sent
+	return "", false
+}
+
+// Unregister removes the registration for the given address and closes its
+// channel. Later packets from addr fall back to control demux.
+func (m *Mux) Unregister(addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
 
 	m.addrMu.Lock()
 	defer m.addrMu.Unlock()
 
-	ch, ok := m.byAddr[key]
-	if !ok {
-		ch = make(chan inbound, queue)
-		m.byAddr[key] = ch
+	if q, ok := m.byAddr[key]; ok {
+		q.close()
+		delete(m.byAddr, key)
+	}
+}
+
+// unregister is Unregister, but only if addr is still registered to ch.
+func (m *Mux) unregister(addr *net.UDPAddr, ch <-chan inbound) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
+
+	m.addrMu.Lock()
+	defer m.addrMu.Unlock()
+
+	if q, ok := m.byAddr[key]; ok && q.ch == ch {
+		q.close()
+		delete(m.byAddr, key)
 	}
-	return ch
 }
 
 // Alias aliases packets from oldAddr to newAddr.
@@ -99,103 +555,279 @@ func (m *Mux) Alias(oldAddr, newAddr *net.UDPAddr) {
 	m.addrMu.Lock()
 	defer m.addrMu.Unlock()
 
-	ch, ok := m.byAddr[oldKey]
+	q, ok := m.byAddr[oldKey]
 	if !ok {
 		return
 	}
 
 	delete(m.byAddr, oldKey)
-	m.byAddr[newKey] = ch
+	m.byAddr[newKey] = q
 }
 
-// Send sends a packet to the given address.
+// Send sends a version 1 packet to the given address.
 func (m *Mux) Send(addr *net.UDPAddr, kind PacketKind, payload []byte) error {
+	if m.isClosed() {
+		return ErrConnectionClosed
+	}
 	wire, err := EncodePacket(kind, payload)
 	if err != nil {
 		return err
 	}
-	_, err = m.conn.WriteToUDP(wire, addr)
+	return m.writeTo(wire, addr)
+}
+
+// SendConn sends a version 2 packet for the peer's connID to the given address.
+func (m *Mux) SendConn(addr *net.UDPAddr, kind PacketKind, connID uint32, payload []byte) error {
+	if m.isClosed() {
+		return ErrConnectionClosed
+	}
+	wire, err := EncodeConnPacket(kind, connID, payload)
+	if err != nil {
+		return err
+	}
+	return m.writeTo(wire, addr)
+}
+
+// sendMessage sends msg encoded with e as a version 1 control packet to addr.
+func (m *Mux) sendMessage(addr *net.UDPAddr, msg *Message, e MessageEncoding) error {
+	kind, payload, err := encodeMessage(msg, e)
+	if err != nil {
+		return err
+	}
+	return m.Send(addr, kind, payload)
+}
+
+// writeTo writes a packet to addr.
+func (m *Mux) writeTo(b []byte, addr *net.UDPAddr) error {
+	var err error
+	if m.udp != nil {
+		_, err = m.udp.WriteToUDP(b, addr)
+	} else {
+		_, err = m.conn.WriteTo(b, addr)
+	}
+	if err == nil && len(b) > 4 {
+		m.metrics().Add(metricBytes, float64(len(b)), "sent", PacketKind(b[4]).String())
+	}
+	if c := m.capture.Load(); c != nil {
+		note := ""
+		if err != nil {
+			note = "send failed: " + err.Error()
+		}
+		m.tap(c, b, addr, false, note)
+	}
 	return err
 }
 
-// recvLoop reads packets from the UDP connection and dispatches them.
-func (m *Mux) recvLoop(ctx context.Context) {
+// tap writes a packet sent to or received from addr to c, with a comment
+// describing the frame and note, if any.
+func (m *Mux) tap(c *Capture, b []byte, addr *net.UDPAddr, inbound bool, note string) {
+	comment := note
+	if pkt, err := DecodePacket(b); err == nil {
+		comment = describeFrame(pkt)
+		if note != "" {
+			comment += "; " + note
+		}
+	}
+
+	local := stun.UDPAddrOf(m.conn.LocalAddr())
+	if local == nil {
+		local = &net.UDPAddr{}
+	}
+	if inbound {
+		c.write(time.Now(), addr, local, b, true, comment)
+	} else {
+		c.write(time.Now(), local, addr, b, false, comment)
+	}
+}
+
+// readFrom reads a packet into buf. A nil address means the source could
+// not be converted to a UDP address.
+func (m *Mux) readFrom(buf []byte) (int, *net.UDPAddr, error) {
+	if m.udp != nil {
+		return m.udp.ReadFromUDP(buf)
+	}
+	n, addr, err := m.conn.ReadFrom(buf)
+	return n, stun.UDPAddrOf(addr), err
+}
+
+// recvLoop reads packets from the UDP connection and dispatches them
+// until the Mux is closed or the connection fails permanently.
+func (m *Mux) recvLoop() {
 	buf := make([]byte, 64*1024)
 
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		n, addr, err := m.conn.ReadFromUDP(buf)
+		n, addr, err := m.readFrom(buf)
 		if err != nil {
+			if m.isClosed() || errors.Is(err, net.ErrClosed) {
+				m.log().Debug("nat: mux receive loop stopped", "local", m.conn.LocalAddr())
+				return
+			}
+			// Transient errors (e.g. ICMP-induced) are skipped.
+			m.log().Debug("nat: mux read failed", "local", m.conn.LocalAddr(), "err", err)
+			continue
+		}
+		if addr == nil {
+			m.log().Debug("nat: mux ignoring packet from non-UDP address", "local", m.conn.LocalAddr())
 			continue
 		}
 
+		m.received.Add(1)
+
 		frame := make([]byte, n)
 		copy(frame, buf[:n])
 
-		pkt, err := DecodePacket(frame)
-		if err != nil {
-			continue
+		note := m.dispatch(frame, addr)
+		if note != "" {
+			m.log().Debug("nat: mux packet not delivered", "from", addr, "size", n, "reason", note)
 		}
-
-		inb := inbound{
-			pkt:  pkt,
-			addr: addr,
+		if c := m.capture.Load(); c != nil {
+			m.tap(c, frame, addr, true, note)
 		}
+	}
+}
 
-		// First try address-based dispatch.
-		if m.dispatchByAddr(inb) {
-			continue
+// dispatch decodes a received frame and routes it to its queue.
+// It returns why the frame was not delivered, or "" if it was.
+func (m *Mux) dispatch(frame []byte, addr *net.UDPAddr) string {
+	pkt, err := DecodePacket(frame)
+	if err != nil {
+		m.countUndecodable(addr)
+		m.metrics().Add(metricDrops, 1, "undecodable")
+		return "undecodable: " + err.Error()
+	}
+	m.metrics().Add(metricBytes, float64(len(frame)), "received", pkt.Kind.String())
+
+	inb := inbound{
+		pkt:  pkt,
+		addr: addr,
+	}
+
+	// Version 2 packets belong to a session and are routed by connection ID only.
+	if pkt.Version == 2 {
+		queued, ok := m.dispatchByConn(inb)
+		if !ok {
+			m.drop("unknown_conn", 1)
+			return "dropped: unknown connection id"
 		}
+		return queueNote(queued)
+	}
+
+	// Version 1 packets are routed by source address first.
+	if queued, ok := m.dispatchByAddr(inb); ok {
+		return queueNote(queued)
+	}
 
-		// Otherwise, handle control demux.
-		if pkt.Kind == PacketControl {
-			m.dispatchControl(inb)
+	// Otherwise, handle control demux.
+	if pkt.Kind.isControl() {
+		if note, ok := m.dispatchHello(inb); ok {
+			return note
 		}
+		return queueNote(m.dispatchControl(inb))
 	}
+
+	// Nobody is waiting for unrouted data.
+	m.drop("no_receiver", 1)
+	return "dropped: no receiver"
 }
 
-// dispatchByAddr dispatches packets by source address.
-// Returns true if dispatched.
-func (m *Mux) dispatchByAddr(inb inbound) bool {
-	key := inb.addr.String()
+// drop counts n packets dropped for reason.
+func (m *Mux) drop(reason string, n uint64) {
+	m.dropped.Add(n)
+	m.metrics().Add(metricDrops, float64(n), reason)
+}
+
+// queueNote returns the capture note for a packet offered to a queue.
+func queueNote(queued bool) string {
+	if queued {
+		return ""
+	}
+	return "dropped: queue full"
+}
+
+// countUndecodable records an undecodable datagram from addr.
+func (m *Mux) countUndecodable(addr *net.UDPAddr) {
+	m.undecodable.Add(1)
 
 	m.addrMu.RLock()
-	ch, ok := m.byAddr[key]
+	defer m.addrMu.RUnlock()
+	if q, ok := m.byAddr[addr.String()]; ok {
+		q.undecodable.Add(1)
+	}
+}
+
+// push offers inb to q and updates the global counters.
+// It reports whether inb was queued.
+func (m *Mux) push(q *packetQueue, inb inbound) bool {
+	queued, evicted := q.push(inb, m.closed)
+	if evicted > 0 {
+		m.delivered.Add(-evicted)
+		m.drop("queue_full", evicted)
+	}
+	if queued {
+		m.delivered.Add(1)
+	} else {
+		m.drop("queue_full", 1)
+	}
+	return queued
+}
+
+// dispatchByConn dispatches packets by connection ID.
+// ok reports whether the connection ID is registered, queued whether the
+// packet was queued.
+func (m *Mux) dispatchByConn(inb inbound) (queued, ok bool) {
+	m.connMu.RLock()
+	q, ok := m.byConn[inb.pkt.ConnID]
+	m.connMu.RUnlock()
+
+	if ok {
+		return m.push(q, inb), true
+	}
+	return false, false
+}
+
+// dispatchByAddr dispatches packets by source address.
+// ok reports whether the address is registered, queued whether the packet
+// was queued.
+func (m *Mux) dispatchByAddr(inb inbound) (queued, ok bool) {
+	// The queue is pushed to without the lock, so that a Block wait does not
+	// stall registrations; the queue itself guards against being closed.
+	m.addrMu.RLock()
+	q, ok := m.byAddr[inb.addr.String()]
 	m.addrMu.RUnlock()
 
 	if ok {
-		select {
-		case ch <- inb:
-		default:
-		}
-		return true
+		return m.push(q, inb), true
 	}
-	return false
+	return false, false
 }
 
 // dispatchControl dispatches control packets by ToPeerID.
-func (m *Mux) dispatchControl(inb inbound) {
-	msg, err := DecodeMessage(inb.pkt.Payload)
-	if err != nil || msg.ToPeerID == "" {
-		m.controlCh <- inb
-		return
+// It reports whether the packet was queued.
+func (m *Mux) dispatchControl(inb inbound) bool {
+	var to []byte
+	if inb.pkt.Kind == PacketMessage && payloadEncoding(inb.pkt.Payload) == MessageEncodingBinary {
+		// Only the recipient is needed here, so skip a full decode.
+		to, _ = messageRecipient(inb.pkt.Payload)
+	} else if msg, err := decodeMessageJSON(inb.pkt.Payload); err == nil {
+		to = []byte(msg.ToPeerID)
+	}
+	if len(to) == 0 {
+		return m.push(m.control, inb)
 	}
 
 	m.controlMu.RLock()
-	ch, ok := m.controlByPeer[msg.ToPeerID]
+	q, ok := m.controlByPeer[string(to)]
 	m.controlMu.RUnlock()
 
 	if ok {
-		select {
-		case ch <- inb:
-		default:
-		}
-	} else {
-		m.controlCh <- inb
+		return m.push(q, inb)
 	}
+	return m.push(m.control, inb)
+}
+
+// closedInbound returns an already closed channel.
+func closedInbound() chan inbound {
+	ch := make(chan inbound)
+	close(ch)
+	return ch
 }
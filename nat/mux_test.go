@@ -3,6 +3,7 @@ package nat_test
 import (
 	"context"
 	"net"
+	"runtime"
 	"testing"
 	"time"
 
@@ -71,3 +72,169 @@ func TestMuxAliasViaSession(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, payload, got)
 }
+
+func TestMuxClose(t *testing.T) {
+	t.Parallel()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	s := nat.NewSession(mux, remote, 4)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		_, _, err := s.RecvData(ctx)
+		recvErr <- err
+	}()
+
+	assert.NoError(t, mux.Close())
+	assert.NoError(t, mux.Close())
+
+	assert.ErrorIs(t, <-recvErr, nat.ErrConnectionClosed)
+	<-s.Done()
+	assert.ErrorIs(t, s.Err(), nat.ErrConnectionClosed)
+
+	_, ok := <-mux.Control()
+	assert.False(t, ok)
+	_, ok = <-mux.ControlFor("late")
+	assert.False(t, ok)
+	_, ok = <-mux.Register(remote, 1)
+	assert.False(t, ok)
+	assert.ErrorIs(t, mux.Send(remote, nat.PacketData, []byte("x")), nat.ErrConnectionClosed)
+
+	// The connection is left usable for the caller.
+	_, err = conn.WriteToUDP([]byte("still open"), remote)
+	assert.NoError(t, err)
+}
+
+func TestMuxStopsOnContextOrConnClose(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		stop func(cancel context.CancelFunc, conn *net.UDPConn)
+	}{
+		{
+			name: "context cancelled",
+			stop: func(cancel context.CancelFunc, _ *net.UDPConn) { cancel() },
+		},
+		{
+			name: "connection closed",
+			stop: func(_ context.CancelFunc, conn *net.UDPConn) { _ = conn.Close() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			mux := nat.NewMux(conn)
+			mux.Start(ctx)
+			control := mux.Control()
+
+			tt.stop(cancel, conn)
+
+			select {
+			case _, ok := <-control:
+				assert.False(t, ok)
+			case <-time.After(2 * time.Second):
+				assert.FailNow(t, "mux did not shut down")
+			}
+		})
+	}
+}
+
+func TestMuxUnregister(t *testing.T) {
+	t.Parallel()
+
+	aConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer aConn.Close()
+	bConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(aConn)
+	mux.Start(ctx)
+
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+	ch := mux.Register(bAddr, 4)
+	mux.Unregister(bAddr)
+
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	// Packets from the unregistered address now reach the control fallback.
+	wire, err := nat.EncodePacket(nat.PacketControl, []byte("hi"))
+	assert.NoError(t, err)
+	_, err = bConn.WriteToUDP(wire, aConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	select {
+	case _, ok := <-mux.Control():
+		assert.True(t, ok)
+	case <-ctx.Done():
+		assert.FailNow(t, "packet was not delivered to the control fallback")
+	}
+}
+
+func TestMuxShutdownLeavesNoGoroutines(t *testing.T) {
+	// Not parallel: it compares global goroutine counts.
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer aConn.Close()
+	bConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.NoError(t, err)
+	defer bConn.Close()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	sA := nat.NewSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 4)
+	sB := nat.NewSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 4)
+	for _, s := range []*nat.Session{sA, sB} {
+		s.SetKeepalive(10 * time.Millisecond)
+		s.StartKeepalive(context.Background())
+	}
+
+	assert.NoError(t, sA.Send([]byte("ping")))
+	_, _, err = sB.Recv(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, aMux.Close())
+	assert.NoError(t, bMux.Close())
+	<-sA.Done()
+	<-sB.Done()
+
+	// Poll by hand: assert.Eventually runs its condition in a goroutine of its own.
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,188 @@
+package nattest
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connQueue is the number of packets a Conn buffers before dropping.
+const connQueue = 1024
+
+var _ net.PacketConn = (*Conn)(nil)
+
+// Conn is a UDP endpoint on a Host. It implements net.PacketConn, and
+// ReadFromUDP and WriteToUDP like *net.UDPConn.
+//
+// Writes never block; like UDP, packets are dropped when the receiver's
+// queue is full or nothing listens at the destination.
+type Conn struct {
+	host *Host
+	addr *net.UDPAddr
+
+	in        chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	readDeadline deadline
+}
+
+// datagram is a packet queued for reading.
+type datagram struct {
+	src *net.UDPAddr
+	p   []byte
+}
+
+func newConn(h *Host, addr *net.UDPAddr) *Conn {
+	return &Conn{
+		host:   h,
+		addr:   addr,
+		in:     make(chan datagram, connQueue),
+		closed: make(chan struct{}),
+		readDeadline: deadline{
+			expired: make(chan struct{}),
+			changed: make(chan struct{}),
+		},
+	}
+}
+
+// ReadFromUDP reads a packet into b and returns its size and source address.
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		expired, changed := c.readDeadline.wait()
+		select {
+		case d := <-c.in:
+			return copy(b, d.p), d.src, nil
+		case <-c.closed:
+			return 0, nil, c.opError("read", net.ErrClosed)
+		case <-expired:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		case <-changed:
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(b)
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, addr, err
+}
+
+// WriteToUDP sends b to addr.
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	n := c.host.network
+	n.mu.Lock()
+	n.send(c.host, c.addr, addr, b)
+	n.mu.Unlock()
+	return len(b), nil
+}
+
+// WriteTo implements net.PacketConn. addr must be a *net.UDPAddr.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", net.InvalidAddrError("not a UDP address"))
+	}
+	return c.WriteToUDP(b, udpAddr)
+}
+
+// Close closes the Conn and frees its port. Pending reads return net.ErrClosed.
+func (c *Conn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+
+		n := c.host.network
+		n.mu.Lock()
+		delete(c.host.conns, c.addr.Port)
+		n.mu.Unlock()
+	})
+	return err
+}
+
+// LocalAddr returns the Conn's address in its host's realm.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets the read deadline; writes never block.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future reads.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, since writes never block.
+func (c *Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// enqueue queues a copy of p from src, dropping it if the queue is full.
+// The caller holds the network lock.
+func (c *Conn) enqueue(src *net.UDPAddr, p []byte) {
+	d := datagram{src: src, p: append([]byte(nil), p...)}
+	select {
+	case c.in <- d:
+	default:
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.addr, Err: err}
+}
+
+// deadline wakes readers when a deadline passes or is changed.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+	changed chan struct{}
+}
+
+// wait returns channels closed when the current deadline passes and when
+// it is replaced.
+func (d *deadline) wait() (expired, changed <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired, d.changed
+}
+
+// set replaces the deadline. The zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.expired = make(chan struct{})
+
+	if t.IsZero() {
+		return
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(d.expired)
+		return
+	}
+	expired := d.expired
+	d.timer = time.AfterFunc(wait, func() { close(expired) })
+}
@@ -0,0 +1,8 @@
+package nattest
+
+import "errors"
+
+var (
+	// ErrAddrInUse is returned by Host.ListenUDP when the port is already open.
+	ErrAddrInUse = errors.New("nattest: address already in use")
+)
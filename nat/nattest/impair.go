@@ -0,0 +1,203 @@
+package nattest
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// reorderHold is how much longer than the worst-case delay a reordered
+	// packet is held back.
+	reorderHold = 10 * time.Millisecond
+
+	// defaultQueueLimit is the default Profile.QueueLimit.
+	defaultQueueLimit = time.Second
+)
+
+// Profile describes the impairments an ImpairedConn applies to the packets
+// it sends. The zero Profile passes packets through unchanged.
+type Profile struct {
+	// Name identifies the profile in test output.
+	Name string
+
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+
+	// Duplicate is the probability that a packet is sent twice.
+	Duplicate float64
+
+	// Reorder is the probability that a packet is held back long enough for
+	// the packets sent after it to overtake it.
+	Reorder float64
+
+	// Delay is added to every packet, give or take up to Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// Bandwidth limits the send rate in bytes per second; zero means unlimited.
+	// Packets queue behind each other, and are dropped once the queue would
+	// delay them by more than QueueLimit (default 1 second).
+	Bandwidth  int
+	QueueLimit time.Duration
+}
+
+// Common network conditions.
+var (
+	Mobile3G = Profile{
+		Name:      "3G",
+		Loss:      0.02,
+		Duplicate: 0.005,
+		Reorder:   0.01,
+		Delay:     100 * time.Millisecond,
+		Jitter:    50 * time.Millisecond,
+		Bandwidth: 48_000,
+	}
+	LossyWiFi = Profile{
+		Name:      "lossy Wi-Fi",
+		Loss:      0.15,
+		Duplicate: 0.02,
+		Reorder:   0.05,
+		Delay:     5 * time.Millisecond,
+		Jitter:    20 * time.Millisecond,
+	}
+	Satellite = Profile{
+		Name:      "satellite",
+		Loss:      0.01,
+		Delay:     300 * time.Millisecond,
+		Jitter:    20 * time.Millisecond,
+		Bandwidth: 1_000_000,
+	}
+	Congested = Profile{
+		Name:      "congested",
+		Loss:      0.3,
+		Reorder:   0.1,
+		Delay:     50 * time.Millisecond,
+		Jitter:    100 * time.Millisecond,
+		Bandwidth: 16_000,
+	}
+)
+
+// ImpairedConn wraps a net.PacketConn, such as a *net.UDPConn or a Conn,
+// and impairs the packets written to it according to a Profile. Reads are
+// passed through. It can be placed under a Mux like any nat.PacketConn.
+//
+// Every random decision is drawn from a source seeded by Impair, so the same
+// sequence of writes meets the same fate on every run.
+type ImpairedConn struct {
+	net.PacketConn
+
+	mu       sync.Mutex
+	profile  Profile
+	rng      *rand.Rand
+	nextFree time.Time // when the bandwidth-limited link is idle again
+	stats    ImpairStats
+}
+
+// ImpairStats counts what an ImpairedConn did to the packets written to it.
+type ImpairStats struct {
+	Sent       uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// Impair wraps conn, impairing its writes according to p with randomness
+// seeded by seed.
+func Impair(conn net.PacketConn, p Profile, seed uint64) *ImpairedConn {
+	return &ImpairedConn{
+		PacketConn: conn,
+		profile:    p,
+		rng:        rand.New(rand.NewPCG(seed, 0)),
+	}
+}
+
+// SetProfile replaces the profile for subsequent writes, for example to
+// simulate an outage with Profile{Loss: 1}.
+func (c *ImpairedConn) SetProfile(p Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = p
+}
+
+// Stats returns the counters of the connection.
+func (c *ImpairedConn) Stats() ImpairStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// WriteTo sends b to addr after the profile's impairments. Like UDP, it
+// reports success for packets that are dropped.
+func (c *ImpairedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	delays := c.schedule(len(b))
+	for _, d := range delays {
+		if d <= 0 {
+			if _, err := c.PacketConn.WriteTo(b, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		p := append([]byte(nil), b...)
+		time.AfterFunc(d, func() {
+			_, _ = c.PacketConn.WriteTo(p, addr)
+		})
+	}
+	return len(b), nil
+}
+
+// schedule decides the fate of a packet of size bytes, returning the delay
+// of each copy to send; none if it is dropped.
+func (c *ImpairedConn) schedule(size int) []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.profile
+	c.stats.Sent++
+	if c.rng.Float64() < p.Loss {
+		c.stats.Dropped++
+		return nil
+	}
+
+	// Serialize the packet onto the bandwidth-limited link.
+	var queued time.Duration
+	if p.Bandwidth > 0 {
+		limit := p.QueueLimit
+		if limit <= 0 {
+			limit = defaultQueueLimit
+		}
+		now := time.Now()
+		start := now
+		if c.nextFree.After(now) {
+			start = c.nextFree
+		}
+		if start.Sub(now) > limit {
+			c.stats.Dropped++
+			return nil
+		}
+		done := start.Add(time.Duration(size) * time.Second / time.Duration(p.Bandwidth))
+		c.nextFree = done
+		queued = done.Sub(now)
+	}
+
+	copies := 1
+	if c.rng.Float64() < p.Duplicate {
+		c.stats.Duplicated++
+		copies++
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		d := queued + p.Delay
+		if p.Jitter > 0 {
+			d += time.Duration(c.rng.Int64N(int64(2*p.Jitter)+1)) - p.Jitter
+		}
+		if c.rng.Float64() < p.Reorder {
+			c.stats.Reordered++
+			d = queued + p.Delay + p.Jitter + reorderHold
+		}
+		delays[i] = max(d, 0)
+	}
+	return delays
+}
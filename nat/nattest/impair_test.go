@@ -0,0 +1,137 @@
+package nattest_test
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat/nattest"
+	"github.com/stretchr/testify/assert"
+)
+
+// impairedPair returns an impaired sender and a receiver on public hosts.
+func impairedPair(t *testing.T, p nattest.Profile, seed uint64) (*nattest.ImpairedConn, *nattest.Conn) {
+	t.Helper()
+
+	n := nattest.NewNetwork()
+	sender := nattest.Impair(listen(t, n.AddHost("203.0.113.1"), 1000), p, seed)
+	receiver := listen(t, n.AddHost("203.0.113.2"), 2000)
+	return sender, receiver
+}
+
+// sendSeq sends count packets carrying their sequence number, each size bytes.
+func sendSeq(t *testing.T, c *nattest.ImpairedConn, to *nattest.Conn, count, size int) {
+	t.Helper()
+
+	for i := range count {
+		b := make([]byte, size)
+		binary.BigEndian.PutUint32(b, uint32(i))
+		_, err := c.WriteTo(b, to.LocalAddr())
+		assert.NoError(t, err)
+	}
+}
+
+// recvSeq reads sequence numbers until nothing arrives for a while.
+func recvSeq(c *nattest.Conn) []int {
+	var seqs []int
+	buf := make([]byte, 1500)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return seqs
+		}
+		if n >= 4 {
+			seqs = append(seqs, int(binary.BigEndian.Uint32(buf)))
+		}
+	}
+}
+
+func TestImpairPassthrough(t *testing.T) {
+	t.Parallel()
+
+	sender, receiver := impairedPair(t, nattest.Profile{}, 1)
+	sendSeq(t, sender, receiver, 100, 100)
+
+	want := make([]int, 100)
+	for i := range want {
+		want[i] = i
+	}
+	assert.Equal(t, want, recvSeq(receiver))
+	assert.Equal(t, nattest.ImpairStats{Sent: 100}, sender.Stats())
+}
+
+func TestImpairDeterministic(t *testing.T) {
+	t.Parallel()
+
+	p := nattest.Profile{Loss: 0.3, Duplicate: 0.1}
+	run := func(seed uint64) ([]int, nattest.ImpairStats) {
+		sender, receiver := impairedPair(t, p, seed)
+		sendSeq(t, sender, receiver, 200, 100)
+		return recvSeq(receiver), sender.Stats()
+	}
+
+	got1, stats1 := run(42)
+	got2, stats2 := run(42)
+	assert.Equal(t, got1, got2)
+	assert.Equal(t, stats1, stats2)
+
+	// Roughly the configured rates.
+	assert.InDelta(t, 60, stats1.Dropped, 20)
+	assert.InDelta(t, 14, stats1.Duplicated, 10)
+	assert.Equal(t, 200-int(stats1.Dropped)+int(stats1.Duplicated), len(got1))
+
+	_, stats3 := run(43)
+	assert.NotEqual(t, stats1, stats3)
+}
+
+func TestImpairDelayAndReorder(t *testing.T) {
+	t.Parallel()
+
+	sender, receiver := impairedPair(t, nattest.Profile{Delay: 30 * time.Millisecond, Reorder: 0.2}, 1)
+
+	start := time.Now()
+	sendSeq(t, sender, receiver, 50, 100)
+	_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := receiver.ReadFrom(make([]byte, 1500))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+
+	// Every packet arrives, but not in order.
+	got := append([]int{0}, recvSeq(receiver)...)
+	assert.Len(t, got, 50)
+	assert.False(t, slices.IsSorted(got[1:]))
+	assert.NotZero(t, sender.Stats().Reordered)
+}
+
+func TestImpairBandwidth(t *testing.T) {
+	t.Parallel()
+
+	// 20 packets of 1000 bytes at 100 kB/s take 200ms; a queue limit of
+	// 100ms drops about half of them.
+	sender, receiver := impairedPair(t, nattest.Profile{Bandwidth: 100_000, QueueLimit: 100 * time.Millisecond}, 1)
+
+	start := time.Now()
+	sendSeq(t, sender, receiver, 20, 1000)
+	got := recvSeq(receiver)
+	elapsed := time.Since(start)
+
+	assert.InDelta(t, 11, len(got), 1)
+	assert.Equal(t, uint64(20-len(got)), sender.Stats().Dropped)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.True(t, slices.IsSorted(got))
+}
+
+func TestImpairSetProfile(t *testing.T) {
+	t.Parallel()
+
+	sender, receiver := impairedPair(t, nattest.Profile{}, 1)
+	sender.SetProfile(nattest.Profile{Loss: 1})
+	sendSeq(t, sender, receiver, 10, 100)
+	assert.Empty(t, recvSeq(receiver))
+
+	sender.SetProfile(nattest.Profile{})
+	sendSeq(t, sender, receiver, 10, 100)
+	assert.Len(t, recvSeq(receiver), 10)
+}
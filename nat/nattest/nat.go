@@ -0,0 +1,301 @@
+package nattest
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Mapping selects how a NAT reuses external ports (RFC 4787 section 4.1).
+type Mapping string
+
+const (
+	// MappingEndpointIndependent reuses one external port for every destination.
+	MappingEndpointIndependent Mapping = "EIM"
+
+	// MappingAddressDependent uses one external port per destination IP.
+	MappingAddressDependent Mapping = "ADM"
+
+	// MappingAddressPortDependent uses one external port per destination IP and port.
+	MappingAddressPortDependent Mapping = "APDM"
+)
+
+// Filtering selects which inbound packets a NAT lets through to a binding
+// (RFC 4787 section 5).
+type Filtering string
+
+const (
+	// FilteringEndpointIndependent accepts packets from any source.
+	FilteringEndpointIndependent Filtering = "EIF"
+
+	// FilteringAddressDependent accepts packets from IPs the binding has sent to.
+	FilteringAddressDependent Filtering = "ADF"
+
+	// FilteringAddressPortDependent accepts packets from IPs and ports the
+	// binding has sent to.
+	FilteringAddressPortDependent Filtering = "APDF"
+)
+
+// PortAllocation selects how a NAT picks the external port of a new binding.
+type PortAllocation string
+
+const (
+	// PortPreserving uses the internal port if it is free, and otherwise
+	// falls back to PortSequential.
+	PortPreserving PortAllocation = "preserving"
+
+	// PortSequential uses the next free port after the last one allocated.
+	PortSequential PortAllocation = "sequential"
+
+	// PortRandom uses a free port chosen at random.
+	PortRandom PortAllocation = "random"
+)
+
+const (
+	// firstNATPort is where sequential allocation starts.
+	firstNATPort = 20000
+
+	// minNATPort is the lowest port random allocation picks.
+	minNATPort = 1024
+)
+
+// NATConfig configures the behavior of a NAT.
+type NATConfig struct {
+	// Mapping defaults to MappingEndpointIndependent.
+	Mapping Mapping
+
+	// Filtering defaults to FilteringEndpointIndependent.
+	Filtering Filtering
+
+	// Allocation defaults to PortPreserving.
+	Allocation PortAllocation
+
+	// Hairpinning lets hosts behind the NAT reach each other through its
+	// public address.
+	Hairpinning bool
+
+	// BindingTimeout expires a binding that has sent nothing for this long.
+	// Inbound packets do not refresh a binding. Zero means bindings never expire.
+	BindingTimeout time.Duration
+}
+
+// Common NAT types, as classified by RFC 3489.
+var (
+	FullCone = NATConfig{
+		Mapping:   MappingEndpointIndependent,
+		Filtering: FilteringEndpointIndependent,
+	}
+	RestrictedCone = NATConfig{
+		Mapping:   MappingEndpointIndependent,
+		Filtering: FilteringAddressDependent,
+	}
+	PortRestrictedCone = NATConfig{
+		Mapping:   MappingEndpointIndependent,
+		Filtering: FilteringAddressPortDependent,
+	}
+	Symmetric = NATConfig{
+		Mapping:    MappingAddressPortDependent,
+		Filtering:  FilteringAddressPortDependent,
+		Allocation: PortSequential,
+	}
+)
+
+// NAT translates between a private realm and the public realm of a Network.
+type NAT struct {
+	network *Network
+	ip      net.IP
+	cfg     NATConfig
+
+	hosts    map[string]*Host
+	bindings map[bindingKey]*binding
+	byPort   map[int]*binding
+	nextPort int
+	filtered int
+}
+
+// bindingKey identifies a binding: the internal address and, depending on
+// the mapping behavior, the destination.
+type bindingKey struct {
+	internal string
+	remote   string
+}
+
+// binding is an external port allocated to an internal address.
+type binding struct {
+	internal *net.UDPAddr
+	port     int
+	lastOut  time.Time
+
+	// Destinations sent to, by IP and by IP and port.
+	sentIP   map[string]bool
+	sentAddr map[string]bool
+}
+
+func newNAT(n *Network, ip net.IP, cfg NATConfig) *NAT {
+	if cfg.Mapping == "" {
+		cfg.Mapping = MappingEndpointIndependent
+	}
+	if cfg.Filtering == "" {
+		cfg.Filtering = FilteringEndpointIndependent
+	}
+	if cfg.Allocation == "" {
+		cfg.Allocation = PortPreserving
+	}
+	return &NAT{
+		network:  n,
+		ip:       ip,
+		cfg:      cfg,
+		hosts:    make(map[string]*Host),
+		bindings: make(map[bindingKey]*binding),
+		byPort:   make(map[int]*binding),
+		nextPort: firstNATPort,
+	}
+}
+
+// IP returns the NAT's public IP address.
+func (g *NAT) IP() net.IP {
+	return g.ip
+}
+
+// Config returns the NAT's configuration, with defaults filled in.
+func (g *NAT) Config() NATConfig {
+	return g.cfg
+}
+
+// AddHost adds a host with the private IP address ip behind the NAT.
+// Private addresses only need to be unique behind one NAT.
+// It panics if ip is already in use behind the NAT.
+func (g *NAT) AddHost(ip string) *Host {
+	g.network.mu.Lock()
+	defer g.network.mu.Unlock()
+
+	addr := mustParseIP(ip)
+	if _, ok := g.hosts[addr.String()]; ok {
+		panic(fmt.Sprintf("nattest: private address %s already in use behind %s", addr, g.ip))
+	}
+	h := newHost(g.network, g, addr)
+	g.hosts[addr.String()] = h
+	return h
+}
+
+// Bindings returns the number of bindings that have not expired.
+func (g *NAT) Bindings() int {
+	g.network.mu.Lock()
+	defer g.network.mu.Unlock()
+
+	g.expire(g.network.now())
+	return len(g.bindings)
+}
+
+// Filtered returns the number of inbound packets the NAT has dropped, either
+// for lack of a binding or because its filtering rejected the source.
+// Tests can wait on it to step through an exchange that is expected to fail.
+func (g *NAT) Filtered() int {
+	g.network.mu.Lock()
+	defer g.network.mu.Unlock()
+	return g.filtered
+}
+
+// outbound returns the external address for a packet from the internal
+// address src to dst, creating or refreshing its binding.
+// The caller holds the network lock.
+func (g *NAT) outbound(src, dst *net.UDPAddr) *net.UDPAddr {
+	now := g.network.now()
+	g.expire(now)
+
+	key := bindingKey{internal: src.String()}
+	switch g.cfg.Mapping {
+	case MappingAddressDependent:
+		key.remote = dst.IP.String()
+	case MappingAddressPortDependent:
+		key.remote = dst.String()
+	}
+
+	b, ok := g.bindings[key]
+	if !ok {
+		b = &binding{
+			internal: src,
+			port:     g.allocate(src.Port),
+			sentIP:   make(map[string]bool),
+			sentAddr: make(map[string]bool),
+		}
+		g.bindings[key] = b
+		g.byPort[b.port] = b
+	}
+	b.lastOut = now
+	b.sentIP[dst.IP.String()] = true
+	b.sentAddr[dst.String()] = true
+
+	return &net.UDPAddr{IP: g.ip, Port: b.port}
+}
+
+// inbound delivers a packet from src to the external address dst if a
+// binding exists and its filtering lets src through.
+// The caller holds the network lock.
+func (g *NAT) inbound(src, dst *net.UDPAddr, p []byte) {
+	g.expire(g.network.now())
+
+	b, ok := g.byPort[dst.Port]
+	if !ok {
+		g.filtered++
+		return
+	}
+	switch g.cfg.Filtering {
+	case FilteringAddressDependent:
+		if !b.sentIP[src.IP.String()] {
+			g.filtered++
+			return
+		}
+	case FilteringAddressPortDependent:
+		if !b.sentAddr[src.String()] {
+			g.filtered++
+			return
+		}
+	}
+	if h, ok := g.hosts[b.internal.IP.String()]; ok {
+		h.deliver(src, b.internal, p)
+	}
+}
+
+// expire removes bindings that have been idle for the binding timeout.
+// The caller holds the network lock.
+func (g *NAT) expire(now time.Time) {
+	if g.cfg.BindingTimeout <= 0 {
+		return
+	}
+	for key, b := range g.bindings {
+		if now.Sub(b.lastOut) >= g.cfg.BindingTimeout {
+			delete(g.bindings, key)
+			delete(g.byPort, b.port)
+		}
+	}
+}
+
+// allocate picks a free external port for a binding of internalPort.
+// The caller holds the network lock.
+func (g *NAT) allocate(internalPort int) int {
+	switch g.cfg.Allocation {
+	case PortPreserving:
+		if _, used := g.byPort[internalPort]; !used {
+			return internalPort
+		}
+	case PortRandom:
+		for {
+			port := minNATPort + g.network.rng.IntN(65536-minNATPort)
+			if _, used := g.byPort[port]; !used {
+				return port
+			}
+		}
+	}
+
+	for {
+		port := g.nextPort
+		g.nextPort++
+		if g.nextPort > 65535 {
+			g.nextPort = minNATPort
+		}
+		if _, used := g.byPort[port]; !used {
+			return port
+		}
+	}
+}
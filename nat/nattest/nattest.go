@@ -0,0 +1,236 @@
+// Package nattest provides an in-memory packet network in which hosts sit
+// behind emulated NATs, for testing NAT traversal without real networks.
+//
+// A Network has a public realm, where hosts added with Network.AddHost live,
+// and one private realm per NAT added with Network.AddNAT. Hosts added with
+// NAT.AddHost reach the public realm through their NAT, which translates
+// addresses according to its NATConfig. Packets are delivered synchronously
+// by Conn.WriteTo, and random port allocation draws from a seeded source, so
+// a test observes the same behavior on every run. Binding expiry follows the
+// Network's clock, which a test can replace with a Clock it advances itself.
+//
+// A Conn satisfies nat.PacketConn and stun.PacketConn, so a Mux, a
+// stun.Client or a stun.Server runs on it as on a UDP socket.
+//
+// Impair wraps any net.PacketConn to add loss, duplication, reordering,
+// delay and bandwidth limits according to a Profile.
+package nattest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultSeed seeds random port allocation unless SetSeed is called.
+const defaultSeed = 1
+
+// Network is an in-memory packet network.
+type Network struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	now    func() time.Time
+	public map[string]*Host
+	nats   map[string]*NAT
+}
+
+// NewNetwork returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{
+		rng:    rand.New(rand.NewPCG(defaultSeed, 0)),
+		now:    time.Now,
+		public: make(map[string]*Host),
+		nats:   make(map[string]*NAT),
+	}
+}
+
+// SetSeed reseeds the source used for random port allocation.
+func (n *Network) SetSeed(seed uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rng = rand.New(rand.NewPCG(seed, 0))
+}
+
+// SetClock replaces the time source the NATs expire bindings by, which
+// defaults to time.Now. Clock.Now can be passed to control time from a test.
+func (n *Network) SetClock(now func() time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.now = now
+}
+
+// Clock is a time source that only moves when Advance is called.
+type Clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewClock returns a Clock reading start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{t: start}
+}
+
+// Now returns the Clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Advance moves the Clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// AddHost adds a host with a public IP address, reachable by every host.
+// It panics if ip is already in use in the public realm.
+func (n *Network) AddHost(ip string) *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr := mustParseIP(ip)
+	n.claimPublic(addr)
+	h := newHost(n, nil, addr)
+	n.public[addr.String()] = h
+	return h
+}
+
+// AddNAT adds a NAT with the public IP address ip.
+// It panics if ip is already in use in the public realm.
+func (n *Network) AddNAT(ip string, cfg NATConfig) *NAT {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr := mustParseIP(ip)
+	n.claimPublic(addr)
+	g := newNAT(n, addr, cfg)
+	n.nats[addr.String()] = g
+	return g
+}
+
+// claimPublic panics if ip is already used in the public realm.
+// The caller holds n.mu.
+func (n *Network) claimPublic(ip net.IP) {
+	_, host := n.public[ip.String()]
+	_, nat := n.nats[ip.String()]
+	if host || nat {
+		panic(fmt.Sprintf("nattest: public address %s already in use", ip))
+	}
+}
+
+// send routes a packet from the host h. The caller holds n.mu.
+func (n *Network) send(h *Host, src, dst *net.UDPAddr, p []byte) {
+	if g := h.nat; g != nil {
+		// Hosts behind the same NAT reach each other directly.
+		if peer, ok := g.hosts[dst.IP.String()]; ok {
+			peer.deliver(src, dst, p)
+			return
+		}
+
+		ext := g.outbound(src, dst)
+		if dst.IP.Equal(g.ip) {
+			if g.cfg.Hairpinning {
+				g.inbound(ext, dst, p)
+			}
+			return
+		}
+		src = ext
+	}
+	n.deliverPublic(src, dst, p)
+}
+
+// deliverPublic delivers a packet addressed to the public realm.
+// The caller holds n.mu.
+func (n *Network) deliverPublic(src, dst *net.UDPAddr, p []byte) {
+	if g, ok := n.nats[dst.IP.String()]; ok {
+		g.inbound(src, dst, p)
+		return
+	}
+	if h, ok := n.public[dst.IP.String()]; ok {
+		h.deliver(src, dst, p)
+	}
+}
+
+// Host is a host on a Network, either public or behind a NAT.
+type Host struct {
+	network *Network
+	nat     *NAT
+	ip      net.IP
+
+	conns    map[int]*Conn
+	nextPort int
+}
+
+// firstEphemeralPort is the first port handed out for ListenUDP with port 0.
+const firstEphemeralPort = 49152
+
+func newHost(n *Network, g *NAT, ip net.IP) *Host {
+	return &Host{
+		network:  n,
+		nat:      g,
+		ip:       ip,
+		conns:    make(map[int]*Conn),
+		nextPort: firstEphemeralPort,
+	}
+}
+
+// IP returns the host's address in its realm.
+func (h *Host) IP() net.IP {
+	return h.ip
+}
+
+// NAT returns the NAT the host is behind, or nil for a public host.
+func (h *Host) NAT() *NAT {
+	return h.nat
+}
+
+// ListenUDP opens a Conn on port, or on an unused port if port is zero.
+// It returns ErrAddrInUse if the port is already open.
+func (h *Host) ListenUDP(port int) (*Conn, error) {
+	h.network.mu.Lock()
+	defer h.network.mu.Unlock()
+
+	if port == 0 {
+		for {
+			port = h.nextPort
+			h.nextPort++
+			if h.nextPort > 65535 {
+				h.nextPort = firstEphemeralPort
+			}
+			if _, used := h.conns[port]; !used {
+				break
+			}
+		}
+	}
+	addr := &net.UDPAddr{IP: h.ip, Port: port}
+	if _, used := h.conns[port]; used {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: addr, Err: ErrAddrInUse}
+	}
+
+	c := newConn(h, addr)
+	h.conns[port] = c
+	return c, nil
+}
+
+// deliver queues a packet for the Conn bound to dst.Port, if any.
+// The caller holds the network lock.
+func (h *Host) deliver(src, dst *net.UDPAddr, p []byte) {
+	if c, ok := h.conns[dst.Port]; ok {
+		c.enqueue(src, p)
+	}
+}
+
+func mustParseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		panic(fmt.Sprintf("nattest: invalid IP address %q", s))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,346 @@
+package nattest_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat/nattest"
+	"github.com/stretchr/testify/assert"
+)
+
+// listen opens a Conn on h or fails the test.
+func listen(t *testing.T, h *nattest.Host, port int) *nattest.Conn {
+	t.Helper()
+
+	c, err := h.ListenUDP(port)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// recv reads one packet from c, or returns a nil source if none arrives soon.
+func recv(c *nattest.Conn) (string, *net.UDPAddr) {
+	buf := make([]byte, 1500)
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	n, src, err := c.ReadFromUDP(buf)
+	if err != nil {
+		return "", nil
+	}
+	return string(buf[:n]), src
+}
+
+func addr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestPublicDelivery(t *testing.T) {
+	t.Parallel()
+
+	n := nattest.NewNetwork()
+	a := listen(t, n.AddHost("203.0.113.1"), 1000)
+	b := listen(t, n.AddHost("203.0.113.2"), 0)
+
+	_, err := a.WriteTo([]byte("hello"), b.LocalAddr())
+	assert.NoError(t, err)
+
+	payload, src := recv(b)
+	assert.Equal(t, "hello", payload)
+	assert.Equal(t, "203.0.113.1:1000", src.String())
+}
+
+func TestMapping(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		mapping nattest.Mapping
+		// Whether the external port stays the same for another port on the
+		// same server, and for another server.
+		samePort, sameIP bool
+	}{
+		{nattest.MappingEndpointIndependent, true, true},
+		{nattest.MappingAddressDependent, true, false},
+		{nattest.MappingAddressPortDependent, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mapping), func(t *testing.T) {
+			t.Parallel()
+
+			n := nattest.NewNetwork()
+			g := n.AddNAT("198.51.100.1", nattest.NATConfig{Mapping: tt.mapping})
+			client := listen(t, g.AddHost("192.168.0.2"), 5000)
+			s1 := n.AddHost("203.0.113.1")
+			s1a := listen(t, s1, 3478)
+			s1b := listen(t, s1, 3479)
+			s2 := listen(t, n.AddHost("203.0.113.2"), 3478)
+
+			observed := func(server *nattest.Conn) *net.UDPAddr {
+				_, err := client.WriteTo([]byte("ping"), server.LocalAddr())
+				assert.NoError(t, err)
+				_, src := recv(server)
+				if !assert.NotNil(t, src) {
+					t.FailNow()
+				}
+				return src
+			}
+
+			first := observed(s1a)
+			assert.Equal(t, "198.51.100.1:5000", first.String())
+			assert.Equal(t, tt.samePort, first.Port == observed(s1b).Port)
+			assert.Equal(t, tt.sameIP, first.Port == observed(s2).Port)
+
+			// Sending again reuses the binding.
+			assert.Equal(t, first.Port, observed(s1a).Port)
+		})
+	}
+}
+
+func TestFiltering(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		filtering nattest.Filtering
+		// Whether packets get through from the contacted address, another
+		// port on the same IP, and another IP.
+		same, otherPort, otherIP bool
+	}{
+		{nattest.FilteringEndpointIndependent, true, true, true},
+		{nattest.FilteringAddressDependent, true, true, false},
+		{nattest.FilteringAddressPortDependent, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.filtering), func(t *testing.T) {
+			t.Parallel()
+
+			n := nattest.NewNetwork()
+			g := n.AddNAT("198.51.100.1", nattest.NATConfig{Filtering: tt.filtering})
+			client := listen(t, g.AddHost("192.168.0.2"), 5000)
+			s1 := n.AddHost("203.0.113.1")
+			s1a := listen(t, s1, 3478)
+			s1b := listen(t, s1, 3479)
+			s2 := listen(t, n.AddHost("203.0.113.2"), 3478)
+
+			_, err := client.WriteTo([]byte("ping"), s1a.LocalAddr())
+			assert.NoError(t, err)
+			_, ext := recv(s1a)
+			if !assert.NotNil(t, ext) {
+				return
+			}
+
+			reaches := func(from *nattest.Conn) bool {
+				_, err := from.WriteTo([]byte("pong"), ext)
+				assert.NoError(t, err)
+				_, src := recv(client)
+				return src != nil
+			}
+			assert.Equal(t, tt.same, reaches(s1a))
+			assert.Equal(t, tt.otherPort, reaches(s1b))
+			assert.Equal(t, tt.otherIP, reaches(s2))
+		})
+	}
+}
+
+func TestUnsolicitedInboundDropped(t *testing.T) {
+	t.Parallel()
+
+	n := nattest.NewNetwork()
+	g := n.AddNAT("198.51.100.1", nattest.FullCone)
+	client := listen(t, g.AddHost("192.168.0.2"), 5000)
+	server := listen(t, n.AddHost("203.0.113.1"), 3478)
+
+	// No binding exists yet, even on a full cone NAT.
+	_, err := server.WriteTo([]byte("hello"), addr("198.51.100.1", 5000))
+	assert.NoError(t, err)
+	_, src := recv(client)
+	assert.Nil(t, src)
+	assert.Equal(t, 1, g.Filtered())
+}
+
+func TestPortAllocation(t *testing.T) {
+	t.Parallel()
+
+	// externalPorts returns the external ports of two hosts behind one NAT,
+	// both using internal port 5000.
+	externalPorts := func(t *testing.T, allocation nattest.PortAllocation, seed uint64) (int, int) {
+		n := nattest.NewNetwork()
+		n.SetSeed(seed)
+		g := n.AddNAT("198.51.100.1", nattest.NATConfig{Allocation: allocation})
+		a := listen(t, g.AddHost("192.168.0.2"), 5000)
+		b := listen(t, g.AddHost("192.168.0.3"), 5000)
+		server := listen(t, n.AddHost("203.0.113.1"), 3478)
+
+		var ports []int
+		for _, c := range []*nattest.Conn{a, b} {
+			_, err := c.WriteTo([]byte("ping"), server.LocalAddr())
+			assert.NoError(t, err)
+			_, src := recv(server)
+			if !assert.NotNil(t, src) {
+				t.FailNow()
+			}
+			ports = append(ports, src.Port)
+		}
+		return ports[0], ports[1]
+	}
+
+	t.Run("preserving", func(t *testing.T) {
+		a, b := externalPorts(t, nattest.PortPreserving, 1)
+		assert.Equal(t, 5000, a)
+		assert.Equal(t, 20000, b)
+	})
+	t.Run("sequential", func(t *testing.T) {
+		a, b := externalPorts(t, nattest.PortSequential, 1)
+		assert.Equal(t, 20000, a)
+		assert.Equal(t, 20001, b)
+	})
+	t.Run("random", func(t *testing.T) {
+		a1, b1 := externalPorts(t, nattest.PortRandom, 7)
+		a2, b2 := externalPorts(t, nattest.PortRandom, 7)
+		assert.Equal(t, a1, a2)
+		assert.Equal(t, b1, b2)
+		assert.NotEqual(t, a1, b1)
+
+		a3, _ := externalPorts(t, nattest.PortRandom, 8)
+		assert.NotEqual(t, a1, a3)
+	})
+}
+
+func TestHairpinning(t *testing.T) {
+	t.Parallel()
+
+	for _, hairpin := range []bool{true, false} {
+		name := "off"
+		if hairpin {
+			name = "on"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			n := nattest.NewNetwork()
+			g := n.AddNAT("198.51.100.1", nattest.NATConfig{Hairpinning: hairpin})
+			a := listen(t, g.AddHost("192.168.0.2"), 5000)
+			b := listen(t, g.AddHost("192.168.0.3"), 6000)
+			server := listen(t, n.AddHost("203.0.113.1"), 3478)
+
+			// b creates its binding, 198.51.100.1:6000.
+			_, err := b.WriteTo([]byte("ping"), server.LocalAddr())
+			assert.NoError(t, err)
+			recv(server)
+
+			_, err = a.WriteTo([]byte("hairpin"), addr("198.51.100.1", 6000))
+			assert.NoError(t, err)
+			payload, src := recv(b)
+			if hairpin {
+				assert.Equal(t, "hairpin", payload)
+				// The packet appears to come from a's external address.
+				assert.Equal(t, "198.51.100.1:5000", src.String())
+			} else {
+				assert.Nil(t, src)
+			}
+		})
+	}
+}
+
+func TestPrivateRealm(t *testing.T) {
+	t.Parallel()
+
+	n := nattest.NewNetwork()
+	g1 := n.AddNAT("198.51.100.1", nattest.Symmetric)
+	g2 := n.AddNAT("198.51.100.2", nattest.Symmetric)
+
+	// The same private address behind two NATs.
+	a := listen(t, g1.AddHost("192.168.0.2"), 5000)
+	b := listen(t, g1.AddHost("192.168.0.3"), 5000)
+	c := listen(t, g2.AddHost("192.168.0.3"), 5000)
+
+	_, err := a.WriteTo([]byte("lan"), b.LocalAddr())
+	assert.NoError(t, err)
+	payload, src := recv(b)
+	assert.Equal(t, "lan", payload)
+	assert.Equal(t, "192.168.0.2:5000", src.String())
+
+	_, src = recv(c)
+	assert.Nil(t, src)
+	assert.Equal(t, 0, g1.Bindings())
+}
+
+func TestBindingTimeout(t *testing.T) {
+	t.Parallel()
+
+	n := nattest.NewNetwork()
+	clock := nattest.NewClock(time.Unix(0, 0))
+	n.SetClock(clock.Now)
+	g := n.AddNAT("198.51.100.1", nattest.NATConfig{BindingTimeout: 100 * time.Millisecond})
+	client := listen(t, g.AddHost("192.168.0.2"), 5000)
+	server := listen(t, n.AddHost("203.0.113.1"), 3478)
+
+	_, err := client.WriteTo([]byte("ping"), server.LocalAddr())
+	assert.NoError(t, err)
+	_, ext := recv(server)
+	if !assert.NotNil(t, ext) {
+		return
+	}
+	assert.Equal(t, 1, g.Bindings())
+
+	// Inbound traffic does not keep the binding alive.
+	for range 3 {
+		clock.Advance(30 * time.Millisecond)
+		_, err = server.WriteTo([]byte("pong"), ext)
+		assert.NoError(t, err)
+		payload, _ := recv(client)
+		assert.Equal(t, "pong", payload)
+	}
+	clock.Advance(10 * time.Millisecond)
+	assert.Equal(t, 0, g.Bindings())
+
+	_, err = server.WriteTo([]byte("late"), ext)
+	assert.NoError(t, err)
+	_, src := recv(client)
+	assert.Nil(t, src)
+	assert.Equal(t, 1, g.Filtered())
+}
+
+func TestConnDeadline(t *testing.T) {
+	t.Parallel()
+
+	n := nattest.NewNetwork()
+	h := n.AddHost("203.0.113.1")
+	c := listen(t, h, 1000)
+
+	// A deadline in the past fails reads right away.
+	assert.NoError(t, c.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, _, err := c.ReadFrom(make([]byte, 10))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var ne net.Error
+	assert.True(t, errors.As(err, &ne) && ne.Timeout())
+
+	// Setting a deadline unblocks a pending read, as Mux.Close relies on.
+	assert.NoError(t, c.SetReadDeadline(time.Time{}))
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, c.SetReadDeadline(time.Now()))
+	assert.ErrorIs(t, <-done, os.ErrDeadlineExceeded)
+
+	// Close unblocks a pending read and frees the port.
+	assert.NoError(t, c.SetReadDeadline(time.Time{}))
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, c.Close())
+	assert.ErrorIs(t, <-done, net.ErrClosed)
+	assert.ErrorIs(t, c.Close(), net.ErrClosed)
+
+	_, err = h.ListenUDP(1000)
+	assert.NoError(t, err)
+	_, err = h.ListenUDP(1000)
+	assert.ErrorIs(t, err, nattest.ErrAddrInUse)
+}
@@ -0,0 +1,87 @@
+// Package otelnat adapts OpenTelemetry tracing to nat.Tracer, so that
+// nat.PunchTracer records hole punching attempts as OpenTelemetry spans.
+//
+// It is a module of its own, so that natto itself does not depend on
+// OpenTelemetry.
+package otelnat
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer returns a nat.Tracer that starts its spans with tracer.
+func NewTracer(tracer trace.Tracer) nat.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, nat.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(Attributes(attrs)...))
+	return ctx, otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) AddEvent(name string, attrs ...slog.Attr) {
+	s.span.AddEvent(name, trace.WithAttributes(Attributes(attrs)...))
+}
+
+func (s otelSpan) SetAttributes(attrs ...slog.Attr) {
+	s.span.SetAttributes(Attributes(attrs)...)
+}
+
+func (s otelSpan) SetStatus(ok bool, description string) {
+	if ok {
+		s.span.SetStatus(codes.Ok, "")
+		return
+	}
+	s.span.SetStatus(codes.Error, description)
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+// Attributes converts slog attributes to OpenTelemetry ones. Groups are
+// flattened into keys joined by dots, and values of kinds OpenTelemetry
+// has no type for are converted to strings.
+func Attributes(attrs []slog.Attr) []attribute.KeyValue {
+	out := make([]attribute.KeyValue, 0, len(attrs))
+	return appendAttributes(out, "", attrs)
+}
+
+func appendAttributes(out []attribute.KeyValue, prefix string, attrs []slog.Attr) []attribute.KeyValue {
+	for _, a := range attrs {
+		key := prefix + a.Key
+		v := a.Value.Resolve()
+		switch v.Kind() {
+		case slog.KindInt64:
+			out = append(out, attribute.Int64(key, v.Int64()))
+		case slog.KindUint64:
+			out = append(out, attribute.Int64(key, int64(v.Uint64())))
+		case slog.KindBool:
+			out = append(out, attribute.Bool(key, v.Bool()))
+		case slog.KindFloat64:
+			out = append(out, attribute.Float64(key, v.Float64()))
+		case slog.KindGroup:
+			if a.Key != "" {
+				key += "."
+			}
+			out = appendAttributes(out, key, v.Group())
+		default:
+			out = append(out, attribute.String(key, v.String()))
+		}
+	}
+	return out
+}
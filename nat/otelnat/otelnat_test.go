@@ -0,0 +1,73 @@
+package otelnat_test
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/nat/otelnat"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPunchTracer(t *testing.T) {
+	t.Parallel()
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer tp.Shutdown(context.Background())
+
+	pt := nat.NewPunchTracer(context.Background(), otelnat.NewTracer(tp.Tracer("natto")))
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 5000}
+	pt.Handle(nat.PunchEvent{Type: nat.PunchStarted, PeerID: "peer-b", Candidates: []*net.UDPAddr{addr}})
+	pt.Handle(nat.PunchEvent{Type: nat.PunchHelloSent, Addr: addr, CandidateType: nat.CandidateServerReflexive})
+	pt.Handle(nat.PunchEvent{Type: nat.PunchTimedOut, Err: nat.ErrPunchTimeout})
+
+	spans := rec.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	cand, root := spans[0], spans[1]
+
+	assert.Equal(t, "nat.punch", root.Name())
+	assert.Contains(t, root.Attributes(), attribute.String("nat.peer_id", "peer-b"))
+	assert.Contains(t, root.Attributes(), attribute.Int64("nat.candidates", 1))
+	assert.Equal(t, codes.Error, root.Status().Code)
+	assert.Equal(t, nat.ErrPunchTimeout.Error(), root.Status().Description)
+
+	assert.Equal(t, "nat.punch.candidate", cand.Name())
+	assert.Equal(t, root.SpanContext().SpanID(), cand.Parent().SpanID())
+	assert.Contains(t, cand.Attributes(), attribute.String("nat.candidate.addr", addr.String()))
+	assert.Contains(t, cand.Attributes(), attribute.Bool("nat.candidate.won", false))
+	if assert.Len(t, cand.Events(), 1) {
+		assert.Equal(t, string(nat.PunchHelloSent), cand.Events()[0].Name)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	t.Parallel()
+
+	got := otelnat.Attributes([]slog.Attr{
+		slog.String("s", "x"),
+		slog.Int("i", -1),
+		slog.Uint64("u", 2),
+		slog.Bool("b", true),
+		slog.Float64("f", 0.5),
+		slog.Group("g", slog.Int("n", 3)),
+		slog.Any("a", net.IPv4(192, 0, 2, 1)),
+	})
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("s", "x"),
+		attribute.Int64("i", -1),
+		attribute.Int64("u", 2),
+		attribute.Bool("b", true),
+		attribute.Float64("f", 0.5),
+		attribute.Int64("g.n", 3),
+		attribute.String("a", "192.0.2.1"),
+	}, got)
+}
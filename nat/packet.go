@@ -9,58 +9,152 @@ type PacketKind uint8
 const (
 	PacketControl PacketKind = 1
 	PacketData    PacketKind = 2
+
+	// PacketDataSeq is data prefixed with a 64-bit sequence number.
+	// It is used when data is sent over several paths at once, so that the
+	// receiver can drop duplicates.
+	PacketDataSeq PacketKind = 3
+
+	// PacketMessage is a control packet carrying a Message: handshakes in
+	// the binary encoding of EncodeMessageBinary, and session messages in
+	// the Session's encoding. PacketControl carries JSON handshakes and
+	// application control payloads, which Sessions never interpret.
+	PacketMessage PacketKind = 4
 )
 
+// String returns the kind name.
+func (k PacketKind) String() string {
+	switch k {
+	case PacketControl:
+		return "control"
+	case PacketData:
+		return "data"
+	case PacketDataSeq:
+		return "data-seq"
+	case PacketMessage:
+		return "message"
+	default:
+		return "unknown"
+	}
+}
+
+// isControl reports whether packets of kind k are control packets.
+func (k PacketKind) isControl() bool {
+	return k == PacketControl || k == PacketMessage
+}
+
 var (
 	// Magic prefix for all packets generated by this library.
 	packetMagic = [4]byte{'N', 'A', 'T', '1'}
+
+	// Magic prefix for packets carrying a connection ID.
+	packetMagicV2 = [4]byte{'N', 'A', 'T', '2'}
+)
+
+const (
+	headerLenV1 = 7
+	headerLenV2 = 11
 )
 
 // Packet is a framed UDP payload used by this library.
-// Layout (big endian):
+//
+// Version 1 layout (big endian):
 // [0..3]  magic "NAT1"
-// [4]     kind (1=control, 2=data)
+// [4]     kind (1=control, 2=data, 3=data-seq, 4=message)
 // [5..6]  payload length (uint16)
 // [7..]   payload bytes
+//
+// Version 2 layout (big endian):
+// [0..3]  magic "NAT2"
+// [4]     kind (1=control, 2=data, 3=data-seq, 4=message)
+// [5..8]  connection ID (uint32), chosen by the receiver
+// [9..10] payload length (uint16)
+// [11..]  payload bytes
 type Packet struct {
-	Kind    PacketKind
+	// Version is 1 for "NAT1" packets and 2 for "NAT2" packets.
+	Version uint8
+
+	Kind PacketKind
+
+	// ConnID identifies the receiving session. It is zero for version 1.
+	ConnID uint32
+
 	Payload []byte
 }
 
+// EncodePacket encodes a version 1 packet, which is demultiplexed by source address.
 func EncodePacket(kind PacketKind, payload []byte) (out []byte, err error) {
 	if len(payload) > 0xFFFF {
 		err = ErrMalformedPacket
 		return
 	}
 
-	out = make([]byte, 7+len(payload))
+	out = make([]byte, headerLenV1+len(payload))
 	copy(out[0:4], packetMagic[:])
 	out[4] = byte(kind)
 	binary.BigEndian.PutUint16(out[5:7], uint16(len(payload)))
-	copy(out[7:], payload)
+	copy(out[headerLenV1:], payload)
 	return
 }
 
-func DecodePacket(b []byte) (p *Packet, err error) {
-	if len(b) < 7 {
+// EncodeConnPacket encodes a version 2 packet addressed to connID.
+func EncodeConnPacket(kind PacketKind, connID uint32, payload []byte) (out []byte, err error) {
+	if len(payload) > 0xFFFF {
 		err = ErrMalformedPacket
 		return
 	}
-	if b[0] != packetMagic[0] || b[1] != packetMagic[1] || b[2] != packetMagic[2] || b[3] != packetMagic[3] {
-		err = ErrNotOurPacket
-		return
-	}
 
-	kind := PacketKind(b[4])
-	n := int(binary.BigEndian.Uint16(b[5:7]))
-	if 7+n > len(b) {
+	out = make([]byte, headerLenV2+len(payload))
+	copy(out[0:4], packetMagicV2[:])
+	out[4] = byte(kind)
+	binary.BigEndian.PutUint32(out[5:9], connID)
+	binary.BigEndian.PutUint16(out[9:11], uint16(len(payload)))
+	copy(out[headerLenV2:], payload)
+	return
+}
+
+// DecodePacket decodes a packet of either version.
+func DecodePacket(b []byte) (p *Packet, err error) {
+	if len(b) < headerLenV1 {
 		err = ErrMalformedPacket
 		return
 	}
 
-	p = &Packet{
-		Kind:    kind,
-		Payload: b[7 : 7+n],
+	var magic [4]byte
+	copy(magic[:], b[0:4])
+
+	switch magic {
+	case packetMagic:
+		n := int(binary.BigEndian.Uint16(b[5:7]))
+		if headerLenV1+n > len(b) {
+			err = ErrMalformedPacket
+			return
+		}
+		p = &Packet{
+			Version: 1,
+			Kind:    PacketKind(b[4]),
+			Payload: b[headerLenV1 : headerLenV1+n],
+		}
+
+	case packetMagicV2:
+		if len(b) < headerLenV2 {
+			err = ErrMalformedPacket
+			return
+		}
+		n := int(binary.BigEndian.Uint16(b[9:11]))
+		if headerLenV2+n > len(b) {
+			err = ErrMalformedPacket
+			return
+		}
+		p = &Packet{
+			Version: 2,
+			Kind:    PacketKind(b[4]),
+			ConnID:  binary.BigEndian.Uint32(b[5:9]),
+			Payload: b[headerLenV2 : headerLenV2+n],
+		}
+
+	default:
+		err = ErrNotOurPacket
 	}
 	return
 }
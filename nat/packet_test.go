@@ -27,3 +27,23 @@ func TestPacketRejectsForeignData(t *testing.T) {
 	_, err := nat.DecodePacket([]byte("foreign payload"))
 	assert.ErrorIs(t, err, nat.ErrNotOurPacket)
 }
+
+func TestConnPacketRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("hello")
+	wire, err := nat.EncodeConnPacket(nat.PacketData, 0xdeadbeef, payload)
+	assert.NoError(t, err)
+
+	pkt, err := nat.DecodePacket(wire)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint8(2), pkt.Version)
+	assert.Equal(t, nat.PacketData, pkt.Kind)
+	assert.Equal(t, uint32(0xdeadbeef), pkt.ConnID)
+	assert.Equal(t, payload, pkt.Payload)
+
+	// Truncated headers are rejected.
+	_, err = nat.DecodePacket(wire[:9])
+	assert.ErrorIs(t, err, nat.ErrMalformedPacket)
+}
@@ -14,4 +14,9 @@ type Peer struct {
 	Candidates []*net.UDPAddr
 
 	LocalAddr *net.UDPAddr
+
+	// MappedPorts are the peer's external ports observed by successive STUN
+	// probes, oldest first (see NATResult.MappedPorts). PortPrediction uses
+	// them to guess the ports a symmetric NAT will allocate next.
+	MappedPorts []int
 }
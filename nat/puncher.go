@@ -2,7 +2,9 @@ package nat
 
 import (
 	"context"
+	"log/slog"
 	"net"
+	"slices"
 	"sync"
 	"time"
 )
@@ -15,14 +17,58 @@ const (
 	NATEndpointDependent   NATBehavior = "endpoint-dependent-like"
 )
 
+// CandidateType tells where the address a hole was punched to came from.
+type CandidateType string
+
+const (
+	// CandidateHost is the peer's private address, Peer.LocalAddr.
+	CandidateHost CandidateType = "host"
+
+	// CandidateServerReflexive is one of the peer's public addresses,
+	// Peer.Addr or Peer.Candidates.
+	CandidateServerReflexive CandidateType = "srflx"
+
+	// CandidatePredicted is an address added by the PunchStrategy.
+	CandidatePredicted CandidateType = "predicted"
+
+	// CandidatePeerReflexive is an address the peer reached us from that
+	// was not probed, such as a new mapping of the peer's NAT.
+	CandidatePeerReflexive CandidateType = "prflx"
+)
+
 // PunchResult represents the outcome of a hole punching attempt.
 type PunchResult struct {
 	Addr   *net.UDPAddr // observed remote addr that reached us
 	PeerID string
 
+	// CandidateType tells which kind of candidate Addr is.
+	CandidateType CandidateType
+
 	// Behavior is a best-effort heuristic based on observed address changes.
 	// Note: with only two peers (no STUN server) this cannot be definitive.
 	Behavior NATBehavior
+
+	// LocalConnID and RemoteConnID are the connection IDs negotiated in the
+	// handshake. Both are zero if the peer only supports address-based packets.
+	// Otherwise LocalConnID stays registered on the Mux, to be taken over by
+	// NewConnSession.
+	LocalConnID  uint32
+	RemoteConnID uint32
+
+	// RTT is the round trip from a HELLO to Addr to the ACK answering it.
+	// It is zero if the hole was punched by the peer's HELLO, or if the
+	// peer does not echo the HELLO's timestamp.
+	RTT time.Duration
+
+	// Encoding is the MessageEncoding the peer used in the handshake.
+	// Sessions created from the result start out with it.
+	Encoding MessageEncoding
+
+	// Mux is the Mux the hole was punched on. It is the Puncher's Mux, one
+	// added with AddMux, or, if birthday punching succeeded on one of the
+	// extra sockets, that socket's Mux, which the caller then owns and
+	// closes, together with its socket, once done.
+	Mux *Mux
 }
 
 type punchState int
@@ -43,8 +89,39 @@ type Puncher struct {
 
 	// steadyInterval is used after peer is known (less spammy).
 	steadyInterval time.Duration
+
+	// connOpts configures the queue registered for the local connection ID.
+	connOpts QueueOptions
+
+	// strategy adds remote addresses to probe; see SetStrategy.
+	strategy PunchStrategy
+
+	// localGrace is how long a public candidate's success waits for the
+	// peer's private address to answer as well; see SetLocalGrace.
+	localGrace time.Duration
+
+	// Birthday punching: extra local sockets; see SetBirthdaySockets.
+	birthdaySockets int
+	listen          ListenFunc
+
+	// muxes are further Muxes to punch from, such as one per address
+	// family; see AddMux.
+	muxes []*Mux
+
+	// attemptDelay staggers the first HELLO to each candidate; see
+	// SetAttemptDelay.
+	attemptDelay time.Duration
+
+	// logger overrides the Mux logger; see SetLogger.
+	logger *slog.Logger
+
+	// onEvent receives progress events; see SetEventHandler.
+	onEvent func(PunchEvent)
 }
 
+// ListenFunc opens a local socket, such as one from net.ListenUDP.
+type ListenFunc func() (PacketConn, error)
+
 // NewPuncher creates a new Puncher.
 // interval is treated as the "steady" interval. init interval becomes smaller.
 func NewPuncher(mux *Mux, selfID string, interval time.Duration) *Puncher {
@@ -60,11 +137,145 @@ func NewPuncher(mux *Mux, selfID string, interval time.Duration) *Puncher {
 		selfID:         selfID,
 		initInterval:   init,
 		steadyInterval: interval,
+		localGrace:     interval,
+	}
+}
+
+// SetLocalGrace sets how long Punch waits for the peer's private address
+// (Peer.LocalAddr) to answer once a public candidate has. The private address
+// wins if it answers within that time, unless the HELLO→ACK round trips of
+// both were measured and the public one was shorter, so peers behind the same
+// NAT talk directly when that is the faster path. It defaults to the interval
+// passed to NewPuncher.
+func (p *Puncher) SetLocalGrace(d time.Duration) {
+	if d > 0 {
+		p.localGrace = d
+	}
+}
+
+// SetLogger sets the logger for Punch: state transitions and results at
+// info level, candidates probed and messages received at debug level, and
+// failures to send at warn level. If l is nil, the logger of the Mux is used.
+func (p *Puncher) SetLogger(l *slog.Logger) {
+	p.logger = l
+}
+
+// log returns the logger of the Puncher, or that of its Mux.
+func (p *Puncher) log() *slog.Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+	return p.mux.log()
+}
+
+// SetEventHandler sets a callback for the events of Punch, for example to
+// show progress or to record traces with PunchTracer.
+// The callback is invoked synchronously, possibly from several goroutines
+// at once, and must not block.
+func (p *Puncher) SetEventHandler(fn func(PunchEvent)) {
+	p.onEvent = fn
+}
+
+// emit delivers ev to the event handler, if set.
+func (p *Puncher) emit(ev PunchEvent) {
+	if p.onEvent == nil {
+		return
+	}
+	ev.Time = time.Now()
+	p.onEvent(ev)
+}
+
+// SetStrategy sets a strategy that adds remote addresses to probe while the
+// peer has not been heard from, such as PortPrediction or BirthdayProbe.
+func (p *Puncher) SetStrategy(strategy PunchStrategy) {
+	p.strategy = strategy
+}
+
+// AddMux adds a Mux to punch from, for hosts with one socket per address
+// family instead of a dual-stack socket. Punch sends to every candidate from
+// each Mux that can reach its family and listens on all of them; the hole
+// may be punched on m (see PunchResult.Mux). m must be started, and stays
+// owned by the caller.
+func (p *Puncher) AddMux(m *Mux) {
+	p.muxes = append(p.muxes, m)
+}
+
+// SetAttemptDelay makes Punch race the peer's candidates the way Happy
+// Eyeballs (RFC 8305) races connection attempts: the private address
+// (Peer.LocalAddr) comes first, the other candidates follow by alternating
+// address family, starting with IPv6, and the first HELLO to each is sent
+// d after the previous candidate's, unless the peer has been heard from by
+// then. Started candidates keep being probed every round, and the first to
+// answer wins. DefaultAttemptDelay is the delay the RFC recommends. Zero,
+// the default, probes all candidates at once.
+func (p *Puncher) SetAttemptDelay(d time.Duration) {
+	p.attemptDelay = max(d, 0)
+}
+
+// muxFor returns the Mux to send to addr from: the Puncher's own if it can
+// reach the family of addr, otherwise the first such Mux added with AddMux.
+func (p *Puncher) muxFor(addr *net.UDPAddr) *Mux {
+	if addr == nil || p.mux.canSend(addr) {
+		return p.mux
 	}
+	for _, m := range p.muxes {
+		if m.canSend(addr) {
+			return m
+		}
+	}
+	return p.mux
+}
+
+// allocConn reserves a connection ID that is free on the Puncher's Mux and
+// on those added with AddMux, and registers it on all of them.
+// It returns zero if one of them is closed.
+func (p *Puncher) allocConn() uint32 {
+	for {
+		id := p.mux.allocConn(p.connOpts)
+		if id == 0 {
+			return 0
+		}
+
+		registered := []*Mux{p.mux}
+		free := true
+		for _, m := range p.muxes {
+			if _, created := m.registerConn(id, p.connOpts); !created {
+				free = false
+				break
+			}
+			registered = append(registered, m)
+		}
+		if free {
+			return id
+		}
+
+		for _, m := range registered {
+			m.UnregisterConn(id)
+		}
+		if slices.ContainsFunc(p.muxes, (*Mux).isClosed) {
+			return 0
+		}
+	}
+}
+
+// SetBirthdaySockets makes Punch open n extra local sockets with listen and
+// send HELLO from each of them to the peer every round, in addition to the
+// Puncher's own Mux. Behind a symmetric NAT, every socket gets a different
+// external port, which the peer can hit with BirthdayProbe.
+//
+// If listen is nil, sockets are opened on the IP address of the Puncher's Mux.
+// Sockets that fail to open are skipped. The extra sockets are closed when
+// Punch returns, except the one the hole was punched on (see PunchResult.Mux).
+func (p *Puncher) SetBirthdaySockets(n int, listen ListenFunc) {
+	p.birthdaySockets = n
+	p.listen = listen
 }
 
 // Punch attempts to establish reachability with the given peer.
 //
+// The peer's private address (Peer.LocalAddr) is probed along with its public
+// candidates and preferred over them; see SetLocalGrace.
+//
 // Design notes (important):
 //   - We ALWAYS listen on both Control() and ControlFor(selfID). Do NOT gate listening by state.
 //     Gating causes ACK loss depending on timing (Accept sends ACK with ToPeerID set).
@@ -73,56 +284,126 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Reserve the connection ID we announce; it is released unless a
+	// connection-ID session can take it over.
+	localID := p.allocConn()
+	if localID == 0 {
+		return nil, ErrConnectionClosed
+	}
+	start := time.Now()
+	rec := p.mux.metrics()
+	rec.Add(metricPunchAttempts, 1)
+	keepLocalID := false
+	var winner *Mux
+	owned := append([]*Mux{p.mux}, p.muxes...)
+	defer func() {
+		for _, m := range owned {
+			if !keepLocalID || m != winner {
+				m.UnregisterConn(localID)
+			}
+		}
+	}()
+
 	// --- shared mutable observed state ---
 	var mu sync.Mutex
 	state := stateInit
 
 	remoteAddr := (*net.UDPAddr)(nil)
+	// remoteMux is the Mux the peer was last heard on, from remoteAddr.
+	var remoteMux *Mux
 	peerID := ""
 	if peer != nil {
 		remoteAddr = peer.Addr
 		peerID = peer.ID
 	}
+	log := p.log().With("self", p.selfID, "peer", peerID)
 
-	// ICE-lite candidates
+	// ICE-lite candidates, with their types by address. The private address
+	// comes first so that it is probed first.
 	var candidates []*net.UDPAddr
-	if peer != nil {
-		if peer.Addr != nil {
-			candidates = append(candidates, peer.Addr)
+	candidateTypes := make(map[string]CandidateType)
+	addCandidate := func(c *net.UDPAddr, typ CandidateType) {
+		if c == nil {
+			return
 		}
+		if _, dup := candidateTypes[c.String()]; dup {
+			return
+		}
+		candidates = append(candidates, c)
+		candidateTypes[c.String()] = typ
+	}
+	if peer != nil {
+		addCandidate(peer.LocalAddr, CandidateHost)
+		addCandidate(peer.Addr, CandidateServerReflexive)
 		for _, c := range peer.Candidates {
-			if c == nil {
-				continue
-			}
-			dup := false
-			for _, e := range candidates {
-				if e.String() == c.String() {
-					dup = true
-					break
-				}
-			}
-			if !dup {
-				candidates = append(candidates, c)
-			}
+			addCandidate(c, CandidateServerReflexive)
+		}
+	}
+	hasHost := peer != nil && peer.LocalAddr != nil
+
+	// With an attempt delay, candidates start one by one in Happy Eyeballs
+	// order, after the private address; candidates[:started] have been sent to.
+	started := len(candidates)
+	if p.attemptDelay > 0 && len(candidates) > 1 {
+		public := 0
+		if hasHost {
+			public = 1
+		}
+		candidates = append(candidates[:public:public], interleaveFamilies(candidates[public:])...)
+		started = 1
+	}
+	log.Debug("nat: punch started", "candidates", candidates, "conn_id", localID)
+	p.emit(PunchEvent{Type: PunchStarted, PeerID: peerID, Candidates: slices.Clone(candidates), Local: p.mux.LocalAddr()})
+
+	// candidateType classifies an address the peer answered from.
+	candidateType := func(addr *net.UDPAddr) CandidateType {
+		mu.Lock()
+		defer mu.Unlock()
+		if typ, ok := candidateTypes[addr.String()]; ok {
+			return typ
+		}
+		return CandidatePeerReflexive
+	}
+
+	// The encoding of the messages the peer sent; until it has answered,
+	// binary HELLOs go out together with JSON ones for older peers.
+	var heard bool
+	peerEncoding := p.mux.messageEncoding()
+	helloEncodings := func() []MessageEncoding {
+		mu.Lock()
+		defer mu.Unlock()
+		if heard || peerEncoding == MessageEncodingJSON {
+			return []MessageEncoding{peerEncoding}
 		}
+		return []MessageEncoding{MessageEncodingBinary, MessageEncodingJSON}
 	}
 
 	// behavior heuristic bookkeeping
 	var firstObserved *net.UDPAddr
 	behavior := NATUnknown
 
-	setObserved := func(addr *net.UDPAddr, id string) {
+	setObserved := func(mux *Mux, addr *net.UDPAddr, id string) {
+		var events []PunchEvent
+		defer func() {
+			for _, ev := range events {
+				p.emit(ev)
+			}
+		}()
+
 		mu.Lock()
 		defer mu.Unlock()
+		prevBehavior := behavior
 
 		if id != "" {
 			peerID = id
 			if state == stateInit {
 				state = statePeerKnown
+				log.Info("nat: punch peer known", "peer_id", id, "addr", addr)
+				events = append(events, PunchEvent{Type: PunchPeerKnown, PeerID: id, Addr: addr, Local: mux.LocalAddr()})
 			}
 		}
 
-		if addr != nil {
+		if addr != nil && candidateTypes[addr.String()] != CandidateHost {
 			if firstObserved == nil {
 				firstObserved = addr
 			} else if firstObserved.String() != addr.String() {
@@ -130,19 +411,28 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 				// With only two peers, this is merely suggestive of endpoint-dependent behavior.
 				behavior = NATEndpointDependent
 			}
+		}
+
+		if addr != nil && (remoteAddr == nil || remoteAddr.String() != addr.String()) {
 			// keep remoteAddr current and alias for inbound demux continuity
-			if remoteAddr == nil || remoteAddr.String() != addr.String() {
-				if remoteAddr != nil {
-					p.mux.Alias(remoteAddr, addr)
-				}
-				remoteAddr = addr
+			if remoteAddr != nil && mux == p.mux {
+				p.mux.Alias(remoteAddr, addr)
 			}
+			log.Debug("nat: punch remote address changed", "from", remoteAddr, "to", addr)
+			events = append(events, PunchEvent{Type: PunchAddressChanged, PeerID: peerID, Addr: addr, Prev: remoteAddr, Local: mux.LocalAddr()})
+			remoteAddr = addr
+		}
+		if addr != nil {
+			remoteMux = mux
 		}
 
 		if behavior == NATUnknown && firstObserved != nil {
 			// If we never observed changes, call it "endpoint-independent-like" heuristically.
 			behavior = NATEndpointIndependent
 		}
+		if behavior != prevBehavior {
+			events = append(events, PunchEvent{Type: PunchBehaviorInferred, PeerID: peerID, Addr: addr, Behavior: behavior})
+		}
 	}
 
 	getSnapshot := func() (st punchState, id string, addr *net.UDPAddr, cands []*net.UDPAddr, beh NATBehavior) {
@@ -161,17 +451,40 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 		return
 	}
 
-	// --- result signaling (once) ---
-	resultCh := make(chan *PunchResult, 1)
-	var once sync.Once
-	succeed := func(addr *net.UDPAddr, id string) {
-		once.Do(func() {
-			_, _, _, _, beh := getSnapshot()
-			resultCh <- &PunchResult{Addr: addr, PeerID: id, Behavior: beh}
-			mu.Lock()
-			state = stateDone
-			mu.Unlock()
-		})
+	// sendMux returns the Mux to send to addr from: the one the peer was
+	// heard on if addr is where it was heard from, since the hole is only
+	// known to be open from that socket.
+	sendMux := func(addr *net.UDPAddr) *Mux {
+		mu.Lock()
+		defer mu.Unlock()
+		if remoteMux != nil && sameAddr(addr, remoteAddr) {
+			return remoteMux
+		}
+		return p.muxFor(addr)
+	}
+
+	// --- result signaling ---
+	// Every success is reported; the main loop picks the result.
+	resultCh := make(chan *PunchResult, 8)
+	succeed := func(mux *Mux, addr *net.UDPAddr, id string, remoteID uint32, enc MessageEncoding, rtt time.Duration) {
+		_, _, _, _, beh := getSnapshot()
+		res := &PunchResult{
+			Addr:          addr,
+			PeerID:        id,
+			CandidateType: candidateType(addr),
+			Behavior:      beh,
+			RTT:           rtt,
+			Encoding:      enc,
+			Mux:           mux,
+		}
+		if remoteID != 0 {
+			res.LocalConnID = localID
+			res.RemoteConnID = remoteID
+		}
+		select {
+		case resultCh <- res:
+		default:
+		}
 	}
 
 	// --- channels ---
@@ -180,6 +493,7 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 
 	// If we know at least one candidate, also register address-based channels (helps when control demux misses).
 	// We register each candidate with its own queue and fan-in in receive loop.
+	// Registrations created here are released when Punch returns; a Session takes over afterwards.
 	type addrListen struct {
 		addr *net.UDPAddr
 		ch   <-chan inbound
@@ -188,46 +502,76 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 	{
 		_, _, _, cands, _ := getSnapshot()
 		for _, a := range cands {
+			q, created := p.mux.register(a, QueueOptions{Size: 16})
+			if created {
+				defer p.mux.unregister(a, q.ch)
+			}
 			addrListens = append(addrListens, addrListen{
 				addr: a,
-				ch:   p.mux.Register(a, 16),
+				ch:   q.ch,
 			})
 		}
 	}
 
-	handleInbound := func(inb inbound) {
-		if inb.pkt.Kind != PacketControl {
+	// closedCh is closed if the Mux shuts down while punching.
+	closedCh := make(chan struct{})
+	var closeOnce sync.Once
+	muxClosed := func() {
+		closeOnce.Do(func() {
+			close(closedCh)
+		})
+	}
+
+	handleInbound := func(mux *Mux, inb inbound) {
+		if !inb.pkt.Kind.isControl() {
 			return
 		}
-		msg, err := DecodeMessage(inb.pkt.Payload)
+		msg, err := DecodePacketMessage(inb.pkt)
 		if err != nil {
+			log.Debug("nat: punch ignoring undecodable control message", "from", inb.addr, "err", err)
 			return
 		}
 		if msg.ToPeerID != "" && msg.ToPeerID != p.selfID {
+			log.Debug("nat: punch ignoring message for another peer", "from", inb.addr, "to_peer_id", msg.ToPeerID)
 			return
 		}
+		mu.Lock()
+		heard = true
+		peerEncoding = encodingOf(inb.pkt.Kind)
+		mu.Unlock()
 
 		switch msg.Type {
 		case MessageHello:
 			// learn peer and reply ack
-			setObserved(inb.addr, msg.PeerID)
+			log.Debug("nat: punch hello received", "from", inb.addr, "local", mux.LocalAddr())
+			p.emit(PunchEvent{Type: PunchHelloReceived, PeerID: msg.PeerID, Addr: inb.addr, Local: mux.LocalAddr(), CandidateType: candidateType(inb.addr)})
+			setObserved(mux, inb.addr, msg.PeerID)
 
 			ack := &Message{
 				Type:      MessageAck,
 				PeerID:    p.selfID,
 				ToPeerID:  msg.PeerID,
 				Timestamp: time.Now().UnixNano(),
+				Echo:      msg.Timestamp,
+				ConnID:    localID,
 			}
-			if payload, err := EncodeMessage(ack); err == nil {
-				_ = p.mux.Send(inb.addr, PacketControl, payload)
+			enc := encodingOf(inb.pkt.Kind)
+			if err := mux.sendMessage(inb.addr, ack, enc); err != nil {
+				log.Warn("nat: punch sending ack failed", "to", inb.addr, "err", err)
 			}
 
 			// success on hello-received (prevents half-open)
-			succeed(inb.addr, msg.PeerID)
+			succeed(mux, inb.addr, msg.PeerID, msg.ConnID, enc, 0)
 
 		case MessageAck:
-			setObserved(inb.addr, msg.PeerID)
-			succeed(inb.addr, msg.PeerID)
+			log.Debug("nat: punch ack received", "from", inb.addr, "local", mux.LocalAddr())
+			p.emit(PunchEvent{Type: PunchAckReceived, PeerID: msg.PeerID, Addr: inb.addr, Local: mux.LocalAddr(), CandidateType: candidateType(inb.addr)})
+			setObserved(mux, inb.addr, msg.PeerID)
+			var rtt time.Duration
+			if msg.Echo != 0 {
+				rtt = time.Since(time.Unix(0, msg.Echo))
+			}
+			succeed(mux, inb.addr, msg.PeerID, msg.ConnID, encodingOf(inb.pkt.Kind), rtt)
 		}
 	}
 
@@ -238,19 +582,32 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 			case <-ctx.Done():
 				return
 
-			case inb := <-fallback:
-				handleInbound(inb)
-			case inb := <-dedicated:
-				handleInbound(inb)
+			case inb, ok := <-fallback:
+				if !ok {
+					muxClosed()
+					return
+				}
+				handleInbound(p.mux, inb)
+			case inb, ok := <-dedicated:
+				if !ok {
+					muxClosed()
+					return
+				}
+				handleInbound(p.mux, inb)
 
 			default:
 				// poll addr channels without blocking forever on one
 				// (keeps this loop responsive; small overhead but test-stable)
 				handled := false
-				for _, al := range addrListens {
+				for i := range addrListens {
 					select {
-					case inb := <-al.ch:
-						handleInbound(inb)
+					case inb, ok := <-addrListens[i].ch:
+						if !ok {
+							// Unregistered; stop polling it.
+							addrListens[i].ch = nil
+							continue
+						}
+						handleInbound(p.mux, inb)
 						handled = true
 					default:
 					}
@@ -264,8 +621,41 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 		}
 	}()
 
+	// --- birthday sockets: extra Muxes, each probing from its own port ---
+	sprays := p.openBirthdaySockets(log, localID)
+	defer func() {
+		for _, m := range sprays {
+			if m != winner {
+				_ = m.Close()
+			}
+		}
+	}()
+	for _, m := range append(slices.Clone(p.muxes), sprays...) {
+		go func(m *Mux) {
+			control := m.Control()
+			dedicated := m.ControlFor(p.selfID)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case inb, ok := <-control:
+					if !ok {
+						return
+					}
+					handleInbound(m, inb)
+				case inb, ok := <-dedicated:
+					if !ok {
+						return
+					}
+					handleInbound(m, inb)
+				}
+			}
+		}(m)
+	}
+
 	// --- send strategy (state machine decides interval + destinations) ---
-	sendHelloTo := func(to *net.UDPAddr, toPeerID string) {
+	round := 0
+	sendHelloTo := func(mux *Mux, to *net.UDPAddr, toPeerID string) {
 		if to == nil {
 			return
 		}
@@ -274,10 +664,57 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 			PeerID:    p.selfID,
 			ToPeerID:  toPeerID,
 			Timestamp: time.Now().UnixNano(),
+			ConnID:    localID,
 		}
-		if payload, err := EncodeMessage(hello); err == nil {
-			_ = p.mux.Send(to, PacketControl, payload)
+		var err error
+		for _, enc := range helloEncodings() {
+			if serr := mux.sendMessage(to, hello, enc); serr != nil {
+				err = serr
+			}
+		}
+		if err != nil {
+			log.Warn("nat: punch sending hello failed", "to", to, "err", err)
 		}
+		p.emit(PunchEvent{Type: PunchHelloSent, PeerID: toPeerID, Addr: to, Local: mux.LocalAddr(), CandidateType: candidateType(to), Round: round, Err: err})
+	}
+
+	// sendAll sends HELLO to c from every socket that can reach it.
+	sockets := append(slices.Clone(owned), sprays...)
+	sendAll := func(c *net.UDPAddr, id string) {
+		for _, m := range sockets {
+			if c != nil && m.canSend(c) {
+				sendHelloTo(m, c, id)
+			}
+		}
+	}
+
+	// probe sends one round of HELLOs while the peer has not been heard from:
+	// to every started candidate from every socket, plus the strategy's targets.
+	probe := func(id string, addr *net.UDPAddr, cands []*net.UDPAddr) {
+		cands = cands[:started]
+		log.Debug("nat: punch probing candidates", "round", round, "candidates", cands, "sockets", len(sockets))
+		for _, c := range cands {
+			sendAll(c, id)
+		}
+		// also send to addr (if set but not in candidates for some reason)
+		if addr != nil && !slices.ContainsFunc(candidates, func(c *net.UDPAddr) bool { return sameAddr(c, addr) }) {
+			sendAll(addr, id)
+		}
+		if p.strategy != nil {
+			targets := p.strategy.Targets(peer, round)
+			if len(targets) > 0 {
+				log.Debug("nat: punch probing predicted candidates", "round", round, "count", len(targets))
+			}
+			for _, t := range targets {
+				mu.Lock()
+				if _, ok := candidateTypes[t.String()]; !ok {
+					candidateTypes[t.String()] = CandidatePredicted
+				}
+				mu.Unlock()
+				sendHelloTo(p.muxFor(t), t, id)
+			}
+		}
+		round++
 	}
 
 	// one immediate burst to reduce first-RTT variance
@@ -285,14 +722,52 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 		st, id, addr, cands, _ := getSnapshot()
 		if st == stateInit {
 			// init: spray to all candidates (ICE-lite)
-			for _, c := range cands {
-				sendHelloTo(c, id)
-			}
-			// also send to addr (if set but not in candidates for some reason)
-			sendHelloTo(addr, id)
+			probe(id, addr, cands)
 		} else {
-			sendHelloTo(addr, id)
+			sendHelloTo(sendMux(addr), addr, id)
+		}
+	}
+
+	// stagger fires when the next candidate is due to start.
+	var stagger <-chan time.Time
+	if started < len(candidates) {
+		stagger = time.After(p.attemptDelay)
+	}
+
+	// finish settles on res and the Mux it was punched on.
+	var pending *PunchResult
+	var grace <-chan time.Time
+	finish := func(res *PunchResult) *PunchResult {
+		mu.Lock()
+		state = stateDone
+		mu.Unlock()
+
+		log.Info("nat: punch succeeded", "addr", res.Addr, "candidate", res.CandidateType,
+			"behavior", res.Behavior, "rtt", res.RTT, "remote_conn_id", res.RemoteConnID)
+
+		p.emit(PunchEvent{Type: PunchSucceeded, PeerID: res.PeerID, Addr: res.Addr, Local: res.Mux.LocalAddr(),
+			CandidateType: res.CandidateType, Behavior: res.Behavior, Result: res})
+		rec.Add(metricPunches, 1, "succeeded", behaviorLabel(res.Behavior))
+		rec.Observe(metricPunchConnect, time.Since(start).Seconds(), behaviorLabel(res.Behavior))
+
+		winner = res.Mux
+		keepLocalID = res.LocalConnID != 0 && slices.Contains(owned, winner)
+		if winner != p.mux && res.LocalConnID == 0 {
+			winner.UnregisterConn(localID)
 		}
+		return res
+	}
+
+	// fail reports that punching ended with err.
+	fail := func(typ PunchEventType, err error) error {
+		_, id, _, _, beh := getSnapshot()
+		outcome := "failed"
+		if typ == PunchTimedOut {
+			outcome = "timed_out"
+		}
+		rec.Add(metricPunches, 1, outcome, behaviorLabel(beh))
+		p.emit(PunchEvent{Type: typ, PeerID: id, Round: round, Behavior: beh, Err: err})
+		return err
 	}
 
 	// ticker uses dynamic interval: initInterval until peer known, then steadyInterval
@@ -303,12 +778,52 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 		select {
 		case <-ctx.Done():
 			if ctx.Err() == context.DeadlineExceeded {
-				return nil, ErrPunchTimeout
+				log.Info("nat: punch timed out", "rounds", round)
+				return nil, fail(PunchTimedOut, ErrPunchTimeout)
 			}
-			return nil, ctx.Err()
+			log.Debug("nat: punch cancelled", "err", ctx.Err())
+			return nil, fail(PunchFailed, ctx.Err())
 
 		case res := <-resultCh:
-			return res, nil
+			// A public candidate waits briefly for the private one.
+			if res.CandidateType != CandidateHost && hasHost {
+				if pending == nil {
+					log.Debug("nat: punch waiting for host candidate", "addr", res.Addr, "grace", p.localGrace)
+					pending = res
+					grace = time.After(p.localGrace)
+				}
+				continue
+			}
+			// The private address wins unless both round trips were
+			// measured and the public one was shorter.
+			if pending != nil && res.RTT > 0 && pending.RTT > 0 && pending.RTT < res.RTT {
+				log.Debug("nat: punch host candidate slower", "addr", res.Addr, "rtt", res.RTT, "public_rtt", pending.RTT)
+				return finish(pending), nil
+			}
+			return finish(res), nil
+
+		case <-grace:
+			return finish(pending), nil
+
+		case <-stagger:
+			st, id, _, _, _ := getSnapshot()
+			if st != stateInit {
+				// The peer has been heard from; no need to start more.
+				stagger = nil
+				continue
+			}
+			c := candidates[started]
+			started++
+			log.Debug("nat: punch starting candidate", "addr", c, "started", started, "candidates", len(candidates))
+			sendAll(c, id)
+			stagger = nil
+			if started < len(candidates) {
+				stagger = time.After(p.attemptDelay)
+			}
+
+		case <-closedCh:
+			log.Debug("nat: punch stopped, mux closed")
+			return nil, fail(PunchFailed, ErrConnectionClosed)
 
 		case <-ticker.C:
 			st, id, addr, cands, _ := getSnapshot()
@@ -328,15 +843,48 @@ func (p *Puncher) Punch(ctx context.Context, peer *Peer) (*PunchResult, error) {
 
 			// INIT: send to all candidates (fallback-centric discovery)
 			if st == stateInit {
-				for _, c := range cands {
-					sendHelloTo(c, id)
-				}
-				sendHelloTo(addr, id)
+				probe(id, addr, cands)
 				continue
 			}
 
-			// PEER_KNOWN: send only to the currently best observed addr
-			sendHelloTo(addr, id)
+			// PEER_KNOWN: send only to the currently best observed addr,
+			// and to the private address while waiting for it.
+			sendHelloTo(sendMux(addr), addr, id)
+			if pending != nil && !sameAddr(addr, peer.LocalAddr) {
+				sendHelloTo(p.muxFor(peer.LocalAddr), peer.LocalAddr, id)
+			}
+		}
+	}
+}
+
+// openBirthdaySockets opens the extra sockets configured by SetBirthdaySockets,
+// with localID registered on each of them.
+func (p *Puncher) openBirthdaySockets(log *slog.Logger, localID uint32) []*Mux {
+	if p.birthdaySockets <= 0 {
+		return nil
+	}
+
+	listen := p.listen
+	if listen == nil {
+		var ip net.IP
+		if la, ok := p.mux.LocalAddr().(*net.UDPAddr); ok {
+			ip = la.IP
+		}
+		listen = listenUDP(ip)
+	}
+
+	muxes := make([]*Mux, 0, p.birthdaySockets)
+	for range p.birthdaySockets {
+		conn, err := listen()
+		if err != nil {
+			log.Warn("nat: opening birthday socket failed", "err", err)
+			continue
 		}
+		m := NewMux(conn)
+		m.ownsConn = true
+		m.Start(context.Background())
+		m.registerConn(localID, p.connOpts)
+		muxes = append(muxes, m)
 	}
+	return muxes
 }
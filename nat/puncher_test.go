@@ -3,6 +3,7 @@ package nat_test
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -46,6 +47,174 @@ func TestPuncherHandshake(t *testing.T) {
 		chB <- res
 	}()
 
-	assert.NotNil(t, <-chA)
-	assert.NotNil(t, <-chB)
+	resA, resB := <-chA, <-chB
+	if assert.NotNil(t, resA) && assert.NotNil(t, resB) {
+		assert.Equal(t, nat.CandidateServerReflexive, resA.CandidateType)
+		assert.Equal(t, nat.CandidateServerReflexive, resB.CandidateType)
+	}
+}
+
+// ackingPeer answers every HELLO on a new socket with an ACK after delay,
+// echoing the HELLO's timestamp. If delay is negative, it never answers.
+func ackingPeer(t *testing.T, delay time.Duration) *net.UDPAddr {
+	t.Helper()
+	return ackingPeerEcho(t, delay, true)
+}
+
+// ackingPeerEcho is ackingPeer for a peer that echoes timestamps only if echo
+// is set, like peers built before ACKs carried them.
+func ackingPeerEcho(t *testing.T, delay time.Duration, echo bool) *net.UDPAddr {
+	t.Helper()
+
+	conn := newLocalUDP(t)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := nat.DecodePacket(buf[:n])
+			if err != nil || delay < 0 {
+				continue
+			}
+			msg, err := nat.DecodeMessage(pkt.Payload)
+			if err != nil || msg.Type != nat.MessageHello {
+				continue
+			}
+			ack := &nat.Message{Type: nat.MessageAck, PeerID: "B", ToPeerID: msg.PeerID}
+			if echo {
+				ack.Echo = msg.Timestamp
+			}
+			payload, _ := nat.EncodeMessage(ack)
+			wire, _ := nat.EncodePacket(nat.PacketControl, payload)
+			time.AfterFunc(delay, func() { _, _ = conn.WriteToUDP(wire, from) })
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPunchPrefersLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		public  time.Duration // delay of the public address; negative never answers
+		local   time.Duration // delay of the private address; negative never answers
+		noLocal bool
+		noEcho  bool // the peer does not echo timestamps, so RTTs are unknown
+		want    nat.CandidateType
+	}{
+		{name: "no hairpinning", public: -1, local: 0, want: nat.CandidateHost},
+		{name: "local within grace", public: 120 * time.Millisecond, local: 0, want: nat.CandidateHost},
+		{name: "local slower", public: 0, local: 60 * time.Millisecond, want: nat.CandidateServerReflexive},
+		{name: "local within grace, RTT unknown", public: 0, local: 60 * time.Millisecond, noEcho: true, want: nat.CandidateHost},
+		{name: "local too slow", public: 0, local: time.Second, want: nat.CandidateServerReflexive},
+		{name: "local unreachable", public: 0, local: -1, want: nat.CandidateServerReflexive},
+		{name: "no local addr", public: 0, noLocal: true, want: nat.CandidateServerReflexive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			aConn := newLocalUDP(t)
+			defer aConn.Close()
+			aMux := nat.NewMux(aConn)
+			aMux.Start(ctx)
+
+			peer := &nat.Peer{ID: "B", Addr: ackingPeerEcho(t, tt.public, !tt.noEcho)}
+			if !tt.noLocal {
+				peer.LocalAddr = ackingPeerEcho(t, tt.local, !tt.noEcho)
+			}
+
+			p := nat.NewPuncher(aMux, "A", 30*time.Millisecond)
+			p.SetLocalGrace(300 * time.Millisecond)
+			res, err := p.Punch(ctx, peer)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, res.CandidateType)
+			assert.Equal(t, tt.noEcho, res.RTT == 0)
+			if tt.want == nat.CandidateHost {
+				assert.Equal(t, peer.LocalAddr.String(), res.Addr.String())
+			} else {
+				assert.Equal(t, peer.Addr.String(), res.Addr.String())
+			}
+		})
+	}
+}
+
+func TestPunchSendsFromObservingMux(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a1Conn, a2Conn := newLocalUDP(t), newLocalUDP(t)
+	defer a1Conn.Close()
+	defer a2Conn.Close()
+	a1, a2 := nat.NewMux(a1Conn), nat.NewMux(a2Conn)
+	a1.Start(ctx)
+	a2.Start(ctx)
+
+	// The peer only answers HELLOs from a2, as if only its hole were open.
+	// It counts the HELLOs from each socket after it answered.
+	peerConn := newLocalUDP(t)
+	defer peerConn.Close()
+	var mu sync.Mutex
+	after := map[string]int{}
+	acked := false
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := peerConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := nat.DecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			msg, err := nat.DecodePacketMessage(pkt)
+			if err != nil || msg.Type != nat.MessageHello {
+				continue
+			}
+			mu.Lock()
+			if acked {
+				after[from.String()]++
+			} else if from.String() == a2Conn.LocalAddr().String() {
+				acked = true
+				ack, _ := nat.EncodeMessage(&nat.Message{Type: nat.MessageAck, PeerID: "B", ToPeerID: msg.PeerID})
+				wire, _ := nat.EncodePacket(nat.PacketControl, ack)
+				_, _ = peerConn.WriteToUDP(wire, from)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	// The unreachable private address keeps Punch sending to the peer
+	// during the grace period.
+	p := nat.NewPuncher(a1, "A", 30*time.Millisecond)
+	p.AddMux(a2)
+	p.SetLocalGrace(200 * time.Millisecond)
+	res, err := p.Punch(ctx, &nat.Peer{
+		ID:        "B",
+		Addr:      peerConn.LocalAddr().(*net.UDPAddr),
+		LocalAddr: ackingPeer(t, -1),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Same(t, a2, res.Mux)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// One HELLO from a1 may have been on its way when the peer answered.
+	assert.LessOrEqual(t, after[a1Conn.LocalAddr().String()], 1)
+	assert.GreaterOrEqual(t, after[a2Conn.LocalAddr().String()], 2)
 }
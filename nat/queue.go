@@ -0,0 +1,195 @@
+package nat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBlockTimeout is used by Block when QueueOptions.BlockTimeout is zero.
+const defaultBlockTimeout = 100 * time.Millisecond
+
+// BackpressurePolicy selects what happens when a receive queue is full.
+type BackpressurePolicy int
+
+const (
+	// DropNewest discards the incoming packet. This is the default.
+	DropNewest BackpressurePolicy = iota
+
+	// DropOldest discards the oldest queued packet to make room.
+	DropOldest
+
+	// Block waits for room for up to the block timeout, then drops the packet.
+	// While it waits, the Mux receive loop is stalled for every peer.
+	Block
+)
+
+// String returns the policy name.
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// QueueOptions configures a receive queue.
+type QueueOptions struct {
+	// Size is the queue capacity in packets. Defaults to 32.
+	Size int
+
+	// Policy is applied when the queue is full.
+	Policy BackpressurePolicy
+
+	// BlockTimeout bounds how long Block waits. Defaults to 100ms.
+	BlockTimeout time.Duration
+}
+
+// QueueStats counts what happened to packets offered to a queue.
+type QueueStats struct {
+	// Delivered is the number of packets queued for the reader,
+	// excluding those evicted again by DropOldest.
+	Delivered uint64
+
+	// Dropped is the number of packets discarded by the backpressure policy.
+	Dropped uint64
+
+	// Undecodable is the number of datagrams from the queue's address
+	// that could not be decoded as packets.
+	Undecodable uint64
+}
+
+// packetQueue is a bounded channel of inbound packets with a drop policy.
+type packetQueue struct {
+	ch     chan inbound
+	policy BackpressurePolicy
+
+	// blockTimeout bounds Block waits; zero waits until the queue or the
+	// caller gives up.
+	blockTimeout time.Duration
+
+	// mu guards closing ch against pushes; done is closed first, to end
+	// Block waits so that close does not wait for them.
+	mu       sync.RWMutex
+	closed   bool
+	done     chan struct{}
+	doneOnce sync.Once
+
+	delivered   atomic.Uint64
+	dropped     atomic.Uint64
+	undecodable atomic.Uint64
+}
+
+// newPacketQueue creates a queue, applying defaults to opts.
+func newPacketQueue(opts QueueOptions) *packetQueue {
+	if opts.Size <= 0 {
+		opts.Size = 32
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
+	}
+	return &packetQueue{
+		ch:           make(chan inbound, opts.Size),
+		policy:       opts.Policy,
+		blockTimeout: opts.BlockTimeout,
+		done:         make(chan struct{}),
+	}
+}
+
+// newFallbackQueue creates the fallback control queue of a Mux. It waits for
+// room until the Mux closes, so that bursts of handshake messages are not
+// lost while no Acceptor is reading.
+func newFallbackQueue() *packetQueue {
+	q := newPacketQueue(QueueOptions{Policy: Block})
+	q.blockTimeout = 0
+	return q
+}
+
+// close closes the queue channel. Later pushes drop their packets.
+func (q *packetQueue) close() {
+	q.doneOnce.Do(func() {
+		close(q.done)
+	})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// push offers inb to the queue according to its policy.
+// abort ends a Block wait early. It reports whether inb was queued and how
+// many previously queued packets were evicted to make room for it.
+func (q *packetQueue) push(inb inbound, abort <-chan struct{}) (queued bool, evicted uint64) {
+	defer func() {
+		// Evicted packets were counted as delivered when they were queued.
+		q.delivered.Add(-evicted)
+		q.dropped.Add(evicted)
+		if queued {
+			q.delivered.Add(1)
+		} else {
+			q.dropped.Add(1)
+		}
+	}()
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false, 0
+	}
+
+	select {
+	case q.ch <- inb:
+		return true, 0
+	default:
+	}
+
+	switch q.policy {
+	case DropOldest:
+		for {
+			select {
+			case <-q.ch:
+				evicted++
+			default:
+			}
+			select {
+			case q.ch <- inb:
+				return true, evicted
+			default:
+			}
+		}
+
+	case Block:
+		var timeout <-chan time.Time
+		if q.blockTimeout > 0 {
+			timer := time.NewTimer(q.blockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case q.ch <- inb:
+			return true, 0
+		case <-timeout:
+		case <-abort:
+		case <-q.done:
+		}
+	}
+
+	return false, 0
+}
+
+// stats returns a snapshot of the queue counters.
+func (q *packetQueue) stats() QueueStats {
+	return QueueStats{
+		Delivered:   q.delivered.Load(),
+		Dropped:     q.dropped.Load(),
+		Undecodable: q.undecodable.Load(),
+	}
+}
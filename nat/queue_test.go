@@ -0,0 +1,241 @@
+package nat_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionBackpressure(t *testing.T) {
+	t.Parallel()
+
+	const total = 10
+
+	tests := []struct {
+		name      string
+		opts      nat.QueueOptions
+		readDelay time.Duration
+		check     func(t *testing.T, got []string, st nat.SessionStats)
+	}{
+		{
+			name: "drop newest",
+			opts: nat.QueueOptions{Size: 2, Policy: nat.DropNewest},
+			check: func(t *testing.T, got []string, st nat.SessionStats) {
+				assert.NotEmpty(t, got)
+				assert.Equal(t, "0", got[0])
+				assert.Equal(t, uint64(total-len(got)), st.PacketsDropped)
+			},
+		},
+		{
+			name: "drop oldest",
+			opts: nat.QueueOptions{Size: 2, Policy: nat.DropOldest},
+			check: func(t *testing.T, got []string, st nat.SessionStats) {
+				assert.NotEmpty(t, got)
+				assert.Equal(t, fmt.Sprint(total-1), got[len(got)-1])
+				assert.Equal(t, uint64(total-len(got)), st.PacketsDropped)
+			},
+		},
+		{
+			name:      "block",
+			opts:      nat.QueueOptions{Size: 2, Policy: nat.Block, BlockTimeout: 2 * time.Second},
+			readDelay: 10 * time.Millisecond,
+			check: func(t *testing.T, got []string, st nat.SessionStats) {
+				assert.Len(t, got, total)
+				for i, p := range got {
+					assert.Equal(t, fmt.Sprint(i), p)
+				}
+				assert.Zero(t, st.PacketsDropped)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+			bConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+			defer aConn.Close()
+			defer bConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			mux := nat.NewMux(aConn)
+			mux.Start(ctx)
+			s := nat.NewSessionWithOptions(mux, bConn.LocalAddr().(*net.UDPAddr), tt.opts)
+
+			for i := range total {
+				wire, err := nat.EncodePacket(nat.PacketData, []byte(fmt.Sprint(i)))
+				assert.NoError(t, err)
+				_, err = bConn.WriteToUDP(wire, aConn.LocalAddr().(*net.UDPAddr))
+				assert.NoError(t, err)
+			}
+
+			var got []string
+			if tt.readDelay > 0 {
+				for range total {
+					time.Sleep(tt.readDelay)
+					p, _, err := s.Recv(ctx)
+					assert.NoError(t, err)
+					got = append(got, string(p))
+				}
+			} else {
+				// Let every packet settle before reading anything.
+				assert.Eventually(t, func() bool {
+					ms := mux.Stats()
+					return ms.Delivered+ms.Dropped == total && s.Stats().PacketsReceived == ms.Delivered
+				}, 2*time.Second, 5*time.Millisecond)
+
+				for {
+					recvCtx, cancelRecv := context.WithTimeout(ctx, 50*time.Millisecond)
+					p, _, err := s.Recv(recvCtx)
+					cancelRecv()
+					if err != nil {
+						break
+					}
+					got = append(got, string(p))
+				}
+			}
+
+			tt.check(t, got, s.Stats())
+		})
+	}
+}
+
+func TestMuxDropAccounting(t *testing.T) {
+	t.Parallel()
+
+	aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	bConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	cConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer aConn.Close()
+	defer bConn.Close()
+	defer cConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(aConn)
+	mux.Start(ctx)
+
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+	s := nat.NewSession(mux, bAddr, 4)
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+
+	// Garbage from the session's peer.
+	_, err := bConn.WriteToUDP([]byte("garbage"), aAddr)
+	assert.NoError(t, err)
+
+	// Data from an address nobody registered.
+	wire, err := nat.EncodePacket(nat.PacketData, []byte("stray"))
+	assert.NoError(t, err)
+	_, err = cConn.WriteToUDP(wire, aAddr)
+	assert.NoError(t, err)
+
+	// A valid packet for the session.
+	wire, err = nat.EncodePacket(nat.PacketData, []byte("ok"))
+	assert.NoError(t, err)
+	_, err = bConn.WriteToUDP(wire, aAddr)
+	assert.NoError(t, err)
+
+	got, _, err := s.Recv(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ok"), got)
+
+	assert.Eventually(t, func() bool {
+		return mux.Stats().Received == 3
+	}, time.Second, 5*time.Millisecond)
+
+	ms := mux.Stats()
+	assert.Equal(t, uint64(1), ms.Undecodable)
+	assert.Equal(t, uint64(1), ms.Dropped)
+	assert.Equal(t, uint64(1), ms.Delivered)
+
+	qs, ok := mux.QueueStats(bAddr)
+	assert.True(t, ok)
+	assert.Equal(t, nat.QueueStats{Delivered: 1, Undecodable: 1}, qs)
+	assert.Equal(t, uint64(1), s.Stats().Undecodable)
+
+	_, ok = mux.QueueStats(cConn.LocalAddr().(*net.UDPAddr))
+	assert.False(t, ok)
+}
+
+func TestMuxBlockDoesNotStallRegistrations(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(aConn)
+	mux.Start(ctx)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+	mux.RegisterWithOptions(bAddr, nat.QueueOptions{Size: 1, Policy: nat.Block, BlockTimeout: 3 * time.Second})
+
+	// Nobody reads, so the receive loop blocks on the second packet.
+	for i := range 2 {
+		wire, err := nat.EncodePacket(nat.PacketData, []byte(fmt.Sprint(i)))
+		assert.NoError(t, err)
+		_, err = bConn.WriteToUDP(wire, aConn.LocalAddr().(*net.UDPAddr))
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return mux.Stats().Received == 2
+	}, time.Second, 5*time.Millisecond)
+
+	start := time.Now()
+	mux.Register(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, 1)
+	mux.Unregister(bAddr)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The blocked packet is dropped once its queue is gone.
+	assert.Eventually(t, func() bool {
+		return mux.Stats().Dropped == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestMuxControlFallbackWaits(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(aConn)
+	mux.Start(ctx)
+
+	// More HELLOs than the fallback queue holds arrive before anyone reads.
+	const total = 40
+	for i := range total {
+		payload, err := nat.EncodeMessage(&nat.Message{Type: nat.MessageHello, PeerID: fmt.Sprint(i)})
+		assert.NoError(t, err)
+		wire, err := nat.EncodePacket(nat.PacketControl, payload)
+		assert.NoError(t, err)
+		_, err = bConn.WriteToUDP(wire, aConn.LocalAddr().(*net.UDPAddr))
+		assert.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for range total {
+		select {
+		case <-mux.Control():
+		case <-ctx.Done():
+			assert.FailNow(t, "HELLO lost")
+		}
+	}
+	assert.Zero(t, mux.Stats().Dropped)
+}
@@ -2,29 +2,189 @@ package nat
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/aethiopicuschan/natto/metrics"
+)
+
+const (
+	// byeInterval is how often MessageBye is retransmitted while closing.
+	byeInterval = 100 * time.Millisecond
+
+	// byeTimeout bounds how long Close waits for MessageByeAck.
+	byeTimeout = 500 * time.Millisecond
+
+	// DefaultKeepaliveInterval is the interval StartAdaptiveKeepalive starts
+	// with if none has been set. It is below the shortest UDP binding
+	// lifetimes seen on carrier NATs.
+	DefaultKeepaliveInterval = 15 * time.Second
 )
 
-// Session represents an established path to a peer over a shared Mux.
+// Session represents an established connection to a peer over one or more paths.
+//
+// A Session starts with a single path over the Mux it was created with.
+// Sessions with a connection ID can add more paths with AddPath.
 type Session struct {
-	mux        *Mux
-	remoteAddr *net.UDPAddr
-	in         <-chan inbound
+	// Connection IDs for version 2 packets; both are zero for
+	// address-based sessions.
+	localID  uint32
+	remoteID uint32
+
+	// opts configures registrations on Muxes added by AddPath.
+	opts QueueOptions
+
+	// Packets demultiplexed by the read loops.
+	dataQueue    *packetQueue
+	controlQueue *packetQueue
+
+	// signalQueue holds TCP hole punching offers and answers.
+	signalQueue *packetQueue
 
 	mu                sync.RWMutex
 	closed            bool
+	err               error
 	keepaliveInterval time.Duration
+
+	// keepaliveReset tells a running keepalive goroutine that the interval changed.
+	keepaliveReset chan struct{}
+
+	// Inbound registrations, one per Mux. Each has its own read loop.
+	ins []*muxIn
+
+	// Paths to the peer. paths[0] is the path the Session was created with,
+	// unless its Mux has been closed since.
+	paths  []*path
+	active *path
+	policy MultipathPolicy
+
+	// Outstanding validations of new remote addresses (connection-ID sessions only).
+	challenges map[challengeKey]*pathChallenge
+
+	// Duplicate suppression for redundantly sent data.
+	dedup dedupWindow
+	seq   atomic.Uint64
+
+	// Liveness tracking.
+	idleTimeout  time.Duration
+	quietTimeout time.Duration
+	quietAuto    bool // quietTimeout follows the keepalive interval
+	lastRecv     time.Time
+	onEvent      func(SessionEvent)
+
+	// logger overrides the logger of baseMux, the Mux the Session was
+	// created with; see SetLogger.
+	logger  atomic.Pointer[slog.Logger]
+	baseMux *Mux
+
+	// rec is the Recorder of baseMux when the Session was created, so that
+	// sessions active is decremented where it was incremented.
+	rec metrics.Recorder
+
+	// encoding is the MessageEncoding of control messages sent, that of the
+	// last message received from the peer.
+	encoding atomic.Uint32
+
+	// Traffic counters.
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+
+	done     chan struct{}
+	doneOnce sync.Once
+
+	byeAcked chan struct{}
+	byeOnce  sync.Once
+}
+
+// muxIn is a Session's registration on one Mux.
+type muxIn struct {
+	mux *Mux
+	q   *packetQueue
 }
 
 // NewSession creates a new Session to the given remote address over the Mux.
+// Packets are dropped when the queue is full.
 func NewSession(mux *Mux, remote *net.UDPAddr, queue int) *Session {
-	return &Session{
-		mux:        mux,
-		remoteAddr: remote,
-		in:         mux.Register(remote, queue),
+	return NewSessionWithOptions(mux, remote, QueueOptions{Size: queue})
+}
+
+// NewSessionWithOptions creates a new Session to the given remote address over
+// the Mux. opts applies to the Mux registration and to the session's own data
+// and control queues.
+func NewSessionWithOptions(mux *Mux, remote *net.UDPAddr, opts QueueOptions) *Session {
+	inQueue, _ := mux.register(remote, opts)
+	return newSession(mux, remote, inQueue, 0, 0, opts)
+}
+
+// NewConnSession creates a new Session that is demultiplexed by connection ID.
+//
+// It receives version 2 packets carrying localID, from any address, and sends
+// packets carrying remoteID to remote. If localID is already registered on the
+// Mux (as done by Puncher.Punch), the Session takes over that registration.
+//
+// When packets arrive from a new address, for example after the peer's NAT
+// rebinds or the peer changes networks, the Session sends MessagePathChallenge
+// there and migrates to the address once it answers, emitting SessionMigrated.
+// The challenge only proves that the peer can receive at the new address; the
+// connection ID is sent in clear, so anyone on the path who learns it can
+// make the Session send challenges.
+func NewConnSession(mux *Mux, remote *net.UDPAddr, localID, remoteID uint32, opts QueueOptions) *Session {
+	inQueue, _ := mux.registerConn(localID, opts)
+	return newSession(mux, remote, inQueue, localID, remoteID, opts)
+}
+
+// newSession creates a Session reading from inQueue and starts its read loop.
+func newSession(mux *Mux, remote *net.UDPAddr, inQueue *packetQueue, localID, remoteID uint32, opts QueueOptions) *Session {
+	now := time.Now()
+	primary := &path{
+		mux:         mux,
+		remote:      remote,
+		validated:   true,
+		validatedCh: closedSignal(),
+		lastRecv:    now,
+	}
+	in := &muxIn{mux: mux, q: inQueue}
+
+	s := &Session{
+		localID:        localID,
+		remoteID:       remoteID,
+		opts:           opts,
+		dataQueue:      newPacketQueue(opts),
+		controlQueue:   newPacketQueue(opts),
+		signalQueue:    newPacketQueue(QueueOptions{Size: 8}),
+		ins:            []*muxIn{in},
+		paths:          []*path{primary},
+		active:         primary,
+		challenges:     make(map[challengeKey]*pathChallenge),
+		keepaliveReset: make(chan struct{}, 1),
+		lastRecv:       now,
+		baseMux:        mux,
+		rec:            mux.metrics(),
+		done:           make(chan struct{}),
+		byeAcked:       make(chan struct{}),
 	}
+	s.setEncoding(mux.messageEncoding())
+	s.rec.Add(metricSessionsActive, 1)
+	go s.readLoop(in)
+	return s
+}
+
+// LocalConnID returns the connection ID this session receives on,
+// or zero for an address-based session.
+func (s *Session) LocalConnID() uint32 {
+	return s.localID
+}
+
+// RemoteConnID returns the connection ID this session sends to,
+// or zero for an address-based session.
+func (s *Session) RemoteConnID() uint32 {
+	return s.remoteID
 }
 
 // -----------------------------------------------------------------------------
@@ -32,64 +192,67 @@ func NewSession(mux *Mux, remote *net.UDPAddr, queue int) *Session {
 // -----------------------------------------------------------------------------
 
 // SendData sends application data to the remote peer.
+//
+// With the Redundant multipath policy, the data is sent over every validated
+// path and the peer delivers the first copy to arrive.
 func (s *Session) SendData(p []byte) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
 		return ErrConnectionClosed
 	}
-	return s.mux.Send(s.remoteAddr, PacketData, p)
+	if s.policy == Redundant {
+		if paths := s.validatedPaths(); len(paths) > 1 {
+			return s.sendRedundant(paths, p)
+		}
+	}
+	return s.sendOn(s.active, PacketData, p)
 }
 
 // RecvData receives application data from the remote peer.
+// Once the session is over, it returns the reason reported by Err.
 func (s *Session) RecvData(ctx context.Context) ([]byte, *net.UDPAddr, error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-
-		case inb, ok := <-s.in:
-			if !ok {
-				return nil, nil, ErrConnectionClosed
-			}
-			if inb.pkt.Kind != PacketData {
-				continue
-			}
-			return inb.pkt.Payload, inb.addr, nil
-		}
-	}
+	return s.recv(ctx, s.dataQueue.ch)
 }
 
 // -----------------------------------------------------------------------------
 // Control plane (meta / coordination)
 // -----------------------------------------------------------------------------
 
-// SendControl sends a control packet to the peer.
+// SendControl sends a control packet to the peer over the active path.
+// The peer's RecvControl returns p as is; the Session never interprets it.
 func (s *Session) SendControl(p []byte) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
 		return ErrConnectionClosed
 	}
-	return s.mux.Send(s.remoteAddr, PacketControl, p)
+	return s.sendOn(s.active, PacketControl, p)
 }
 
 // RecvControl receives a control packet from the peer.
+// Session-internal messages (such as MessageBye) are not returned.
 func (s *Session) RecvControl(ctx context.Context) ([]byte, *net.UDPAddr, error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
+	return s.recv(ctx, s.controlQueue.ch)
+}
 
-		case inb, ok := <-s.in:
-			if !ok {
-				return nil, nil, ErrConnectionClosed
-			}
-			if inb.pkt.Kind != PacketControl {
-				continue
-			}
+// recv waits for the next packet on ch.
+// Packets queued before the session ended are still returned.
+func (s *Session) recv(ctx context.Context, ch <-chan inbound) ([]byte, *net.UDPAddr, error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+
+	case inb := <-ch:
+		return inb.pkt.Payload, inb.addr, nil
+
+	case <-s.done:
+		select {
+		case inb := <-ch:
 			return inb.pkt.Payload, inb.addr, nil
+		default:
 		}
+		return nil, nil, s.Err()
 	}
 }
 
@@ -108,21 +271,86 @@ func (s *Session) Recv(ctx context.Context) ([]byte, *net.UDPAddr, error) {
 }
 
 // -----------------------------------------------------------------------------
-// Keepalive (control plane)
+// Keepalive and liveness (control plane)
 // -----------------------------------------------------------------------------
 
 // SetKeepalive sets the keepalive interval for the session.
+// A running keepalive goroutine switches to the new interval.
 func (s *Session) SetKeepalive(interval time.Duration) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.keepaliveInterval = interval
+	s.mu.Unlock()
+
+	select {
+	case s.keepaliveReset <- struct{}{}:
+	default:
+	}
+}
+
+// KeepaliveInterval returns the current keepalive interval.
+func (s *Session) KeepaliveInterval() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keepaliveInterval
+}
+
+// SetIdleTimeout sets how long the session may go without receiving anything
+// from the peer before it is failed with ErrPeerUnreachable.
+// Zero disables the timeout. It is enforced by the keepalive goroutine.
+func (s *Session) SetIdleTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idleTimeout = timeout
+}
+
+// SetQuietTimeout sets how long a path may go without receiving anything
+// before SessionPathQuiet is emitted for it.
+// If zero, three keepalive intervals are used.
+func (s *Session) SetQuietTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quietTimeout = timeout
+	s.quietAuto = false
+}
+
+// SetEventHandler sets a callback for path events.
+// The callback is invoked synchronously and must not block.
+func (s *Session) SetEventHandler(fn func(SessionEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvent = fn
+}
+
+// SetLogger sets the logger for the session: path events and the end of the
+// session at info level, and failures to send control messages at warn
+// level. If l is nil, the logger of the Mux the Session was created with is
+// used.
+func (s *Session) SetLogger(l *slog.Logger) {
+	s.logger.Store(l)
+}
+
+// log returns the logger of the session.
+func (s *Session) log() *slog.Logger {
+	if l := s.logger.Load(); l != nil {
+		return l
+	}
+	return s.baseMux.log()
 }
 
 // StartKeepalive starts the keepalive goroutine.
+//
+// Every interval it sends MessageKeepalive over each validated path, which the
+// peer answers with MessageKeepaliveAck, checks the idle and quiet timeouts,
+// and fails over to another path if the active one has gone quiet.
+// It stops when ctx is done or the session ends.
 func (s *Session) StartKeepalive(ctx context.Context) {
-	s.mu.RLock()
+	s.mu.Lock()
 	interval := s.keepaliveInterval
-	s.mu.RUnlock()
+	if s.quietTimeout <= 0 {
+		s.quietTimeout = 3 * interval
+		s.quietAuto = true
+	}
+	s.mu.Unlock()
 
 	if interval <= 0 {
 		return
@@ -136,32 +364,477 @@ func (s *Session) StartKeepalive(ctx context.Context) {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
-				// keepalive is a control packet with empty payload
-				_ = s.SendControl(nil)
+			case <-s.done:
+				return
+			case <-s.keepaliveReset:
+				s.mu.Lock()
+				if s.keepaliveInterval > 0 {
+					interval = s.keepaliveInterval
+				}
+				if s.quietAuto {
+					s.quietTimeout = 3 * interval
+				}
+				s.mu.Unlock()
+				ticker.Reset(interval)
+			case now := <-ticker.C:
+				if !s.checkLiveness(now) {
+					return
+				}
+				ka := &Message{
+					Type:      MessageKeepalive,
+					Timestamp: now.UnixNano(),
+				}
+
+				s.mu.Lock()
+				probed := s.validatedPaths()
+				for _, p := range probed {
+					p.rtt.expire(now, 2*interval)
+					p.rtt.onSent(ka.Timestamp, now)
+				}
+				s.mu.Unlock()
+
+				for _, p := range probed {
+					if s.sendMessageOn(p, ka) == nil {
+						s.rec.Add(metricKeepalives, 1)
+					}
+				}
 			}
 		}
 	}()
 }
 
+// StartAdaptiveKeepalive starts keepalive like StartKeepalive and tunes its
+// interval to the NAT's binding lifetime.
+//
+// Keepalive starts at the interval set with SetKeepalive, or
+// DefaultKeepaliveInterval. Meanwhile MeasureBindingLifetime runs in the
+// background with opts; once it returns, the interval is set to half the
+// measured lifetime and SessionKeepaliveAdjusted is emitted. If the
+// measurement fails, the starting interval is kept.
+func (s *Session) StartAdaptiveKeepalive(ctx context.Context, opts LifetimeOptions) {
+	if s.KeepaliveInterval() <= 0 {
+		s.SetKeepalive(DefaultKeepaliveInterval)
+	}
+	s.StartKeepalive(ctx)
+
+	go func() {
+		// Stop measuring if the session ends first.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		lifetime, err := MeasureBindingLifetime(ctx, opts)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.log().Warn("nat: session binding lifetime measurement failed", "err", err)
+			}
+			return
+		}
+
+		// A binding that died before the first trial lives less than Step.
+		step := opts.Step
+		if step <= 0 {
+			step = defaultLifetimeStep
+		}
+		interval := max(lifetime, step) / 2
+		s.SetKeepalive(interval)
+
+		s.mu.RLock()
+		fn := s.onEvent
+		s.mu.RUnlock()
+		s.emit(fn, SessionEvent{Type: SessionKeepaliveAdjusted, Interval: interval, Lifetime: lifetime, Time: time.Now()})
+	}()
+}
+
+// checkLiveness evaluates the idle and quiet timeouts at now.
+// It returns false if the session has been failed.
+func (s *Session) checkLiveness(now time.Time) bool {
+	s.mu.Lock()
+	if s.idleTimeout > 0 && now.Sub(s.lastRecv) >= s.idleTimeout {
+		s.mu.Unlock()
+		s.finish(ErrPeerUnreachable)
+		return false
+	}
+
+	var events []SessionEvent
+	for _, p := range s.validatedPaths() {
+		idle := now.Sub(p.lastRecv)
+		if !p.quiet && s.quietTimeout > 0 && idle >= s.quietTimeout {
+			p.quiet = true
+			events = append(events, SessionEvent{Type: SessionPathQuiet, PathID: p.id, Addr: p.remote, Idle: idle, Time: now})
+		}
+	}
+	if ev := s.selectActive(now); ev != nil {
+		events = append(events, *ev)
+	}
+	fn := s.onEvent
+	s.mu.Unlock()
+
+	s.emit(fn, events...)
+	return true
+}
+
+// touch records that a packet has been received from addr on mux at now.
+func (s *Session) touch(mux *Mux, addr *net.UDPAddr, now time.Time) {
+	s.mu.Lock()
+	var events []SessionEvent
+	if p := s.pathFor(mux, addr); p != nil {
+		if p.quiet {
+			p.quiet = false
+			events = append(events, SessionEvent{Type: SessionPathRecovered, PathID: p.id, Addr: p.remote, Idle: now.Sub(p.lastRecv), Time: now})
+		}
+		p.lastRecv = now
+	}
+	s.lastRecv = now
+	fn := s.onEvent
+	s.mu.Unlock()
+
+	s.emit(fn, events...)
+}
+
+// emit logs events and delivers them to fn, if set.
+func (s *Session) emit(fn func(SessionEvent), events ...SessionEvent) {
+	for _, ev := range events {
+		s.logEvent(ev)
+	}
+	if fn == nil {
+		return
+	}
+	for _, ev := range events {
+		fn(ev)
+	}
+}
+
+// logEvent logs ev with the attributes relevant to its type.
+func (s *Session) logEvent(ev SessionEvent) {
+	attrs := []any{"event", ev.Type, "path", ev.PathID, "addr", ev.Addr}
+	switch ev.Type {
+	case SessionMigrated, SessionFailover:
+		attrs = append(attrs, "prev", ev.Prev)
+	case SessionPathQuiet, SessionPathRecovered:
+		attrs = append(attrs, "idle", ev.Idle)
+	case SessionKeepaliveAdjusted:
+		attrs = append(attrs, "interval", ev.Interval, "lifetime", ev.Lifetime)
+	}
+	s.log().Info("nat: session "+string(ev.Type), attrs...)
+}
+
+// Stats returns a snapshot of the session's path quality and traffic counters.
+// Round-trip times are those of the active path; see PathStats for the others.
+func (s *Session) Stats() SessionStats {
+	st := SessionStats{
+		PacketsSent:     s.packetsSent.Load(),
+		PacketsReceived: s.packetsReceived.Load(),
+		PacketsDropped:  s.dataQueue.dropped.Load() + s.controlQueue.dropped.Load(),
+		BytesSent:       s.bytesSent.Load(),
+		BytesReceived:   s.bytesReceived.Load(),
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, in := range s.ins {
+		qs := in.q.stats()
+		st.PacketsDropped += qs.Dropped
+		st.Undecodable += qs.Undecodable
+	}
+	s.active.rtt.fill(&st)
+	if st.PacketsReceived > 0 {
+		st.LastReceived = s.lastRecv
+	}
+	return st
+}
+
+// -----------------------------------------------------------------------------
+// Lifecycle
+// -----------------------------------------------------------------------------
+
 // Close closes the session.
+//
+// The remote peer is notified with MessageBye, and Close waits briefly for
+// MessageByeAck before releasing the Mux registrations. Close is safe to call
+// multiple times.
 func (s *Session) Close() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
 	s.closed = true
+	mux, remote := s.active.mux, s.active.remote
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		// Already ended (e.g. closed by the remote); nothing to announce.
+	default:
+		s.sayBye(mux, remote)
+	}
+	s.finish(ErrConnectionClosed)
+}
+
+// Done returns a channel that is closed when the session ends,
+// either by Close or by the remote peer.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, or nil while it is still open.
+func (s *Session) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
 }
 
-// UpdateRemote updates the remote address used for sending,
-// and aliases the new address to the existing inbound channel.
+// UpdateRemote updates the remote address of the active path.
+// For address-based sessions it also aliases the new address to the existing
+// inbound channel; sessions with a connection ID receive from any address.
 func (s *Session) UpdateRemote(newRemote *net.UDPAddr) {
 	if newRemote == nil {
 		return
 	}
 
-	// Alias new remote address to the existing inbound channel.
-	s.mux.Alias(s.remoteAddr, newRemote)
-
 	s.mu.Lock()
-	s.remoteAddr = newRemote
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+
+	if s.localID == 0 {
+		// Alias new remote address to the existing inbound channel.
+		s.active.mux.Alias(s.active.remote, newRemote)
+	}
+	s.active.remote = newRemote
+}
+
+// sendMessage sends a control message over the active path.
+func (s *Session) sendMessage(msg *Message) error {
+	s.mu.RLock()
+	p := s.active
+	s.mu.RUnlock()
+	return s.sendMessageOn(p, msg)
+}
+
+// sendMessageOn sends a control message over path p.
+func (s *Session) sendMessageOn(p *path, msg *Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrConnectionClosed
+	}
+	return s.sendMessageTo(p.mux, p.remote, msg)
+}
+
+// setEncoding sets the encoding of control messages sent.
+func (s *Session) setEncoding(e MessageEncoding) {
+	s.encoding.Store(uint32(e))
+}
+
+// sendMessageTo encodes msg in the encoding the peer uses and sends it as a
+// PacketMessage to addr via mux, whatever the encoding, so that it is not
+// mistaken for a SendControl payload. Failures are logged.
+func (s *Session) sendMessageTo(mux *Mux, addr *net.UDPAddr, msg *Message) error {
+	_, payload, err := encodeMessage(msg, MessageEncoding(s.encoding.Load()))
+	if err == nil {
+		err = s.sendTo(mux, addr, PacketMessage, payload)
+	}
+	if err != nil {
+		s.log().Warn("nat: session sending control message failed", "type", msg.Type, "to", addr, "err", err)
+	}
+	return err
+}
+
+// sendOn sends a packet over path p. The caller holds s.mu.
+func (s *Session) sendOn(p *path, kind PacketKind, payload []byte) error {
+	return s.sendTo(p.mux, p.remote, kind, payload)
+}
+
+// sendTo sends a packet to addr via mux and updates the traffic counters.
+func (s *Session) sendTo(mux *Mux, addr *net.UDPAddr, kind PacketKind, payload []byte) error {
+	var err error
+	if s.remoteID != 0 {
+		err = mux.SendConn(addr, kind, s.remoteID, payload)
+	} else {
+		err = mux.Send(addr, kind, payload)
+	}
+	if err != nil {
+		return err
+	}
+	s.packetsSent.Add(1)
+	s.bytesSent.Add(uint64(len(payload)))
+	return nil
+}
+
+// sayBye sends MessageBye until it is acknowledged or byeTimeout elapses.
+func (s *Session) sayBye(mux *Mux, remote *net.UDPAddr) {
+	bye := &Message{
+		Type:      MessageBye,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	timeout := time.NewTimer(byeTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(byeInterval)
+	defer ticker.Stop()
+
+	for {
+		_ = s.sendMessageTo(mux, remote, bye)
+
+		select {
+		case <-s.byeAcked:
+			return
+		case <-s.done:
+			return
+		case <-timeout.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finish ends the session with err and releases its Mux registrations.
+// Only the first call has an effect.
+func (s *Session) finish(err error) {
+	s.doneOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.err = err
+		ins := s.ins
+		remote := s.active.remote
+		s.mu.Unlock()
+
+		close(s.done)
+		s.rec.Add(metricSessionsActive, -1)
+		s.logEnd(err, remote)
+		for _, in := range ins {
+			if s.localID != 0 {
+				in.mux.unregisterConn(s.localID, in.q.ch)
+			} else {
+				in.mux.unregister(remote, in.q.ch)
+			}
+		}
+	})
+}
+
+// logEnd logs why the session ended, at a level by how unexpected it is.
+func (s *Session) logEnd(err error, remote *net.UDPAddr) {
+	level := slog.LevelInfo
+	switch {
+	case errors.Is(err, ErrConnectionClosed):
+		level = slog.LevelDebug
+	case errors.Is(err, ErrPeerUnreachable):
+		level = slog.LevelWarn
+	}
+	s.log().Log(context.Background(), level, "nat: session ended", "addr", remote, "conn_id", s.localID, "err", err)
+}
+
+// readLoop demultiplexes inbound packets from one Mux until the session ends.
+func (s *Session) readLoop(in *muxIn) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case inb, ok := <-in.q.ch:
+			if !ok {
+				s.dropMux(in.mux)
+				return
+			}
+			s.handleInbound(in.mux, inb)
+		}
+	}
+}
+
+// handleInbound handles session-internal messages and queues everything else.
+// Full queues are handled according to the session's backpressure policy.
+func (s *Session) handleInbound(mux *Mux, inb inbound) {
+	now := time.Now()
+	s.touch(mux, inb.addr, now)
+	s.packetsReceived.Add(1)
+	s.bytesReceived.Add(uint64(len(inb.pkt.Payload)))
+
+	// A PATH_RESPONSE is checked before its address is challenged again.
+	defer s.observeAddr(mux, inb.addr, now)
+
+	switch inb.pkt.Kind {
+	case PacketData:
+		s.dataQueue.push(inb, s.done)
+
+	case PacketDataSeq:
+		if data, ok := s.deduplicate(inb.pkt.Payload); ok {
+			pkt := *inb.pkt
+			pkt.Kind = PacketData
+			pkt.Payload = data
+			s.dataQueue.push(inbound{pkt: &pkt, addr: inb.addr}, s.done)
+		}
+
+	case PacketControl:
+		// Application payloads are never taken for session messages.
+		s.controlQueue.push(inb, s.done)
+
+	case PacketMessage:
+		msg, err := DecodeMessage(inb.pkt.Payload)
+		if err != nil {
+			s.log().Debug("nat: session ignoring undecodable message", "from", inb.addr, "err", err)
+			return
+		}
+
+		switch msg.Type {
+		case MessageBye, MessageByeAck, MessageKeepalive, MessageKeepaliveAck,
+			MessagePathChallenge, MessagePathResponse, MessageTCPOffer, MessageTCPAnswer:
+			// Answer in the encoding the peer's session messages use.
+			s.setEncoding(payloadEncoding(inb.pkt.Payload))
+		default:
+			s.log().Debug("nat: session ignoring message", "from", inb.addr, "type", msg.Type)
+			return
+		}
+
+		switch msg.Type {
+		case MessageBye:
+			ack := &Message{
+				Type:      MessageByeAck,
+				Timestamp: time.Now().UnixNano(),
+			}
+			_ = s.sendMessageTo(mux, inb.addr, ack)
+
+			s.mu.RLock()
+			reason := ErrRemoteClosed
+			if s.closed {
+				// Both sides are closing at once; keep the local reason.
+				reason = ErrConnectionClosed
+			}
+			s.mu.RUnlock()
+			s.finish(reason)
+
+		case MessageByeAck:
+			s.byeOnce.Do(func() {
+				close(s.byeAcked)
+			})
+
+		case MessageKeepalive:
+			ack := &Message{
+				Type:      MessageKeepaliveAck,
+				Timestamp: time.Now().UnixNano(),
+				Echo:      msg.Timestamp,
+			}
+			_ = s.sendMessageTo(mux, inb.addr, ack)
+
+		case MessageKeepaliveAck:
+			s.mu.Lock()
+			if p := s.pathFor(mux, inb.addr); p != nil {
+				p.rtt.onAck(msg.Echo, now)
+			}
+			s.mu.Unlock()
+
+		case MessagePathChallenge:
+			s.answerChallenge(mux, inb.addr, msg)
+
+		case MessagePathResponse:
+			s.handlePathResponse(mux, inb.addr, msg, now)
+
+		case MessageTCPOffer, MessageTCPAnswer:
+			s.signalQueue.push(inb, s.done)
+		}
+	}
 }
@@ -58,3 +58,530 @@ func TestSessionClose(t *testing.T) {
 	err := s.Send([]byte("x"))
 	assert.Error(t, err)
 }
+
+func TestSessionCloseHandshake(t *testing.T) {
+	t.Parallel()
+
+	aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	bConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	sA := nat.NewSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 4)
+	sB := nat.NewSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 4)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		_, _, err := sB.RecvData(ctx)
+		recvErr <- err
+	}()
+
+	sA.Close()
+
+	select {
+	case <-sB.Done():
+	case <-ctx.Done():
+		assert.FailNow(t, "remote close was not detected")
+	}
+
+	assert.ErrorIs(t, <-recvErr, nat.ErrRemoteClosed)
+	assert.ErrorIs(t, sB.Err(), nat.ErrRemoteClosed)
+	assert.ErrorIs(t, sA.Err(), nat.ErrConnectionClosed)
+	assert.ErrorIs(t, sB.Send([]byte("x")), nat.ErrConnectionClosed)
+
+	// Both registrations are released, so a fresh session can take their place.
+	sA2 := nat.NewSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 4)
+	sB2 := nat.NewSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 4)
+	assert.NoError(t, sA2.Send([]byte("again")))
+
+	got, _, err := sB2.Recv(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("again"), got)
+}
+
+func TestSessionControlNotInterpreted(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a, b := newSessionPair(t, ctx)
+	defer a.Close()
+	defer b.Close()
+
+	// Application payloads that look like session messages reach the peer
+	// as they are, and do not act on its session.
+	for _, p := range []string{
+		`{"type":"bye"}`,
+		`{"type":"keepalive"}`,
+		`{"type":"path-challenge"}`,
+		`{"type":"tcp-offer"}`,
+	} {
+		assert.NoError(t, a.SendControl([]byte(p)))
+		got, _, err := b.RecvControl(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, p, string(got))
+	}
+	assert.NoError(t, b.Err())
+	assert.NoError(t, b.Send([]byte("x")))
+}
+
+func TestSessionMessagesJSON(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	peer := newLocalUDP(t)
+	defer peer.Close()
+
+	mux := nat.NewMux(conn)
+	mux.SetMessageEncoding(nat.MessageEncodingJSON)
+	mux.Start(ctx)
+
+	s := nat.NewSession(mux, peer.LocalAddr().(*net.UDPAddr), 1)
+	s.Close()
+
+	// A JSON session still sends its messages as PacketMessage.
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFromUDP(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pkt, err := nat.DecodePacket(buf[:n])
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, nat.PacketMessage, pkt.Kind)
+	msg, err := nat.DecodePacketMessage(pkt)
+	if assert.NoError(t, err) {
+		assert.Equal(t, nat.MessageBye, msg.Type)
+	}
+	assert.Equal(t, byte('{'), pkt.Payload[0])
+}
+
+func TestSessionEncodingIgnoresOtherMessages(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	peer := newLocalUDP(t)
+	defer peer.Close()
+
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+	s := nat.NewSession(mux, peer.LocalAddr().(*net.UDPAddr), 1)
+
+	// A stray JSON ACK is not a session message, so the session keeps
+	// sending binary.
+	payload, err := nat.EncodeMessage(&nat.Message{Type: nat.MessageAck})
+	assert.NoError(t, err)
+	frame, err := nat.EncodePacket(nat.PacketMessage, payload)
+	assert.NoError(t, err)
+	_, err = peer.WriteToUDP(frame, conn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	s.Close()
+
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFromUDP(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pkt, err := nat.DecodePacket(buf[:n])
+	if !assert.NoError(t, err) {
+		return
+	}
+	msg, err := nat.DecodeMessageBinary(pkt.Payload)
+	if assert.NoError(t, err) {
+		assert.Equal(t, nat.MessageBye, msg.Type)
+	}
+}
+
+func TestSessionKeepaliveLiveness(t *testing.T) {
+	t.Parallel()
+
+	aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	bConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	events := make(chan nat.SessionEvent, 8)
+	sA := nat.NewSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 4)
+	sA.SetEventHandler(func(ev nat.SessionEvent) { events <- ev })
+	sA.SetKeepalive(20 * time.Millisecond)
+	sA.SetQuietTimeout(60 * time.Millisecond)
+	sA.SetIdleTimeout(time.Second)
+	sA.StartKeepalive(ctx)
+
+	// B has no session yet, so A's keepalives go unanswered.
+	select {
+	case ev := <-events:
+		assert.Equal(t, nat.SessionPathQuiet, ev.Type)
+		assert.GreaterOrEqual(t, ev.Idle, 60*time.Millisecond)
+	case <-ctx.Done():
+		assert.FailNow(t, "path quiet was not reported")
+	}
+
+	// Once B answers keepalives, the path recovers and A stays up.
+	sB := nat.NewSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 4)
+	defer sB.Close()
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, nat.SessionPathRecovered, ev.Type)
+	case <-ctx.Done():
+		assert.FailNow(t, "path recovery was not reported")
+	}
+	assert.NoError(t, sA.Err())
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	silent, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer aConn.Close()
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mux := nat.NewMux(aConn)
+	mux.Start(ctx)
+
+	s := nat.NewSession(mux, silent.LocalAddr().(*net.UDPAddr), 4)
+	s.SetKeepalive(20 * time.Millisecond)
+	s.SetIdleTimeout(100 * time.Millisecond)
+	s.StartKeepalive(ctx)
+
+	select {
+	case <-s.Done():
+	case <-ctx.Done():
+		assert.FailNow(t, "idle timeout did not fire")
+	}
+
+	assert.ErrorIs(t, s.Err(), nat.ErrPeerUnreachable)
+	_, _, err := s.RecvData(ctx)
+	assert.ErrorIs(t, err, nat.ErrPeerUnreachable)
+}
+
+func TestConnSessionsShareEndpoint(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+
+	// Two sessions between the same pair of endpoints, told apart by ID only.
+	a1 := nat.NewConnSession(aMux, bAddr, 1, 101, nat.QueueOptions{})
+	a2 := nat.NewConnSession(aMux, bAddr, 2, 102, nat.QueueOptions{})
+	b1 := nat.NewConnSession(bMux, aAddr, 101, 1, nat.QueueOptions{})
+	b2 := nat.NewConnSession(bMux, aAddr, 102, 2, nat.QueueOptions{})
+
+	assert.NoError(t, a1.SendData([]byte("one")))
+	assert.NoError(t, a2.SendData([]byte("two")))
+	assert.NoError(t, b2.SendData([]byte("two back")))
+
+	got, _, err := b1.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("one"), got)
+
+	got, _, err = b2.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("two"), got)
+
+	got, _, err = a2.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("two back"), got)
+
+	// Closing one session leaves the other running.
+	a1.Close()
+	<-b1.Done()
+	assert.ErrorIs(t, b1.Err(), nat.ErrRemoteClosed)
+
+	assert.NoError(t, a2.SendData([]byte("still here")))
+	got, _, err = b2.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("still here"), got)
+}
+
+func TestConnSessionSurvivesRebinding(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	acceptor := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{})
+	type acceptResult struct {
+		sess *nat.Session
+		res  *nat.PunchResult
+		err  error
+	}
+	acceptCh := make(chan acceptResult, 1)
+	go func() {
+		sess, res, err := acceptor.Accept(ctx)
+		acceptCh <- acceptResult{sess, res, err}
+	}()
+
+	sA, resA, err := nat.Dial(ctx, aMux, "peer-a", &nat.Peer{
+		ID:   "peer-b",
+		Addr: bConn.LocalAddr().(*net.UDPAddr),
+	}, nat.DialOptions{Interval: 30 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	acc := <-acceptCh
+	if !assert.NoError(t, acc.err) {
+		return
+	}
+
+	// Both sides agree on the negotiated IDs.
+	assert.NotZero(t, resA.LocalConnID)
+	assert.Equal(t, resA.LocalConnID, acc.res.RemoteConnID)
+	assert.Equal(t, resA.RemoteConnID, acc.res.LocalConnID)
+	assert.Equal(t, resA.LocalConnID, sA.LocalConnID())
+	assert.Equal(t, acc.res.LocalConnID, acc.sess.LocalConnID())
+
+	// B's NAT rebinds: packets now come from a different port.
+	rebound := newLocalUDP(t)
+	defer rebound.Close()
+
+	wire, err := nat.EncodeConnPacket(nat.PacketData, sA.LocalConnID(), []byte("after rebind"))
+	assert.NoError(t, err)
+	_, err = rebound.WriteToUDP(wire, aConn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+
+	got, from, err := sA.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("after rebind"), got)
+	assert.Equal(t, rebound.LocalAddr().String(), from.String())
+}
+
+func TestConnSessionMigration(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+
+	events := make(chan nat.SessionEvent, 4)
+	sA := nat.NewConnSession(aMux, bAddr, 1, 2, nat.QueueOptions{})
+	sA.SetEventHandler(func(ev nat.SessionEvent) { events <- ev })
+	sB := nat.NewConnSession(bMux, aAddr, 2, 1, nat.QueueOptions{})
+
+	assert.NoError(t, sB.SendData([]byte("before")))
+	got, _, err := sA.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("before"), got)
+
+	// B moves to a new socket, as after a NAT rebinding or a network change.
+	// The old session is abandoned without a BYE.
+	movedConn := newLocalUDP(t)
+	defer movedConn.Close()
+	movedMux := nat.NewMux(movedConn)
+	movedMux.Start(ctx)
+	movedAddr := movedConn.LocalAddr().(*net.UDPAddr)
+
+	sB2 := nat.NewConnSession(movedMux, aAddr, 2, 1, nat.QueueOptions{})
+	assert.NoError(t, sB2.SendData([]byte("moved")))
+
+	// The packet is delivered right away, before the new path is validated.
+	got, from, err := sA.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("moved"), got)
+	assert.Equal(t, movedAddr.String(), from.String())
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, nat.SessionMigrated, ev.Type)
+		assert.Equal(t, movedAddr.String(), ev.Addr.String())
+		assert.Equal(t, bAddr.String(), ev.Prev.String())
+	case <-ctx.Done():
+		assert.FailNow(t, "migration was not reported")
+	}
+
+	// Replies now follow B to its new address.
+	assert.NoError(t, sA.SendData([]byte("reply")))
+	got, _, err = sB2.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("reply"), got)
+}
+
+func TestConnSessionSlowPathResponse(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	moved := newLocalUDP(t)
+	defer aConn.Close()
+	defer moved.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	aMux.Start(ctx)
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+
+	events := make(chan nat.SessionEvent, 4)
+	sA := nat.NewConnSession(aMux, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, 1, 2, nat.QueueOptions{})
+	sA.SetEventHandler(func(ev nat.SessionEvent) { events <- ev })
+
+	send := func(kind nat.PacketKind, payload []byte) {
+		wire, err := nat.EncodeConnPacket(kind, 1, payload)
+		assert.NoError(t, err)
+		_, err = moved.WriteToUDP(wire, aAddr)
+		assert.NoError(t, err)
+	}
+	readChallenge := func() []byte {
+		buf := make([]byte, 1500)
+		_ = moved.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := moved.ReadFromUDP(buf)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		pkt, err := nat.DecodePacket(buf[:n])
+		assert.NoError(t, err)
+		msg, err := nat.DecodePacketMessage(pkt)
+		assert.NoError(t, err)
+		assert.Equal(t, nat.MessagePathChallenge, msg.Type)
+		return msg.Challenge
+	}
+
+	// The peer keeps sending from its new address while the first response
+	// is still in flight over a slow link.
+	send(nat.PacketData, []byte("one"))
+	first := readChallenge()
+	time.Sleep(250 * time.Millisecond)
+	send(nat.PacketData, []byte("two"))
+	assert.Equal(t, first, readChallenge(), "retransmits reuse the challenge data")
+
+	// The response to the first challenge still completes the migration.
+	resp, err := nat.EncodeMessageBinary(&nat.Message{Type: nat.MessagePathResponse, Challenge: first})
+	assert.NoError(t, err)
+	send(nat.PacketMessage, resp)
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, nat.SessionMigrated, ev.Type)
+		assert.Equal(t, moved.LocalAddr().String(), ev.Addr.String())
+	case <-ctx.Done():
+		assert.FailNow(t, "migration was not reported")
+	}
+}
+
+func TestConnSessionIgnoresUnansweredChallenge(t *testing.T) {
+	t.Parallel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	spoofer := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+	defer spoofer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	aAddr := aConn.LocalAddr().(*net.UDPAddr)
+	sA := nat.NewConnSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 1, 2, nat.QueueOptions{})
+	sB := nat.NewConnSession(bMux, aAddr, 2, 1, nat.QueueOptions{})
+
+	// A third party that knows the connection ID but does not answer challenges.
+	wire, err := nat.EncodeConnPacket(nat.PacketData, 1, []byte("spoofed"))
+	assert.NoError(t, err)
+	_, err = spoofer.WriteToUDP(wire, aAddr)
+	assert.NoError(t, err)
+
+	_, _, err = sA.RecvData(ctx)
+	assert.NoError(t, err)
+
+	// The challenge reached the spoofer, but A keeps sending to B.
+	buf := make([]byte, 1500)
+	_ = spoofer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := spoofer.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	pkt, err := nat.DecodePacket(buf[:n])
+	assert.NoError(t, err)
+	msg, err := nat.DecodeMessage(pkt.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, nat.MessagePathChallenge, msg.Type)
+	assert.Len(t, msg.Challenge, 8)
+
+	// A wrong answer does not migrate the session either.
+	payload, err := nat.EncodeMessage(&nat.Message{Type: nat.MessagePathResponse, Challenge: []byte("guessed!")})
+	assert.NoError(t, err)
+	wire, err = nat.EncodeConnPacket(nat.PacketControl, 1, payload)
+	assert.NoError(t, err)
+	_, err = spoofer.WriteToUDP(wire, aAddr)
+	assert.NoError(t, err)
+
+	assert.NoError(t, sA.SendData([]byte("to b")))
+	got, _, err := sB.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("to b"), got)
+}
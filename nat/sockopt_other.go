@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd || windows)
+
+package nat
+
+import "syscall"
+
+// reuseControl reports that local ports cannot be shared on this platform.
+func reuseControl(network, address string, c syscall.RawConn) error {
+	return ErrTCPUnsupported
+}
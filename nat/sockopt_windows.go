@@ -0,0 +1,18 @@
+//go:build windows
+
+package nat
+
+import "syscall"
+
+// reuseControl sets SO_REUSEADDR, so that a listener and outgoing
+// connections can share one local TCP port.
+func reuseControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,202 @@
+package nat
+
+import (
+	"net"
+	"time"
+)
+
+// SessionStats is a snapshot of a Session's path quality and traffic counters.
+//
+// Round-trip times are sampled from keepalive exchanges, so they stay zero
+// until keepalive is started and the first MessageKeepaliveAck arrives.
+type SessionStats struct {
+	// SmoothedRTT is the smoothed round-trip time (RFC 6298 SRTT).
+	SmoothedRTT time.Duration
+
+	// RTTVar is the round-trip time variation (RFC 6298 RTTVAR).
+	RTTVar time.Duration
+
+	// MinRTT is the smallest round-trip time observed.
+	MinRTT time.Duration
+
+	// LatestRTT is the most recent round-trip time sample.
+	LatestRTT time.Duration
+
+	// Jitter is the mean deviation between consecutive RTT samples (RFC 3550 style).
+	Jitter time.Duration
+
+	// ProbesSent, ProbesAcked and ProbesLost count keepalive probes.
+	// A probe is lost once it has been outstanding for longer than the probe timeout.
+	ProbesSent  uint64
+	ProbesAcked uint64
+	ProbesLost  uint64
+
+	// Loss is the fraction of resolved probes that were lost, in [0, 1].
+	Loss float64
+
+	// Traffic counters for all packets of the session, data and control.
+	// Byte counts are payload bytes, excluding the packet header.
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+
+	// PacketsDropped counts packets from the peer discarded by a full queue,
+	// in the Mux or in the session itself.
+	PacketsDropped uint64
+
+	// Undecodable counts datagrams from the peer's address that were not valid packets.
+	Undecodable uint64
+
+	// LastReceived is when the last packet from the peer arrived.
+	LastReceived time.Time
+}
+
+// PathStats is a snapshot of the state and quality of one of a Session's paths.
+type PathStats struct {
+	// ID identifies the path. The path a Session was created with has ID zero.
+	ID uint32
+
+	// Local is the local address of the path's Mux.
+	Local net.Addr
+
+	// Remote is the peer's address on this path.
+	Remote *net.UDPAddr
+
+	// Active reports whether the path is the one used for sending.
+	Active bool
+
+	// Validated reports whether the path has answered a path challenge.
+	Validated bool
+
+	// Round-trip times and probe counters, as in SessionStats.
+	SmoothedRTT time.Duration
+	RTTVar      time.Duration
+	MinRTT      time.Duration
+	LatestRTT   time.Duration
+	Jitter      time.Duration
+	ProbesSent  uint64
+	ProbesAcked uint64
+	ProbesLost  uint64
+	Loss        float64
+
+	// LastReceived is when the last packet arrived over this path.
+	LastReceived time.Time
+}
+
+// rttEstimator tracks probe round trips and losses for a single path.
+// It is not safe for concurrent use.
+type rttEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	minRTT  time.Duration
+	latest  time.Duration
+	jitter  time.Duration
+	sampled bool
+
+	sent  uint64
+	acked uint64
+	lost  uint64
+
+	// pending maps probe IDs (the probe's Timestamp) to their send time.
+	pending map[int64]time.Time
+}
+
+// onSent records that probe id was sent at.
+func (e *rttEstimator) onSent(id int64, at time.Time) {
+	if e.pending == nil {
+		e.pending = make(map[int64]time.Time)
+	}
+	e.pending[id] = at
+	e.sent++
+}
+
+// onAck records the acknowledgement of probe id at.
+// Acks for unknown or already expired probes are ignored.
+func (e *rttEstimator) onAck(id int64, at time.Time) {
+	sentAt, ok := e.pending[id]
+	if !ok {
+		return
+	}
+	delete(e.pending, id)
+	e.acked++
+	e.sample(at.Sub(sentAt))
+}
+
+// sample feeds one RTT measurement into the estimators.
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	if !e.sampled {
+		e.sampled = true
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.minRTT = rtt
+		e.latest = rtt
+		return
+	}
+
+	// RFC 6298 section 2.3 with alpha = 1/8 and beta = 1/4.
+	e.rttvar = (3*e.rttvar + absDuration(e.srtt-rtt)) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+
+	// RFC 3550 section 6.4.1 applied to consecutive RTT samples.
+	e.jitter += (absDuration(rtt-e.latest) - e.jitter) / 16
+
+	e.minRTT = min(e.minRTT, rtt)
+	e.latest = rtt
+}
+
+// expire counts probes outstanding for longer than the probe timeout as lost.
+// floor is the smallest timeout used, typically a multiple of the probe interval.
+func (e *rttEstimator) expire(now time.Time, floor time.Duration) {
+	timeout := floor
+	if e.sampled {
+		timeout = max(timeout, e.srtt+4*e.rttvar)
+	}
+	for id, sentAt := range e.pending {
+		if now.Sub(sentAt) > timeout {
+			delete(e.pending, id)
+			e.lost++
+		}
+	}
+}
+
+// fill copies the estimator state into st.
+func (e *rttEstimator) fill(st *SessionStats) {
+	st.SmoothedRTT = e.srtt
+	st.RTTVar = e.rttvar
+	st.MinRTT = e.minRTT
+	st.LatestRTT = e.latest
+	st.Jitter = e.jitter
+	st.ProbesSent = e.sent
+	st.ProbesAcked = e.acked
+	st.ProbesLost = e.lost
+	if resolved := e.acked + e.lost; resolved > 0 {
+		st.Loss = float64(e.lost) / float64(resolved)
+	}
+}
+
+// fillPath copies the estimator state into st.
+func (e *rttEstimator) fillPath(st *PathStats) {
+	var ss SessionStats
+	e.fill(&ss)
+	st.SmoothedRTT = ss.SmoothedRTT
+	st.RTTVar = ss.RTTVar
+	st.MinRTT = ss.MinRTT
+	st.LatestRTT = ss.LatestRTT
+	st.Jitter = ss.Jitter
+	st.ProbesSent = ss.ProbesSent
+	st.ProbesAcked = ss.ProbesAcked
+	st.ProbesLost = ss.ProbesLost
+	st.Loss = ss.Loss
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,116 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		samples    []time.Duration
+		wantSRTT   time.Duration
+		wantVar    time.Duration
+		wantMin    time.Duration
+		wantJitter time.Duration
+	}{
+		{
+			name:     "first sample",
+			samples:  []time.Duration{100 * time.Millisecond},
+			wantSRTT: 100 * time.Millisecond,
+			wantVar:  50 * time.Millisecond,
+			wantMin:  100 * time.Millisecond,
+		},
+		{
+			name:       "second sample",
+			samples:    []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+			wantSRTT:   112500 * time.Microsecond,
+			wantVar:    62500 * time.Microsecond,
+			wantMin:    100 * time.Millisecond,
+			wantJitter: 6250 * time.Microsecond,
+		},
+		{
+			name:       "stable path",
+			samples:    []time.Duration{40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+			wantSRTT:   40 * time.Millisecond,
+			wantVar:    11250 * time.Microsecond,
+			wantMin:    40 * time.Millisecond,
+			wantJitter: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			st := nat.ExportRTTSamples(tt.samples...)
+			assert.Equal(t, tt.wantSRTT, st.SmoothedRTT)
+			assert.Equal(t, tt.wantVar, st.RTTVar)
+			assert.Equal(t, tt.wantMin, st.MinRTT)
+			assert.Equal(t, tt.wantJitter, st.Jitter)
+			assert.Equal(t, tt.samples[len(tt.samples)-1], st.LatestRTT)
+		})
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	t.Parallel()
+
+	aConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	bConn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	silent, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	defer aConn.Close()
+	defer bConn.Close()
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	sA := nat.NewSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 16)
+	sB := nat.NewSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 16)
+	lossy := nat.NewSession(aMux, silent.LocalAddr().(*net.UDPAddr), 16)
+
+	for _, s := range []*nat.Session{sA, lossy} {
+		s.SetKeepalive(10 * time.Millisecond)
+		s.StartKeepalive(ctx)
+	}
+
+	assert.NoError(t, sA.Send([]byte("12345")))
+	_, _, err := sB.Recv(ctx)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return sA.Stats().ProbesAcked >= 3 && lossy.Stats().ProbesLost >= 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	st := sA.Stats()
+	assert.Greater(t, st.SmoothedRTT, time.Duration(0))
+	assert.Greater(t, st.MinRTT, time.Duration(0))
+	assert.LessOrEqual(t, st.MinRTT, st.LatestRTT)
+	assert.GreaterOrEqual(t, st.ProbesSent, st.ProbesAcked)
+	assert.GreaterOrEqual(t, st.PacketsSent, st.ProbesSent+1)
+	assert.GreaterOrEqual(t, st.BytesSent, uint64(5))
+	assert.Greater(t, st.PacketsReceived, uint64(0))
+	assert.WithinDuration(t, time.Now(), st.LastReceived, time.Second)
+
+	stB := sB.Stats()
+	assert.GreaterOrEqual(t, stB.BytesReceived, uint64(5))
+
+	stLossy := lossy.Stats()
+	assert.Equal(t, 1.0, stLossy.Loss)
+	assert.Zero(t, stLossy.ProbesAcked)
+	assert.Zero(t, stLossy.SmoothedRTT)
+	assert.True(t, stLossy.LastReceived.IsZero())
+}
@@ -0,0 +1,166 @@
+package nat
+
+import (
+	"math/rand/v2"
+	"net"
+)
+
+const (
+	// Ports below minEphemeralPort are never predicted or probed.
+	minEphemeralPort = 1024
+	maxPort          = 65535
+)
+
+// PunchStrategy chooses extra remote addresses to send HELLO to while punching,
+// in addition to the peer's address and candidates.
+//
+// Targets is called once per probing round until the peer is heard from,
+// starting with round 0. Returning nil means the strategy's budget is spent.
+type PunchStrategy interface {
+	Targets(peer *Peer, round int) []*net.UDPAddr
+}
+
+// PortPrediction probes the ports a symmetric NAT is likely to allocate next
+// for the peer, predicted from Peer.MappedPorts with PredictPorts.
+//
+// It only helps against NATs that allocate ports in a predictable sequence.
+type PortPrediction struct {
+	// Range is how many predicted ports are probed each round. Defaults to 16.
+	// Each round probes the next Range ports of the predicted sequence, so
+	// later rounds reach further ahead of ports the NAT has meanwhile
+	// allocated to other flows.
+	Range int
+
+	// MaxProbes bounds the total number of HELLOs sent. Defaults to 256.
+	MaxProbes int
+}
+
+// Targets implements PunchStrategy.
+func (s PortPrediction) Targets(peer *Peer, round int) []*net.UDPAddr {
+	if peer == nil || peer.Addr == nil || len(peer.MappedPorts) == 0 {
+		return nil
+	}
+	n := s.Range
+	if n <= 0 {
+		n = 16
+	}
+	budget := s.MaxProbes
+	if budget <= 0 {
+		budget = 256
+	}
+
+	left := budget - round*n
+	if left <= 0 {
+		return nil
+	}
+	ports := PredictPorts(peer.MappedPorts, round*n+min(n, left))
+	if len(ports) <= round*n {
+		// A NAT that keeps the port has a single prediction.
+		return nil
+	}
+	return portAddrs(peer.Addr, ports[round*n:])
+}
+
+// BirthdayProbe probes random ports on the peer's IP address.
+//
+// It is the receiving side of birthday punching: the peer opens many sockets
+// (see Puncher.SetBirthdaySockets), each of which gets its own mapping on the
+// peer's symmetric NAT, and every probe here opens one more mapping on our NAT
+// for the peer to hit. A few hundred probes on each side give a good chance
+// that one pair lines up.
+type BirthdayProbe struct {
+	// PerRound is how many random ports are probed each round. Defaults to 32.
+	PerRound int
+
+	// MaxProbes bounds the total number of HELLOs sent. Defaults to 1024.
+	MaxProbes int
+
+	// Rand is the source of probed ports. If nil, a random source is used.
+	Rand *rand.Rand
+}
+
+// Targets implements PunchStrategy.
+func (s BirthdayProbe) Targets(peer *Peer, round int) []*net.UDPAddr {
+	if peer == nil || peer.Addr == nil {
+		return nil
+	}
+	n := s.PerRound
+	if n <= 0 {
+		n = 32
+	}
+	budget := s.MaxProbes
+	if budget <= 0 {
+		budget = 1024
+	}
+
+	left := budget - round*n
+	if left <= 0 {
+		return nil
+	}
+	n = min(n, left)
+
+	intN := rand.IntN
+	if s.Rand != nil {
+		intN = s.Rand.IntN
+	}
+
+	seen := make(map[int]bool, n)
+	ports := make([]int, 0, n)
+	for len(ports) < n {
+		p := minEphemeralPort + intN(maxPort-minEphemeralPort+1)
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	return portAddrs(peer.Addr, ports)
+}
+
+// PredictPorts predicts the next n ports a NAT will allocate, given the ports
+// it allocated for successive destinations, oldest first.
+//
+// The step is the most common difference between consecutive observations,
+// the latest one winning ties; a single observation assumes a step of 1.
+// If the NAT reused the same port, that port is the only prediction.
+// Predictions wrap around within the ephemeral range 1024-65535.
+func PredictPorts(observed []int, n int) []int {
+	if len(observed) == 0 || n <= 0 {
+		return nil
+	}
+	last := observed[len(observed)-1]
+
+	step := 1
+	if len(observed) > 1 {
+		counts := make(map[int]int)
+		best := 0
+		for i := 1; i < len(observed); i++ {
+			d := observed[i] - observed[i-1]
+			counts[d]++
+			if counts[d] >= best {
+				best = counts[d]
+				step = d
+			}
+		}
+	}
+	if step == 0 {
+		return []int{last}
+	}
+
+	const span = maxPort - minEphemeralPort + 1
+	ports := make([]int, 0, n)
+	for k := 1; k <= n; k++ {
+		p := last + k*step
+		p = ((p-minEphemeralPort)%span+span)%span + minEphemeralPort
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// portAddrs returns addresses on base's IP with the given ports.
+func portAddrs(base *net.UDPAddr, ports []int) []*net.UDPAddr {
+	out := make([]*net.UDPAddr, 0, len(ports))
+	for _, p := range ports {
+		out = append(out, &net.UDPAddr{IP: base.IP, Port: p, Zone: base.Zone})
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+package nat_test
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredictPorts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		observed []int
+		n        int
+		want     []int
+	}{
+		{"none", nil, 4, nil},
+		{"single", []int{5000}, 3, []int{5001, 5002, 5003}},
+		{"sequential", []int{5000, 5001}, 3, []int{5002, 5003, 5004}},
+		{"stride", []int{5000, 5002, 5004}, 2, []int{5006, 5008}},
+		{"most common step", []int{5000, 5004, 5008, 5009, 5013}, 2, []int{5017, 5021}},
+		{"descending", []int{6000, 5999}, 2, []int{5998, 5997}},
+		{"reused", []int{5000, 5000}, 4, []int{5000}},
+		{"wraps", []int{65534, 65535}, 2, []int{1024, 1025}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, nat.PredictPorts(tt.observed, tt.n))
+		})
+	}
+}
+
+func TestStrategyBudgets(t *testing.T) {
+	t.Parallel()
+
+	peer := &nat.Peer{
+		Addr:        &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5001},
+		MappedPorts: []int{5000, 5001},
+	}
+
+	t.Run("port prediction", func(t *testing.T) {
+		s := nat.PortPrediction{Range: 4, MaxProbes: 10}
+		assert.Len(t, s.Targets(peer, 0), 4)
+		assert.Len(t, s.Targets(peer, 1), 4)
+		// The last round spends what is left of the budget.
+		assert.Len(t, s.Targets(peer, 2), 2)
+		assert.Nil(t, s.Targets(peer, 3))
+		assert.Equal(t, 5002, s.Targets(peer, 0)[0].Port)
+		// The next round moves on to the following ports.
+		assert.Equal(t, 5006, s.Targets(peer, 1)[0].Port)
+
+		// A NAT that keeps the port is predicted once.
+		still := &nat.Peer{Addr: peer.Addr, MappedPorts: []int{5001, 5001}}
+		assert.Len(t, s.Targets(still, 0), 1)
+		assert.Nil(t, s.Targets(still, 1))
+	})
+
+	t.Run("birthday", func(t *testing.T) {
+		s := nat.BirthdayProbe{PerRound: 32, MaxProbes: 40, Rand: rand.New(rand.NewPCG(1, 2))}
+		first := s.Targets(peer, 0)
+		assert.Len(t, first, 32)
+		seen := map[int]bool{}
+		for _, a := range first {
+			assert.True(t, a.IP.Equal(peer.Addr.IP))
+			assert.GreaterOrEqual(t, a.Port, 1024)
+			assert.False(t, seen[a.Port], "duplicate port %d", a.Port)
+			seen[a.Port] = true
+		}
+		assert.Len(t, s.Targets(peer, 1), 8)
+		assert.Nil(t, s.Targets(peer, 2))
+	})
+}
+
+func TestDialPortPrediction(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer bConn.Close()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	acceptor := nat.NewAcceptor(bMux, "peer-b", nat.AcceptOptions{})
+	go func() {
+		_, _, _ = acceptor.Accept(ctx)
+	}()
+
+	// B's NAT allocated two ports before the one it now uses for A.
+	bAddr := bConn.LocalAddr().(*net.UDPAddr)
+	peer := &nat.Peer{
+		ID:          "peer-b",
+		Addr:        &net.UDPAddr{IP: bAddr.IP, Port: bAddr.Port - 2},
+		MappedPorts: []int{bAddr.Port - 4, bAddr.Port - 2},
+	}
+
+	sess, pr, err := nat.Dial(ctx, aMux, "peer-a", peer, nat.DialOptions{
+		Interval: 30 * time.Millisecond,
+		Strategy: nat.PortPrediction{Range: 4},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sess.Close()
+	assert.Equal(t, bAddr.String(), pr.Addr.String())
+}
+
+func TestDialBirthdaySockets(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	peerConn := newLocalUDP(t)
+	defer aConn.Close()
+	defer peerConn.Close()
+
+	aMux := nat.NewMux(aConn)
+	aMux.Start(ctx)
+
+	// The peer's NAT only lets in the first of A's extra sockets it sees,
+	// never A's main one.
+	type datagram struct {
+		pkt  *nat.Packet
+		from *net.UDPAddr
+	}
+	data := make(chan datagram, 1)
+	var lucky *net.UDPAddr
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := peerConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := nat.DecodePacket(append([]byte(nil), buf[:n]...))
+			if err != nil {
+				continue
+			}
+			if pkt.Kind == nat.PacketData {
+				data <- datagram{pkt, from}
+				continue
+			}
+			msg, err := nat.DecodeMessage(pkt.Payload)
+			if err != nil || msg.Type != nat.MessageHello || from.Port == aConn.LocalAddr().(*net.UDPAddr).Port {
+				continue
+			}
+			if lucky == nil {
+				lucky = from
+			}
+			if from.String() != lucky.String() {
+				continue
+			}
+			ack, _ := nat.EncodeMessage(&nat.Message{Type: nat.MessageAck, PeerID: "peer-b", ToPeerID: msg.PeerID, ConnID: 7})
+			wire, _ := nat.EncodePacket(nat.PacketControl, ack)
+			_, _ = peerConn.WriteToUDP(wire, from)
+		}
+	}()
+
+	opened := 0
+	sess, pr, err := nat.Dial(ctx, aMux, "peer-a", &nat.Peer{
+		ID:   "peer-b",
+		Addr: peerConn.LocalAddr().(*net.UDPAddr),
+	}, nat.DialOptions{
+		Interval:        30 * time.Millisecond,
+		BirthdaySockets: 4,
+		Listen: func() (nat.PacketConn, error) {
+			opened++
+			return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pr.Mux.Close()
+	defer sess.Close()
+
+	assert.Equal(t, 4, opened)
+	assert.NotSame(t, aMux, pr.Mux)
+	assert.Equal(t, uint32(7), sess.RemoteConnID())
+
+	// The session runs on the winning socket.
+	assert.NoError(t, sess.SendData([]byte("via birthday")))
+	select {
+	case d := <-data:
+		assert.Equal(t, uint32(7), d.pkt.ConnID)
+		assert.Equal(t, []byte("via birthday"), d.pkt.Payload)
+		assert.Equal(t, pr.Mux.LocalAddr().String(), d.from.String())
+	case <-ctx.Done():
+		assert.FailNow(t, "data was not received")
+	}
+}
@@ -0,0 +1,460 @@
+package nat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/aethiopicuschan/natto/stun"
+)
+
+const (
+	// defaultTCPAttemptInterval is how often connects are retried by default.
+	defaultTCPAttemptInterval = 200 * time.Millisecond
+
+	// tcpHandshakeTimeout bounds the token exchange on a new connection.
+	tcpHandshakeTimeout = 2 * time.Second
+)
+
+// tcpMagic starts the token exchange on a punched TCP connection.
+var tcpMagic = [4]byte{'N', 'A', 'T', 'T'}
+
+// Single-byte replies of the token exchange.
+const (
+	tcpAck      byte = 1
+	tcpNominate byte = 2
+)
+
+// TCPOptions configures DialTCP and AcceptTCP.
+type TCPOptions struct {
+	// LocalAddr is the local address to listen and connect from.
+	// If nil or its port is zero, a free port is picked.
+	LocalAddr *net.TCPAddr
+
+	// MappedAddr is the external address of LocalAddr on the NAT, if known
+	// (for example from a port mapping). The peer always also tries the local
+	// port on the IP address it sees the Session's UDP traffic from, which
+	// works for NATs that preserve ports.
+	MappedAddr *net.TCPAddr
+
+	// STUNServer, if set and MappedAddr is nil, is a STUN server reachable over
+	// TCP that MappedAddr is discovered from (see DiscoverTCPMapping).
+	STUNServer string
+
+	// AttemptInterval is how often connects are retried. Defaults to 200ms.
+	AttemptInterval time.Duration
+}
+
+// DialTCP establishes a TCP connection to the peer of an established Session
+// by TCP hole punching (simultaneous open).
+//
+// Both peers listen on a local port and connect from that same port to each
+// other's candidate addresses, which are exchanged over the Session with
+// MessageTCPOffer and MessageTCPAnswer. The peer must call AcceptTCP.
+// Whichever connection is established first is authenticated with a token
+// from the offer; others are closed.
+//
+// It returns ErrPunchTimeout if ctx expires first.
+func DialTCP(ctx context.Context, sess *Session, opts TCPOptions) (net.Conn, error) {
+	interval := opts.tcpInterval()
+
+	ln, err := listenTCPReuse(ctx, opts.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	addrs, err := opts.offerAddrs(ctx, ln)
+	if err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 8)
+	_, _ = rand.Read(token)
+	offer := &Message{
+		Type:  MessageTCPOffer,
+		Token: token,
+		Addrs: addrs,
+	}
+
+	// Offer until answered, once per interval.
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	send := true
+	var answer *Message
+	for answer == nil {
+		if send {
+			offer.Timestamp = time.Now().UnixNano()
+			if err := sess.sendMessage(offer); err != nil {
+				return nil, err
+			}
+			send = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, tcpCtxErr(ctx)
+		case <-sess.done:
+			return nil, sess.Err()
+		case inb, ok := <-sess.signalQueue.ch:
+			if !ok {
+				return nil, ErrConnectionClosed
+			}
+			msg, err := DecodePacketMessage(inb.pkt)
+			if err == nil && msg.Type == MessageTCPAnswer && bytes.Equal(msg.Token, token) {
+				answer = msg
+			}
+		case <-ticker.C:
+			send = true
+		}
+	}
+
+	return punchTCP(ctx, sess, ln, answer.Addrs, token, nil, interval)
+}
+
+// AcceptTCP waits for the peer of an established Session to call DialTCP
+// and establishes the TCP connection with it.
+//
+// It returns ErrPunchTimeout if ctx expires first.
+func AcceptTCP(ctx context.Context, sess *Session, opts TCPOptions) (net.Conn, error) {
+	var offer *Message
+	for offer == nil {
+		select {
+		case <-ctx.Done():
+			return nil, tcpCtxErr(ctx)
+		case <-sess.done:
+			return nil, sess.Err()
+		case inb, ok := <-sess.signalQueue.ch:
+			if !ok {
+				return nil, ErrConnectionClosed
+			}
+			msg, err := DecodePacketMessage(inb.pkt)
+			if err == nil && msg.Type == MessageTCPOffer && len(msg.Token) > 0 {
+				offer = msg
+			}
+		}
+	}
+
+	ln, err := listenTCPReuse(ctx, opts.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	addrs, err := opts.offerAddrs(ctx, ln)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := &Message{
+		Type:      MessageTCPAnswer,
+		Timestamp: time.Now().UnixNano(),
+		Token:     offer.Token,
+		Addrs:     addrs,
+	}
+	if err := sess.sendMessage(answer); err != nil {
+		return nil, err
+	}
+
+	return punchTCP(ctx, sess, ln, offer.Addrs, offer.Token, answer, opts.tcpInterval())
+}
+
+// punchTCP connects from ln's port to every candidate in addrs, and accepts on
+// ln, until a connection passes the token exchange.
+//
+// Several connections may come up at once, so the dialing side
+// (answer == nil) nominates one: it sends the token on each connection and
+// confirms the first one acknowledged. The accepting side acknowledges every
+// valid token, uses the confirmed connection, and re-sends answer whenever
+// the offer is repeated.
+func punchTCP(ctx context.Context, sess *Session, ln net.Listener, addrs []string, token []byte, answer *Message, interval time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conns := make(chan net.Conn)
+	deliver := func(c net.Conn) {
+		select {
+		case conns <- c:
+		case <-ctx.Done():
+			_ = c.Close()
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go deliver(c)
+		}
+	}()
+
+	d := &net.Dialer{
+		LocalAddr: ln.Addr(),
+		Control:   reuseControl,
+		Timeout:   tcpHandshakeTimeout,
+	}
+	for _, raddr := range tcpCandidates(addrs, sess.remoteIP()) {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				if c, err := d.DialContext(ctx, "tcp", raddr); err == nil {
+					deliver(c)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	if answer != nil {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case inb, ok := <-sess.signalQueue.ch:
+					if !ok {
+						return
+					}
+					msg, err := DecodePacketMessage(inb.pkt)
+					if err == nil && msg.Type == MessageTCPOffer && bytes.Equal(msg.Token, token) {
+						_ = sess.sendMessage(answer)
+					}
+				}
+			}
+		}()
+	}
+
+	chooser := answer == nil
+	ready := make(chan net.Conn)
+	var pending []net.Conn
+	closePending := func(keep net.Conn) {
+		for _, c := range pending {
+			if c != keep {
+				_ = c.Close()
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			closePending(nil)
+			return nil, tcpCtxErr(ctx)
+		case <-sess.done:
+			closePending(nil)
+			return nil, sess.Err()
+		case c := <-conns:
+			pending = append(pending, c)
+			go func() {
+				if err := tcpHandshake(c, token, chooser); err != nil {
+					_ = c.Close()
+					return
+				}
+				select {
+				case ready <- c:
+				case <-ctx.Done():
+				}
+			}()
+		case c := <-ready:
+			if chooser {
+				// Nominate c; the peer drops the others once they close.
+				if _, err := c.Write([]byte{tcpNominate}); err != nil {
+					_ = c.Close()
+					continue
+				}
+			}
+			closePending(c)
+			return c, nil
+		}
+	}
+}
+
+// tcpHandshake authenticates c with token. The chooser sends the token and
+// waits for an acknowledgement; the other side checks the token, acknowledges
+// it and waits for the chooser to nominate c.
+func tcpHandshake(c net.Conn, token []byte, chooser bool) error {
+	_ = c.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	hello := append(tcpMagic[:], token...)
+	reply := make([]byte, 1)
+	if chooser {
+		if _, err := c.Write(hello); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return err
+		}
+		if reply[0] != tcpAck {
+			return ErrInvalidMessage
+		}
+		return nil
+	}
+
+	got := make([]byte, len(hello))
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, hello) {
+		return ErrInvalidMessage
+	}
+	if _, err := c.Write([]byte{tcpAck}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[0] != tcpNominate {
+		return ErrInvalidMessage
+	}
+	return nil
+}
+
+// listenTCPReuse listens on addr with a shareable local port.
+func listenTCPReuse(ctx context.Context, addr *net.TCPAddr) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reuseControl}
+	laddr := ":0"
+	if addr != nil {
+		laddr = addr.String()
+	}
+	return lc.Listen(ctx, "tcp", laddr)
+}
+
+// DiscoverTCPMapping asks the STUN server at server, over TCP, for the
+// external address of local. The connection is made from local's port with
+// the port shared, so a listener may already be bound to it.
+func DiscoverTCPMapping(ctx context.Context, server string, local *net.TCPAddr) (*net.TCPAddr, error) {
+	d := &net.Dialer{LocalAddr: local, Control: reuseControl}
+	c, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(tcpHandshakeTimeout)
+	}
+	_ = c.SetDeadline(deadline)
+
+	tid, err := stun.NewTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(stun.NewBindingRequest(tid).Marshal()); err != nil {
+		return nil, err
+	}
+
+	// Over TCP, STUN messages are framed by the length in their header.
+	buf := make([]byte, stun.HeaderLen)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	n := int(buf[2])<<8 | int(buf[3])
+	buf = append(buf, make([]byte, n)...)
+	if _, err := io.ReadFull(c, buf[stun.HeaderLen:]); err != nil {
+		return nil, err
+	}
+
+	resp, err := stun.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	if resp.TransactionID != tid || resp.Class != stun.ClassSuccessResponse {
+		return nil, stun.ErrNotSTUN
+	}
+	m, err := stun.FindMappedAddress(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: m.IP, Port: m.Port}, nil
+}
+
+// offerAddrs lists the addresses to offer the peer for listener ln:
+// the mapped address, if known or discovered, and the local one.
+func (o TCPOptions) offerAddrs(ctx context.Context, ln net.Listener) ([]string, error) {
+	mapped := o.MappedAddr
+	if mapped == nil && o.STUNServer != "" {
+		m, err := DiscoverTCPMapping(ctx, o.STUNServer, ln.Addr().(*net.TCPAddr))
+		if err != nil {
+			return nil, err
+		}
+		mapped = m
+	}
+
+	var out []string
+	if mapped != nil {
+		out = append(out, mapped.String())
+	}
+	return append(out, ln.Addr().String()), nil
+}
+
+// tcpCandidates returns the addresses to connect to: the offered ones with a
+// specified IP, and every offered port on the peer's UDP address.
+func tcpCandidates(addrs []string, remoteIP net.IP) []string {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(a string) {
+		if !seen[a] {
+			seen[a] = true
+			out = append(out, a)
+		}
+	}
+
+	for _, a := range addrs {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			add(a)
+		}
+		if remoteIP != nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				add((&net.TCPAddr{IP: remoteIP, Port: p}).String())
+			}
+		}
+	}
+	return out
+}
+
+// tcpCtxErr maps an expired ctx to ErrPunchTimeout.
+func tcpCtxErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrPunchTimeout
+	}
+	return ctx.Err()
+}
+
+// remoteIP returns the IP address of the active path's remote address.
+func (s *Session) remoteIP() net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active.remote.IP
+}
+
+// tcpInterval returns AttemptInterval or its default.
+func (o TCPOptions) tcpInterval() time.Duration {
+	if o.AttemptInterval > 0 {
+		return o.AttemptInterval
+	}
+	return defaultTCPAttemptInterval
+}
@@ -0,0 +1,220 @@
+package nat_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSessionPair connects two connection-ID sessions over loopback.
+func newSessionPair(t *testing.T, ctx context.Context) (a, b *nat.Session) {
+	t.Helper()
+
+	aConn := newLocalUDP(t)
+	bConn := newLocalUDP(t)
+	t.Cleanup(func() {
+		aConn.Close()
+		bConn.Close()
+	})
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	a = nat.NewConnSession(aMux, bConn.LocalAddr().(*net.UDPAddr), 1, 2, nat.QueueOptions{})
+	b = nat.NewConnSession(bMux, aConn.LocalAddr().(*net.UDPAddr), 2, 1, nat.QueueOptions{})
+	return a, b
+}
+
+func TestTCPSimultaneousOpen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, b := newSessionPair(t, ctx)
+	defer a.Close()
+	defer b.Close()
+
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	opts := nat.TCPOptions{LocalAddr: loopback, AttemptInterval: 50 * time.Millisecond}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		c, err := nat.AcceptTCP(ctx, b, opts)
+		accepted <- result{c, err}
+	}()
+
+	ac, err := nat.DialTCP(ctx, a, opts)
+	if errors.Is(err, nat.ErrTCPUnsupported) {
+		t.Skip(err)
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ac.Close()
+
+	r := <-accepted
+	if !assert.NoError(t, r.err) {
+		return
+	}
+	bc := r.conn
+	defer bc.Close()
+
+	_, err = ac.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(bc, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	_, err = bc.Write([]byte("pong"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(ac, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+
+	// The UDP session is still usable.
+	assert.NoError(t, a.SendData([]byte("udp")))
+	data, _, err := b.RecvData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "udp", string(data))
+}
+
+func TestDialTCPOffersOnTimer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	peer := newLocalUDP(t)
+	defer peer.Close()
+	mux := nat.NewMux(conn)
+	mux.Start(ctx)
+	sess := nat.NewConnSession(mux, peer.LocalAddr().(*net.UDPAddr), 1, 2, nat.QueueOptions{})
+	defer sess.Close()
+
+	dialed := make(chan error, 1)
+	short, cancelShort := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelShort()
+	go func() {
+		_, err := nat.DialTCP(short, sess, nat.TCPOptions{
+			LocalAddr:       &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			AttemptInterval: time.Second,
+		})
+		dialed <- err
+	}()
+
+	// The peer answers every offer with answers for another attempt, which
+	// must not make DialTCP offer again before its interval.
+	stale, _ := nat.EncodeMessageBinary(&nat.Message{Type: nat.MessageTCPAnswer, Token: []byte("stale")})
+	wire, _ := nat.EncodeConnPacket(nat.PacketMessage, 1, stale)
+	offers := 0
+	buf := make([]byte, 1500)
+	for {
+		_ = peer.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		pkt, err := nat.DecodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if msg, err := nat.DecodePacketMessage(pkt); err == nil && msg.Type == nat.MessageTCPOffer {
+			offers++
+			for range 5 {
+				_, _ = peer.WriteToUDP(wire, conn.LocalAddr().(*net.UDPAddr))
+			}
+		}
+	}
+
+	err := <-dialed
+	if errors.Is(err, nat.ErrTCPUnsupported) {
+		t.Skip(err)
+	}
+	assert.ErrorIs(t, err, nat.ErrPunchTimeout)
+	assert.Equal(t, 1, offers)
+}
+
+func TestTCPAcceptTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, b := newSessionPair(t, ctx)
+	defer a.Close()
+	defer b.Close()
+
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+
+	_, err := nat.AcceptTCP(short, b, nat.TCPOptions{})
+	assert.ErrorIs(t, err, nat.ErrPunchTimeout)
+}
+
+func TestDiscoverTCPMapping(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A STUN server over TCP that reports the source address it sees.
+	srv, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+	go func() {
+		c, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		buf := make([]byte, stun.HeaderLen)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		req, err := stun.Parse(buf)
+		if err != nil {
+			return
+		}
+		src := c.RemoteAddr().(*net.TCPAddr)
+		value := []byte{0, 1, byte(src.Port >> 8), byte(src.Port)}
+		resp := &stun.Message{
+			Method:        stun.MethodBinding,
+			Class:         stun.ClassSuccessResponse,
+			Cookie:        stun.MagicCookie,
+			TransactionID: req.TransactionID,
+			Attributes: []stun.Attribute{
+				{Type: stun.AttrMappedAddress, Value: append(value, src.IP.To4()...)},
+			},
+		}
+		_, _ = c.Write(resp.Marshal())
+	}()
+
+	// Pick a free local port to discover the mapping of.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	local := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	mapped, err := nat.DiscoverTCPMapping(ctx, srv.Addr().String(), local)
+	if errors.Is(err, nat.ErrTCPUnsupported) {
+		t.Skip(err)
+	}
+	if assert.NoError(t, err) {
+		assert.Equal(t, local.Port, mapped.Port)
+		assert.True(t, mapped.IP.Equal(local.IP))
+	}
+}
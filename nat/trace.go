@@ -0,0 +1,174 @@
+package nat
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Tracer starts spans. Its shape follows the OpenTelemetry tracing API, so
+// that this module does not depend on OpenTelemetry: the separate
+// github.com/aethiopicuschan/natto/nat/otelnat module adapts an
+// OpenTelemetry trace.Tracer to it.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	AddEvent(name string, attrs ...slog.Attr)
+	SetAttributes(attrs ...slog.Attr)
+
+	// SetStatus marks the span as succeeded or failed with a description.
+	SetStatus(ok bool, description string)
+
+	End()
+}
+
+// PunchTracer records the events of a Puncher or an Acceptor as spans: a
+// "nat.punch" span for the attempt with a "nat.punch.candidate" child span
+// per candidate address. Candidate spans carry the address, its type and
+// whether the hole was punched to it. Pass Handle to
+// Puncher.SetEventHandler or DialOptions.OnEvent.
+//
+// A PunchTracer records a single attempt; events after it ends are ignored.
+type PunchTracer struct {
+	tracer Tracer
+
+	mu         sync.Mutex
+	ctx        context.Context
+	root       Span
+	candidates map[string]Span
+	order      []string
+	done       bool
+}
+
+// NewPunchTracer returns a PunchTracer whose spans are children of the span
+// in ctx, if any.
+func NewPunchTracer(ctx context.Context, tracer Tracer) *PunchTracer {
+	return &PunchTracer{
+		tracer:     tracer,
+		ctx:        ctx,
+		candidates: make(map[string]Span),
+	}
+}
+
+// Handle records ev.
+func (t *PunchTracer) Handle(ev PunchEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return
+	}
+	if t.root == nil {
+		var attrs []slog.Attr
+		if ev.Local != nil {
+			attrs = append(attrs, slog.String("nat.local", ev.Local.String()))
+		}
+		if ev.Type == PunchStarted {
+			attrs = append(attrs, slog.Int("nat.candidates", len(ev.Candidates)))
+		}
+		t.ctx, t.root = t.tracer.Start(t.ctx, "nat.punch", attrs...)
+	}
+
+	switch ev.Type {
+	case PunchStarted:
+		if ev.PeerID != "" {
+			t.root.SetAttributes(slog.String("nat.peer_id", ev.PeerID))
+		}
+
+	case PunchHelloSent:
+		attrs := []slog.Attr{slog.Int("nat.round", ev.Round)}
+		if ev.Err != nil {
+			attrs = append(attrs, slog.String("error", ev.Err.Error()))
+		}
+		t.candidate(ev).AddEvent(string(ev.Type), attrs...)
+
+	case PunchHelloReceived, PunchAckReceived:
+		t.candidate(ev).AddEvent(string(ev.Type))
+
+	case PunchPeerKnown:
+		t.root.SetAttributes(slog.String("nat.peer_id", ev.PeerID))
+		t.root.AddEvent(string(ev.Type), slog.String("nat.addr", addrString(ev.Addr)))
+
+	case PunchAddressChanged:
+		t.root.AddEvent(string(ev.Type),
+			slog.String("nat.addr", addrString(ev.Addr)),
+			slog.String("nat.prev", addrString(ev.Prev)))
+
+	case PunchBehaviorInferred:
+		t.root.AddEvent(string(ev.Type), slog.String("nat.behavior", string(ev.Behavior)))
+
+	case PunchSucceeded:
+		won := addrString(ev.Addr)
+		t.root.SetAttributes(
+			slog.String("nat.peer_id", ev.PeerID),
+			slog.String("nat.addr", won),
+			slog.String("nat.candidate.type", string(ev.CandidateType)),
+			slog.String("nat.behavior", string(ev.Behavior)))
+		t.root.SetStatus(true, "")
+		if _, ok := t.candidates[won]; !ok {
+			t.candidate(ev)
+		}
+		for _, key := range t.order {
+			span := t.candidates[key]
+			span.SetAttributes(slog.Bool("nat.candidate.won", key == won))
+			if key == won {
+				span.SetStatus(true, "")
+			}
+		}
+		t.end()
+
+	case PunchTimedOut, PunchFailed:
+		desc := string(ev.Type)
+		if ev.Err != nil {
+			desc = ev.Err.Error()
+		}
+		t.root.SetStatus(false, desc)
+		for _, key := range t.order {
+			t.candidates[key].SetAttributes(slog.Bool("nat.candidate.won", false))
+		}
+		t.end()
+	}
+}
+
+// candidate returns the span of ev.Addr, starting it if needed.
+func (t *PunchTracer) candidate(ev PunchEvent) Span {
+	key := addrString(ev.Addr)
+	if span, ok := t.candidates[key]; ok {
+		return span
+	}
+
+	attrs := []slog.Attr{
+		slog.String("nat.candidate.addr", key),
+		slog.String("nat.candidate.type", string(ev.CandidateType)),
+	}
+	if ev.Local != nil {
+		attrs = append(attrs, slog.String("nat.local", ev.Local.String()))
+	}
+	_, span := t.tracer.Start(t.ctx, "nat.punch.candidate", attrs...)
+	t.candidates[key] = span
+	t.order = append(t.order, key)
+	return span
+}
+
+// end ends the candidate spans and then the root span.
+func (t *PunchTracer) end() {
+	for _, key := range t.order {
+		t.candidates[key].End()
+	}
+	t.root.End()
+	t.done = true
+}
+
+// addrString formats addr, which may be nil.
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,103 @@
+package nat_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/aethiopicuschan/natto/nat"
+)
+
+// The types below show what an adapter from nat.Tracer to OpenTelemetry,
+// such as the one in the otelnat module, does. otelKeyValue stands in for
+// attribute.KeyValue, and the methods print what they would pass to
+// trace.Tracer and trace.Span.
+
+// otelKeyValue stands in for attribute.KeyValue.
+type otelKeyValue struct {
+	Key   string
+	Value any
+}
+
+// otelAttrs converts slog attributes to OpenTelemetry ones. With the real
+// API the cases are attribute.String, attribute.Int64, attribute.Bool and
+// attribute.Float64.
+func otelAttrs(attrs []slog.Attr) []otelKeyValue {
+	out := make([]otelKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		v := a.Value.Resolve()
+		switch v.Kind() {
+		case slog.KindInt64:
+			out = append(out, otelKeyValue{a.Key, v.Int64()})
+		case slog.KindUint64:
+			out = append(out, otelKeyValue{a.Key, int64(v.Uint64())})
+		case slog.KindBool:
+			out = append(out, otelKeyValue{a.Key, v.Bool()})
+		case slog.KindFloat64:
+			out = append(out, otelKeyValue{a.Key, v.Float64()})
+		default:
+			out = append(out, otelKeyValue{a.Key, v.String()})
+		}
+	}
+	return out
+}
+
+// otelTracer wraps a trace.Tracer.
+type otelTracer struct{}
+
+// Start calls tracer.Start(ctx, name, trace.WithAttributes(...)).
+func (otelTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, nat.Span) {
+	fmt.Println("start", name, otelAttrs(attrs))
+	return ctx, otelSpan{name: name}
+}
+
+// otelSpan wraps a trace.Span.
+type otelSpan struct {
+	name string
+}
+
+// AddEvent calls span.AddEvent(name, trace.WithAttributes(...)).
+func (s otelSpan) AddEvent(name string, attrs ...slog.Attr) {
+	fmt.Println(s.name, "event", name, otelAttrs(attrs))
+}
+
+// SetAttributes calls span.SetAttributes(...).
+func (s otelSpan) SetAttributes(attrs ...slog.Attr) {
+	fmt.Println(s.name, "attributes", otelAttrs(attrs))
+}
+
+// SetStatus calls span.SetStatus with codes.Ok or codes.Error.
+func (s otelSpan) SetStatus(ok bool, description string) {
+	code := "Error"
+	if ok {
+		code = "Ok"
+	}
+	fmt.Println(s.name, "status", code, description)
+}
+
+// End calls span.End().
+func (s otelSpan) End() {
+	fmt.Println(s.name, "end")
+}
+
+func ExamplePunchTracer() {
+	pt := nat.NewPunchTracer(context.Background(), otelTracer{})
+
+	// Events as a Puncher reports them; pass pt.Handle to
+	// Puncher.SetEventHandler or DialOptions.OnEvent.
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 5000}
+	pt.Handle(nat.PunchEvent{Type: nat.PunchStarted, PeerID: "peer-b", Candidates: []*net.UDPAddr{addr}})
+	pt.Handle(nat.PunchEvent{Type: nat.PunchHelloSent, Addr: addr, CandidateType: nat.CandidateServerReflexive})
+	pt.Handle(nat.PunchEvent{Type: nat.PunchTimedOut, Err: nat.ErrPunchTimeout})
+
+	// Output:
+	// start nat.punch [{nat.candidates 1}]
+	// nat.punch attributes [{nat.peer_id peer-b}]
+	// start nat.punch.candidate [{nat.candidate.addr 203.0.113.1:5000} {nat.candidate.type srflx}]
+	// nat.punch.candidate event hello-sent [{nat.round 0}]
+	// nat.punch status Error nat traversal timed out
+	// nat.punch.candidate attributes [{nat.candidate.won false}]
+	// nat.punch.candidate end
+	// nat.punch end
+}
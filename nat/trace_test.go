@@ -0,0 +1,249 @@
+package nat_test
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder records the types of the events handed to it.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []nat.PunchEvent
+}
+
+func (r *eventRecorder) handle(ev nat.PunchEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// types returns the distinct event types in the order first seen.
+func (r *eventRecorder) types() []nat.PunchEventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []nat.PunchEventType
+	for _, ev := range r.events {
+		if !slices.Contains(out, ev.Type) {
+			out = append(out, ev.Type)
+		}
+	}
+	return out
+}
+
+// last returns the last recorded event.
+func (r *eventRecorder) last() nat.PunchEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+// recordTracer is a nat.Tracer that records its spans.
+type recordTracer struct {
+	mu    sync.Mutex
+	spans []*recordSpan
+}
+
+type recordSpan struct {
+	tracer *recordTracer
+	name   string
+	parent *recordSpan
+	attrs  map[string]string
+	events []string
+	ok     bool
+	desc   string
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (t *recordTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, nat.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &recordSpan{tracer: t, name: name, attrs: map[string]string{}}
+	s.parent, _ = ctx.Value(spanKey{}).(*recordSpan)
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value.String()
+	}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordSpan) AddEvent(name string, attrs ...slog.Attr) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.events = append(s.events, name)
+}
+
+func (s *recordSpan) SetAttributes(attrs ...slog.Attr) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value.String()
+	}
+}
+
+func (s *recordSpan) SetStatus(ok bool, desc string) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ok, s.desc = ok, desc
+}
+
+func (s *recordSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended = true
+}
+
+func TestPunchEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	aConn := newLocalUDP(t)
+	defer aConn.Close()
+	bConn := newLocalUDP(t)
+	defer bConn.Close()
+
+	aMux := nat.NewMux(aConn)
+	bMux := nat.NewMux(bConn)
+	aMux.Start(ctx)
+	bMux.Start(ctx)
+
+	var dialEvents, acceptEvents eventRecorder
+	tracer := &recordTracer{}
+	pt := nat.NewPunchTracer(ctx, tracer)
+
+	// An unreachable candidate is probed alongside the real one.
+	dead := newLocalUDP(t)
+	deadAddr := dead.LocalAddr().(*net.UDPAddr)
+	dead.Close()
+	peerB := &nat.Peer{
+		ID:         "peer-b",
+		Addr:       bConn.LocalAddr().(*net.UDPAddr),
+		Candidates: []*net.UDPAddr{deadAddr},
+	}
+
+	accepted := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, _ := nat.NewAcceptor(bMux, peerB.ID, nat.AcceptOptions{OnEvent: acceptEvents.handle}).Accept(ctx)
+		accepted <- sess
+	}()
+
+	aSess, res, err := nat.Dial(ctx, aMux, "peer-a", peerB, nat.DialOptions{
+		Interval: 20 * time.Millisecond,
+		OnEvent: func(ev nat.PunchEvent) {
+			dialEvents.handle(ev)
+			pt.Handle(ev)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer aSess.Close()
+	if bSess := <-accepted; assert.NotNil(t, bSess) {
+		defer bSess.Close()
+	}
+
+	types := dialEvents.types()
+	assert.Equal(t, nat.PunchStarted, types[0])
+	for _, typ := range []nat.PunchEventType{nat.PunchHelloSent, nat.PunchAckReceived, nat.PunchPeerKnown, nat.PunchBehaviorInferred} {
+		assert.Contains(t, types, typ)
+	}
+	last := dialEvents.last()
+	assert.Equal(t, nat.PunchSucceeded, last.Type)
+	assert.Equal(t, res, last.Result)
+	assert.Equal(t, nat.NATEndpointIndependent, last.Behavior)
+
+	assert.Equal(t, []nat.PunchEventType{nat.PunchStarted, nat.PunchHelloReceived, nat.PunchPeerKnown, nat.PunchSucceeded}, acceptEvents.types())
+	assert.Equal(t, "peer-a", acceptEvents.last().PeerID)
+
+	// One root span with a child per candidate; only the winner won.
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	root := tracer.spans[0]
+	assert.Equal(t, "nat.punch", root.name)
+	assert.True(t, root.ok)
+	assert.Equal(t, "peer-b", root.attrs["nat.peer_id"])
+	assert.Contains(t, root.events, string(nat.PunchPeerKnown))
+
+	won := map[string]string{}
+	for _, s := range tracer.spans {
+		assert.True(t, s.ended, s.name)
+		if s == root {
+			continue
+		}
+		assert.Equal(t, "nat.punch.candidate", s.name)
+		assert.Same(t, root, s.parent)
+		assert.Contains(t, s.events, string(nat.PunchHelloSent))
+		won[s.attrs["nat.candidate.addr"]] = s.attrs["nat.candidate.won"]
+	}
+	assert.Equal(t, map[string]string{
+		peerB.Addr.String(): "true",
+		deadAddr.String():   "false",
+	}, won)
+}
+
+func TestPunchEventsTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	mux.Start(context.Background())
+	defer mux.Close()
+
+	var events eventRecorder
+	tracer := &recordTracer{}
+	pt := nat.NewPunchTracer(context.Background(), tracer)
+
+	p := nat.NewPuncher(mux, "peer-a", 20*time.Millisecond)
+	p.SetEventHandler(func(ev nat.PunchEvent) {
+		events.handle(ev)
+		pt.Handle(ev)
+	})
+	_, err := p.Punch(ctx, &nat.Peer{ID: "peer-b", Addr: ackingPeer(t, -1)})
+	assert.ErrorIs(t, err, nat.ErrPunchTimeout)
+
+	last := events.last()
+	assert.Equal(t, nat.PunchTimedOut, last.Type)
+	assert.ErrorIs(t, last.Err, nat.ErrPunchTimeout)
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	root := tracer.spans[0]
+	assert.False(t, root.ok)
+	assert.Equal(t, nat.ErrPunchTimeout.Error(), root.desc)
+	for _, s := range tracer.spans {
+		assert.True(t, s.ended, s.name)
+	}
+}
+
+func TestAcceptEventsTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	conn := newLocalUDP(t)
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	mux.Start(context.Background())
+	defer mux.Close()
+
+	var events eventRecorder
+	_, _, err := nat.NewAcceptor(mux, "peer-b", nat.AcceptOptions{OnEvent: events.handle}).Accept(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []nat.PunchEventType{nat.PunchStarted, nat.PunchTimedOut}, events.types())
+}
@@ -0,0 +1,345 @@
+package nat_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/nat/nattest"
+	"github.com/aethiopicuschan/natto/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+// virtualNATs are the NAT types tests run against; nil means a public host.
+var virtualNATs = []struct {
+	name string
+	cfg  *nattest.NATConfig
+}{
+	{"public", nil},
+	{"full-cone", &nattest.FullCone},
+	{"restricted-cone", &nattest.RestrictedCone},
+	{"port-restricted-cone", &nattest.PortRestrictedCone},
+	{"symmetric", &nattest.Symmetric},
+}
+
+// startVirtualSTUN starts a STUN server on a public host of n at ip:3478.
+func startVirtualSTUN(t *testing.T, n *nattest.Network, ip string) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := n.AddHost(ip).ListenUDP(3478)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	srv := stun.NewServer(conn)
+	go func() { _ = srv.Serve() }()
+	t.Cleanup(func() { srv.Close() })
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// virtualHost adds a host to n, behind a NAT with the public IP natIP if cfg
+// is set.
+func virtualHost(n *nattest.Network, cfg *nattest.NATConfig, natIP, ip string) *nattest.Host {
+	if cfg == nil {
+		return n.AddHost(natIP)
+	}
+	return n.AddNAT(natIP, *cfg).AddHost(ip)
+}
+
+// virtualPeer opens a socket on h, learns its public address from the STUN
+// server and starts a Mux on it, wrapped by wrap if set.
+func virtualPeer(t *testing.T, ctx context.Context, h *nattest.Host, id string, server *net.UDPAddr, wrap func(*nattest.Conn) nat.PacketConn) (*nat.Mux, *nat.Peer) {
+	t.Helper()
+
+	conn, err := h.ListenUDP(5000)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	mapped, err := stun.NewClient().BindingRequestTo(ctx, conn, server)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var pc nat.PacketConn = conn
+	if wrap != nil {
+		pc = wrap(conn)
+	}
+	mux := nat.NewMux(pc)
+	mux.Start(ctx)
+	return mux, &nat.Peer{
+		ID:        id,
+		Addr:      &net.UDPAddr{IP: mapped.IP, Port: mapped.Port},
+		LocalAddr: conn.LocalAddr().(*net.UDPAddr),
+	}
+}
+
+// punchable reports whether simultaneous punching between the two NAT
+// types succeeds without port prediction. It fails when one side's mapping
+// depends on the destination and the other side filters by port.
+func punchable(a, b *nattest.NATConfig) bool {
+	symmetric := func(c *nattest.NATConfig) bool {
+		return c != nil && c.Mapping == nattest.MappingAddressPortDependent
+	}
+	portFiltering := func(c *nattest.NATConfig) bool {
+		return c != nil && c.Filtering == nattest.FilteringAddressPortDependent
+	}
+	return !(symmetric(a) && portFiltering(b)) && !(symmetric(b) && portFiltering(a))
+}
+
+// waitFiltered returns once the NATs, nil for public hosts, have dropped at
+// least n inbound packets between them, or ctx is done.
+func waitFiltered(ctx context.Context, n int, nats ...*nattest.NAT) {
+	for {
+		var filtered int
+		for _, g := range nats {
+			if g != nil {
+				filtered += g.Filtered()
+			}
+		}
+		if filtered >= n {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestDialVirtualNATs(t *testing.T) {
+	t.Parallel()
+
+	for _, a := range virtualNATs {
+		for _, b := range virtualNATs {
+			t.Run(a.name+"/"+b.name, func(t *testing.T) {
+				t.Parallel()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				n := nattest.NewNetwork()
+				server := startVirtualSTUN(t, n, "203.0.113.100")
+				aHost := virtualHost(n, a.cfg, "198.51.100.1", "192.168.0.2")
+				bHost := virtualHost(n, b.cfg, "198.51.100.2", "192.168.0.2")
+				aMux, peerA := virtualPeer(t, ctx, aHost, "peer-a", server, nil)
+				bMux, peerB := virtualPeer(t, ctx, bHost, "peer-b", server, nil)
+
+				// A pair that cannot punch is given up on once its NATs have
+				// dropped a number of HELLOs, rather than after a fixed time.
+				want := punchable(a.cfg, b.cfg)
+				punchCtx, punchCancel := context.WithCancel(ctx)
+				defer punchCancel()
+				if !want {
+					go func() {
+						waitFiltered(punchCtx, 10, aHost.NAT(), bHost.NAT())
+						punchCancel()
+					}()
+				}
+
+				// Both peers dial at the same time, as after exchanging
+				// addresses through a signaling server.
+				type dialResult struct {
+					sess *nat.Session
+					err  error
+				}
+				results := make(chan dialResult, 1)
+				go func() {
+					sess, _, err := nat.Dial(punchCtx, bMux, peerB.ID, peerA, nat.DialOptions{Interval: 20 * time.Millisecond})
+					results <- dialResult{sess, err}
+				}()
+				aSess, _, aErr := nat.Dial(punchCtx, aMux, peerA.ID, peerB, nat.DialOptions{Interval: 20 * time.Millisecond})
+				bRes := <-results
+
+				if !want {
+					assert.ErrorIs(t, aErr, context.Canceled)
+					assert.ErrorIs(t, bRes.err, context.Canceled)
+					return
+				}
+				if !assert.NoError(t, aErr) || !assert.NoError(t, bRes.err) {
+					return
+				}
+				defer aSess.Close()
+				defer bRes.sess.Close()
+
+				assert.NoError(t, aSess.SendData([]byte("hello")))
+				got, _, err := bRes.sess.RecvData(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, "hello", string(got))
+			})
+		}
+	}
+}
+
+func TestAcceptVirtualNATs(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range virtualNATs {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// The dialer is behind the NAT; the acceptor is public.
+			n := nattest.NewNetwork()
+			server := startVirtualSTUN(t, n, "203.0.113.100")
+			aMux, peerA := virtualPeer(t, ctx, virtualHost(n, tt.cfg, "198.51.100.1", "192.168.0.2"), "peer-a", server, nil)
+			bMux, peerB := virtualPeer(t, ctx, n.AddHost("203.0.113.1"), "peer-b", server, nil)
+
+			type acceptResult struct {
+				sess *nat.Session
+				res  *nat.PunchResult
+				err  error
+			}
+			accepted := make(chan acceptResult, 1)
+			go func() {
+				sess, res, err := nat.NewAcceptor(bMux, peerB.ID, nat.AcceptOptions{}).Accept(ctx)
+				accepted <- acceptResult{sess, res, err}
+			}()
+
+			aSess, _, err := nat.Dial(ctx, aMux, peerA.ID, peerB, nat.DialOptions{Interval: 20 * time.Millisecond})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer aSess.Close()
+			acc := <-accepted
+			if !assert.NoError(t, acc.err) {
+				return
+			}
+			defer acc.sess.Close()
+
+			// The acceptor sees the dialer's public address.
+			if tt.cfg != nil {
+				assert.Equal(t, "198.51.100.1", acc.res.Addr.IP.String())
+			}
+
+			assert.NoError(t, acc.sess.SendData([]byte("hello")))
+			got, _, err := aSess.RecvData(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(got))
+		})
+	}
+}
+
+func TestDetectNATVirtual(t *testing.T) {
+	t.Parallel()
+
+	withHairpin := nattest.FullCone
+	withHairpin.Hairpinning = true
+
+	tests := []struct {
+		name        string
+		cfg         *nattest.NATConfig
+		wantType    nat.NATType
+		wantHairpin bool
+	}{
+		// Without a NAT, the public address is reached directly.
+		{"public", nil, nat.NATOpenInternet, true},
+		{"full-cone", &nattest.FullCone, nat.NATPortRestricted, false},
+		{"full-cone-hairpin", &withHairpin, nat.NATPortRestricted, true},
+		{"port-restricted-cone", &nattest.PortRestrictedCone, nat.NATPortRestricted, false},
+		{"symmetric", &nattest.Symmetric, nat.NATSymmetric, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			n := nattest.NewNetwork()
+			s1 := startVirtualSTUN(t, n, "203.0.113.100")
+			s2 := startVirtualSTUN(t, n, "203.0.113.101")
+			h := virtualHost(n, tt.cfg, "198.51.100.1", "192.168.0.2")
+			conn, err := h.ListenUDP(5000)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			r, err := nat.DetectNAT(ctx, conn,
+				nat.WithSTUNServers(s1.String(), s2.String()),
+				nat.WithHairpinTimeout(100*time.Millisecond),
+				nat.WithListen(func() (nat.PacketConn, error) { return h.ListenUDP(0) }),
+			)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantType, r.Type)
+			assert.Equal(t, tt.wantHairpin, r.Hairpinning)
+		})
+	}
+}
+
+func TestDialImpaired(t *testing.T) {
+	t.Parallel()
+
+	// Both peers are behind port-restricted cones and every packet they send
+	// suffers the profile. Punching retries, so most attempts still succeed.
+	const trials = 10
+	profiles := []struct {
+		profile nattest.Profile
+		minRate float64
+	}{
+		{nattest.Profile{Name: "clean"}, 1},
+		{nattest.Mobile3G, 0.9},
+		{nattest.LossyWiFi, 0.8},
+		{nattest.Satellite, 0.9},
+		{nattest.Congested, 0.5},
+	}
+	for _, tt := range profiles {
+		t.Run(tt.profile.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var succeeded int
+			for seed := range uint64(trials) {
+				if dialImpaired(t, tt.profile, seed) {
+					succeeded++
+				}
+			}
+			rate := float64(succeeded) / trials
+			t.Logf("%s: %d/%d punched", tt.profile.Name, succeeded, trials)
+			assert.GreaterOrEqual(t, rate, tt.minRate)
+		})
+	}
+}
+
+// dialImpaired punches between two peers whose sends are impaired by p and
+// reports whether both sides got a session.
+func dialImpaired(t *testing.T, p nattest.Profile, seed uint64) bool {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n := nattest.NewNetwork()
+	server := startVirtualSTUN(t, n, "203.0.113.100")
+	impair := func(seed uint64) func(*nattest.Conn) nat.PacketConn {
+		return func(c *nattest.Conn) nat.PacketConn { return nattest.Impair(c, p, seed) }
+	}
+	aMux, peerA := virtualPeer(t, ctx, virtualHost(n, &nattest.PortRestrictedCone, "198.51.100.1", "192.168.0.2"), "peer-a", server, impair(2*seed))
+	bMux, peerB := virtualPeer(t, ctx, virtualHost(n, &nattest.PortRestrictedCone, "198.51.100.2", "192.168.0.2"), "peer-b", server, impair(2*seed+1))
+
+	punchCtx, punchCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer punchCancel()
+
+	opts := nat.DialOptions{Interval: 20 * time.Millisecond}
+	results := make(chan *nat.Session, 1)
+	go func() {
+		sess, _, _ := nat.Dial(punchCtx, bMux, peerB.ID, peerA, opts)
+		results <- sess
+	}()
+	aSess, _, _ := nat.Dial(punchCtx, aMux, peerA.ID, peerB, opts)
+	bSess := <-results
+	if aSess != nil {
+		defer aSess.Close()
+	}
+	if bSess != nil {
+		defer bSess.Close()
+	}
+	return aSess != nil && bSess != nil
+}
@@ -0,0 +1,79 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+)
+
+// Discover finds a gateway that can map ports, trying PCP and NAT-PMP
+// (see DiscoverPMP) and UPnP (see DiscoverUPnP) at the same time.
+// It returns the first gateway found, or ErrNoGateway.
+func Discover(ctx context.Context, opts ...DiscoverOption) (Gateway, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		gw  Gateway
+		err error
+	}
+	results := make(chan result, 2)
+	go func() {
+		gw, err := DiscoverPMP(ctx, opts...)
+		results <- result{gw, err}
+	}()
+	go func() {
+		gw, err := DiscoverUPnP(ctx, opts...)
+		results <- result{gw, err}
+	}()
+
+	for range 2 {
+		if r := <-results; r.err == nil {
+			return r.gw, nil
+		}
+	}
+	return nil, ErrNoGateway
+}
+
+// DiscoverPMP returns a client for the gateway of the default route, or the
+// one set with WithGateway: a PCPGateway if the gateway speaks PCP, or a
+// NATPMPGateway if it only speaks NAT-PMP.
+//
+// It returns ErrNoGateway if the gateway speaks neither.
+func DiscoverPMP(ctx context.Context, opts ...DiscoverOption) (Gateway, error) {
+	cfg := newDiscoverConfig(opts)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	addr := cfg.gateway
+	if addr == "" {
+		ip, err := DefaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		addr = ip.String()
+	}
+
+	pcp, err := NewPCPGateway(addr)
+	if err != nil {
+		return nil, err
+	}
+	err = pcp.probe(ctx)
+	if err == nil {
+		return pcp, nil
+	}
+	var gerr *GatewayError
+	if !errors.As(err, &gerr) {
+		// Nothing answered at all.
+		return nil, ErrNoGateway
+	}
+
+	pmp, err := NewNATPMPGateway(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pmp.ExternalIP(ctx); err != nil {
+		return nil, ErrNoGateway
+	}
+	return pmp, nil
+}
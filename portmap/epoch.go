@@ -0,0 +1,63 @@
+package portmap
+
+import (
+	"sync"
+	"time"
+)
+
+// restartNotifier is implemented by gateways that can tell when they have
+// restarted and lost their mappings. Mappings on such gateways are renewed
+// as soon as a restart is noticed.
+type restartNotifier interface {
+	restartSignal() <-chan struct{}
+}
+
+// epochTracker detects gateway restarts from the epoch (seconds since the
+// gateway started) in NAT-PMP and PCP responses; see RFC 6886 section 3.6
+// and RFC 6887 section 8.5.
+type epochTracker struct {
+	mu        sync.Mutex
+	valid     bool
+	epoch     uint32
+	at        time.Time
+	restarted chan struct{}
+}
+
+// observe records an epoch received at now and signals a restart if it is
+// inconsistent with the previous one.
+func (t *epochTracker) observe(epoch uint32, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restarted == nil {
+		t.restarted = make(chan struct{})
+	}
+	if t.valid && epochRestarted(t.epoch, t.at, epoch, now) {
+		close(t.restarted)
+		t.restarted = make(chan struct{})
+	}
+	t.valid, t.epoch, t.at = true, epoch, now
+}
+
+// restartSignal returns a channel that is closed at the next detected restart.
+func (t *epochTracker) restartSignal() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restarted == nil {
+		t.restarted = make(chan struct{})
+	}
+	return t.restarted
+}
+
+// epochRestarted reports whether a gateway that reported prev at prevAt has
+// restarted, given that it reports epoch at now. The epochs may drift apart
+// from the local clock by up to 1/16 plus two seconds.
+func epochRestarted(prev uint32, prevAt time.Time, epoch uint32, now time.Time) bool {
+	if int64(epoch)+1 < int64(prev) {
+		return true
+	}
+	client := int64(now.Sub(prevAt) / time.Second)
+	server := int64(epoch) - int64(prev)
+	return client+2 < server-server/16 || server+2 < client-client/16
+}
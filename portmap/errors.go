@@ -0,0 +1,46 @@
+package portmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoGateway is returned when no gateway answers discovery.
+	ErrNoGateway = errors.New("portmap: no gateway found")
+
+	// ErrMappingClosed is returned by Close after the first call.
+	ErrMappingClosed = errors.New("portmap: mapping closed")
+
+	// ErrNoDefaultRoute is returned when the default gateway cannot be determined.
+	ErrNoDefaultRoute = errors.New("portmap: no default route")
+
+	// ErrUnsupportedAddr is returned when a local address is not a UDP address.
+	ErrUnsupportedAddr = errors.New("portmap: unsupported local address")
+
+	// ErrInvalidResponse indicates that a gateway's response could not be parsed.
+	ErrInvalidResponse = errors.New("portmap: invalid gateway response")
+)
+
+// UPnPError is an error reported by a UPnP gateway in a SOAP fault.
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+// Error implements error.
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("portmap: upnp error %d: %s", e.Code, e.Description)
+}
+
+// GatewayError is a result code reported by a NAT-PMP or PCP gateway.
+type GatewayError struct {
+	// Protocol is "nat-pmp" or "pcp".
+	Protocol string
+	Code     int
+}
+
+// Error implements error.
+func (e *GatewayError) Error() string {
+	return fmt.Sprintf("portmap: %s result code %d", e.Protocol, e.Code)
+}
@@ -0,0 +1,7 @@
+package portmap
+
+// This file exposes unexported functions for black-box tests
+// in package portmap_test. It is compiled only during `go test`.
+
+var ExportEpochRestarted = epochRestarted
+var ExportParseProcRoute = parseProcRoute
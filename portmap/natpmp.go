@@ -0,0 +1,121 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NAT-PMP opcodes (RFC 6886).
+const (
+	natpmpVersion         = 0
+	natpmpOpExternalAddr  = 0
+	natpmpOpMapUDP        = 1
+	natpmpOpMapTCP        = 2
+	natpmpResponseBit     = 128
+	natpmpResultUnsupVers = 1
+)
+
+// NATPMPGateway is a gateway speaking NAT-PMP (RFC 6886).
+type NATPMPGateway struct {
+	addr  *net.UDPAddr
+	epoch epochTracker
+}
+
+// NewNATPMPGateway returns a NAT-PMP client for the gateway at addr
+// ("host" or "host:port"; the port defaults to 5351).
+func NewNATPMPGateway(addr string) (*NATPMPGateway, error) {
+	raddr, err := resolveGateway(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &NATPMPGateway{addr: raddr}, nil
+}
+
+// ExternalIP implements Gateway.
+func (g *NATPMPGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	resp, err := g.request(ctx, []byte{natpmpVersion, natpmpOpExternalAddr}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// AddMapping implements Gateway.
+func (g *NATPMPGateway) AddMapping(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	resp, err := g.mapRequest(ctx, proto, internalPort, externalPort, uint32(lifetime/time.Second))
+	if err != nil {
+		return 0, 0, err
+	}
+	ext := int(binary.BigEndian.Uint16(resp[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return ext, granted, nil
+}
+
+// DeleteMapping implements Gateway.
+func (g *NATPMPGateway) DeleteMapping(ctx context.Context, proto Protocol, internalPort, externalPort int) error {
+	_, err := g.mapRequest(ctx, proto, internalPort, 0, 0)
+	return err
+}
+
+// restartSignal implements restartNotifier.
+func (g *NATPMPGateway) restartSignal() <-chan struct{} {
+	return g.epoch.restartSignal()
+}
+
+// mapRequest sends a mapping request; a lifetime of zero deletes the mapping.
+func (g *NATPMPGateway) mapRequest(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime uint32) ([]byte, error) {
+	op := byte(natpmpOpMapUDP)
+	if proto == TCP {
+		op = natpmpOpMapTCP
+	}
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], lifetime)
+
+	resp, err := g.request(ctx, req, 16)
+	if err != nil {
+		return nil, err
+	}
+	if int(binary.BigEndian.Uint16(resp[8:10])) != internalPort {
+		return nil, ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+// request sends req and returns the successful response of at least size bytes.
+// The epoch of the response is checked for gateway restarts.
+func (g *NATPMPGateway) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	op := req[1]
+	resp, err := pmpRoundTrip(ctx, g.addr, req, func(b []byte) bool {
+		return len(b) >= 4 && b[0] == natpmpVersion && b[1] == op|natpmpResponseBit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return nil, &GatewayError{Protocol: "nat-pmp", Code: int(code)}
+	}
+	if len(resp) < size {
+		return nil, ErrInvalidResponse
+	}
+	g.epoch.observe(binary.BigEndian.Uint32(resp[4:8]), time.Now())
+	return resp, nil
+}
+
+// resolveGateway resolves a gateway address, defaulting to the NAT-PMP port.
+func resolveGateway(addr string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(pmpPort))
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
@@ -0,0 +1,59 @@
+package portmap
+
+import (
+	"net/http"
+	"time"
+)
+
+// DiscoverOption configures gateway discovery.
+type DiscoverOption func(*discoverConfig)
+
+type discoverConfig struct {
+	gateway    string
+	ssdpAddr   string
+	httpClient *http.Client
+	timeout    time.Duration
+}
+
+func newDiscoverConfig(opts []DiscoverOption) discoverConfig {
+	cfg := discoverConfig{
+		ssdpAddr:   "239.255.255.250:1900",
+		httpClient: &http.Client{Timeout: requestTimeout},
+		timeout:    3 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithSSDPAddr overrides the SSDP address searched for UPnP gateways.
+// It defaults to the SSDP multicast group 239.255.255.250:1900.
+func WithSSDPAddr(addr string) DiscoverOption {
+	return func(c *discoverConfig) {
+		c.ssdpAddr = addr
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to talk to UPnP gateways.
+func WithHTTPClient(client *http.Client) DiscoverOption {
+	return func(c *discoverConfig) {
+		c.httpClient = client
+	}
+}
+
+// WithDiscoverTimeout sets how long discovery waits for a gateway
+// if ctx has no earlier deadline. It defaults to 3 seconds.
+func WithDiscoverTimeout(d time.Duration) DiscoverOption {
+	return func(c *discoverConfig) {
+		c.timeout = d
+	}
+}
+
+// WithGateway sets the address of the NAT-PMP and PCP gateway
+// ("host" or "host:port"). It defaults to the gateway of the default route.
+func WithGateway(addr string) DiscoverOption {
+	return func(c *discoverConfig) {
+		c.gateway = addr
+	}
+}
@@ -0,0 +1,200 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// PCP opcodes and result codes (RFC 6887).
+const (
+	pcpVersion         = 2
+	pcpOpAnnounce      = 0
+	pcpOpMap           = 1
+	pcpResponseBit     = 0x80
+	pcpResultUnsupVers = 1
+
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+// IANA protocol numbers used in PCP MAP requests.
+var pcpProtocols = map[Protocol]byte{
+	TCP: 6,
+	UDP: 17,
+}
+
+// PCPGateway is a gateway speaking PCP (RFC 6887).
+type PCPGateway struct {
+	addr    *net.UDPAddr
+	localIP net.IP
+	epoch   epochTracker
+
+	mu         sync.Mutex
+	nonces     map[pcpKey][]byte
+	externalIP net.IP
+}
+
+// pcpKey identifies a mapping, which PCP tracks by nonce.
+type pcpKey struct {
+	proto Protocol
+	port  int
+}
+
+// NewPCPGateway returns a PCP client for the gateway at addr
+// ("host" or "host:port"; the port defaults to 5351).
+func NewPCPGateway(addr string) (*PCPGateway, error) {
+	raddr, err := resolveGateway(addr)
+	if err != nil {
+		return nil, err
+	}
+	local, err := localIPFor(raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &PCPGateway{
+		addr:    raddr,
+		localIP: local,
+		nonces:  make(map[pcpKey][]byte),
+	}, nil
+}
+
+// ExternalIP implements Gateway.
+//
+// PCP has no request for the external address alone; it is the one assigned
+// by the most recent mapping, so ExternalIP returns ErrInvalidResponse until
+// a mapping has been made.
+func (g *PCPGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.externalIP == nil {
+		return nil, ErrInvalidResponse
+	}
+	return g.externalIP, nil
+}
+
+// AddMapping implements Gateway.
+func (g *PCPGateway) AddMapping(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	resp, err := g.mapRequest(ctx, proto, internalPort, externalPort, uint32(lifetime/time.Second))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ip := net.IP(append([]byte(nil), resp[pcpHeaderLen+20:pcpHeaderLen+36]...))
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	g.mu.Lock()
+	g.externalIP = ip
+	g.mu.Unlock()
+
+	ext := int(binary.BigEndian.Uint16(resp[pcpHeaderLen+18 : pcpHeaderLen+20]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	return ext, granted, nil
+}
+
+// DeleteMapping implements Gateway.
+func (g *PCPGateway) DeleteMapping(ctx context.Context, proto Protocol, internalPort, externalPort int) error {
+	_, err := g.mapRequest(ctx, proto, internalPort, 0, 0)
+
+	g.mu.Lock()
+	delete(g.nonces, pcpKey{proto, internalPort})
+	g.mu.Unlock()
+	return err
+}
+
+// restartSignal implements restartNotifier.
+func (g *PCPGateway) restartSignal() <-chan struct{} {
+	return g.epoch.restartSignal()
+}
+
+// probe checks that the gateway speaks PCP with an ANNOUNCE request.
+func (g *PCPGateway) probe(ctx context.Context) error {
+	_, err := g.request(ctx, g.header(pcpOpAnnounce, 0))
+	return err
+}
+
+// mapRequest sends a MAP request; a lifetime of zero deletes the mapping.
+// Requests for the same mapping reuse its nonce, as renewals must.
+func (g *PCPGateway) mapRequest(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime uint32) ([]byte, error) {
+	key := pcpKey{proto, internalPort}
+	g.mu.Lock()
+	nonce, ok := g.nonces[key]
+	if !ok {
+		nonce = make([]byte, 12)
+		_, _ = rand.Read(nonce)
+		g.nonces[key] = nonce
+	}
+	g.mu.Unlock()
+
+	req := append(g.header(pcpOpMap, lifetime), make([]byte, pcpMapLen)...)
+	body := req[pcpHeaderLen:]
+	copy(body[0:12], nonce)
+	body[12] = pcpProtocols[proto]
+	binary.BigEndian.PutUint16(body[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(body[18:20], uint16(externalPort))
+	if g.localIP.To4() != nil {
+		copy(body[20:36], net.IPv4zero.To16())
+	}
+
+	resp, err := g.request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < pcpHeaderLen+pcpMapLen || !bytes.Equal(resp[pcpHeaderLen:pcpHeaderLen+12], nonce) {
+		return nil, ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+// header builds a request header.
+func (g *PCPGateway) header(op byte, lifetime uint32) []byte {
+	h := make([]byte, pcpHeaderLen)
+	h[0] = pcpVersion
+	h[1] = op
+	binary.BigEndian.PutUint32(h[4:8], lifetime)
+	copy(h[8:24], g.localIP.To16())
+	return h
+}
+
+// request sends req and returns the successful response.
+// The epoch of the response is checked for gateway restarts.
+func (g *PCPGateway) request(ctx context.Context, req []byte) ([]byte, error) {
+	op := req[1]
+	var nonce []byte
+	if op == pcpOpMap {
+		nonce = req[pcpHeaderLen : pcpHeaderLen+12]
+	}
+	resp, err := pmpRoundTrip(ctx, g.addr, req, func(b []byte) bool {
+		switch {
+		case len(b) >= 4 && b[0] == natpmpVersion && b[3] == natpmpResultUnsupVers:
+			// A NAT-PMP gateway rejecting the PCP version.
+			return true
+		case len(b) < pcpHeaderLen || b[0] != pcpVersion || b[1] != op|pcpResponseBit:
+			return false
+		case nonce != nil && b[3] == 0:
+			return len(b) >= pcpHeaderLen+12 && bytes.Equal(b[pcpHeaderLen:pcpHeaderLen+12], nonce)
+		default:
+			return true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp[0] != pcpVersion {
+		return nil, &GatewayError{Protocol: "pcp", Code: pcpResultUnsupVers}
+	}
+	if code := resp[3]; code != 0 {
+		return nil, &GatewayError{Protocol: "pcp", Code: int(code)}
+	}
+	g.epoch.observe(binary.BigEndian.Uint32(resp[8:12]), time.Now())
+	return resp, nil
+}
@@ -0,0 +1,72 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// pmpPort is the server port of NAT-PMP and PCP.
+const pmpPort = 5351
+
+// Retransmission of NAT-PMP and PCP requests (RFC 6886 section 3.1):
+// the interval starts at 250ms and doubles, for at most nine attempts.
+const (
+	pmpInitialRTO  = 250 * time.Millisecond
+	pmpMaxAttempts = 9
+)
+
+// pmpRoundTrip sends req to the gateway at addr until a response accepted by
+// match arrives, and returns it. Both NAT-PMP and PCP use it.
+func pmpRoundTrip(ctx context.Context, addr *net.UDPAddr, req []byte, match func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	rto := pmpInitialRTO
+	buf := make([]byte, 1100)
+	for attempt := 0; attempt < pmpMaxAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		retry := time.Now().Add(rto)
+		_ = conn.SetReadDeadline(retry)
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				// ICMP port unreachable and the like: wait for the next attempt.
+				time.Sleep(time.Until(retry))
+				break
+			}
+			if match(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+		rto *= 2
+	}
+	return nil, ErrNoGateway
+}
+
+// localIPFor returns the local address used to reach addr.
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,288 @@
+package portmap_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/portmap"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePMP is an in-process NAT-PMP gateway that also speaks PCP if pcp is set.
+// It maps internal port p to external port p+offset.
+type fakePMP struct {
+	conn *net.UDPConn
+	pcp  bool
+
+	mu          sync.Mutex
+	started     time.Time
+	epochBase   uint32
+	offset      int
+	maxLifetime uint32
+	mappings    map[string]int // "proto/internal port" -> external port
+}
+
+func newFakePMP(t *testing.T, pcp bool) *fakePMP {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	g := &fakePMP{
+		conn:        conn,
+		pcp:         pcp,
+		started:     time.Now(),
+		epochBase:   1000,
+		offset:      10000,
+		maxLifetime: 3600,
+		mappings:    make(map[string]int),
+	}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g
+}
+
+func (g *fakePMP) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+// restart forgets every mapping, resets the epoch and allocates other ports.
+func (g *fakePMP) restart() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.started = time.Now()
+	g.epochBase = 0
+	g.offset += 100
+	clear(g.mappings)
+}
+
+func (g *fakePMP) mapping(key string) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ext, ok := g.mappings[key]
+	return ext, ok
+}
+
+func (g *fakePMP) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := g.handle(buf[:n]); resp != nil {
+			_, _ = g.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (g *fakePMP) handle(req []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	epoch := g.epochBase + uint32(time.Since(g.started)/time.Second)
+	if len(req) < 2 {
+		return nil
+	}
+	switch {
+	case req[0] == 0 && req[1] == 0:
+		resp := make([]byte, 12)
+		resp[1] = 128
+		binary.BigEndian.PutUint32(resp[4:8], epoch)
+		copy(resp[8:12], net.IPv4(198, 51, 100, 1).To4())
+		return resp
+
+	case req[0] == 0 && (req[1] == 1 || req[1] == 2) && len(req) >= 12:
+		proto := map[byte]string{1: "UDP", 2: "TCP"}[req[1]]
+		internal := int(binary.BigEndian.Uint16(req[4:6]))
+		lifetime := g.grant(proto, internal, binary.BigEndian.Uint32(req[8:12]))
+
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		binary.BigEndian.PutUint32(resp[4:8], epoch)
+		binary.BigEndian.PutUint16(resp[8:10], uint16(internal))
+		binary.BigEndian.PutUint16(resp[10:12], uint16(g.mappings[fmt.Sprintf("%s/%d", proto, internal)]))
+		binary.BigEndian.PutUint32(resp[12:16], lifetime)
+		return resp
+
+	case req[0] == 2 && !g.pcp:
+		// A NAT-PMP-only gateway rejects the PCP version.
+		resp := make([]byte, 8)
+		resp[1] = 128 + req[1]
+		resp[3] = 1
+		binary.BigEndian.PutUint32(resp[4:8], epoch)
+		return resp
+
+	case req[0] == 2 && req[1] == 0 && len(req) >= 24:
+		resp := make([]byte, 24)
+		resp[0] = 2
+		resp[1] = 0x80
+		binary.BigEndian.PutUint32(resp[8:12], epoch)
+		return resp
+
+	case req[0] == 2 && req[1] == 1 && len(req) >= 60:
+		proto := map[byte]string{6: "TCP", 17: "UDP"}[req[36]]
+		internal := int(binary.BigEndian.Uint16(req[40:42]))
+		lifetime := g.grant(proto, internal, binary.BigEndian.Uint32(req[4:8]))
+
+		resp := make([]byte, 60)
+		resp[0] = 2
+		resp[1] = 0x81
+		binary.BigEndian.PutUint32(resp[4:8], lifetime)
+		binary.BigEndian.PutUint32(resp[8:12], epoch)
+		copy(resp[24:60], req[24:60])
+		binary.BigEndian.PutUint16(resp[42:44], uint16(g.mappings[fmt.Sprintf("%s/%d", proto, internal)]))
+		copy(resp[44:60], net.IPv4(198, 51, 100, 1).To16())
+		return resp
+	}
+	return nil
+}
+
+// grant creates, renews or, for a zero lifetime, deletes a mapping.
+// The caller holds g.mu.
+func (g *fakePMP) grant(proto string, internal int, lifetime uint32) uint32 {
+	key := fmt.Sprintf("%s/%d", proto, internal)
+	if lifetime == 0 {
+		delete(g.mappings, key)
+		return 0
+	}
+	if _, ok := g.mappings[key]; !ok {
+		g.mappings[key] = internal + g.offset
+	}
+	return min(lifetime, g.maxLifetime)
+}
+
+func TestPMPMapping(t *testing.T) {
+	for _, pcp := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pcp=%v", pcp), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			fake := newFakePMP(t, pcp)
+			gw, err := portmap.DiscoverPMP(ctx, portmap.WithGateway(fake.addr()))
+			if !assert.NoError(t, err) {
+				return
+			}
+			if pcp {
+				assert.IsType(t, &portmap.PCPGateway{}, gw)
+			} else {
+				assert.IsType(t, &portmap.NATPMPGateway{}, gw)
+			}
+
+			m, err := portmap.Map(ctx, gw, portmap.UDP, 40000, portmap.MapOptions{Lifetime: 2 * time.Hour})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "198.51.100.1:50000", m.UDPAddr().String())
+			assert.Equal(t, time.Hour, m.Lifetime())
+
+			ext, ok := fake.mapping("UDP/40000")
+			assert.True(t, ok)
+			assert.Equal(t, 50000, ext)
+
+			assert.NoError(t, m.Close())
+			_, ok = fake.mapping("UDP/40000")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestPMPRestart(t *testing.T) {
+	for _, pcp := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pcp=%v", pcp), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			fake := newFakePMP(t, pcp)
+			gw, err := portmap.DiscoverPMP(ctx, portmap.WithGateway(fake.addr()))
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// A long-lived mapping, and a short-lived one whose renewal
+			// notices the restart.
+			changed := make(chan *portmap.Mapping, 1)
+			long, err := portmap.Map(ctx, gw, portmap.TCP, 41000, portmap.MapOptions{
+				OnChange: func(m *portmap.Mapping) { changed <- m },
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer long.Close()
+			short, err := portmap.Map(ctx, gw, portmap.UDP, 41001, portmap.MapOptions{Lifetime: 2 * time.Second})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer short.Close()
+
+			fake.restart()
+
+			select {
+			case m := <-changed:
+				assert.Equal(t, 41000+10100, m.ExternalPort())
+			case <-ctx.Done():
+				t.Fatal("mapping not renewed after gateway restart")
+			}
+			_, ok := fake.mapping("TCP/41000")
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestDiscoverPMPNoGateway(t *testing.T) {
+	// Nothing answers on this address.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = portmap.DiscoverPMP(context.Background(),
+		portmap.WithGateway(conn.LocalAddr().String()),
+		portmap.WithDiscoverTimeout(300*time.Millisecond),
+	)
+	assert.ErrorIs(t, err, portmap.ErrNoGateway)
+}
+
+func TestEpochRestarted(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		prev    uint32
+		elapsed time.Duration
+		epoch   uint32
+		want    bool
+	}{
+		{"steady", 1000, 60 * time.Second, 1060, false},
+		{"drift", 1000, 160 * time.Second, 1155, false},
+		{"went back", 1000, 10 * time.Second, 5, true},
+		{"too slow", 1000, 600 * time.Second, 1010, true},
+		{"too fast", 1000, 10 * time.Second, 2000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := portmap.ExportEpochRestarted(tt.prev, now, tt.epoch, now.Add(tt.elapsed))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseProcRoute(t *testing.T) {
+	const table = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+
+	ip, err := portmap.ExportParseProcRoute(strings.NewReader(table))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1", ip.String())
+
+	_, err = portmap.ExportParseProcRoute(strings.NewReader(strings.SplitAfter(table, "\n")[0]))
+	assert.ErrorIs(t, err, portmap.ErrNoDefaultRoute)
+}
@@ -0,0 +1,261 @@
+// Package portmap requests port mappings from the local Internet gateway,
+// so that peers can reach this host without hole punching.
+package portmap
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+)
+
+// Protocol is the transport protocol of a port mapping.
+type Protocol string
+
+const (
+	UDP Protocol = "UDP"
+	TCP Protocol = "TCP"
+)
+
+const (
+	// DefaultLifetime is the mapping lifetime requested when MapOptions.Lifetime is zero.
+	DefaultLifetime = time.Hour
+
+	// requestTimeout bounds renewal and deletion requests.
+	requestTimeout = 5 * time.Second
+)
+
+// Gateway is a router that can map its external ports to this host.
+type Gateway interface {
+	// ExternalIP returns the gateway's external IP address.
+	ExternalIP(ctx context.Context) (net.IP, error)
+
+	// AddMapping maps an external port to internalPort on this host for
+	// lifetime. externalPort is a hint; if it is zero, internalPort is
+	// preferred. It returns the external port and lifetime granted;
+	// a granted lifetime of zero means the mapping does not expire.
+	AddMapping(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error)
+
+	// DeleteMapping removes a mapping created by AddMapping.
+	DeleteMapping(ctx context.Context, proto Protocol, internalPort, externalPort int) error
+}
+
+// MapOptions configures Map.
+type MapOptions struct {
+	// ExternalPort is the preferred external port. Defaults to the internal port.
+	ExternalPort int
+
+	// Lifetime is the lifetime requested for the mapping. Defaults to DefaultLifetime.
+	// The mapping is renewed before the granted lifetime runs out.
+	Lifetime time.Duration
+
+	// OnChange, if set, is called when a renewal changes the external
+	// address, for example after the gateway restarted.
+	OnChange func(*Mapping)
+}
+
+// Mapping is a port mapping on a Gateway, renewed until it is closed.
+type Mapping struct {
+	gw           Gateway
+	proto        Protocol
+	internalPort int
+	lifetime     time.Duration
+	onChange     func(*Mapping)
+
+	mu           sync.RWMutex
+	externalIP   net.IP
+	externalPort int
+	granted      time.Duration
+	err          error
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Map maps a port on gw to internalPort on this host and keeps the mapping
+// alive in the background until Close is called.
+func Map(ctx context.Context, gw Gateway, proto Protocol, internalPort int, opts MapOptions) (*Mapping, error) {
+	lifetime := opts.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+
+	ext, granted, err := gw.AddMapping(ctx, proto, internalPort, opts.ExternalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := gw.ExternalIP(ctx)
+	if err != nil {
+		_ = gw.DeleteMapping(ctx, proto, internalPort, ext)
+		return nil, err
+	}
+
+	m := &Mapping{
+		gw:           gw,
+		proto:        proto,
+		internalPort: internalPort,
+		lifetime:     lifetime,
+		onChange:     opts.OnChange,
+		externalIP:   ip,
+		externalPort: ext,
+		granted:      granted,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go m.renewLoop()
+	return m, nil
+}
+
+// MapMux maps a port on gw to the local port of mux.
+// With TCP, the mapping can be used for a TCP socket bound to the same port
+// (see nat.TCPOptions).
+func MapMux(ctx context.Context, gw Gateway, mux *nat.Mux, proto Protocol, opts MapOptions) (*Mapping, error) {
+	addr, ok := mux.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, ErrUnsupportedAddr
+	}
+	return Map(ctx, gw, proto, addr.Port, opts)
+}
+
+// Protocol returns the mapped protocol.
+func (m *Mapping) Protocol() Protocol {
+	return m.proto
+}
+
+// InternalPort returns the mapped port on this host.
+func (m *Mapping) InternalPort() int {
+	return m.internalPort
+}
+
+// ExternalIP returns the gateway's external IP address.
+func (m *Mapping) ExternalIP() net.IP {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.externalIP
+}
+
+// ExternalPort returns the mapped external port.
+func (m *Mapping) ExternalPort() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.externalPort
+}
+
+// UDPAddr returns the external address as a UDP address, which can be
+// shared with peers as a candidate (see nat.Peer.Candidates).
+func (m *Mapping) UDPAddr() *net.UDPAddr {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &net.UDPAddr{IP: m.externalIP, Port: m.externalPort}
+}
+
+// TCPAddr returns the external address as a TCP address
+// (see nat.TCPOptions.MappedAddr).
+func (m *Mapping) TCPAddr() *net.TCPAddr {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &net.TCPAddr{IP: m.externalIP, Port: m.externalPort}
+}
+
+// Lifetime returns the lifetime granted by the last successful request.
+// Zero means the mapping does not expire.
+func (m *Mapping) Lifetime() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.granted
+}
+
+// Err returns the error of the last renewal, or nil if it succeeded.
+func (m *Mapping) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.err
+}
+
+// Close stops renewing the mapping and deletes it from the gateway.
+// Close is safe to call multiple times; only the first call deletes.
+func (m *Mapping) Close() error {
+	err := ErrMappingClosed
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		<-m.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		err = m.gw.DeleteMapping(ctx, m.proto, m.internalPort, m.ExternalPort())
+	})
+	return err
+}
+
+// renewLoop renews the mapping halfway through its granted lifetime, and
+// right away when the gateway is noticed to have restarted.
+// After a failure it retries a quarter of the lifetime later.
+func (m *Mapping) renewLoop() {
+	defer close(m.done)
+
+	notifier, _ := m.gw.(restartNotifier)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	wait := m.Lifetime() / 2
+	for {
+		var timeout <-chan time.Time
+		if wait > 0 {
+			// Otherwise the mapping is permanent and only restarts matter.
+			timer.Reset(wait)
+			timeout = timer.C
+		}
+		var restarted <-chan struct{}
+		if notifier != nil {
+			restarted = notifier.restartSignal()
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-timeout:
+		case <-restarted:
+		}
+
+		if err := m.renew(); err != nil {
+			wait = m.lifetime / 4
+			if granted := m.Lifetime(); granted > 0 {
+				wait = granted / 4
+			}
+			continue
+		}
+		wait = m.Lifetime() / 2
+	}
+}
+
+// renew requests the mapping again and refreshes the external address.
+func (m *Mapping) renew() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	ext, granted, err := m.gw.AddMapping(ctx, m.proto, m.internalPort, m.ExternalPort(), m.lifetime)
+	if err == nil {
+		var ip net.IP
+		if ip, err = m.gw.ExternalIP(ctx); err == nil {
+			m.mu.Lock()
+			changed := ext != m.externalPort || !ip.Equal(m.externalIP)
+			m.externalIP = ip
+			m.externalPort = ext
+			m.granted = granted
+			m.mu.Unlock()
+
+			if changed && m.onChange != nil {
+				m.onChange(m)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+	return err
+}
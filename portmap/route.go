@@ -0,0 +1,43 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rtfGateway is the RTF_GATEWAY route flag.
+const rtfGateway = 0x2
+
+// parseProcRoute returns the gateway of the default route in the format of
+// Linux's /proc/net/route.
+func parseProcRoute(r io.Reader) (net.IP, error) {
+	sc := bufio.NewScanner(r)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&rtfGateway == 0 {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		// Addresses are in host byte order, which is little endian on
+		// every platform Linux exposes the file on in practice.
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip, nil
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoDefaultRoute
+}
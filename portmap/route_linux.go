@@ -0,0 +1,16 @@
+package portmap
+
+import (
+	"net"
+	"os"
+)
+
+// DefaultGateway returns the IPv4 gateway of the default route.
+func DefaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcRoute(f)
+}
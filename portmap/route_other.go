@@ -0,0 +1,12 @@
+//go:build !linux
+
+package portmap
+
+import "net"
+
+// DefaultGateway returns the IPv4 gateway of the default route.
+// It is only implemented on Linux; elsewhere, pass the gateway address
+// explicitly with WithGateway.
+func DefaultGateway() (net.IP, error) {
+	return nil, ErrNoDefaultRoute
+}
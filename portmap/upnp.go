@@ -0,0 +1,348 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP error codes handled by AddMapping.
+const (
+	upnpConflictInMappingEntry       = 718
+	upnpOnlyPermanentLeasesSupported = 725
+)
+
+// upnpMappingAttempts bounds how many external ports AddMapping tries.
+const upnpMappingAttempts = 5
+
+// upnpSearchTargets are the SSDP search targets for Internet gateways.
+var upnpSearchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// upnpServicePrefixes are the service types that can map ports.
+var upnpServicePrefixes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// UPnPGateway is an Internet Gateway Device controlled over UPnP.
+type UPnPGateway struct {
+	controlURL  string
+	serviceType string
+	localIP     net.IP
+	client      *http.Client
+}
+
+// DiscoverUPnP searches the local network for an Internet Gateway Device
+// with SSDP and returns the first one offering a WAN connection service.
+//
+// It returns ErrNoGateway if none answers before ctx is done or the
+// discovery timeout elapses.
+func DiscoverUPnP(ctx context.Context, opts ...DiscoverOption) (*UPnPGateway, error) {
+	cfg := newDiscoverConfig(opts)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	raddr, err := net.ResolveUDPAddr("udp4", cfg.ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, st := range upnpSearchTargets {
+		req := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + cfg.ssdpAddr + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(req), raddr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Reading stops at the deadline, or as soon as ctx is done.
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, ErrNoGateway
+			}
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		gw, err := newUPnPGateway(ctx, cfg.httpClient, location)
+		if err != nil {
+			continue
+		}
+		return gw, nil
+	}
+}
+
+// newUPnPGateway reads the device description at location.
+func newUPnPGateway(ctx context.Context, client *http.Client, location string) (*UPnPGateway, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrInvalidResponse
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	svc := root.Device.findService()
+	if svc == nil {
+		return nil, ErrNoGateway
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	control, err := base.Parse(svc.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The address this host uses to reach the gateway is the one to map to.
+	port := base.Port()
+	if port == "" {
+		port = "80"
+		if base.Scheme == "https" {
+			port = "443"
+		}
+	}
+	local, err := net.Dial("udp", net.JoinHostPort(base.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+
+	return &UPnPGateway{
+		controlURL:  control.String(),
+		serviceType: svc.ServiceType,
+		localIP:     local.LocalAddr().(*net.UDPAddr).IP,
+		client:      client,
+	}, nil
+}
+
+// ExternalIP implements Gateway.
+func (g *UPnPGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	out, err := g.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(out["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, ErrInvalidResponse
+	}
+	return ip, nil
+}
+
+// AddMapping implements Gateway.
+//
+// If the gateway only supports permanent leases, the mapping is made
+// permanent. If the external port is taken, random ports are tried.
+func (g *UPnPGateway) AddMapping(ctx context.Context, proto Protocol, internalPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	lease := int(lifetime / time.Second)
+
+	var err error
+	for attempt := 0; attempt < upnpMappingAttempts; attempt++ {
+		_, err = g.call(ctx, "AddPortMapping", []soapArg{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(externalPort)},
+			{"NewProtocol", string(proto)},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", g.localIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "natto"},
+			{"NewLeaseDuration", strconv.Itoa(lease)},
+		})
+
+		var uerr *UPnPError
+		switch {
+		case err == nil:
+			return externalPort, time.Duration(lease) * time.Second, nil
+		case errors.As(err, &uerr) && uerr.Code == upnpOnlyPermanentLeasesSupported && lease != 0:
+			lease = 0
+		case errors.As(err, &uerr) && uerr.Code == upnpConflictInMappingEntry:
+			externalPort = 1024 + rand.IntN(65535-1024+1)
+		default:
+			return 0, 0, err
+		}
+	}
+	return 0, 0, err
+}
+
+// DeleteMapping implements Gateway.
+func (g *UPnPGateway) DeleteMapping(ctx context.Context, proto Protocol, internalPort, externalPort int) error {
+	_, err := g.call(ctx, "DeletePortMapping", []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", string(proto)},
+	})
+	return err
+}
+
+// soapArg is an argument of a SOAP action, in order.
+type soapArg struct {
+	name, value string
+}
+
+// call invokes a SOAP action on the gateway's WAN connection service and
+// returns the text of every element of the response by local name.
+func (g *UPnPGateway) call(ctx context.Context, action string, args []soapArg) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, g.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a.name)
+		_ = xml.EscapeText(&body, []byte(a.value))
+		fmt.Fprintf(&body, "</%s>", a.name)
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.serviceType, action))
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := soapValues(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		code, cerr := strconv.Atoi(out["errorCode"])
+		if err != nil || cerr != nil {
+			return nil, fmt.Errorf("%w: http status %d", ErrInvalidResponse, resp.StatusCode)
+		}
+		return nil, &UPnPError{Code: code, Description: out["errorDescription"]}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// soapValues collects the text of the leaf elements of a SOAP envelope.
+func soapValues(r io.Reader) (map[string]string, error) {
+	out := make(map[string]string)
+	dec := xml.NewDecoder(r)
+
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				out[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+// upnpRoot is a UPnP device description.
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService returns the first WAN connection service of d or its
+// embedded devices.
+func (d *upnpDevice) findService() *upnpService {
+	for i := range d.Services {
+		for _, prefix := range upnpServicePrefixes {
+			if strings.HasPrefix(d.Services[i].ServiceType, prefix) {
+				return &d.Services[i]
+			}
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].findService(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package portmap_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aethiopicuschan/natto/nat"
+	"github.com/aethiopicuschan/natto/portmap"
+	"github.com/stretchr/testify/assert"
+)
+
+const wanIPConnection = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// fakeIGD is an in-process UPnP Internet Gateway Device:
+// an SSDP responder and a SOAP control endpoint.
+type fakeIGD struct {
+	ssdp *net.UDPConn
+	http *httptest.Server
+
+	// permanentOnly rejects leases other than zero, like many routers.
+	permanentOnly bool
+
+	// urlBase is the URLBase of the device description, if not empty.
+	urlBase string
+
+	mu       sync.Mutex
+	host     string            // HOST header of the last M-SEARCH
+	mappings map[string]string // "proto/external port" -> "client:internal port"
+	leases   map[string]string
+	adds     int
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	t.Helper()
+
+	g := &fakeIGD{
+		mappings: make(map[string]string),
+		leases:   make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <URLBase>%s</URLBase>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>%s</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`, g.urlBase, wanIPConnection)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	g.http = httptest.NewServer(mux)
+
+	var err error
+	g.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go g.serveSSDP()
+
+	t.Cleanup(func() {
+		g.ssdp.Close()
+		g.http.Close()
+	})
+	return g
+}
+
+// serveSSDP answers M-SEARCH requests for gateways.
+func (g *fakeIGD) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := g.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" {
+			continue
+		}
+		g.mu.Lock()
+		g.host = req.Host
+		g.mu.Unlock()
+		st := req.Header.Get("ST")
+		if !strings.Contains(st, "InternetGatewayDevice") {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: " + st + "\r\n" +
+			"LOCATION: " + g.http.URL + "/desc.xml\r\n\r\n"
+		_, _ = g.ssdp.WriteToUDP([]byte(resp), addr)
+	}
+}
+
+// control handles SOAP actions.
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	action := r.Header.Get("SOAPAction")
+	body, _ := io.ReadAll(r.Body)
+	args := soapArgs(body)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := args["NewProtocol"] + "/" + args["NewExternalPort"]
+	var out string
+	switch {
+	case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+		out = "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>"
+
+	case strings.HasSuffix(action, `#AddPortMapping"`):
+		target := args["NewInternalClient"] + ":" + args["NewInternalPort"]
+		if g.permanentOnly && args["NewLeaseDuration"] != "0" {
+			soapFault(w, 725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		if cur, ok := g.mappings[key]; ok && cur != target {
+			soapFault(w, 718, "ConflictInMappingEntry")
+			return
+		}
+		g.mappings[key] = target
+		g.leases[key] = args["NewLeaseDuration"]
+		g.adds++
+
+	case strings.HasSuffix(action, `#DeletePortMapping"`):
+		if _, ok := g.mappings[key]; !ok {
+			soapFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		delete(g.mappings, key)
+
+	default:
+		soapFault(w, 401, "Invalid Action")
+		return
+	}
+
+	name := action[strings.Index(action, "#")+1 : len(action)-1]
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`, name, wanIPConnection, out, name)
+}
+
+func (g *fakeIGD) mapping(key string) (target, lease string, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	target, ok = g.mappings[key]
+	return target, g.leases[key], ok
+}
+
+func (g *fakeIGD) addCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.adds
+}
+
+func (g *fakeIGD) discover(t *testing.T, ctx context.Context) *portmap.UPnPGateway {
+	t.Helper()
+
+	gw, err := portmap.DiscoverUPnP(ctx, portmap.WithSSDPAddr(g.ssdp.LocalAddr().String()))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return gw
+}
+
+func soapFault(w http.ResponseWriter, code int, desc string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+		`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, desc)
+}
+
+// soapArgs returns the arguments of a SOAP request by name.
+func soapArgs(body []byte) map[string]string {
+	out := make(map[string]string)
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var name string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return out
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if name != "" {
+				out[name] = string(t)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
+
+func TestUPnPMapping(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	igd := newFakeIGD(t)
+	gw := igd.discover(t, ctx)
+
+	ip, err := gw.ExternalIP(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", ip.String())
+
+	m, err := portmap.Map(ctx, gw, portmap.UDP, 40000, portmap.MapOptions{Lifetime: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 40000, m.ExternalPort())
+	assert.Equal(t, "203.0.113.7:40000", m.UDPAddr().String())
+
+	target, lease, ok := igd.mapping("UDP/40000")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:40000", target)
+	assert.Equal(t, "3600", lease)
+
+	assert.NoError(t, m.Close())
+	_, _, ok = igd.mapping("UDP/40000")
+	assert.False(t, ok)
+	assert.ErrorIs(t, m.Close(), portmap.ErrMappingClosed)
+}
+
+func TestUPnPDiscoverAddressing(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A URLBase without a port means the default one.
+	g := newFakeIGD(t)
+	g.urlBase = "http://127.0.0.1/"
+	g.discover(t, ctx)
+
+	// M-SEARCH names the address it is sent to.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	assert.Equal(t, g.ssdp.LocalAddr().String(), g.host)
+}
+
+func TestUPnPConflictAndPermanentLease(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	igd := newFakeIGD(t)
+	igd.permanentOnly = true
+	gw := igd.discover(t, ctx)
+
+	// Another host already holds the preferred external port.
+	igd.mappings["TCP/41000"] = "192.0.2.9:41000"
+
+	ext, lifetime, err := gw.AddMapping(ctx, portmap.TCP, 41000, 0, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, 41000, ext)
+	assert.Zero(t, lifetime)
+
+	_, lease, ok := igd.mapping(fmt.Sprintf("TCP/%d", ext))
+	assert.True(t, ok)
+	assert.Equal(t, "0", lease)
+
+	var uerr *portmap.UPnPError
+	err = gw.DeleteMapping(ctx, portmap.TCP, 42000, 42000)
+	if assert.ErrorAs(t, err, &uerr) {
+		assert.Equal(t, 714, uerr.Code)
+	}
+}
+
+func TestUPnPRenewal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	igd := newFakeIGD(t)
+	gw := igd.discover(t, ctx)
+
+	m, err := portmap.Map(ctx, gw, portmap.UDP, 40001, portmap.MapOptions{Lifetime: 2 * time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer m.Close()
+
+	assert.Eventually(t, func() bool { return igd.addCount() >= 2 }, 3*time.Second, 50*time.Millisecond)
+	assert.NoError(t, m.Err())
+}
+
+func TestUPnPNoGateway(t *testing.T) {
+	// Nothing answers on this address.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = portmap.DiscoverUPnP(context.Background(),
+		portmap.WithSSDPAddr(conn.LocalAddr().String()),
+		portmap.WithDiscoverTimeout(200*time.Millisecond),
+	)
+	assert.ErrorIs(t, err, portmap.ErrNoGateway)
+}
+
+func TestMapMux(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	igd := newFakeIGD(t)
+	gw := igd.discover(t, ctx)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	mux := nat.NewMux(conn)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, proto := range []portmap.Protocol{portmap.UDP, portmap.TCP} {
+		m, err := portmap.MapMux(ctx, gw, mux, proto, portmap.MapOptions{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, port, m.InternalPort())
+
+		target, _, ok := igd.mapping(fmt.Sprintf("%s/%d", proto, m.ExternalPort()))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), target)
+		assert.NoError(t, m.Close())
+	}
+}
@@ -79,6 +79,22 @@ func decodeAddress(v []byte, xor bool, tid TransactionID) (MappedAddress, error)
 	}
 }
 
+// ResponsePortAttr builds a RESPONSE-PORT attribute (RFC 5780), which asks the
+// server to send its response to the request's source IP at port instead.
+func ResponsePortAttr(port int) Attribute {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[0:2], uint16(port))
+	return Attribute{Type: AttrResponsePort, Value: v}
+}
+
+// DecodeResponsePort decodes a RESPONSE-PORT attribute (RFC 5780).
+func DecodeResponsePort(a Attribute) (int, error) {
+	if len(a.Value) < 2 {
+		return 0, ErrNotSTUN
+	}
+	return int(binary.BigEndian.Uint16(a.Value[0:2])), nil
+}
+
 // FindMappedAddress tries XOR-MAPPED-ADDRESS first, then MAPPED-ADDRESS.
 func FindMappedAddress(msg *Message) (MappedAddress, error) {
 	if a, ok := msg.GetAttribute(AttrXORMappedAddress); ok {
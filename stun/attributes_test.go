@@ -192,3 +192,18 @@ func TestFindMappedAddress_NoAttributes(t *testing.T) {
 
 	assert.ErrorIs(t, err, stun.ErrNoMappedAddress)
 }
+
+func TestResponsePortAttr(t *testing.T) {
+	t.Parallel()
+
+	a := stun.ResponsePortAttr(54321)
+	assert.Equal(t, stun.AttrResponsePort, a.Type)
+	assert.Len(t, a.Value, 4)
+
+	port, err := stun.DecodeResponsePort(a)
+	assert.NoError(t, err)
+	assert.Equal(t, 54321, port)
+
+	_, err = stun.DecodeResponsePort(stun.Attribute{Type: stun.AttrResponsePort, Value: []byte{1}})
+	assert.ErrorIs(t, err, stun.ErrNotSTUN)
+}
@@ -3,6 +3,7 @@ package stun
 import (
 	"context"
 	"errors"
+	"log/slog"
 	"net"
 	"time"
 )
@@ -17,6 +18,10 @@ type Client struct {
 
 	// RTO is the initial retransmission timeout.
 	RTO time.Duration
+
+	// Logger, if set, receives retransmissions and ignored responses at
+	// debug level.
+	Logger *slog.Logger
 }
 
 // NewClient returns a Client with sensible defaults.
@@ -48,6 +53,29 @@ func (c *Client) BindingRequest(ctx context.Context, serverAddr string) (MappedA
 // BindingRequestConn performs a STUN Binding Request using an existing UDP connection.
 // The connection must be connected to the STUN server (DialUDP), not a raw ListenUDP socket.
 func (c *Client) BindingRequestConn(ctx context.Context, conn *net.UDPConn) (MappedAddress, error) {
+	send := func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}
+	return c.bindingRequest(ctx, conn, send, nil)
+}
+
+// BindingRequestTo performs a STUN Binding Request to server using an unconnected
+// socket (such as one from ListenUDP), so that the mapping of that socket is discovered.
+// Packets from other sources are ignored. The read deadline of conn is cleared on return.
+func (c *Client) BindingRequestTo(ctx context.Context, conn PacketConn, server *net.UDPAddr) (MappedAddress, error) {
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	send := func(b []byte) error {
+		_, err := conn.WriteTo(b, server)
+		return err
+	}
+	return c.bindingRequest(ctx, conn, send, server)
+}
+
+// bindingRequest runs a Binding transaction, sending requests with send and
+// reading responses from conn. If server is set, responses from other
+// sources are ignored.
+func (c *Client) bindingRequest(ctx context.Context, conn PacketConn, send func([]byte) error, server *net.UDPAddr) (MappedAddress, error) {
 	tid, err := NewTransactionID()
 	if err != nil {
 		return MappedAddress{}, err
@@ -64,6 +92,10 @@ func (c *Client) BindingRequestConn(ctx context.Context, conn *net.UDPConn) (Map
 
 	rto := c.RTO
 	buf := make([]byte, 1500)
+	log := loggerOr(c.Logger)
+	if server != nil {
+		log = log.With("server", server)
+	}
 
 	for attempt := 0; attempt <= c.Retries; attempt++ {
 		// Respect context cancellation.
@@ -74,9 +106,10 @@ func (c *Client) BindingRequestConn(ctx context.Context, conn *net.UDPConn) (Map
 		}
 
 		// Send request.
-		if _, err := conn.Write(reqBytes); err != nil {
+		if err := send(reqBytes); err != nil {
 			return MappedAddress{}, err
 		}
+		log.Debug("stun: sent binding request", "attempt", attempt, "rto", rto)
 
 		// Wait for response until min(deadline, now+rto).
 		waitUntil := time.Now().Add(rto)
@@ -85,11 +118,12 @@ func (c *Client) BindingRequestConn(ctx context.Context, conn *net.UDPConn) (Map
 		}
 		_ = conn.SetReadDeadline(waitUntil)
 
-		n, err := conn.Read(buf)
+		n, src, err := conn.ReadFrom(buf)
 		if err != nil {
 			// Timeout -> retransmit with backoff.
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
 				if time.Now().After(deadline) {
+					log.Debug("stun: binding request timed out", "attempts", attempt+1)
 					return MappedAddress{}, ErrTimeout
 				}
 				rto *= 2
@@ -98,14 +132,22 @@ func (c *Client) BindingRequestConn(ctx context.Context, conn *net.UDPConn) (Map
 			return MappedAddress{}, err
 		}
 
+		// Ignore packets that did not come from the server.
+		if from := UDPAddrOf(src); server != nil && (from == nil || !from.IP.Equal(server.IP) || from.Port != server.Port) {
+			log.Debug("stun: ignoring packet from another source", "from", src)
+			continue
+		}
+
 		resp, err := Parse(buf[:n])
 		if err != nil {
 			// Ignore non-STUN packets and keep trying within this attempt window.
+			log.Debug("stun: ignoring malformed response", "size", n, "err", err)
 			continue
 		}
 
 		// Match transaction ID.
 		if resp.TransactionID != tid {
+			log.Debug("stun: ignoring response to another transaction")
 			continue
 		}
 
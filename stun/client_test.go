@@ -103,6 +103,38 @@ func TestClient_BindingRequest_Success(t *testing.T) {
 	assert.True(t, publicIP.Equal(got.IP))
 }
 
+func TestClient_BindingRequestTo_Success(t *testing.T) {
+	t.Parallel()
+
+	publicIP := net.IPv4(203, 0, 113, 9)
+	publicPort := 54321
+
+	serverAddr, closeFn := startMockSTUNServer(t, func(req *stun.Message, _ *net.UDPAddr) *stun.Message {
+		return makeSuccessResponse(req, publicIP, publicPort)
+	})
+	defer closeFn()
+
+	server, err := net.ResolveUDPAddr("udp", serverAddr)
+	assert.NoError(t, err)
+
+	// An unconnected socket, as used by a Mux.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	client := stun.NewClient()
+	client.Timeout = 500 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	got, err := client.BindingRequestTo(ctx, conn, server)
+
+	assert.NoError(t, err)
+	assert.Equal(t, publicPort, got.Port)
+	assert.True(t, publicIP.Equal(got.IP))
+}
+
 func TestClient_BindingRequest_TransactionIDMismatch(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,34 @@
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// PacketConn is the packet transport used by Client.BindingRequestTo and
+// Server. *net.UDPConn satisfies it, as does any net.PacketConn.
+type PacketConn interface {
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// UDPAddrOf converts an address reported by a PacketConn to a
+// *net.UDPAddr. Addresses that are not *net.UDPAddr are converted from their
+// string form; it returns nil if that is not an IP and port.
+func UDPAddrOf(addr net.Addr) *net.UDPAddr {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a
+	}
+	if addr == nil {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.UDPAddrFromAddrPort(ap)
+}
@@ -0,0 +1,29 @@
+package stun_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/aethiopicuschan/natto/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+// strAddr is a non-UDP net.Addr, such as an in-memory connection reports.
+type strAddr string
+
+func (a strAddr) Network() string { return "mem" }
+func (a strAddr) String() string  { return string(a) }
+
+func TestUDPAddrOf(t *testing.T) {
+	t.Parallel()
+
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	assert.Same(t, udp, stun.UDPAddrOf(udp))
+
+	got := stun.UDPAddrOf(strAddr("[2001:db8::1]:3478"))
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "[2001:db8::1]:3478", got.String())
+	}
+	assert.Nil(t, stun.UDPAddrOf(strAddr("not an address")))
+	assert.Nil(t, stun.UDPAddrOf(nil))
+}
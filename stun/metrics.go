@@ -0,0 +1,15 @@
+package stun
+
+import "github.com/aethiopicuschan/natto/metrics"
+
+// metricRequests counts the datagrams handled by a Server.
+var metricRequests = &metrics.Desc{
+	Name:   "natto_stun_requests_total",
+	Help:   "Datagrams handled by the STUN server, by outcome (answered, malformed, unsupported, send_failed).",
+	Kind:   metrics.Counter,
+	Labels: []string{"outcome"},
+}
+
+// Metrics describes the metrics reported to Server.Metrics, to declare them
+// with metrics.Registry.Register before they are first reported.
+var Metrics = []*metrics.Desc{metricRequests}
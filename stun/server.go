@@ -5,20 +5,25 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/aethiopicuschan/natto/metrics"
 )
 
 // Server is a minimal STUN server (RFC 5389) that supports UDP Binding requests.
 //
 // It listens on UDP, parses STUN messages, and replies to Binding Requests with
 // a Binding Success Response that includes XOR-MAPPED-ADDRESS.
+// A RESPONSE-PORT attribute (RFC 5780) redirects the response to another port
+// at the client's IP, which is used to measure binding lifetimes.
 //
 // This is intentionally small and designed to be embedded into your NAT/P2P stack.
 type Server struct {
-	// Conn is the UDP socket the server reads from and writes to.
-	Conn *net.UDPConn
+	// Conn is the socket the server reads from and writes to.
+	Conn PacketConn
 
 	// Software, if non-empty, is included as a SOFTWARE attribute in responses.
 	Software string
@@ -31,6 +36,13 @@ type Server struct {
 	// If zero, defaults to 1500.
 	MaxPacketSize int
 
+	// Logger, if set, receives malformed and ignored requests at debug
+	// level and failures to send responses at warn level.
+	Logger *slog.Logger
+
+	// Metrics, if set, counts requests by outcome; see Metrics.
+	Metrics metrics.Recorder
+
 	onceClose sync.Once
 	closeCh   chan struct{}
 	wg        sync.WaitGroup
@@ -48,12 +60,20 @@ func ListenUDP(addr string) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewServer(conn), nil
+}
+
+// NewServer creates a STUN server on conn, such as a *net.UDPConn or an
+// in-memory connection for tests. Close closes conn.
+//
+// Call Serve/ServeContext to start handling requests.
+func NewServer(conn PacketConn) *Server {
 	return &Server{
 		Conn:          conn,
 		ReadTimeout:   1 * time.Second,
 		MaxPacketSize: 1500,
 		closeCh:       make(chan struct{}),
-	}, nil
+	}
 }
 
 // Close stops the server and closes the underlying UDP socket.
@@ -106,7 +126,7 @@ func (s *Server) ServeContext(ctx context.Context) error {
 			_ = s.Conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
 		}
 
-		n, raddr, err := s.Conn.ReadFromUDP(buf)
+		n, src, err := s.Conn.ReadFrom(buf)
 		if err != nil {
 			// If this is a timeout, just continue to allow checking ctx/closeCh.
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
@@ -121,6 +141,12 @@ func (s *Server) ServeContext(ctx context.Context) error {
 			return err
 		}
 
+		raddr := UDPAddrOf(src)
+		if raddr == nil {
+			loggerOr(s.Logger).Debug("stun: ignoring packet from non-UDP address", "from", src)
+			continue
+		}
+
 		// Handle each packet inline (fast path). If you expect heavy load,
 		// you can fork this into a goroutine pool.
 		s.handlePacket(buf[:n], raddr)
@@ -129,20 +155,43 @@ func (s *Server) ServeContext(ctx context.Context) error {
 
 // handlePacket parses a STUN request and replies if it is a supported Binding Request.
 func (s *Server) handlePacket(pkt []byte, raddr *net.UDPAddr) {
+	log := loggerOr(s.Logger)
+	rec := metrics.Or(s.Metrics)
 	req, err := Parse(pkt)
 	if err != nil {
 		// Ignore non-STUN packets or malformed messages.
+		log.Debug("stun: ignoring malformed request", "from", raddr, "size", len(pkt), "err", err)
+		rec.Add(metricRequests, 1, "malformed")
 		return
 	}
 
 	// Only handle Binding Requests.
 	if req.Method != MethodBinding || req.Class != ClassRequest {
 		// For minimal server, ignore other methods/classes.
+		log.Debug("stun: ignoring unsupported message", "from", raddr, "method", req.Method, "class", req.Class)
+		rec.Add(metricRequests, 1, "unsupported")
 		return
 	}
 
+	dst := raddr
+	if a, ok := req.GetAttribute(AttrResponsePort); ok {
+		port, err := DecodeResponsePort(a)
+		if err != nil {
+			log.Debug("stun: ignoring malformed RESPONSE-PORT", "from", raddr, "err", err)
+			rec.Add(metricRequests, 1, "malformed")
+			return
+		}
+		dst = &net.UDPAddr{IP: raddr.IP, Port: port, Zone: raddr.Zone}
+	}
+
 	resp := s.makeBindingSuccess(req, raddr)
-	_, _ = s.Conn.WriteToUDP(resp.Marshal(), raddr)
+	if _, err := s.Conn.WriteTo(resp.Marshal(), dst); err != nil {
+		log.Warn("stun: sending binding response failed", "to", dst, "err", err)
+		rec.Add(metricRequests, 1, "send_failed")
+		return
+	}
+	log.Debug("stun: answered binding request", "from", raddr, "to", dst)
+	rec.Add(metricRequests, 1, "answered")
 }
 
 // makeBindingSuccess builds a Binding Success Response with XOR-MAPPED-ADDRESS.
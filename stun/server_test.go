@@ -1,11 +1,16 @@
 package stun_test
 
 import (
+	"bytes"
 	"context"
+	"log/slog"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aethiopicuschan/natto/metrics"
 	"github.com/aethiopicuschan/natto/stun"
 	"github.com/stretchr/testify/assert"
 )
@@ -116,6 +121,49 @@ func TestServer_IgnoresNonBinding(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestServer_ResponsePort(t *testing.T) {
+	t.Parallel()
+
+	srv, addr := startTestSTUNServer(t, "")
+	defer srv.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	assert.NoError(t, err)
+
+	// The request is sent from one socket and answered at another.
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer receiver.Close()
+
+	tid, err := stun.NewTransactionID()
+	assert.NoError(t, err)
+
+	req := stun.NewBindingRequest(tid)
+	req.Attributes = append(req.Attributes, stun.ResponsePortAttr(receiver.LocalAddr().(*net.UDPAddr).Port))
+	_, err = sender.WriteToUDP(req.Marshal(), raddr)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err := receiver.Read(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resp, err := stun.Parse(buf[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, tid, resp.TransactionID)
+
+	// The mapped address is still the sender's.
+	mapped, err := stun.FindMappedAddress(resp)
+	assert.NoError(t, err)
+	assert.Equal(t, sender.LocalAddr().(*net.UDPAddr).Port, mapped.Port)
+}
+
 func TestServer_CloseStopsServe(t *testing.T) {
 	t.Parallel()
 
@@ -152,3 +200,81 @@ func TestBuildSoftwareAttr(t *testing.T) {
 	assert.Equal(t, stun.AttrSoftware, attr.Type)
 	assert.Equal(t, "example", string(attr.Value))
 }
+
+func TestServer_Logger(t *testing.T) {
+	t.Parallel()
+
+	var buf syncBuffer
+	srv, err := stun.ListenUDP("127.0.0.1:0")
+	assert.NoError(t, err)
+	srv.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	go func() { _ = srv.Serve() }()
+	defer srv.Close()
+	addr := srv.Conn.LocalAddr().String()
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	assert.NoError(t, err)
+	conn, err := net.DialUDP("udp", nil, raddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("not stun"))
+	assert.NoError(t, err)
+
+	client := stun.NewClient()
+	_, err = client.BindingRequestConn(context.Background(), conn)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		out := buf.String()
+		return strings.Contains(out, "stun: ignoring malformed request") &&
+			strings.Contains(out, "stun: answered binding request")
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestServer_Metrics(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	srv, err := stun.ListenUDP("127.0.0.1:0")
+	assert.NoError(t, err)
+	srv.Metrics = reg
+	go func() { _ = srv.Serve() }()
+	defer srv.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp", srv.Conn.LocalAddr().String())
+	assert.NoError(t, err)
+	conn, err := net.DialUDP("udp", nil, raddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("not stun"))
+	assert.NoError(t, err)
+	_, err = stun.NewClient().BindingRequestConn(context.Background(), conn)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		var b strings.Builder
+		_ = reg.WriteText(&b)
+		return strings.Contains(b.String(), `natto_stun_requests_total{outcome="answered"} 1`) &&
+			strings.Contains(b.String(), `natto_stun_requests_total{outcome="malformed"} 1`)
+	}, time.Second, 5*time.Millisecond)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -27,6 +27,7 @@ const (
 	AttrXORMappedAddress  uint16 = 0x0020
 	AttrErrorCode         uint16 = 0x0009
 	AttrUnknownAttributes uint16 = 0x000A
+	AttrResponsePort      uint16 = 0x0027
 	AttrSoftware          uint16 = 0x8022
 )
 